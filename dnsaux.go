@@ -23,17 +23,29 @@ func newDnsMsg(id uint16, response, authoritative bool) *dns.Msg {
 	return msg
 }
 
+// The largest message we can receive.  Multicast DNS allows up to 9000 bytes (RFC 6762 section 17).
+const maxPacketSize = 9000
+
+// Returns a message asking the questions.  An OPT RR tells responders how big a message we can receive
+// so that they needn't truncate to the classic 512 bytes (RFC 6891).
+func newQuestionMsg(q []dns.Question) *dns.Msg {
+	msg := newDnsMsg(0, false, false)
+	msg.Question = q
+	msg.Extra = append(msg.Extra, NewOptRR(maxPacketSize))
+	return msg
+}
+
 // Returns an A or AAAA RR, whichever is appropriate for the passed in address.
 func NewAddressRR(name string, class uint16, ttl uint32, ip net.IP) dns.RR {
 	var rr dns.RR
 	if v4 := ip.To4(); v4 != nil {
 		rra := new(dns.RR_A)
-		rra.A = (uint32(v4[0]) << 24) | (uint32(v4[1]) << 16) | (uint32(v4[2]) << 8) | uint32(v4[3])
+		rra.A = append(net.IP(nil), v4...)
 		rra.Header().Rrtype = dns.TypeA
 		rr = rra
 	} else {
 		rraaaa := new(dns.RR_AAAA)
-		copy(rraaaa.AAAA[:], ip)
+		rraaaa.AAAA = append(net.IP(nil), ip.To16()...)
 		rraaaa.Header().Rrtype = dns.TypeAAAA
 		rr = rraaaa
 	}
@@ -61,19 +73,51 @@ func NewPtrRR(name string, class uint16, ttl uint32, ptr string) dns.RR {
 	return &dns.RR_PTR{dns.RR_Header{name, dns.TypePTR, class, ttl, 0}, ptr}
 }
 
+// Returns an NSEC RR saying that name has only RRs of the given types.  In Multicast DNS the next domain
+// name is the name itself (RFC 6762 section 6.1).
+func NewNsecRR(name string, class uint16, ttl uint32, types []uint16) dns.RR {
+	return &dns.RR_NSEC{dns.RR_Header{name, dns.TypeNSEC, class, ttl, 0}, name, types}
+}
+
+// Returns an EDNS0 OPT RR advertising the largest UDP payload we can receive.
+func NewOptRR(udpSize uint16) dns.RR {
+	return &dns.RR_OPT{dns.RR_Header{".", dns.TypeOPT, udpSize, 0, 0}, nil}
+}
+
+// Puts opts in the message's OPT RR, adding one if it hasn't any.
+func setEDNS0Options(msg *dns.Msg, opts []dns.EDNS0Option) {
+	for _, rr := range msg.Extra {
+		if opt, ok := rr.(*dns.RR_OPT); ok {
+			opt.SetOptions(opts)
+			return
+		}
+	}
+	opt := NewOptRR(maxPacketSize).(*dns.RR_OPT)
+	opt.SetOptions(opts)
+	msg.Extra = append(msg.Extra, opt)
+}
+
+// Returns the EDNS0 options of the message's OPT RR, if it has one and they parse.
+func edns0Options(msg *dns.Msg) []dns.EDNS0Option {
+	for _, rr := range msg.Extra {
+		if opt, ok := rr.(*dns.RR_OPT); ok {
+			opts, _ := opt.ParseOptions()
+			return opts
+		}
+	}
+	return nil
+}
+
 // Convert an A RR into a net.IP
 func AtoIP(rr *dns.RR_A) net.IP {
-	ip := make([]byte, 4)
-	ip[0] = byte(rr.A >> 24)
-	ip[1] = byte(rr.A >> 16)
-	ip[2] = byte(rr.A >> 8)
-	ip[3] = byte(rr.A)
+	ip := make(net.IP, net.IPv4len)
+	copy(ip, rr.A.To4())
 	return ip
 }
 
 // Convert an AAAA RR into a net.IP
 func AAAAtoIP(rr *dns.RR_AAAA) net.IP {
-	ip := make([]byte, 16)
-	copy(ip, rr.AAAA[:])
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, rr.AAAA.To16())
 	return ip
 }
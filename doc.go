@@ -14,12 +14,93 @@ An instance is created by:
 			  true if using only loopback (i.e. testing)
 			  true if we want extensive logging)
 
+The addresses must be multicast addresses of the right IP version with a port, or NewMDNS fails.
+If some interfaces can't be listened on, e.g., one that can't multicast, NewMDNS still succeeds
+with an MDNS using the others, and fails with an error wrapping ErrInterface only if none can be.
+Interfaces lists those in use and InterfaceErrors says why the others failed:
+
+	s, err := NewMDNS(hostname, "", "", false, 0)
+	if err != nil {
+		return err
+	}
+	for ifc, err := range s.InterfaceErrors() {
+		log.Printf("not using %s: %v", ifc, err)
+	}
+
+To use the standard groups, DefaultIPv4Addr and DefaultIPv6Addr, without spelling them out:
+
+	s, err := NewStandardMDNS(hostname, loopback, debug)
+
+ExtraGroups(addresses...) joins more groups on every interface, e.g., to be on the standard mdns
+network and a private one at the same time.
+
+Options can follow the logging level, e.g., to use only some of the interfaces:
+
+	s, err := NewMDNS(hostname, "", "", false, 0, InterfaceFilter(func(ifc net.Interface) bool {
+			return !strings.HasPrefix(ifc.Name, "docker")
+		}))
+
+ReceiveInterfaceFilter and SendInterfaceFilter take the same kind of function to split the interfaces
+by direction, e.g., to only announce on a data network while hearing everything on a management one:
+
+	s, err := NewMDNS(hostname, "", "", false, 0, ReceiveInterfaceFilter(func(ifc net.Interface) bool {
+			return ifc.Name == "mgmt0"
+		}))
+
+LogTo(logger) sends log messages to your own logger, anything with a Printf method, rather than the
+standard one.
+
+MaxCacheEntries(n) caps the records cached per interface, evicting the least recently used ones
+learned from others.
+
+MulticastLoopback(false) keeps other MDNS instances on the same host from hearing us.  Note that on
+Linux the loopback interface delivers IPv4 multicasts locally regardless.
+
+Shared answers, e.g., service PTRs, are sent after a short random delay.  If another responder
+multicasts the same answer first, with at least half our TTL, we don't repeat it.
+DuplicateAnswerSuppression(false) always sends our own.
+
+Each interface only learns from and answers the packets that arrived on it, so a host on several
+subnets doesn't leak what it hears on one onto another.
+
+Every 10 seconds the interfaces are rescanned so that ones that come up later or get new addresses,
+e.g., after a laptop wakes, are joined and our host and services announced on them.
+InterfaceScanInterval(d) changes the period and InterfaceScanInterval(0) turns the scanning off.
+
+We send from the port of the multicast address, normally 5353.  When using some other multicast
+address behind a firewall that only passes the standard port, SourcePort(5353) sends from, and listens
+for direct replies on, 5353 instead.
+
+Both IPv4 and IPv6 are used.  Where one of them is turned off, DisableIPv4() or DisableIPv6() keeps
+us from touching it at all; its multicast address passed to NewMDNS is then ignored.
+
+Multicasts are sent with an IP TTL of 255.  MulticastTTL(1) keeps them from ever leaving the local
+subnet; interfaces on which the TTL can't be set are then not used.
+
+Our sockets get the system's default receive buffer.  Where bursts of answers get dropped on a busy
+network, ReceiveBufferSize(n) asks for bigger ones and ReceiveBufferSizes reports what each interface
+actually got.
+
+Messages are kept within each interface's MTU and 9000 bytes, the most RFC 6762 allows, by splitting
+those with more records than fit into several.  MaxPacketSize(n) lowers the cap, e.g., for networks
+that lose fragments or big frames.
+
+As RFC 6762 asks, multicast answers that others may also be giving, e.g., PTRs, and the first query
+after subscribing wait a random 20 to 120 milliseconds so that many hosts don't all send at once.
+
+A question asked on an interface isn't asked there again for a second, so many goroutines looking for
+the same thing at once cause one multicast.  QuerySuppression(d) changes the window; 0 turns it off.
+
 To register interest in a service (i.e. for service discovery ala RFC 6763):
 
-	s.SubscribeToService(service name)
+	err := s.SubscribeToService(service name)
 
 This actually sends a multicast request on all networks asking for anyone providing that service.
 It need only be done once, since, as systems join the network they will multicast that information.
+In case we miss that, the request is repeated after 1, 2, 4, ... seconds, at most once a minute, until
+UnsubscribeFromService.  SubscriptionRequery(first, max) changes the intervals.
+A service name is either a single label, e.g., "http", or a full domain name, e.g., "_http._tcp.local.".
+Anything else, such as "_http._tcp" without the trailing dot, is rejected with an error.
 
 To register as a provider of a service:
 
@@ -27,6 +108,71 @@ To register as a provider of a service:
 		     hostname - default, the host name provided with NewMDNS,
 		     port)
 
+AddService first probes the networks and returns ErrNameConflict if someone else is already using
+the name.  The announcement is repeated one and three seconds later in case it was lost.  Adding a
+service again is harmless: with the same TXT records nothing happens and with different ones the new
+records replace the old.  AddServiceWithRename instead picks new names as RFC 6762 section 9 suggests,
+the instance "<hostname> (2)", "<hostname> (3)", ... and, if the host name is taken too, the host
+<hostname>-2, <hostname>-3, ..., and returns the instance name.
+
+A device offering many services can add them all at once, probing for them together and announcing
+them in as few messages as they fit in:
+
+	err := s.AddServices([]mdns.ServiceSpec{{Service: "http", Port: 80}, {Service: "ipp", Port: 631}})
+
+Either all of them are added or, if any fails, none is and the error names the ones that failed.
+
+Errors can be told apart with errors.Is: ErrNameConflict for names in use, ErrInvalidService and
+ErrInvalidArgument for bad input, ErrNotAnnounced for changing a service we aren't announcing,
+ErrNotFound for names nobody answers for, ErrPassive for sending in passive mode, ErrInterface for
+interfaces we can't listen on, and ErrClosed, once called ErrStopped, for calls after Stop.
+Anything else comes from the networks and may be worth retrying.
+
+Our host name, and the hosts of our services, resolve to the addresses of each interface, and their
+reverse (in-addr.arpa and ip6.arpa) PTR names resolve back.  To do the same for a host with addresses
+of your choosing, e.g., a device you speak for:
+
+	err := s.AddHostAddress(hostname, ips...)
+	err = s.RemoveHostAddress(hostname)
+
+To also announce a service under subtypes (RFC 6763 section 7.1), e.g., a printer offering http:
+
+	s.AddServiceWithSubtypes("http", hostname, port, []string{"printer"}, txt...)
+
+Browsing SubtypeService("printer", "http") instead of "http" finds only the printers.
+
+AddServiceWithOptions takes the subtypes and a TTL for the service's records in a ServiceOptions.
+The default TTL is 120 seconds.  RFC 6762 recommends 120 seconds for records naming a host and 75
+minutes (4500 seconds) for the others, so stable services might use 4500 and mobile ones less:
+
+	s.AddServiceWithOptions(servicename, hostname, port, mdns.ServiceOptions{TTL: 4500}, txt...)
+
+Our records are announced again when 80% of their TTL has gone by without our multicasting them, so
+others' caches keep them without having to ask.  Each record's own TTL decides, so a service with a
+4500 second TTL isn't reannounced as often as its host's addresses.
+
+ServiceOptions{Rename: true} renames the instance on a conflict the way RFC 6762 suggests for
+instance names, "Living Room Speaker" becoming "Living Room Speaker (2)" and so on, probing each new
+name before announcing it.  Only the instance name changes unless someone else also has the host
+name, which then becomes, e.g., Living Room Speaker-2.  RegisterService takes the same options and returns the name used:
+
+	name, err := s.RegisterService(servicename, "Living Room Speaker", port, mdns.ServiceOptions{Rename: true}, txt...)
+
+Rather than formatting the TXT strings yourself, AddServiceMap takes them as a map of keys to values,
+checks the keys, and writes the pairs in order of their keys:
+
+	err := s.AddServiceMap(servicename, hostname, port, map[string]string{"path": "/", "color": "red"})
+
+ServiceOptions{Txtvers: 1} puts txtvers=1 first in the TXT record, as DNS-SD suggests, and a client
+can check an instance's version with its Txtvers method before reading the rest of the TXT.
+
+To change the TXT records of a service without withdrawing it:
+
+	s.UpdateServiceTxt(servicename, hostname, port, txt...)
+
+For a TXT that changes often, TxtUpdateDebounce(d) announces at most one change every d; the updates
+in between are merged and the latest one is announced at the end of the window.
+
 To learn all providers of a service:
 
 	var instances []mdns.ServiceInstance
@@ -35,23 +181,200 @@ To learn all providers of a service:
 where
 
 	type ServiceInstance struct {
-		Target string
-		Port   uint16
+		Name    string
+		Service string
+		SrvRRs  []*dns.RR_SRV
+		TxtRRs  []*dns.RR_TXT
+		Sources []mdns.InstanceSource
+		Removed bool
+		Expiry  time.Time
 	}
 
+Expiry is when the first of the instance's records will be dropped unless the provider refreshes it.
+Callers doing their own refreshing can ask again shortly before then.
+
+TxtRRs holds every TXT RR cached for the instance.  There should be one but a misbehaving responder
+may send several; MergedTxt combines them into one list of strings the same way whatever order they
+arrived in, keeping the first value of each key.
+
+Sources lists each interface the instance was heard on and the address that sent it, so that callers
+can, e.g., prefer a wired interface over a wireless one.  An instance heard on several interfaces with
+the same SRV and TXT records is returned once with all of its sources.  MergeInstances(false) returns it
+once per interface instead.
+
+To order instances by their SRV priorities and weights (RFC 2782) before trying them:
+
+	mdns.SortBySRV(instances, nil)
+
+Passing a *rand.Rand instead of nil makes the order reproducible.  To just pick the one to try first:
+
+	inst = mdns.PickSRV(instances, nil)
+
+Records can outlive the device that sent them.  To skip instances that no longer accept TCP connections:
+
+	if s.VerifyReachable(inst, time.Second) { ... }
+
+Only callers that ask make connections; discovery itself never does.
+
+To leave out the instances we announce ourselves, e.g., when building a list of peers:
+
+	instances = s.ServiceDiscoveryExcludingSelf(service name)
+
+ServiceDiscovery only looks at what has already been learned.  To ask the networks and wait, up to
+a timeout, until the answers stop arriving:
+
+	instances = s.ServiceDiscoveryTimeout(service name, timeout)
+
+Programs that only want to look up a service once, e.g., command line tools, needn't create an MDNS
+at all.  DiscoverOnce starts one, asks, and stops it again, sockets and goroutines included:
+
+	instances, err = mdns.DiscoverOnce(service name, timeout)
+
+To learn which service types are being offered on the networks:
+
+	var types []string
+	types = s.DiscoverServiceTypes()
+
+To be told about changes in the providers of a service:
+
+	stop := s.ServiceMemberCallback(service name, func(inst mdns.ServiceInstance, added bool) {
+		...
+	})
+
+Watchers only hear about real changes, not every refresh.  For devices that flap, e.g., saying
+goodbye and announcing themselves again, WatchDedupWindow(d) holds back removals for d and drops
+them if the instance comes back unchanged.
+
+To watch everything on the networks, SubscribeToAll subscribes to each service type as it is
+discovered, now or later, and announces the changes in all of them on one channel:
+
+	c, stop := s.SubscribeToAll()
+
+To only hear about some of them, ServiceMemberWatchFilter takes a predicate, e.g., on a TXT key,
+which is compared ignoring case.  An instance that stops matching is delivered as removed:
+
+	c, stop := s.ServiceMemberWatchFilter(service name, func(inst mdns.ServiceInstance) bool {
+		role, _ := inst.TxtValue("role")
+		return string(role) == "primary"
+	})
+
+To wait for one particular instance, e.g., a peer being started by the same orchestrator,
+WaitForInstance returns it as soon as it is cached or has been discovered, or an error wrapping
+ErrNotFound after the timeout:
+
+	inst, err := s.WaitForInstance(service name, instance name, 10*time.Second)
+
+Once an instance is found, ResolveService gets everything needed to connect to it in one call: the
+targets and ports of its SRV records, in the order to try them, the addresses of each target, and its
+TXT key/value pairs:
+
+	rs, err := s.ResolveService("Living Room._http._tcp.local.", time.Second)
+	addr := net.JoinHostPort(rs.Targets[0].Addrs[0].String(), strconv.Itoa(int(rs.Targets[0].Port)))
+
 To learn the addresses of a host:
 
 	var ips []net.IP
 	ips = s.ResolveAddress(domain name - can be with or without a trailing ".local")
 
+or, to be able to give up early,
+
+	ips, err = s.ResolveAddressContext(ctx, domain name)
+
+ResolveAddress4 and ResolveAddress6 return only the IPv4 or only the IPv6 addresses, in a stable order.
+If the cached addresses have less than a fifth of their TTL left, all of these ask the networks again
+and wait a moment for fresh ones rather than answer with addresses about to vanish.
+
+IPv6 link local (fe80::) addresses can't be dialed without the interface they are on.  ResolveIPAddr
+and ResolveIPAddrContext return net.IPAddrs whose Zone names the interface each such address was
+learned on:
+
+	addrs, err := s.ResolveIPAddrContext(ctx, domain name)
+	conn, err := net.Dial("tcp", net.JoinHostPort(addrs[0].String(), "80"))
+
 To learn an RR (dns resource record) of a particular type:
 
 	var rrs []dns.RR
 	rrs = s.ResolveRR(domain name - can be with or without a trailing ".local")
 
+ResolveRR only asks the networks if nothing is cached.  To always ask and collect the answers for a
+short while:
+
+	rrs, err = s.Query(domain name, rrtype)
+
+QueryMulti asks about several names in as few packets as they fit in, e.g., a dozen service types at
+startup:
+
+	rrs, err = s.QueryMulti([]string{"_http._tcp.local.", "_ipp._tcp.local."}, dns.TypePTR)
+
+For services in a unicast DNS-SD zone rather than on the local link, ResolveUnicast asks an ordinary
+DNS server, and Resolve asks the networks first and then the server given with UnicastFallback(server):
+
+	rrs, err = s.ResolveUnicast(domain name, rrtype, server)
+	rrs, err = s.Resolve(domain name, rrtype)
+
+To learn the names advertised for an address (i.e. PTR RRs in in-addr.arpa or ip6.arpa):
+
+	var names []string
+	names, err = s.ReverseLookup(ip)
+
+To list the service instances this MDNS instance is announcing:
+
+	instances = s.LocalServices()
+
+For monitoring, Stats returns counts of packets sent and received, parse failures, questions answered,
+the number of cached records, and how many cache lookups found something, e.g., to judge TTL tuning:
+
+	var stats mdns.MDNSStats
+	stats = s.Stats()
+
+For tests that shouldn't depend on the system's multicast, a MemoryNetwork connects MDNS instances in
+memory.  Each gets a host on it with its own addresses:
+
+	network := mdns.NewMemoryNetwork()
+	ipnet := &net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(24, 32)}
+	s, err := mdns.NewMDNS("host1", "", "", false, 0, mdns.UseTransport(network.Host(ipnet)))
+
+EDNS0Options(opts...) puts EDNS0 options in the OPT RR of every message we send, e.g., to advertise a
+capability of an experimental extension, and OnEDNS0Options(f) has f called with the options of every
+message received.  dns.RR_OPT's ParseOptions and SetOptions do the encoding, keeping options they
+don't know.
+
+An MDNS may look for the services it announces itself.  It hears its own announcements, via
+multicast loopback, but ignores the records it is authoritative for rather than relearning them from
+the network, and still answers everyone else's questions.
+
+Passive(true) makes an observer that caches everything it hears without ever sending, so that
+ServiceDiscovery and DumpCache reflect the network without disturbing it.
+
+To capture raw traffic, e.g., for test fixtures, OnPacket(f) has f called with every packet received,
+before parsing, without slowing down the receiving.
+
+For debugging, DumpCache returns a copy of every cached record, along with the interface it was
+learned on, when it expires, who sent it, and when it last arrived with what TTL, the record's own TTL
+being what is left:
+
+	var entries []mdns.CacheEntry
+	entries = s.DumpCache()
+
+When the network may have lost our announcements, e.g., after a switch rebooted, Announce multicasts
+all of our records again without touching the services.
+
+After moving to another network, FlushCache(true) forgets everything learned so far, keeping only
+what we announce, and asks again for the services we are subscribed to.
+
+To go quiet for a while, e.g., during maintenance, without losing subscriptions or rebuilding the
+MDNS, Pause says goodbye for everything we announce and stops answering questions until Resume
+announces it all again:
+
+	s.Pause()
+	...
+	s.Resume()
+
 To stop the service:
 
 	s.Stop()
 
+Stop says goodbye for every service we are announcing before closing down.  It is safe to call more
+than once, e.g., from both a defer and a signal handler; later calls do nothing.
 
 */
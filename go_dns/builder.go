@@ -0,0 +1,54 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dns
+
+// Building messages without setting the header by hand.  The defaults are those of multicast DNS
+// (RFC 6762 section 18): an ID of 0, no opcode or rcode, and no recursion bits.  Each method returns
+// the message so that calls can be chained, e.g.,
+//
+//	msg := NewResponse().AddAnswer(NewA("x.local.", ip, 120))
+
+// NewQuery returns a query asking for the RRs of type rrtype for name in the Internet class.
+func NewQuery(name string, rrtype uint16) *Msg {
+	return new(Msg).AddQuestion(name, rrtype, ClassINET)
+}
+
+// NewResponse returns a response with no records yet, see SetResponse.
+func NewResponse() *Msg {
+	return new(Msg).SetResponse()
+}
+
+// AddQuestion appends a question for name.  The top bit of class asks for a unicast response in
+// multicast DNS.
+func (msg *Msg) AddQuestion(name string, rrtype, class uint16) *Msg {
+	msg.Question = append(msg.Question, Question{name, rrtype, class})
+	return msg
+}
+
+// SetResponse makes msg a response, authoritative as every multicast DNS response is.  Questions
+// are kept, e.g., for a unicast reply that must repeat them, but multicast responses shouldn't
+// have any.
+func (msg *Msg) SetResponse() *Msg {
+	msg.Response = true
+	msg.Authoritative = true
+	return msg
+}
+
+// AddAnswer appends rrs to the answer section.
+func (msg *Msg) AddAnswer(rrs ...RR) *Msg {
+	msg.Answer = append(msg.Answer, rrs...)
+	return msg
+}
+
+// AddAuthority appends rrs to the authority section, e.g., the records we propose when probing.
+func (msg *Msg) AddAuthority(rrs ...RR) *Msg {
+	msg.NS = append(msg.NS, rrs...)
+	return msg
+}
+
+// AddAdditional appends rrs to the additional section.
+func (msg *Msg) AddAdditional(rrs ...RR) *Msg {
+	msg.Extra = append(msg.Extra, rrs...)
+	return msg
+}
@@ -13,10 +13,11 @@ import (
 
 // Error represents a DNS lookup error.
 type Error struct {
-	Err       string // description of the error
-	Name      string // name looked for
-	Server    string // server used
-	IsTimeout bool
+	Err        string // description of the error
+	Name       string // name looked for
+	Server     string // server used
+	IsTimeout  bool
+	IsNotFound bool // the name or records of the type don't exist
 }
 
 func (e *Error) Error() string {
@@ -64,15 +65,38 @@ func reverseaddr(addr string) (arpa string, err error) {
 	return string(buf), nil
 }
 
+// ReverseAddr returns the in-addr.arpa. or ip6.arpa. name under which PTR
+// records for the IP address addr are found.
+func ReverseAddr(addr string) (string, error) {
+	return reverseaddr(addr)
+}
+
 // Answer extracts the appropriate answer for a DNS lookup
 // for (name, qtype) from the response message msg, which
-// is assumed to have come from server.
+// is assumed to have come from server.  Any qtype works,
+// e.g., TypeSRV, TypeTXT or TypePTR, and CNAMEs are followed
+// whatever the qtype.  Only the answer section counts.
 // It is exported mainly for use by registered helpers.
 func Answer(name string, qtype uint16, msg *Msg, server string) (cname string, addrs []RR, err error) {
+	return answer(name, qtype, msg, server, false)
+}
+
+// AnswerMulticast is Answer for a multicast DNS response
+// (RFC 6762).  Records in the additional section count as
+// well as those in the answer section, since responders put
+// the records a querier will want next there, and the cache
+// flush bit of the class is ignored.  Don't use it for unicast
+// replies, whose additional records can't be trusted to answer
+// the question.
+func AnswerMulticast(name string, qtype uint16, msg *Msg, server string) (cname string, addrs []RR, err error) {
+	return answer(name, qtype, msg, server, true)
+}
+
+func answer(name string, qtype uint16, msg *Msg, server string, multicast bool) (cname string, addrs []RR, err error) {
 	addrs = make([]RR, 0, len(msg.Answer))
 
 	if msg.Rcode == RcodeNameError && msg.RecursionAvailable {
-		return "", nil, &Error{Err: noSuchHost, Name: name}
+		return "", nil, &Error{Err: noSuchHost, Name: name, IsNotFound: true}
 	}
 	if msg.Rcode != RcodeSuccess {
 		// None of the error codes make sense
@@ -90,28 +114,40 @@ func Answer(name string, qtype uint16, msg *Msg, server string) (cname string, a
 Cname:
 	for cnameloop := 0; cnameloop < 10; cnameloop++ {
 		addrs = addrs[0:0]
-		for _, rr := range msg.Answer {
-			if _, justHeader := rr.(*RR_Header); justHeader {
-				// Corrupt record: we only have a
-				// header. That header might say it's
-				// of type qtype, but we don't
-				// actually have it. Skip.
-				continue
-			}
-			h := rr.Header()
-			if h.Class == ClassINET && h.Name == name {
-				switch h.Rrtype {
-				case qtype:
-					addrs = append(addrs, rr)
-				case TypeCNAME:
-					// redirect to cname
-					name = rr.(*RR_CNAME).Cname
-					continue Cname
+		sections := [][]RR{msg.Answer}
+		if multicast {
+			sections = append(sections, msg.Extra)
+		}
+		for _, section := range sections {
+			for _, rr := range section {
+				if _, justHeader := rr.(*RR_Header); justHeader {
+					// Corrupt record: we only have a
+					// header. That header might say it's
+					// of type qtype, but we don't
+					// actually have it. Skip.
+					continue
+				}
+				h := rr.Header()
+				class := h.Class
+				if multicast {
+					// Multicast DNS uses the top bit of the
+					// class as a cache flush bit.
+					class &^= 0x8000
+				}
+				if class == ClassINET && h.Name == name {
+					switch h.Rrtype {
+					case qtype:
+						addrs = append(addrs, rr)
+					case TypeCNAME:
+						// redirect to cname
+						name = rr.(*RR_CNAME).Cname
+						continue Cname
+					}
 				}
 			}
 		}
 		if len(addrs) == 0 {
-			return "", nil, &Error{Err: noSuchHost, Name: name, Server: server}
+			return "", nil, &Error{Err: noSuchHost, Name: name, Server: server, IsNotFound: true}
 		}
 		return name, addrs, nil
 	}
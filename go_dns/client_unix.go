@@ -101,7 +101,7 @@ func tryOneName(cfg *dnsConfig, name string, qtype uint16) (cname string, addrs
 			continue
 		}
 		cname, addrs, err = Answer(name, qtype, msg, server)
-		if err == nil || err.(*Error).Err == noSuchHost {
+		if err == nil || err.(*Error).IsNotFound {
 			break
 		}
 	}
@@ -112,7 +112,7 @@ func convertRR_A(records []RR) []net.IP {
 	addrs := make([]net.IP, len(records))
 	for i, rr := range records {
 		a := rr.(*RR_A).A
-		addrs[i] = net.IPv4(byte(a>>24), byte(a>>16), byte(a>>8), byte(a))
+		addrs[i] = net.IPv4(a[0], a[1], a[2], a[3])
 	}
 	return addrs
 }
@@ -121,7 +121,7 @@ func convertRR_AAAA(records []RR) []net.IP {
 	addrs := make([]net.IP, len(records))
 	for i, rr := range records {
 		a := make(net.IP, net.IPv6len)
-		copy(a, rr.(*RR_AAAA).AAAA[:])
+		copy(a, rr.(*RR_AAAA).AAAA)
 		addrs[i] = a
 	}
 	return addrs
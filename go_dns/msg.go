@@ -23,8 +23,14 @@
 package dns
 
 import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"net"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 // Packet formats
@@ -50,6 +56,8 @@ const (
 	TypeTXT   = 16
 	TypeAAAA  = 28
 	TypeSRV   = 33
+	TypeOPT   = 41
+	TypeNSEC  = 47
 
 	// valid Question.qtype only
 	TypeAXFR  = 252
@@ -79,8 +87,10 @@ type dnsStruct interface {
 	// Walk iterates over fields of a structure and calls f
 	// with a reference to that field, the name of the field
 	// and a tag ("", "domain", "ipv4", "ipv6") specifying
-	// particular encodings. Possible concrete types
-	// for v are *uint16, *uint32, *string, or []byte, and
+	// particular encodings.  The class fields are tagged
+	// "class" and "qclass" so that printing can show the
+	// multicast DNS bits.  Possible concrete types
+	// for v are *uint16, *uint32, *string, *net.IP or []byte, and
 	// *int, *bool in the case of MsgHdr.
 	// Whenever f returns false, Walk must stop and return
 	// false, and otherwise return true.
@@ -122,7 +132,7 @@ type Question struct {
 func (q *Question) Walk(f func(v interface{}, name, tag string) bool) bool {
 	return f(&q.Name, "Name", "domain") &&
 		f(&q.Qtype, "Qtype", "") &&
-		f(&q.Qclass, "Qclass", "")
+		f(&q.Qclass, "Qclass", "qclass")
 }
 
 // DNS responses (resource records).
@@ -143,7 +153,7 @@ func (h *RR_Header) Header() *RR_Header {
 func (h *RR_Header) Walk(f func(v interface{}, name, tag string) bool) bool {
 	return f(&h.Name, "Name", "domain") &&
 		f(&h.Rrtype, "Rrtype", "") &&
-		f(&h.Class, "Class", "") &&
+		f(&h.Class, "Class", "class") &&
 		f(&h.Ttl, "Ttl", "") &&
 		f(&h.Rdlength, "Rdlength", "")
 }
@@ -182,6 +192,10 @@ func (rr *RR_HINFO) Walk(f func(v interface{}, name, tag string) bool) bool {
 	return rr.Hdr.Walk(f) && f(&rr.Cpu, "Cpu", "") && f(&rr.Os, "Os", "")
 }
 
+func (rr *RR_HINFO) String() string {
+	return printStruct(rr)
+}
+
 type RR_MB struct {
 	Hdr RR_Header
 	Mb  string `net:"domain-name"`
@@ -314,6 +328,80 @@ func (rr *RR_TXT) Walk(f func(v interface{}, name, tag string) bool) bool {
 	return rr.Hdr.Walk(f) && f(&rr.Txt, "Txt", "")
 }
 
+// Pairs parses the strings of a TXT RR as key=value pairs (RFC 6763 section 6).
+// Keys are case insensitive and are returned in lower case.  A key with no '='
+// maps to a nil value, whereas "key=" maps to an empty, non-nil value.  Only
+// the first occurrence of a key is kept and strings starting with '=' are ignored.
+func (rr *RR_TXT) Pairs() map[string][]byte {
+	pairs := make(map[string][]byte)
+	for _, s := range rr.Txt {
+		key, value := s, []byte(nil)
+		if i := strings.IndexByte(s, '='); i >= 0 {
+			key, value = s[:i], []byte(s[i+1:])
+		}
+		if len(key) == 0 {
+			continue
+		}
+		key = strings.ToLower(key)
+		if _, ok := pairs[key]; ok {
+			continue
+		}
+		pairs[key] = value
+	}
+	return pairs
+}
+
+// TxtFromPairs is the inverse of Pairs.  It returns a TXT RR with one string per
+// key, sorted by key.  A nil value produces a bare key.  The caller is expected to
+// fill in the rest of the header.
+func TxtFromPairs(pairs map[string][]byte) *RR_TXT {
+	keys := make([]string, 0, len(pairs))
+	for key := range pairs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	rr := &RR_TXT{Hdr: RR_Header{Rrtype: TypeTXT, Class: ClassINET}, Txt: make([]string, 0, len(keys))}
+	for _, key := range keys {
+		if value := pairs[key]; value != nil {
+			rr.Txt = append(rr.Txt, key+"="+string(value))
+		} else {
+			rr.Txt = append(rr.Txt, key)
+		}
+	}
+	return rr
+}
+
+// Txtvers returns the version of the TXT RR's schema from its txtvers key (RFC 6763
+// section 6.7).  ok is false if there is no txtvers key or its value isn't a number.
+func (rr *RR_TXT) Txtvers() (v int, ok bool) {
+	value, found := rr.Pairs()["txtvers"]
+	if !found {
+		return 0, false
+	}
+	v, err := strconv.Atoi(string(value))
+	if err != nil || v < 0 {
+		return 0, false
+	}
+	return v, true
+}
+
+// SetTxtvers makes txtvers=v the first string of the TXT RR, as RFC 6763 section 6.7
+// asks, dropping any other txtvers key.
+func (rr *RR_TXT) SetTxtvers(v int) {
+	txt := []string{"txtvers=" + strconv.Itoa(v)}
+	for _, s := range rr.Txt {
+		key := s
+		if i := strings.IndexByte(s, '='); i >= 0 {
+			key = s[:i]
+		}
+		if strings.EqualFold(key, "txtvers") {
+			continue
+		}
+		txt = append(txt, s)
+	}
+	rr.Txt = txt
+}
+
 type RR_SRV struct {
 	Hdr      RR_Header
 	Priority uint16
@@ -334,9 +422,109 @@ func (rr *RR_SRV) Walk(f func(v interface{}, name, tag string) bool) bool {
 		f(&rr.Target, "Target", "domain")
 }
 
+// An NSEC RR (RFC 4034) lists the types of RRs that exist for a name.  Multicast DNS uses it
+// to say that other types don't (RFC 6762 section 6.1).
+type RR_NSEC struct {
+	Hdr        RR_Header
+	NextDomain string   `net:"domain-name"`
+	Types      []uint16 `net:"type-bitmap"`
+}
+
+func (rr *RR_NSEC) Header() *RR_Header {
+	return &rr.Hdr
+}
+
+func (rr *RR_NSEC) Walk(f func(v interface{}, name, tag string) bool) bool {
+	return rr.Hdr.Walk(f) &&
+		f(&rr.NextDomain, "NextDomain", "domain") &&
+		f(&rr.Types, "Types", "typebitmap")
+}
+
+// HasType returns true if the NSEC RR lists rrtype.
+func (rr *RR_NSEC) HasType(rrtype uint16) bool {
+	for _, t := range rr.Types {
+		if t == rrtype {
+			return true
+		}
+	}
+	return false
+}
+
+// An OPT pseudo-RR (RFC 6891) carries EDNS0 information in the additional section.  The name is the
+// root, the class is the largest UDP payload the sender can receive, and the TTL holds the extended
+// RCODE, version and flags.  Options holds the raw option data.
+type RR_OPT struct {
+	Hdr     RR_Header
+	Options []byte `net:"octets"`
+}
+
+func (rr *RR_OPT) Header() *RR_Header {
+	return &rr.Hdr
+}
+
+func (rr *RR_OPT) Walk(f func(v interface{}, name, tag string) bool) bool {
+	return rr.Hdr.Walk(f) && f(&rr.Options, "Options", "octets")
+}
+
+// UDPSize returns the largest UDP payload the sender of the OPT RR can receive.
+func (rr *RR_OPT) UDPSize() int {
+	return int(rr.Hdr.Class)
+}
+
+// An EDNS0 option (RFC 6891 section 6.1.2) in an OPT RR.  Data is left for whoever knows the Code to
+// interpret.
+type EDNS0Option struct {
+	Code uint16
+	Data []byte
+}
+
+// ParseOptions splits the option data of the OPT RR into its options, in order, known or not, so
+// that SetOptions can put them back unchanged.  ok is false if the data is malformed.
+func (rr *RR_OPT) ParseOptions() (opts []EDNS0Option, ok bool) {
+	b := rr.Options
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, false
+		}
+		code := uint16(b[0])<<8 | uint16(b[1])
+		n := int(b[2])<<8 | int(b[3])
+		if len(b) < 4+n {
+			return nil, false
+		}
+		opts = append(opts, EDNS0Option{code, append([]byte(nil), b[4:4+n]...)})
+		b = b[4+n:]
+	}
+	return opts, true
+}
+
+// SetOptions replaces the option data of the OPT RR with opts.  Options with more than 65535 bytes of
+// data can't be encoded and are left out.
+func (rr *RR_OPT) SetOptions(opts []EDNS0Option) {
+	var b []byte
+	for _, o := range opts {
+		if len(o.Data) > 0xffff {
+			continue
+		}
+		b = append(b, byte(o.Code>>8), byte(o.Code), byte(len(o.Data)>>8), byte(len(o.Data)))
+		b = append(b, o.Data...)
+	}
+	rr.Options = b
+}
+
+// Option returns the data of the first option with the given code.
+func (rr *RR_OPT) Option(code uint16) ([]byte, bool) {
+	opts, _ := rr.ParseOptions()
+	for _, o := range opts {
+		if o.Code == code {
+			return o.Data, true
+		}
+	}
+	return nil, false
+}
+
 type RR_A struct {
 	Hdr RR_Header
-	A   uint32 `net:"ipv4"`
+	A   net.IP `net:"ipv4"` // 4 bytes
 }
 
 func (rr *RR_A) Header() *RR_Header {
@@ -347,9 +535,13 @@ func (rr *RR_A) Walk(f func(v interface{}, name, tag string) bool) bool {
 	return rr.Hdr.Walk(f) && f(&rr.A, "A", "ipv4")
 }
 
+func (rr *RR_A) String() string {
+	return printStruct(rr)
+}
+
 type RR_AAAA struct {
 	Hdr  RR_Header
-	AAAA [16]byte `net:"ipv6"`
+	AAAA net.IP `net:"ipv6"` // 16 bytes
 }
 
 func (rr *RR_AAAA) Header() *RR_Header {
@@ -357,7 +549,49 @@ func (rr *RR_AAAA) Header() *RR_Header {
 }
 
 func (rr *RR_AAAA) Walk(f func(v interface{}, name, tag string) bool) bool {
-	return rr.Hdr.Walk(f) && f(rr.AAAA[:], "AAAA", "ipv6")
+	return rr.Hdr.Walk(f) && f(&rr.AAAA, "AAAA", "ipv6")
+}
+
+func (rr *RR_AAAA) String() string {
+	return printStruct(rr)
+}
+
+// Constructors for the common RRs.  The class is INET; Rdlength is filled in when the
+// RR is packed.
+
+// NewA returns an A RR giving the IPv4 address ip for name.
+func NewA(name string, ip net.IP, ttl uint32) *RR_A {
+	return &RR_A{RR_Header{name, TypeA, ClassINET, ttl, 0}, ip.To4()}
+}
+
+// NewAAAA returns an AAAA RR giving the IPv6 address ip for name.
+func NewAAAA(name string, ip net.IP, ttl uint32) *RR_AAAA {
+	return &RR_AAAA{RR_Header{name, TypeAAAA, ClassINET, ttl, 0}, ip.To16()}
+}
+
+// NewPTR returns a PTR RR pointing from name to ptr.
+func NewPTR(name, ptr string, ttl uint32) *RR_PTR {
+	return &RR_PTR{RR_Header{name, TypePTR, ClassINET, ttl, 0}, ptr}
+}
+
+// NewSRV returns an SRV RR saying that the service name is at port on target.
+func NewSRV(name, target string, port, priority, weight uint16, ttl uint32) *RR_SRV {
+	return &RR_SRV{RR_Header{name, TypeSRV, ClassINET, ttl, 0}, priority, weight, port, target}
+}
+
+// NewTXT returns a TXT RR holding txt.  With no strings it holds a single empty one, the
+// smallest legal TXT RR.
+func NewTXT(name string, ttl uint32, txt ...string) *RR_TXT {
+	if len(txt) == 0 {
+		txt = []string{""}
+	}
+	return &RR_TXT{RR_Header{name, TypeTXT, ClassINET, ttl, 0}, txt}
+}
+
+// NewHINFO returns an HINFO RR saying that name is a cpu running os.  Each is a character string
+// so must be at most 255 bytes for the RR to pack.
+func NewHINFO(name string, ttl uint32, cpu, os string) *RR_HINFO {
+	return &RR_HINFO{RR_Header{name, TypeHINFO, ClassINET, ttl, 0}, cpu, os}
 }
 
 // Packing and unpacking.
@@ -384,16 +618,26 @@ var rr_mk = map[int]func() RR{
 	TypeSRV:   func() RR { return new(RR_SRV) },
 	TypeA:     func() RR { return new(RR_A) },
 	TypeAAAA:  func() RR { return new(RR_AAAA) },
+	TypeNSEC:  func() RR { return new(RR_NSEC) },
+	TypeOPT:   func() RR { return new(RR_OPT) },
 }
 
 // Pack a domain name s into msg[off:].
 // Domain names are a sequence of counted strings
 // split at the dots.  They end with a zero-length string.
-func packDomainName(s string, msg []byte, off int) (off1 int, ok bool) {
+// If compression is not nil, it maps names already written
+// to msg to their offsets.  When a suffix of s has already
+// been written, we emit a pointer to it (RFC 1035 section 4.1.4)
+// instead of the remaining labels.
+func packDomainName(s string, msg []byte, off int, compression map[string]int) (off1 int, ok bool) {
 	// Add trailing dot to canonicalize name.
 	if n := len(s); n == 0 || s[n-1] != '.' {
 		s += "."
 	}
+	// The root is just the trailing zero.
+	if s == "." {
+		s = ""
+	}
 
 	// Each dot ends a segment of the name.
 	// We trade each dot byte for a length byte.
@@ -405,21 +649,45 @@ func packDomainName(s string, msg []byte, off int) (off1 int, ok bool) {
 	}
 
 	// Emit sequence of counted strings, chopping at dots.
+	// A backslash quotes the next byte, so `a\.b.` is the one label "a.b".
 	begin := 0
+	var label []byte
 	for i := 0; i < len(s); i++ {
-		if s[i] == '.' {
-			if i-begin >= 1<<6 { // top two bits of length must be clear
+		switch s[i] {
+		case '\\':
+			if i++; i == len(s) {
 				return len(msg), false
 			}
-			msg[off] = byte(i - begin)
-			off++
-			for j := begin; j < i; j++ {
-				msg[off] = s[j]
-				off++
+			label = append(label, s[i])
+		case '.':
+			if compression != nil && i > begin {
+				// Only point backwards, we may be repacking this very name.
+				if ptr, ok := compression[s[begin:]]; ok && ptr < off {
+					msg[off] = byte(0xC0 | ptr>>8)
+					msg[off+1] = byte(ptr)
+					return off + 2, true
+				}
+				// Pointers only have 14 bits of offset.
+				if off <= 0x3FFF {
+					compression[s[begin:]] = off
+				}
 			}
+			if len(label) >= 1<<6 { // top two bits of length must be clear
+				return len(msg), false
+			}
+			msg[off] = byte(len(label))
+			off++
+			off += copy(msg[off:], label)
 			begin = i + 1
+			label = label[:0]
+		default:
+			label = append(label, s[i])
 		}
 	}
+	if begin != len(s) {
+		// The last dot was quoted.
+		return len(msg), false
+	}
 	msg[off] = 0
 	off++
 	return off, true
@@ -438,13 +706,14 @@ func packDomainName(s string, msg []byte, off int) (off1 int, ok bool) {
 // which is where the next record will start.
 // In theory, the pointers are only allowed to jump backward.
 // We let them jump anywhere and stop jumping after a while.
-func unpackDomainName(msg []byte, off int) (s string, off1 int, ok bool) {
+func unpackDomainName(msg []byte, off int) (s string, off1 int, err error) {
 	s = ""
+	n := 0   // length of the name on the wire
 	ptr := 0 // number of pointers followed
 Loop:
 	for {
 		if off >= len(msg) {
-			return "", len(msg), false
+			return "", len(msg), ErrTruncated
 		}
 		c := int(msg[off])
 		off++
@@ -456,10 +725,14 @@ Loop:
 			}
 			// literal string
 			if off+c > len(msg) {
-				return "", len(msg), false
+				return "", len(msg), ErrTruncated
 			}
-			s += string(msg[off:off+c]) + "."
+			s += escapeLabel(msg[off:off+c]) + "."
 			off += c
+			if n += c + 1; n > 255 {
+				// Longer than any legal name (RFC 1035 section 2.3.4).
+				return "", len(msg), ErrNameTooLong
+			}
 		case 0xC0:
 			// pointer to somewhere else in msg.
 			// remember location after first ptr,
@@ -467,7 +740,7 @@ Loop:
 			// also, don't follow too many pointers --
 			// maybe there's a loop.
 			if off >= len(msg) {
-				return "", len(msg), false
+				return "", len(msg), ErrTruncated
 			}
 			c1 := msg[off]
 			off++
@@ -475,23 +748,46 @@ Loop:
 				off1 = off
 			}
 			if ptr++; ptr > 10 {
-				return "", len(msg), false
+				return "", len(msg), ErrPointerLoop
 			}
 			off = (c^0xC0)<<8 | int(c1)
+			if off >= len(msg) {
+				return "", len(msg), ErrBadPointer
+			}
 		default:
 			// 0x80 and 0x40 are reserved
-			return "", len(msg), false
+			return "", len(msg), ErrBadLabel
 		}
 	}
 	if ptr == 0 {
 		off1 = off
 	}
-	return s, off1, true
+	if s == "" {
+		s = "."
+	}
+	return s, off1, nil
+}
+
+// escapeLabel returns the label as text, quoting any dots or
+// backslashes in it so that the name packs back into the same labels.
+func escapeLabel(label []byte) string {
+	if bytes.IndexByte(label, '.') < 0 && bytes.IndexByte(label, '\\') < 0 {
+		return string(label)
+	}
+	var b []byte
+	for _, c := range label {
+		if c == '.' || c == '\\' {
+			b = append(b, '\\')
+		}
+		b = append(b, c)
+	}
+	return string(b)
 }
 
 // packStruct packs a structure into msg at specified offset off, and
-// returns off1 such that msg[off:off1] is the encoded data.
-func packStruct(any dnsStruct, msg []byte, off int) (off1 int, ok bool) {
+// returns off1 such that msg[off:off1] is the encoded data.  Domain
+// names are compressed using compression unless it is nil.
+func packStruct(any dnsStruct, msg []byte, off int, compression map[string]int) (off1 int, ok bool) {
 	ok = any.Walk(func(field interface{}, name, tag string) bool {
 		switch fv := field.(type) {
 		default:
@@ -507,6 +803,9 @@ func packStruct(any dnsStruct, msg []byte, off int) (off1 int, ok bool) {
 			off += 2
 		case *uint32:
 			i := *fv
+			if off+4 > len(msg) {
+				return false
+			}
 			msg[off] = byte(i >> 24)
 			msg[off+1] = byte(i >> 16)
 			msg[off+2] = byte(i >> 8)
@@ -519,6 +818,26 @@ func packStruct(any dnsStruct, msg []byte, off int) (off1 int, ok bool) {
 			}
 			copy(msg[off:off+n], fv)
 			off += n
+		case *[]byte:
+			// Uninterpreted data running to the end of the RR.
+			if tag != "octets" {
+				println("net: dns: unknown []byte tag", tag)
+				return false
+			}
+			if off+len(*fv) > len(msg) {
+				return false
+			}
+			off += copy(msg[off:], *fv)
+		case *net.IP:
+			// Addresses are fixed length, 4 bytes for ipv4 and 16 for ipv6.
+			ip := fv.To16()
+			if tag == "ipv4" {
+				ip = fv.To4()
+			}
+			if ip == nil || off+len(ip) > len(msg) {
+				return false
+			}
+			off += copy(msg[off:], ip)
 		case *string:
 			s := *fv
 			switch tag {
@@ -526,7 +845,7 @@ func packStruct(any dnsStruct, msg []byte, off int) (off1 int, ok bool) {
 				println("net: dns: unknown string tag", tag)
 				return false
 			case "domain":
-				off, ok = packDomainName(s, msg, off)
+				off, ok = packDomainName(s, msg, off, compression)
 				if !ok {
 					return false
 				}
@@ -539,6 +858,33 @@ func packStruct(any dnsStruct, msg []byte, off int) (off1 int, ok bool) {
 				off++
 				off += copy(msg[off:], s)
 			}
+		case *[]uint16:
+			// A type bitmap: for each block of 256 types in use, the block number, the length
+			// of the bitmap, and a bitmap with the most significant bit of the first byte
+			// for the first type of the block.
+			if tag != "typebitmap" {
+				println("net: dns: unknown []uint16 tag", tag)
+				return false
+			}
+			types := append([]uint16(nil), *fv...)
+			sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+			for i := 0; i < len(types); {
+				window := types[i] >> 8
+				var bitmap [32]byte
+				n := 0
+				for ; i < len(types) && types[i]>>8 == window; i++ {
+					b := types[i] & 0xff
+					bitmap[b/8] |= 0x80 >> (b % 8)
+					n = int(b/8) + 1
+				}
+				if off+2+n > len(msg) {
+					return false
+				}
+				msg[off] = byte(window)
+				msg[off+1] = byte(n)
+				off += 2
+				off += copy(msg[off:], bitmap[:n])
+			}
 		case *[]string:
 			// Pack the strings back to back.
 			if *fv == nil {
@@ -562,22 +908,24 @@ func packStruct(any dnsStruct, msg []byte, off int) (off1 int, ok bool) {
 	return off, true
 }
 
-// unpackStruct decodes msg[off:] into the given structure, and
-// returns off1 such that msg[off:off1] is the encoded data.
-func unpackStruct(any dnsStruct, msg []byte, off int) (off1 int, ok bool) {
-	ok = any.Walk(func(field interface{}, name, tag string) bool {
+// unpackStruct decodes msg[off:end] into the given structure, and
+// returns off1 such that msg[off:off1] is the encoded data.  Compressed
+// domain names may point anywhere in msg, not just before end.
+func unpackStruct(any dnsStruct, msg []byte, off, end int) (off1 int, err error) {
+	ok := any.Walk(func(field interface{}, name, tag string) bool {
 		switch fv := field.(type) {
 		default:
 			println("net: dns: unknown packing type")
+			err = ErrUnknownField
 			return false
 		case *uint16:
-			if off+2 > len(msg) {
+			if off+2 > end {
 				return false
 			}
 			*fv = uint16(msg[off])<<8 | uint16(msg[off+1])
 			off += 2
 		case *uint32:
-			if off+4 > len(msg) {
+			if off+4 > end {
 				return false
 			}
 			*fv = uint32(msg[off])<<24 | uint32(msg[off+1])<<16 |
@@ -585,24 +933,46 @@ func unpackStruct(any dnsStruct, msg []byte, off int) (off1 int, ok bool) {
 			off += 4
 		case []byte:
 			n := len(fv)
-			if off+n > len(msg) {
+			if off+n > end {
 				return false
 			}
 			copy(fv, msg[off:off+n])
 			off += n
+		case *[]byte:
+			if tag != "octets" {
+				println("net: dns: unknown []byte tag", tag)
+				err = ErrUnknownField
+				return false
+			}
+			*fv = append([]byte(nil), msg[off:end]...)
+			off = end
+		case *net.IP:
+			n := net.IPv6len
+			if tag == "ipv4" {
+				n = net.IPv4len
+			}
+			if off+n > end {
+				return false
+			}
+			*fv = make(net.IP, n)
+			copy(*fv, msg[off:off+n])
+			off += n
 		case *string:
 			var s string
 			switch tag {
 			default:
 				println("net: dns: unknown string tag", tag)
+				err = ErrUnknownField
 				return false
 			case "domain":
-				s, off, ok = unpackDomainName(msg, off)
-				if !ok {
+				if s, off, err = unpackDomainName(msg, off); err != nil {
+					return false
+				}
+				if off > end {
 					return false
 				}
 			case "":
-				if off >= len(msg) || off+1+int(msg[off]) > len(msg) {
+				if off >= end || off+1+int(msg[off]) > end {
 					return false
 				}
 				n := int(msg[off])
@@ -611,9 +981,38 @@ func unpackStruct(any dnsStruct, msg []byte, off int) (off1 int, ok bool) {
 				off += n
 			}
 			*fv = s
+		case *[]uint16:
+			if tag != "typebitmap" {
+				println("net: dns: unknown []uint16 tag", tag)
+				err = ErrUnknownField
+				return false
+			}
+			for off < end {
+				if off+2 > end {
+					return false
+				}
+				window := uint16(msg[off]) << 8
+				n := int(msg[off+1])
+				off += 2
+				if n == 0 || n > 32 {
+					err = ErrBadBitmap
+					return false
+				}
+				if off+n > end {
+					return false
+				}
+				for i, b := range msg[off : off+n] {
+					for bit := 0; bit < 8; bit++ {
+						if b&(0x80>>uint(bit)) != 0 {
+							*fv = append(*fv, window|uint16(i*8+bit))
+						}
+					}
+				}
+				off += n
+			}
 		case *[]string:
-			for off != len(msg) {
-				if off > len(msg) || off+1+int(msg[off]) > len(msg) {
+			for off != end {
+				if off > end || off+1+int(msg[off]) > end {
 					return false
 				}
 				n := int(msg[off])
@@ -622,19 +1021,26 @@ func unpackStruct(any dnsStruct, msg []byte, off int) (off1 int, ok bool) {
 				off += n
 			}
 			if *fv == nil {
+				err = ErrEmptyTxt
 				return false
 			}
 		}
 		return true
 	})
 	if !ok {
-		return len(msg), false
+		if err == nil {
+			err = ErrTruncated
+		}
+		return end, err
 	}
-	return off, true
+	return off, nil
 }
 
 // Generic struct printer. Prints fields with tag "ipv4" or "ipv6"
-// as IP addresses.
+// as IP addresses.  Classes with the top bit set, which multicast
+// DNS uses as the cache flush bit in RRs and the unicast response
+// bit in questions (RFC 6762 sections 10.2 and 5.4), are followed
+// by "(flush)" or "(unicast)".
 func printStruct(any dnsStruct) string {
 	s := "{"
 	i := 0
@@ -645,12 +1051,8 @@ func printStruct(any dnsStruct) string {
 		}
 		s += name + "="
 		switch tag {
-		case "ipv4":
-			i := *val.(*uint32)
-			s += net.IPv4(byte(i>>24), byte(i>>16), byte(i>>8), byte(i)).String()
-		case "ipv6":
-			i := val.([]byte)
-			s += net.IP(i).String()
+		case "ipv4", "ipv6":
+			s += val.(*net.IP).String()
 		default:
 			var i int64
 			switch v := val.(type) {
@@ -666,9 +1068,17 @@ func printStruct(any dnsStruct) string {
 					s += x + " "
 				}
 				return true
+			case *[]uint16:
+				for _, x := range *v {
+					s += strconv.Itoa(int(x)) + " "
+				}
+				return true
 			case []byte:
 				s += string(v)
 				return true
+			case *[]byte:
+				s += hex.EncodeToString(*v)
+				return true
 			case *bool:
 				if *v {
 					s += "true"
@@ -692,6 +1102,14 @@ func printStruct(any dnsStruct) string {
 				i = int64(*v)
 			}
 			s += strconv.Itoa(int(i))
+			if i&0x8000 != 0 {
+				switch tag {
+				case "class":
+					s += "(flush)"
+				case "qclass":
+					s += "(unicast)"
+				}
+			}
 		}
 		return true
 	})
@@ -700,52 +1118,55 @@ func printStruct(any dnsStruct) string {
 }
 
 // Resource record packer.
-func packRR(rr RR, msg []byte, off int) (off2 int, ok bool) {
+func packRR(rr RR, msg []byte, off int, compression map[string]int) (off2 int, ok bool) {
 	var off1 int
 	// pack twice, once to find end of header
 	// and again to find end of packet.
 	// a bit inefficient but this doesn't need to be fast.
 	// off1 is end of header
 	// off2 is end of rr
-	off1, ok = packStruct(rr.Header(), msg, off)
-	off2, ok = packStruct(rr, msg, off)
+	off1, ok = packStruct(rr.Header(), msg, off, compression)
+	off2, ok = packStruct(rr, msg, off, compression)
 	if !ok {
 		return len(msg), false
 	}
 	// pack a third time; redo header with correct data length
 	rr.Header().Rdlength = uint16(off2 - off1)
-	packStruct(rr.Header(), msg, off)
+	packStruct(rr.Header(), msg, off, compression)
 	return off2, true
 }
 
 // Resource record unpacker.
-func unpackRR(msg []byte, off int) (rr RR, off1 int, ok bool) {
+func unpackRR(msg []byte, off int) (rr RR, off1 int, err error) {
 	// unpack just the header, to find the rr type and length
 	var h RR_Header
 	off0 := off
-	if off, ok = unpackStruct(&h, msg, off); !ok {
-		return nil, len(msg), false
+	if off, err = unpackStruct(&h, msg, off, len(msg)); err != nil {
+		return nil, len(msg), err
 	}
 	end := off + int(h.Rdlength)
-
-	// make a slice ending at the end of the RR so that unpacking
-	// can't overflow the RR
-	if end < len(msg) {
-		msg = msg[:end]
+	if end > len(msg) {
+		// The data runs off the end of the message.  Return just the header
+		// and consume the rest so that any following RR fails to unpack.
+		return &h, len(msg), nil
 	}
 
 	// make an rr of that type and re-unpack.
 	// again inefficient but doesn't need to be fast.
 	mk, known := rr_mk[int(h.Rrtype)]
 	if !known {
-		return &h, end, true
+		return &h, end, nil
 	}
 	rr = mk()
-	off, ok = unpackStruct(rr, msg, off0)
-	if off != end {
-		return &h, end, true
+	// The data can't overflow the RR, but names in it may be compressed
+	// against any part of the message, e.g., a PTR target pointing at a
+	// later additional record.
+	// Data that is too short or too long for its type leaves just the header.
+	off, err = unpackStruct(rr, msg, off0, end)
+	if off != end || err == ErrTruncated || err == ErrEmptyTxt {
+		return &h, end, nil
 	}
-	return rr, off, ok
+	return rr, off, err
 }
 
 // Usable representation of a DNS packet.
@@ -816,24 +1237,27 @@ func (dns *Msg) Pack() (msg []byte, ok bool) {
 	dh.Arcount = uint16(len(extra))
 
 	// Could work harder to calculate message size,
-	// but this is far more than we need and not
-	// big enough to hurt the allocator.
-	msg = make([]byte, 2000)
-
-	// Pack it in: header and then the pieces.
+	// but this is the most multicast DNS allows
+	// (RFC 6762 section 17) and not big enough to
+	// hurt the allocator.
+	msg = make([]byte, 9000)
+
+	// Pack it in: header and then the pieces.  Names are
+	// compressed against any previously packed in the message.
+	compression := make(map[string]int)
 	off := 0
-	off, ok = packStruct(&dh, msg, off)
+	off, ok = packStruct(&dh, msg, off, compression)
 	for i := 0; i < len(question); i++ {
-		off, ok = packStruct(&question[i], msg, off)
+		off, ok = packStruct(&question[i], msg, off, compression)
 	}
 	for i := 0; i < len(answer); i++ {
-		off, ok = packRR(answer[i], msg, off)
+		off, ok = packRR(answer[i], msg, off, compression)
 	}
 	for i := 0; i < len(ns); i++ {
-		off, ok = packRR(ns[i], msg, off)
+		off, ok = packRR(ns[i], msg, off, compression)
 	}
 	for i := 0; i < len(extra); i++ {
-		off, ok = packRR(extra[i], msg, off)
+		off, ok = packRR(extra[i], msg, off, compression)
 	}
 	if !ok {
 		return nil, false
@@ -841,13 +1265,50 @@ func (dns *Msg) Pack() (msg []byte, ok bool) {
 	return msg[0:off], true
 }
 
+// Unpack decodes msg into dns and returns true if it could.  UnpackErr says why not.
 func (dns *Msg) Unpack(msg []byte) bool {
+	return dns.UnpackErr(msg) == nil
+}
+
+// Reasons an UnpackError gives for a message not unpacking.  Tell them apart with errors.Is,
+// which looks through the UnpackError.
+var (
+	ErrTruncated    = errors.New("truncated")
+	ErrBadPointer   = errors.New("compression pointer past the end of the message")
+	ErrPointerLoop  = errors.New("too many compression pointers")
+	ErrBadLabel     = errors.New("reserved label type")
+	ErrNameTooLong  = errors.New("name longer than 255 bytes")
+	ErrBadBitmap    = errors.New("bad type bitmap length")
+	ErrEmptyTxt     = errors.New("empty txt data")
+	ErrUnknownField = errors.New("unknown field type")
+	ErrBadCounts    = errors.New("section counts too large for the message")
+)
+
+// An UnpackError says where in a message unpacking failed and why.
+type UnpackError struct {
+	Section string // "header", "question", "answer", "authority" or "additional"
+	Index   int    // which question or RR of the section
+	Offset  int    // where in the message the question or RR starts
+	Err     error  // what was wrong with it
+}
+
+func (e *UnpackError) Error() string {
+	if e.Section == "header" {
+		return "dns: unpacking header: " + e.Err.Error()
+	}
+	return fmt.Sprintf("dns: unpacking %s %d at offset %d: %v", e.Section, e.Index, e.Offset, e.Err)
+}
+
+func (e *UnpackError) Unwrap() error { return e.Err }
+
+// UnpackErr is Unpack but returns an *UnpackError saying where and why msg couldn't be
+// decoded, e.g., for logging a misbehaving responder.
+func (dns *Msg) UnpackErr(msg []byte) error {
 	// Header.
 	var dh dnsHeader
-	off := 0
-	var ok bool
-	if off, ok = unpackStruct(&dh, msg, off); !ok {
-		return false
+	off, err := unpackStruct(&dh, msg, 0, len(msg))
+	if err != nil {
+		return &UnpackError{"header", 0, 0, err}
 	}
 	dns.ID = dh.Id
 	dns.Response = (dh.Bits & _QR) != 0
@@ -858,42 +1319,45 @@ func (dns *Msg) Unpack(msg []byte) bool {
 	dns.RecursionAvailable = (dh.Bits & _RA) != 0
 	dns.Rcode = int(dh.Bits & 0xF)
 
-	// Arrays.
+	// Arrays.  Don't believe counts that couldn't possibly fit in the message: a question
+	// takes at least 5 bytes and an RR at least 11.
+	if int(dh.Qdcount)*5+(int(dh.Ancount)+int(dh.Nscount)+int(dh.Arcount))*11 > len(msg)-off {
+		return &UnpackError{"header", 0, 0, ErrBadCounts}
+	}
 	dns.Question = make([]Question, dh.Qdcount)
 	dns.Answer = make([]RR, 0, dh.Ancount)
 	dns.NS = make([]RR, 0, dh.Nscount)
 	dns.Extra = make([]RR, 0, dh.Arcount)
 
-	var rec RR
-
 	for i := 0; i < len(dns.Question); i++ {
-		off, ok = unpackStruct(&dns.Question[i], msg, off)
-	}
-	for i := 0; i < int(dh.Ancount); i++ {
-		rec, off, ok = unpackRR(msg, off)
-		if !ok {
-			return false
+		start := off
+		if off, err = unpackStruct(&dns.Question[i], msg, off, len(msg)); err != nil {
+			return &UnpackError{"question", i, start, err}
 		}
-		dns.Answer = append(dns.Answer, rec)
 	}
-	for i := 0; i < int(dh.Nscount); i++ {
-		rec, off, ok = unpackRR(msg, off)
-		if !ok {
-			return false
-		}
-		dns.NS = append(dns.NS, rec)
+	sections := []struct {
+		name  string
+		count uint16
+		rrs   *[]RR
+	}{
+		{"answer", dh.Ancount, &dns.Answer},
+		{"authority", dh.Nscount, &dns.NS},
+		{"additional", dh.Arcount, &dns.Extra},
 	}
-	for i := 0; i < int(dh.Arcount); i++ {
-		rec, off, ok = unpackRR(msg, off)
-		if !ok {
-			return false
+	for _, sec := range sections {
+		for i := 0; i < int(sec.count); i++ {
+			start := off
+			var rec RR
+			if rec, off, err = unpackRR(msg, off); err != nil {
+				return &UnpackError{sec.name, i, start, err}
+			}
+			*sec.rrs = append(*sec.rrs, rec)
 		}
-		dns.Extra = append(dns.Extra, rec)
 	}
 	//	if off != len(msg) {
 	//		println("extra bytes in dns packet", off, "<", len(msg));
 	//	}
-	return true
+	return nil
 }
 
 func (dns *Msg) String() string {
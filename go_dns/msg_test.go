@@ -5,8 +5,12 @@
 package dns
 
 import (
+	"bytes"
 	"encoding/hex"
+	"errors"
+	"net"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -15,12 +19,12 @@ func TestDNSTxt(t *testing.T) {
 	texts := []string{"the rain in spain", "falls mainly on the plane"}
 	rr := &RR_TXT{RR_Header{"x.local.", TypeTXT, ClassINET | 0x8000, 10000, 0}, texts}
 	buf := make([]byte, 512)
-	off, ok := packRR(rr, buf, 0)
+	off, ok := packRR(rr, buf, 0, nil)
 	if !ok {
 		t.Errorf("packing txt rr failed")
 	}
-	rr_out, off_out, ok := unpackRR(buf, 0)
-	if !ok {
+	rr_out, off_out, err := unpackRR(buf, 0)
+	if err != nil {
 		t.Error("unpacking txt rr failed")
 	}
 	if off != off_out {
@@ -33,6 +37,410 @@ func TestDNSTxt(t *testing.T) {
 	if !reflect.DeepEqual(rr.Txt, x.Txt) {
 		t.Errorf("txt rr expected %v, got %v", rr.Txt, x.Txt)
 	}
+
+	// A string longer than 255 bytes can't be encoded and must be rejected rather than truncated.
+	rr.Txt = []string{"short", strings.Repeat("x", 300)}
+	buf = make([]byte, 1024)
+	if _, ok := packRR(rr, buf, 0, nil); ok {
+		t.Errorf("packing txt rr with a 300 byte string succeeded")
+	}
+	msg := &Msg{Answer: []RR{rr}}
+	if _, ok := msg.Pack(); ok {
+		t.Errorf("packing msg with a 300 byte txt string succeeded")
+	}
+}
+
+func TestDNSNsec(t *testing.T) {
+	// Types in two windows, out of order.
+	rr := &RR_NSEC{RR_Header{"x.local.", TypeNSEC, ClassINET | 0x8000, 120, 0}, "x.local.", []uint16{TypeSRV, TypeA, 300, TypeNSEC}}
+	buf := make([]byte, 512)
+	off, ok := packRR(rr, buf, 0, nil)
+	if !ok {
+		t.Fatalf("packing nsec rr failed")
+	}
+	rr_out, off_out, err := unpackRR(buf[:off], 0)
+	if err != nil || off_out != off {
+		t.Fatalf("unpacking nsec rr failed, %d %d", off, off_out)
+	}
+	x, ok := rr_out.(*RR_NSEC)
+	if !ok {
+		t.Fatalf("rr type = %T; want *RR_NSEC", rr_out)
+	}
+	want := []uint16{TypeA, TypeSRV, TypeNSEC, 300}
+	if x.NextDomain != rr.NextDomain || !reflect.DeepEqual(x.Types, want) {
+		t.Errorf("nsec rr expected %s %v, got %s %v", rr.NextDomain, want, x.NextDomain, x.Types)
+	}
+	if !x.HasType(TypeA) || x.HasType(TypeAAAA) {
+		t.Errorf("HasType wrong for %v", x.Types)
+	}
+
+	// A bitmap longer than 32 bytes is illegal.  The last window, for type 300, has 6 bytes of bitmap.
+	buf[off-7] = 33
+	if _, _, err := unpackRR(buf[:off], 0); err == nil {
+		t.Errorf("unpacked nsec rr with a bad bitmap length")
+	}
+}
+
+func TestDNSOpt(t *testing.T) {
+	msg := &Msg{Question: []Question{{"x.local.", TypeA, ClassINET}}}
+	msg.Extra = []RR{&RR_OPT{RR_Header{".", TypeOPT, 9000, 0, 0}, []byte{0, 3, 0, 2, 'h', 'i'}}}
+	buf, ok := msg.Pack()
+	if !ok {
+		t.Fatalf("packing message with opt rr failed")
+	}
+	// The RR is 17 bytes: the root name, a single zero byte, then type, class, ttl, length and options.
+	if buf[len(buf)-17] != 0 || buf[len(buf)-16] != 0 || buf[len(buf)-15] != TypeOPT {
+		t.Errorf("opt rr packed as %x", buf[len(buf)-17:])
+	}
+	var out Msg
+	if !out.Unpack(buf) || len(out.Extra) != 1 {
+		t.Fatalf("unpacking message with opt rr failed")
+	}
+	x, ok := out.Extra[0].(*RR_OPT)
+	if !ok {
+		t.Fatalf("rr type = %T; want *RR_OPT", out.Extra[0])
+	}
+	if x.Hdr.Name != "." || x.UDPSize() != 9000 || !reflect.DeepEqual(x.Options, []byte{0, 3, 0, 2, 'h', 'i'}) {
+		t.Errorf("opt rr expected %v, got %v", msg.Extra[0], x)
+	}
+}
+
+func TestDNSOptOptions(t *testing.T) {
+	opts := []EDNS0Option{{65001, []byte("unicast")}, {4, nil}, {65002, []byte{0, 1, 2}}}
+	rr := &RR_OPT{RR_Header{".", TypeOPT, 9000, 0, 0}, nil}
+	rr.SetOptions(opts)
+	msg := &Msg{Question: []Question{{"x.local.", TypeA, ClassINET}}, Extra: []RR{rr}}
+	buf, ok := msg.Pack()
+	if !ok {
+		t.Fatalf("packing message with opt options failed")
+	}
+	var out Msg
+	if !out.Unpack(buf) || len(out.Extra) != 1 {
+		t.Fatalf("unpacking message with opt options failed")
+	}
+	x := out.Extra[0].(*RR_OPT)
+	got, ok := x.ParseOptions()
+	if !ok || len(got) != len(opts) {
+		t.Fatalf("ParseOptions = %v, %v; want %v", got, ok, opts)
+	}
+	for i := range opts {
+		if got[i].Code != opts[i].Code || !bytes.Equal(got[i].Data, opts[i].Data) {
+			t.Errorf("option %d = %v; want %v", i, got[i], opts[i])
+		}
+	}
+	if data, ok := x.Option(65002); !ok || !bytes.Equal(data, []byte{0, 1, 2}) {
+		t.Errorf("Option(65002) = %v, %v", data, ok)
+	}
+	if _, ok := x.Option(1); ok {
+		t.Errorf("Option(1) found an option that isn't there")
+	}
+
+	// Options we don't know survive a round trip.
+	x.SetOptions(got)
+	if !bytes.Equal(x.Options, rr.Options) {
+		t.Errorf("options after round trip %x; want %x", x.Options, rr.Options)
+	}
+
+	for _, bad := range [][]byte{{0, 1, 0}, {0, 1, 0, 3, 'a'}} {
+		rr.Options = bad
+		if _, ok := rr.ParseOptions(); ok {
+			t.Errorf("ParseOptions accepted %x", bad)
+		}
+	}
+}
+
+func TestAnswerTxtPtr(t *testing.T) {
+	msg := &Msg{MsgHdr: MsgHdr{Response: true}}
+	msg.Answer = []RR{
+		&RR_CNAME{RR_Header{"alias.example.", TypeCNAME, ClassINET, 60, 0}, "host.example."},
+		&RR_TXT{RR_Header{"host.example.", TypeTXT, ClassINET | 0x8000, 60, 0}, []string{"a=1"}},
+		&RR_PTR{RR_Header{"_http._tcp.example.", TypePTR, ClassINET, 60, 0}, "one._http._tcp.example."},
+	}
+	msg.Extra = []RR{
+		&RR_PTR{RR_Header{"_http._tcp.example.", TypePTR, ClassINET, 60, 0}, "two._http._tcp.example."},
+	}
+	buf, ok := msg.Pack()
+	if !ok {
+		t.Fatalf("packing failed")
+	}
+	in := new(Msg)
+	if !in.Unpack(buf) {
+		t.Fatalf("unpacking failed")
+	}
+
+	cname, rrs, err := AnswerMulticast("alias.example.", TypeTXT, in, "foo:53")
+	if err != nil || cname != "host.example." || len(rrs) != 1 {
+		t.Fatalf("txt answer: %s %v %v", cname, rrs, err)
+	}
+	if txt := rrs[0].(*RR_TXT).Txt; !reflect.DeepEqual(txt, []string{"a=1"}) {
+		t.Errorf("txt answer %v", txt)
+	}
+
+	_, rrs, err = AnswerMulticast("_http._tcp.example.", TypePTR, in, "foo:53")
+	if err != nil || len(rrs) != 2 {
+		t.Fatalf("ptr answer: %v %v", rrs, err)
+	}
+	if rrs[0].(*RR_PTR).Ptr != "one._http._tcp.example." || rrs[1].(*RR_PTR).Ptr != "two._http._tcp.example." {
+		t.Errorf("ptr answer %v", rrs)
+	}
+
+	if _, _, err := AnswerMulticast("host.example.", TypePTR, in, "foo:53"); err == nil {
+		t.Errorf("found a ptr for host.example.")
+	}
+
+	// A unicast answer ignores the additional section and the cache flush bit.
+	_, rrs, err = Answer("_http._tcp.example.", TypePTR, in, "foo:53")
+	if err != nil || len(rrs) != 1 || rrs[0].(*RR_PTR).Ptr != "one._http._tcp.example." {
+		t.Errorf("unicast ptr answer: %v %v", rrs, err)
+	}
+	if _, rrs, err := Answer("alias.example.", TypeTXT, in, "foo:53"); err == nil {
+		t.Errorf("unicast txt answer with the cache flush bit: %v", rrs)
+	}
+}
+
+func TestReverseAddr(t *testing.T) {
+	tests := []struct{ addr, arpa string }{
+		{"10.1.2.3", "3.2.1.10.in-addr.arpa."},
+		{"2001:db8::567:89ab", "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa."},
+	}
+	for _, test := range tests {
+		if arpa, err := ReverseAddr(test.addr); err != nil || arpa != test.arpa {
+			t.Errorf("ReverseAddr(%s) = %s, %v; want %s", test.addr, arpa, err, test.arpa)
+		}
+	}
+	if _, err := ReverseAddr("not an address"); err == nil {
+		t.Errorf("ReverseAddr accepted a bad address")
+	}
+}
+
+func TestDNSCompression(t *testing.T) {
+	msg := new(Msg)
+	msg.Response = true
+	msg.Answer = []RR{
+		&RR_PTR{RR_Header{"_veyronns._tcp.local.", TypePTR, ClassINET, 120, 0}, "x._veyronns._tcp.local."},
+		&RR_SRV{RR_Header{"x._veyronns._tcp.local.", TypeSRV, ClassINET, 120, 0}, 0, 0, 666, "x.local."},
+		&RR_TXT{RR_Header{"x._veyronns._tcp.local.", TypeTXT, ClassINET, 120, 0}, []string{"a=b"}},
+		&RR_A{RR_Header{"x.local.", TypeA, ClassINET, 120, 0}, net.ParseIP("192.168.1.2").To4()},
+	}
+	data, ok := msg.Pack()
+	if !ok {
+		t.Fatalf("packing failed")
+	}
+
+	// Make sure we can read it back.
+	msg2 := new(Msg)
+	if !msg2.Unpack(data) {
+		t.Fatalf("unpacking compressed message failed")
+	}
+	if !reflect.DeepEqual(msg.Answer, msg2.Answer) {
+		t.Errorf("unpacked message differs from original:\n%v\n%v", msg, msg2)
+	}
+
+	// Pack the records one at a time without compression to get the uncompressed size.
+	buf := make([]byte, 2000)
+	off, _ := packStruct(&dnsHeader{}, buf, 0, nil)
+	for _, rr := range msg.Answer {
+		off, ok = packRR(rr, buf, off, nil)
+		if !ok {
+			t.Fatalf("packing %v failed", rr)
+		}
+	}
+	if len(data) >= off {
+		t.Errorf("compressed message is %d bytes, uncompressed is %d", len(data), off)
+	}
+}
+
+func TestDNSTxtPairs(t *testing.T) {
+	rr := &RR_TXT{RR_Header{"x.local.", TypeTXT, ClassINET, 120, 0}, []string{"Path=/x", "bare", "empty=", "path=/y", "=novalue", ""}}
+	want := map[string][]byte{
+		"path":  []byte("/x"),
+		"bare":  nil,
+		"empty": []byte{},
+	}
+	pairs := rr.Pairs()
+	if !reflect.DeepEqual(pairs, want) {
+		t.Errorf("pairs = %q; want %q", pairs, want)
+	}
+	if v, ok := pairs["bare"]; !ok || v != nil {
+		t.Errorf("bare key should be present with a nil value")
+	}
+	if v := pairs["empty"]; v == nil {
+		t.Errorf("key= should have an empty, non-nil value")
+	}
+
+	// And back again.
+	x := TxtFromPairs(pairs)
+	if g, e := x.Txt, []string{"bare", "empty=", "path=/x"}; !reflect.DeepEqual(g, e) {
+		t.Errorf("TxtFromPairs = %q; want %q", g, e)
+	}
+	if !reflect.DeepEqual(x.Pairs(), want) {
+		t.Errorf("round trip pairs = %q; want %q", x.Pairs(), want)
+	}
+}
+
+func TestDNSConstructors(t *testing.T) {
+	rrs := []RR{
+		NewA("x.local.", net.IPv4(10, 0, 0, 1), 120),
+		NewAAAA("x.local.", net.ParseIP("fe80::1"), 120),
+		NewPTR("_http._tcp.local.", "x._http._tcp.local.", 4500),
+		NewSRV("x._http._tcp.local.", "x.local.", 80, 1, 2, 120),
+		NewTXT("x._http._tcp.local.", 4500),
+		NewHINFO("x.local.", 4500, "ARMV7", "LINUX"),
+	}
+	msg := &Msg{MsgHdr: MsgHdr{Response: true}, Answer: rrs}
+	b, ok := msg.Pack()
+	if !ok {
+		t.Fatal("couldn't pack")
+	}
+	m := new(Msg)
+	if !m.Unpack(b) {
+		t.Fatal("couldn't unpack")
+	}
+	if len(m.Answer) != len(rrs) {
+		t.Fatalf("got %d RRs, want %d", len(m.Answer), len(rrs))
+	}
+	for i, rr := range m.Answer {
+		if h := rr.Header(); h.Class != ClassINET || h.Rdlength == 0 {
+			t.Errorf("%d: bad header %v", i, printStruct(h))
+		}
+		if g, e := printStruct(rr), printStruct(rrs[i]); g != e {
+			t.Errorf("%d: got %s, want %s", i, g, e)
+		}
+	}
+	if txt := rrs[4].(*RR_TXT).Txt; len(txt) != 1 || txt[0] != "" {
+		t.Errorf("empty NewTXT holds %q", txt)
+	}
+}
+
+func TestDNSHinfo(t *testing.T) {
+	rr := NewHINFO("printer.local.", 120, "MIPS 74K", "")
+	msg := &Msg{MsgHdr: MsgHdr{Response: true}, Answer: []RR{rr}}
+	b, ok := msg.Pack()
+	if !ok {
+		t.Fatal("couldn't pack")
+	}
+	m := new(Msg)
+	if !m.Unpack(b) {
+		t.Fatal("couldn't unpack")
+	}
+	if len(m.Answer) != 1 {
+		t.Fatalf("got %d RRs, want 1", len(m.Answer))
+	}
+	h, ok := m.Answer[0].(*RR_HINFO)
+	if !ok || h.Cpu != rr.Cpu || h.Os != rr.Os {
+		t.Fatalf("got %v, want %v", m.Answer[0], rr)
+	}
+	if s := h.String(); !strings.Contains(s, "MIPS 74K") {
+		t.Errorf("String returned %q", s)
+	}
+
+	// Character strings are limited to 255 bytes.
+	rr.Os = strings.Repeat("x", 256)
+	if _, ok := msg.Pack(); ok {
+		t.Errorf("packed an HINFO with a %d byte OS", len(rr.Os))
+	}
+
+	// A truncated RR comes back as just its header.
+	rr.Os = "LINUX"
+	b, _ = msg.Pack()
+	if m := new(Msg); m.Unpack(b[:len(b)-2]) && len(m.Answer) == 1 {
+		if _, ok := m.Answer[0].(*RR_HINFO); ok {
+			t.Errorf("unpacked a truncated HINFO: %v", m.Answer[0])
+		}
+	}
+}
+
+func TestDNSBuilder(t *testing.T) {
+	q := NewQuery("_http._tcp.local.", TypePTR).AddQuestion("x.local.", TypeA, ClassINET|0x8000)
+	if q.ID != 0 || q.Response || q.Authoritative || q.RecursionDesired || len(q.Question) != 2 {
+		t.Errorf("bad query %v", q)
+	}
+	if x := q.Question[1]; x.Name != "x.local." || x.Qtype != TypeA || x.Qclass != ClassINET|0x8000 {
+		t.Errorf("bad question %v", x)
+	}
+
+	ip := net.IPv4(10, 0, 0, 1)
+	r := NewResponse().
+		AddAnswer(NewPTR("_http._tcp.local.", "x._http._tcp.local.", 4500)).
+		AddAuthority(NewSRV("x._http._tcp.local.", "x.local.", 80, 0, 0, 120)).
+		AddAdditional(NewA("x.local.", ip, 120), NewTXT("x._http._tcp.local.", 4500))
+	b, ok := r.Pack()
+	if !ok {
+		t.Fatal("couldn't pack")
+	}
+	m := new(Msg)
+	if !m.Unpack(b) {
+		t.Fatal("couldn't unpack")
+	}
+	if m.ID != 0 || !m.Response || !m.Authoritative || len(m.Question) != 0 {
+		t.Errorf("bad response header %v", m)
+	}
+	if len(m.Answer) != 1 || len(m.NS) != 1 || len(m.Extra) != 2 {
+		t.Fatalf("got %d answers, %d authority and %d additional RRs", len(m.Answer), len(m.NS), len(m.Extra))
+	}
+	if a, ok := m.Extra[0].(*RR_A); !ok || !net.IP(a.A).Equal(ip) {
+		t.Errorf("got additional %v", m.Extra[0])
+	}
+
+	// Turning a query into its answer keeps the questions.
+	if x := NewQuery("x.local.", TypeA).SetResponse(); !x.Response || !x.Authoritative || len(x.Question) != 1 {
+		t.Errorf("bad response %v", x)
+	}
+}
+
+func TestDNSTxtvers(t *testing.T) {
+	rr := &RR_TXT{RR_Header{"x.local.", TypeTXT, ClassINET, 120, 0}, []string{"path=/x", "TxtVers=2"}}
+	if v, ok := rr.Txtvers(); !ok || v != 2 {
+		t.Errorf("Txtvers = %d, %v; want 2, true", v, ok)
+	}
+	rr.SetTxtvers(3)
+	if g, e := rr.Txt, []string{"txtvers=3", "path=/x"}; !reflect.DeepEqual(g, e) {
+		t.Errorf("after SetTxtvers Txt = %q; want %q", g, e)
+	}
+	for _, txt := range [][]string{nil, {"txtvers"}, {"txtvers=x"}, {"txtvers=-1"}} {
+		rr.Txt = txt
+		if v, ok := rr.Txtvers(); ok {
+			t.Errorf("Txtvers of %q = %d, true; want false", txt, v)
+		}
+	}
+}
+
+func TestDNSAddressRRs(t *testing.T) {
+	// An SRV answer with both A and AAAA records in the additional section.
+	msg := new(Msg)
+	msg.Response = true
+	msg.Answer = []RR{
+		&RR_SRV{RR_Header{"x._veyronns._tcp.local.", TypeSRV, ClassINET, 120, 0}, 0, 0, 666, "x.local."},
+	}
+	msg.Extra = []RR{
+		&RR_A{RR_Header{"x.local.", TypeA, ClassINET | 0x8000, 120, 0}, net.ParseIP("192.168.1.2").To4()},
+		&RR_AAAA{RR_Header{"x.local.", TypeAAAA, ClassINET | 0x8000, 120, 0}, net.ParseIP("fe80::1")},
+	}
+	data, ok := msg.Pack()
+	if !ok {
+		t.Fatalf("packing address rrs failed")
+	}
+	msg2 := new(Msg)
+	if !msg2.Unpack(data) {
+		t.Fatalf("unpacking address rrs failed")
+	}
+	if !reflect.DeepEqual(msg.Answer, msg2.Answer) || !reflect.DeepEqual(msg.Extra, msg2.Extra) {
+		t.Errorf("repacked message differs from original:\n%v\n%v", msg, msg2)
+	}
+	a, ok := msg2.Extra[0].(*RR_A)
+	if !ok {
+		t.Fatalf("extra[0] = %T; want *RR_A", msg2.Extra[0])
+	}
+	if g, e := a.String(), "{Name=x.local., Rrtype=1, Class=32769(flush), Ttl=120, Rdlength=4, A=192.168.1.2}"; g != e {
+		t.Errorf("a.String() = %s; want %s", g, e)
+	}
+	aaaa, ok := msg2.Extra[1].(*RR_AAAA)
+	if !ok {
+		t.Fatalf("extra[1] = %T; want *RR_AAAA", msg2.Extra[1])
+	}
+	if g, e := aaaa.String(), "{Name=x.local., Rrtype=28, Class=32769(flush), Ttl=120, Rdlength=16, AAAA=fe80::1}"; g != e {
+		t.Errorf("aaaa.String() = %s; want %s", g, e)
+	}
 }
 
 func TestDNSParseSRVReply(t *testing.T) {
@@ -136,3 +544,186 @@ const dnsSRVCorruptReply = "0901818000010005000000000c5f786d70702d73657276657204
 	"6503636f6d00c00c002100010000012c00200005000014950b786d70702d7365727665" +
 	"72016c06676f6f676c6503636f6d00c00c002100010000012c00FF0014000014950c78" +
 	"6d70702d73657276657231016c06676f6f676c6503636f6d00"
+
+func TestDNSUnpackMalformed(t *testing.T) {
+	// Each of these should fail to unpack except the last, whose RR data runs off the end of
+	// the message and so degrades to just the header.
+	tests := []struct{ name, data string }{
+		{"short header", "0901818000"},
+		{"pointer loop", "000000000001000000000000c00c00010001"},
+		{"counts too big", "00000000ffffffffffffffff"},
+		{"label past end", "000000000001000000000000" + "3f6162"},
+		{"rdata past end", "000000000000000100000000" + "00" + "0001000100000078ffff" + "01020304"},
+	}
+	for i, test := range tests {
+		data, err := hex.DecodeString(test.data)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		var msg Msg
+		ok := msg.Unpack(data)
+		if i < len(tests)-1 {
+			if ok {
+				t.Errorf("%s: unpacked %v", test.name, &msg)
+			}
+			continue
+		}
+		if !ok || len(msg.Answer) != 1 {
+			t.Fatalf("%s: unpacking failed", test.name)
+		}
+		if _, ok := msg.Answer[0].(*RR_Header); !ok {
+			t.Errorf("%s: answer = %T; want *RR_Header", test.name, msg.Answer[0])
+		}
+	}
+}
+
+// FuzzUnpack makes sure that no packet off the wire can crash or hang the unpacker and that whatever
+// it accepts can be packed again.
+func FuzzUnpack(f *testing.F) {
+	for _, s := range []string{dnsSRVReply, dnsSRVCorruptReply} {
+		data, err := hex.DecodeString(s)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	msg := &Msg{Question: []Question{{"x.local.", TypeALL, ClassINET}}}
+	msg.Answer = []RR{&RR_NSEC{RR_Header{"x.local.", TypeNSEC, ClassINET, 120, 0}, "x.local.", []uint16{TypeA, TypeSRV}}}
+	msg.Extra = []RR{&RR_OPT{RR_Header{".", TypeOPT, 9000, 0, 0}, nil}}
+	if data, ok := msg.Pack(); ok {
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var m Msg
+		if !m.Unpack(data) {
+			return
+		}
+		if m.String() == "" {
+			t.Fatalf("%x unpacked to a message that prints as nothing", data)
+		}
+		packed, ok := m.Pack()
+		if !ok {
+			t.Fatalf("can't pack %v unpacked from %x", &m, data)
+		}
+		var m2 Msg
+		if err := m2.UnpackErr(packed); err != nil {
+			t.Fatalf("can't unpack %x, packed from %v: %v", packed, &m, err)
+		}
+	})
+}
+
+func TestDNSPrintClassBits(t *testing.T) {
+	ptr := &RR_PTR{RR_Header{"x.local.", TypePTR, ClassINET, 120, 0}, "y.local."}
+	if g, e := printStruct(ptr), "{Name=x.local., Rrtype=12, Class=1, Ttl=120, Rdlength=0, Ptr=y.local.}"; g != e {
+		t.Errorf("printStruct(ptr) = %s; want %s", g, e)
+	}
+	msg := new(Msg)
+	msg.Question = []Question{{"x.local.", TypeA, ClassINET | 0x8000}, {"y.local.", TypeA, ClassINET}}
+	s := msg.String()
+	if !strings.Contains(s, "{Name=x.local., Qtype=1, Qclass=32769(unicast)}") || !strings.Contains(s, "{Name=y.local., Qtype=1, Qclass=1}") {
+		t.Errorf("msg.String() = %s", s)
+	}
+}
+
+func TestUnpackErr(t *testing.T) {
+	msg := &Msg{Question: []Question{{"x.local.", TypeA, ClassINET}}}
+	msg.Answer = []RR{&RR_A{RR_Header{"x.local.", TypeA, ClassINET, 120, 0}, net.IPv4(10, 0, 0, 1).To4()}}
+	b, ok := msg.Pack()
+	if !ok {
+		t.Fatal("packing failed")
+	}
+	if err := new(Msg).UnpackErr(b); err != nil {
+		t.Fatalf("UnpackErr of a good message returned %v", err)
+	}
+
+	// The answer's name is a pointer to the question's.  Point it past the end instead.
+	bad := append([]byte(nil), b...)
+	i := bytes.Index(bad[12:], []byte{0xC0, 12}) + 12
+	bad[i+1] = 0xFF
+	var ue *UnpackError
+	if err := new(Msg).UnpackErr(bad); !errors.As(err, &ue) || ue.Section != "answer" || ue.Index != 0 || ue.Offset != i || !errors.Is(err, ErrBadPointer) {
+		t.Errorf("UnpackErr with a bad pointer returned %v", err)
+	}
+	if new(Msg).Unpack(bad) {
+		t.Errorf("Unpack with a bad pointer succeeded")
+	}
+
+	// A message too short for its counts fails in the header.
+	if err := new(Msg).UnpackErr(b[:20]); !errors.As(err, &ue) || ue.Section != "header" || ue.Err != ErrBadCounts {
+		t.Errorf("UnpackErr of a short message returned %v", err)
+	}
+}
+
+func TestDNSCompressedPtr(t *testing.T) {
+	data, err := hex.DecodeString(dnsCompressedPtrReply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := new(Msg)
+	if err := msg.UnpackErr(data); err != nil {
+		t.Fatalf("unpacking packet failed: %v", err)
+	}
+	want := []string{"a._http._tcp.local.", "b.a._http._tcp.local.", "h.local."}
+	if len(msg.Answer) != len(want) {
+		t.Fatalf("len(msg.Answer) = %d; want %d", len(msg.Answer), len(want))
+	}
+	for i, rr := range msg.Answer {
+		ptr, ok := rr.(*RR_PTR)
+		if !ok {
+			t.Errorf("answer[%d] = %T; want *RR_PTR", i, rr)
+			continue
+		}
+		if ptr.Hdr.Name != "_http._tcp.local." || ptr.Ptr != want[i] {
+			t.Errorf("answer[%d] = %s -> %s; want _http._tcp.local. -> %s", i, ptr.Hdr.Name, ptr.Ptr, want[i])
+		}
+	}
+	if len(msg.Extra) != 1 || msg.Extra[0].Header().Name != "h.local." {
+		t.Errorf("extra = %v", msg.Extra)
+	}
+}
+
+func TestDNSCompressionLimit(t *testing.T) {
+	// A name at 0x3FFF can still be pointed at, one at 0x4000 can't.
+	for _, start := range []int{0x3FFF, 0x4000} {
+		msg := make([]byte, 0x5000)
+		compression := make(map[string]int)
+		off, ok := packDomainName("a.local.", msg, start, compression)
+		if !ok {
+			t.Fatalf("packing at %#x failed", start)
+		}
+		off1, ok := packDomainName("a.local.", msg, off, compression)
+		if !ok {
+			t.Fatalf("packing again after %#x failed", start)
+		}
+		if compressed := off1-off == 2; compressed != (start <= 0x3FFF) {
+			t.Errorf("name at %#x packed again in %d bytes", start, off1-off)
+		}
+	}
+}
+
+// A reply to a PTR question for _http._tcp.local. whose PTR targets are compressed: the first
+// points back at the question, the second into the middle of the first answer's data, and the
+// third ahead to the name of the A record in the additional section.
+const dnsCompressedPtrReply = "000084000001000300000001055f68747470045f746370056c6f63616c00000c0001" +
+	"c00c000c00010000119400040161c00cc00c000c00010000119400040162c02ec00c" +
+	"000c0001000011940002c0500168056c6f63616c00000100010000119400040a000001"
+
+func TestDNSEscapedLabel(t *testing.T) {
+	// A dot or backslash within a label is quoted, so the name packs back into the same labels.
+	wire := []byte("\x05My.Pr\x04_ipp\x04_tcp\x05local\x00")
+	name, off, err := unpackDomainName(wire, 0)
+	if err != nil || off != len(wire) {
+		t.Fatalf("unpacking %q: %q %d %v", wire, name, off, err)
+	}
+	if want := `My\.Pr._ipp._tcp.local.`; name != want {
+		t.Errorf("got %q, want %q", name, want)
+	}
+	msg := make([]byte, 100)
+	off, ok := packDomainName(name, msg, 0, nil)
+	if !ok || !bytes.Equal(msg[:off], wire) {
+		t.Errorf("packing %q: %q", name, msg[:off])
+	}
+	if _, ok := packDomainName(`x\`, msg, 0, nil); ok {
+		t.Errorf("packed a name ending in a backslash")
+	}
+}
@@ -18,6 +18,20 @@ func boolint(b bool) int {
 	return 0
 }
 
+// control runs f on the connection's file descriptor.  Unlike conn.File, it leaves the connection in
+// non-blocking mode so that closing it still wakes up a reader.
+func control(conn *net.UDPConn, f func(fd int) error) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ferr error
+	if err := rc.Control(func(fd uintptr) { ferr = f(int(fd)) }); err != nil {
+		return err
+	}
+	return ferr
+}
+
 // SetMulticastTTL sets the TTL on packets from this connection.
 func SetMulticastTTL(conn *net.UDPConn, ipversion int, v int) error {
 	var proto, opt int
@@ -29,30 +43,66 @@ func SetMulticastTTL(conn *net.UDPConn, ipversion int, v int) error {
 		proto = syscall.IPPROTO_IPV6
 		opt = syscall.IPV6_MULTICAST_HOPS
 	}
-	if file, err := conn.File(); err == nil {
-		fd := int(file.Fd())
-		err := syscall.SetsockoptInt(fd, proto, opt, v)
-		if err != nil {
+	return control(conn, func(fd int) error {
+		if err := setsockoptInt(fd, proto, opt, v); err != nil {
 			return os.NewSyscallError("setsockopt", err)
 		}
-		file.Close()
-	} else {
-		return err
-	}
-	return nil
+		return nil
+	})
 }
 
 // SetMulticastLoopback turns on or off multicast loopbacks on the interface the connection is on.
 func SetMulticastLoopback(conn *net.UDPConn, ipversion int, v bool) error {
-	file, err := conn.File()
-	if err != nil {
-		return err
-	}
-	fd := int(file.Fd())
-	switch ipversion {
-	default:
-		return setIPv4MulticastLoopback(fd, v)
-	case 6:
-		return setIPv6MulticastLoopback(fd, v)
-	}
+	return control(conn, func(fd int) error {
+		switch ipversion {
+		default:
+			return setIPv4MulticastLoopback(fd, v)
+		case 6:
+			return setIPv6MulticastLoopback(fd, v)
+		}
+	})
+}
+
+// SetReceiveBuffer sets the size of the connection's socket receive buffer (SO_RCVBUF).  The system may
+// round or limit it, see ReceiveBuffer.
+func SetReceiveBuffer(conn *net.UDPConn, v int) error {
+	return control(conn, func(fd int) error {
+		if err := setsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, v); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+		return nil
+	})
+}
+
+// ReceiveBuffer returns the effective size of the connection's socket receive buffer.  On Linux this is
+// twice what was asked for since the kernel counts its bookkeeping too.
+func ReceiveBuffer(conn *net.UDPConn) (int, error) {
+	var v int
+	err := control(conn, func(fd int) error {
+		var err error
+		if v, err = getsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF); err != nil {
+			return os.NewSyscallError("getsockopt", err)
+		}
+		return nil
+	})
+	return v, err
+}
+
+// SetPacketInfo asks for every packet received on the connection to come with the index of the
+// interface it arrived on, see ReceivedIfIndex.
+func SetPacketInfo(conn *net.UDPConn, ipversion int) error {
+	return control(conn, func(fd int) error {
+		switch ipversion {
+		default:
+			return setIPv4PacketInfo(fd)
+		case 6:
+			return setIPv6PacketInfo(fd)
+		}
+	})
+}
+
+// ReceivedIfIndex returns the index of the interface a packet arrived on from the out-of-band data
+// read with it, or 0 if it doesn't say.
+func ReceivedIfIndex(oob []byte) int {
+	return receivedIfIndex(oob)
 }
@@ -7,8 +7,22 @@ package mdns
 
 import (
 	"syscall"
+	"unsafe"
 )
 
 func setIPv4MulticastLoopback(fd int, v bool) error {
 	return syscall.SetsockoptByte(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, byte(boolint(v)))
 }
+
+func setIPv4PacketInfo(fd int) error {
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_RECVIF, 1)
+}
+
+// ipv4IfIndex returns the interface index from the link level address of an IP_RECVIF control
+// message.
+func ipv4IfIndex(m syscall.SocketControlMessage) int {
+	if m.Header.Level != syscall.IPPROTO_IP || m.Header.Type != syscall.IP_RECVIF || len(m.Data) < 4 {
+		return 0
+	}
+	return int((*syscall.RawSockaddrDatalink)(unsafe.Pointer(&m.Data[0])).Index)
+}
@@ -0,0 +1,15 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build dragonfly freebsd netbsd openbsd
+
+package mdns
+
+import (
+	"syscall"
+)
+
+const (
+	ipv6RecvPktinfo = syscall.IPV6_RECVPKTINFO
+	ipv6Pktinfo     = syscall.IPV6_PKTINFO
+)
@@ -0,0 +1,10 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mdns
+
+// The RFC 3542 socket options, which package syscall doesn't define for darwin.
+const (
+	ipv6RecvPktinfo = 0x3d
+	ipv6Pktinfo     = 0x2e
+)
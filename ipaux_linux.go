@@ -5,8 +5,27 @@ package mdns
 
 import (
 	"syscall"
+	"unsafe"
+)
+
+const (
+	ipv6RecvPktinfo = syscall.IPV6_RECVPKTINFO
+	ipv6Pktinfo     = syscall.IPV6_PKTINFO
 )
 
 func setIPv4MulticastLoopback(fd int, v bool) error {
 	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, boolint(v))
 }
+
+func setIPv4PacketInfo(fd int) error {
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+}
+
+// ipv4IfIndex returns the interface index from an IP_PKTINFO control message.
+func ipv4IfIndex(m syscall.SocketControlMessage) int {
+	if m.Header.Level != syscall.IPPROTO_IP || m.Header.Type != syscall.IP_PKTINFO ||
+		len(m.Data) < syscall.SizeofInet4Pktinfo {
+		return 0
+	}
+	return int((*syscall.Inet4Pktinfo)(unsafe.Pointer(&m.Data[0])).Ifindex)
+}
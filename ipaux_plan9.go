@@ -14,3 +14,15 @@ func setIPv4MulticastLoopback(fd int, v bool) error {
 func setIPv6MulticastLoopback(fd int, v bool) error {
 	return syscall.EPLAN9
 }
+
+func setIPv4PacketInfo(fd int) error {
+	return syscall.EPLAN9
+}
+
+func setIPv6PacketInfo(fd int) error {
+	return syscall.EPLAN9
+}
+
+func receivedIfIndex(oob []byte) int {
+	return 0
+}
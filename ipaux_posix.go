@@ -1,14 +1,44 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// +build darwin dragonfly freebsd linux netbsd openbsd windows
+// +build darwin dragonfly freebsd linux netbsd openbsd
 
 package mdns
 
 import (
 	"syscall"
+	"unsafe"
 )
 
+func setsockoptInt(fd, level, opt, v int) error {
+	return syscall.SetsockoptInt(fd, level, opt, v)
+}
+
+func getsockoptInt(fd, level, opt int) (int, error) {
+	return syscall.GetsockoptInt(fd, level, opt)
+}
+
 func setIPv6MulticastLoopback(fd int, v bool) error {
 	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_LOOP, boolint(v))
 }
+
+func setIPv6PacketInfo(fd int) error {
+	return syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, ipv6RecvPktinfo, 1)
+}
+
+func receivedIfIndex(oob []byte) int {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, m := range msgs {
+		if i := ipv4IfIndex(m); i != 0 {
+			return i
+		}
+		if m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == ipv6Pktinfo &&
+			len(m.Data) >= syscall.SizeofInet6Pktinfo {
+			return int((*syscall.Inet6Pktinfo)(unsafe.Pointer(&m.Data[0])).Ifindex)
+		}
+	}
+	return 0
+}
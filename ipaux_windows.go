@@ -0,0 +1,40 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mdns
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+func setsockoptInt(fd, level, opt, v int) error {
+	return syscall.SetsockoptInt(syscall.Handle(fd), level, opt, v)
+}
+
+func getsockoptInt(fd, level, opt int) (int, error) {
+	var v int32
+	l := int32(unsafe.Sizeof(v))
+	err := syscall.Getsockopt(syscall.Handle(fd), int32(level), int32(opt), (*byte)(unsafe.Pointer(&v)), &l)
+	return int(v), err
+}
+
+func setIPv4MulticastLoopback(fd int, v bool) error {
+	return setsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, boolint(v))
+}
+
+func setIPv6MulticastLoopback(fd int, v bool) error {
+	return setsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_LOOP, boolint(v))
+}
+
+func setIPv4PacketInfo(fd int) error {
+	return syscall.EWINDOWS
+}
+
+func setIPv6PacketInfo(fd int) error {
+	return syscall.EWINDOWS
+}
+
+func receivedIfIndex(oob []byte) int {
+	return 0
+}
@@ -27,13 +27,18 @@ package mdns
 // Each multicastIfc has a cache of information learned from its network.
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
 	"net"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/presotto/go-mdns-sd/go_dns"
@@ -46,12 +51,23 @@ type msgFromNet struct {
 	msg    *dns.Msg
 }
 
+// A truncated message waiting for the rest of its records.
+type partialMsg struct {
+	key   string
+	m     *msgFromNet
+	timer *time.Timer
+}
+
+// How long to wait for the continuation of a truncated message (RFC 6762 section 7.2).
+const truncatedWait = 500 * time.Millisecond
+
 // A multicast interface that we are listening on.  Each physical interface can have both v4 and v6 multicast interfaces.
 type multicastIfc struct {
 	// Info about the physical interface and address range covered (just for debugging).
 	ifc net.Interface
 
-	// Multicast Address
+	// Multicast Address.  Link and interface scoped IPv6 groups carry the interface as their zone so that
+	// what we send to them goes out this interface, see scopedGroup.
 	addr *net.UDPAddr
 
 	// IP version
@@ -61,7 +77,17 @@ type multicastIfc struct {
 	addresses []*net.IPNet
 
 	// The connection for talking on the internet.
-	conn *net.UDPConn
+	conn PacketConn
+
+	// If not nil, the connection we send on, bound to the source port asked for with SourcePort.
+	sendConn PacketConn
+
+	// The effective size of conn's receive buffer, 0 if it couldn't be read.
+	rcvBuf int
+
+	// Set if ReceiveInterfaceFilter or SendInterfaceFilter rejects the interface.  We then ignore
+	// what arrives on it or keep from sending on it.
+	noReceive, noSend bool
 
 	// We keep the cache interface specific because, absent connectivity info, we have to treat each network as separate.
 	cache *rrCache
@@ -69,6 +95,10 @@ type multicastIfc struct {
 	// MDNS we are a child of.
 	mdns *MDNS
 
+	// When we last asked each question, for suppressing duplicates.
+	askedLock sync.Mutex
+	asked     map[dns.Question]time.Time
+
 	// Set to true to terminate any waiting thread.
 	doneLock sync.Mutex
 	done     bool
@@ -77,12 +107,29 @@ type multicastIfc struct {
 func newMulticastIfc(ipver int, ifc net.Interface, addr *net.UDPAddr, addresses []*net.IPNet, mdns *MDNS) *multicastIfc {
 	return &multicastIfc{
 		ifc:       ifc,
-		addr:      addr,
+		addr:      scopedGroup(addr, ifc),
 		addresses: addresses,
-		cache:     newRRCache(mdns.logLevel),
+		cache:     newRRCache(mdns.logLevel, mdns.logger, mdns.maxCacheEntries),
 		mdns:      mdns,
 		ipver:     ipver,
+		asked:     make(map[dns.Question]time.Time),
+		noReceive: mdns.recvFilter != nil && !mdns.recvFilter(ifc),
+		noSend:    mdns.sendFilter != nil && !mdns.sendFilter(ifc),
+	}
+}
+
+// scopedGroup returns the multicast group addr as reached through ifc.  An IPv6 group of link or
+// interface scope, e.g., ff02::fb, is a different group on each link so it needs the interface as its
+// zone.  Otherwise which interface a packet sent to it goes out depends on the socket's default, which
+// is only right if the system set it to ifc.  Other groups are returned as is.
+func scopedGroup(addr *net.UDPAddr, ifc net.Interface) *net.UDPAddr {
+	if addr == nil || addr.IP.To4() != nil || ifc.Name == "" {
+		return addr
 	}
+	if !addr.IP.IsLinkLocalMulticast() && !addr.IP.IsInterfaceLocalMulticast() {
+		return addr
+	}
+	return &net.UDPAddr{IP: addr.IP, Port: addr.Port, Zone: ifc.Name}
 }
 
 func (m *multicastIfc) run() bool {
@@ -101,72 +148,246 @@ func (m *multicastIfc) String() string {
 	return fmt.Sprintf("%d v%d %s multicast addr %s", m.ifc.Index, m.ipver, m.ifc.Name, m.addr)
 }
 
+// hostIPs returns the addresses of a host we announce: those given to AddHostAddress or else the
+// interface's own.  Called only from the main loop.
+func (m *multicastIfc) hostIPs(host string) []net.IP {
+	if ips, ok := m.mdns.hosts[host]; ok {
+		return ips
+	}
+	var ips []net.IP
+	for _, address := range m.addresses {
+		ips = append(ips, address.IP)
+	}
+	return ips
+}
+
 // Append host addresses to the answer section.
 func (m *multicastIfc) appendHostAddresses(msg *dns.Msg, host string, rrtype int, ttl uint32) {
 	hostDN := hostFQDN(host)
-	for _, address := range m.addresses {
+	for _, ip := range m.hostIPs(host) {
 		switch rrtype {
 		case dns.TypeALL:
-			msg.Answer = append(msg.Answer, NewAddressRR(hostDN, 0x8000|dns.ClassINET, ttl, address.IP))
+			msg.Answer = append(msg.Answer, NewAddressRR(hostDN, cacheFlushBit|dns.ClassINET, ttl, ip))
 		case dns.TypeA:
-			if v4 := address.IP.To4(); v4 != nil {
-				msg.Answer = append(msg.Answer, NewAddressRR(hostDN, 0x8000|dns.ClassINET, ttl, v4))
+			if v4 := ip.To4(); v4 != nil {
+				msg.Answer = append(msg.Answer, NewAddressRR(hostDN, cacheFlushBit|dns.ClassINET, ttl, v4))
 			}
 		case dns.TypeAAAA:
-			if v4 := address.IP.To4(); v4 == nil {
-				msg.Answer = append(msg.Answer, NewAddressRR(hostDN, 0x8000|dns.ClassINET, ttl, address.IP))
+			if v4 := ip.To4(); v4 == nil {
+				msg.Answer = append(msg.Answer, NewAddressRR(hostDN, cacheFlushBit|dns.ClassINET, ttl, ip))
 			}
 		}
 	}
 }
 
-func (m *multicastIfc) appendSrvRR(msg *dns.Msg, service, host string, port uint16, ttl uint32) {
+// If we have no addresses of type rrtype for a host, append an NSEC RR listing the types we do have to the additional
+// section (RFC 6762 section 6.1).  This keeps queriers from repeatedly asking for, say, AAAA RRs on a v4 only network.
+func (m *multicastIfc) appendHostNsec(msg *dns.Msg, host string, rrtype uint16, ttl uint32) {
+	var types []uint16
+	for _, ip := range m.hostIPs(host) {
+		t := uint16(dns.TypeAAAA)
+		if ip.To4() != nil {
+			t = dns.TypeA
+		}
+		if t == rrtype {
+			return
+		}
+		// rrtype is A or AAAA so there can only be one other type.
+		types = []uint16{t}
+	}
+	msg.Extra = append(msg.Extra, NewNsecRR(hostFQDN(host), cacheFlushBit|dns.ClassINET, ttl, types))
+}
+
+func (m *multicastIfc) appendSrvRR(msg *dns.Msg, service, instance, host string, port uint16, ttl uint32) {
 	hostDN := hostFQDN(host)
-	uniqueServiceDN := instanceFQDN(host, service)
-	msg.Answer = append(msg.Answer, NewSrvRR(uniqueServiceDN, 0x8000|dns.ClassINET, ttl, hostDN, port, 0, 0))
+	uniqueServiceDN := instanceFQDN(instance, service)
+	msg.Answer = append(msg.Answer, NewSrvRR(uniqueServiceDN, cacheFlushBit|dns.ClassINET, ttl, hostDN, port, 0, 0))
 }
 
-func (m *multicastIfc) appendTxtRR(msg *dns.Msg, service, host string, txt []string, ttl uint32) {
-	uniqueServiceDN := instanceFQDN(host, service)
-	msg.Answer = append(msg.Answer, NewTxtRR(uniqueServiceDN, 0x8000|dns.ClassINET, ttl, txt))
+func (m *multicastIfc) appendTxtRR(msg *dns.Msg, service, instance string, txt []string, ttl uint32) {
+	uniqueServiceDN := instanceFQDN(instance, service)
+	msg.Answer = append(msg.Answer, NewTxtRR(uniqueServiceDN, cacheFlushBit|dns.ClassINET, ttl, txt))
 }
 
 // Append service discovery records to the answer section.
-func (m *multicastIfc) appendDiscoveryRecords(msg *dns.Msg, service, host string, port uint16, txt []string, ttl uint32) {
+func (m *multicastIfc) appendDiscoveryRecords(msg *dns.Msg, service, instance, host string, port uint16, txt, subtypes []string, ttl uint32) {
 	serviceDN := serviceFQDN(service)
-	uniqueServiceDN := instanceFQDN(host, service)
+	uniqueServiceDN := instanceFQDN(instance, service)
 	msg.Answer = append(msg.Answer, NewPtrRR(serviceDN, dns.ClassINET, ttl, uniqueServiceDN))
-	m.appendTxtRR(msg, service, host, txt, ttl)
-	m.appendSrvRR(msg, service, host, port, ttl)
+	for _, subtype := range subtypes {
+		msg.Answer = append(msg.Answer, NewPtrRR(SubtypeService(subtype, service), dns.ClassINET, ttl, uniqueServiceDN))
+	}
+	m.appendTxtRR(msg, service, instance, txt, ttl)
+	m.appendSrvRR(msg, service, instance, host, port, ttl)
 	if port > 0 {
+		// A long lived service doesn't make its host's addresses long lived.
+		if ttl > m.mdns.ttl {
+			ttl = m.mdns.ttl
+		}
 		m.appendHostAddresses(msg, host, dns.TypeALL, ttl)
 	}
 }
 
 // Send a message on a multicast net and cache it locally.
 func (m *multicastIfc) sendMessage(msg *dns.Msg) {
+	m.sendMessageTo(msg, m.addr)
+}
+
+// Send a message to a particular address, usually the multicast one, and cache it locally.
+func (m *multicastIfc) sendMessageTo(msg *dns.Msg, addr *net.UDPAddr) {
+	if len(m.mdns.ednsOptions) > 0 {
+		setEDNS0Options(msg, m.mdns.ednsOptions)
+	}
 	if m.mdns.logLevel >= 2 {
-		log.Printf("sending message %v\n", msg)
+		m.mdns.logger.Printf("sending message %v\n", msg)
 	}
 	buf, ok := msg.Pack()
+	if limit := m.packetLimit(); !ok || len(buf) > limit {
+		if parts := splitMsg(msg, limit); len(parts) > 1 {
+			for _, part := range parts {
+				m.sendMessageTo(part, addr)
+			}
+			return
+		}
+	}
 	if !ok {
 		if m.mdns.logLevel >= 1 {
-			log.Printf("can't pack address message\n")
+			m.mdns.logger.Printf("can't pack address message\n")
 		}
 		return
 	}
-	if _, err := m.conn.WriteTo(buf, m.addr); err != nil {
+	conn := m.conn
+	if m.sendConn != nil {
+		conn = m.sendConn
+	}
+	sent := false
+	if m.mdns.passive || m.noSend {
+		if m.mdns.logLevel >= 2 {
+			m.mdns.logger.Printf("passive on %s, not sending to %v\n", m, addr)
+		}
+	} else if msg.Response && m.mdns.paused && !isGoodbye(msg) {
+		// Responses are only sent from the main loop so paused is safe to look at.
+		if m.mdns.logLevel >= 2 {
+			m.mdns.logger.Printf("paused on %s, not sending to %v\n", m, addr)
+		}
+	} else if _, err := conn.WriteTo(buf, addr); err != nil {
 		if m.mdns.logLevel >= 1 {
-			log.Printf("WriteTo failed %v %v", m.addr, err)
+			m.mdns.logger.Printf("WriteTo failed %v %v", addr, err)
 		}
+	} else {
+		m.mdns.packetsSent.Add(1)
+		sent = true
 	}
 
-	// Cache these RRs in case we ask about ourself.
+	// Cache these RRs in case we ask about ourself.  The answers in a question are what we already
+	// know so there is no point in caching them again.
+	if !msg.Response {
+		return
+	}
 	for _, rr := range msg.Answer {
-		if m.cache.Add(rr) {
+		if m.cache.AddOwn(rr) {
 			m.mdns.changedRR(rr)
 		}
+		// Only what actually went out counts as multicast.
+		if sent && addr.IP.IsMulticast() {
+			m.cache.Multicast(rr)
+		}
+	}
+}
+
+// isGoodbye returns true if msg only says goodbye, i.e., all its answers have a TTL of 0.
+func isGoodbye(msg *dns.Msg) bool {
+	for _, rr := range msg.Answer {
+		if rr.Header().Ttl != 0 {
+			return false
+		}
+	}
+	return len(msg.Answer) > 0
+}
+
+// stale returns true if we haven't multicast one of our records rrs within reannounceFraction of its TTL.
+func (m *multicastIfc) stale(rrs []dns.RR) bool {
+	for _, rr := range rrs {
+		if !m.cache.MulticastRecently(rr, reannounceFraction) {
+			return true
+		}
+	}
+	return false
+}
+
+// packetLimit returns the most we put in a message sent on the interface: what fits in its MTU, but no
+// more than MaxPacketSize allows (RFC 6762 section 17).
+func (m *multicastIfc) packetLimit() int {
+	limit := maxPacketSize
+	if m.mdns.maxMessageSize != 0 {
+		limit = m.mdns.maxMessageSize
+	}
+	headers := 20 + 8 // IPv4 and UDP
+	if m.ipver == 6 {
+		headers = 40 + 8
+	}
+	if m.ifc.MTU > 0 && m.ifc.MTU-headers < limit {
+		limit = m.ifc.MTU - headers
+	}
+	return limit
+}
+
+// splitMsg breaks msg into messages of at most limit bytes with as many records in each as fit.  A
+// record too big to fit goes in a message by itself.  The questions go in the first message and the
+// EDNS0 OPT record, if any, in each.  Since a query's known answers are for its questions, all but the
+// last message of a query have the TC bit set so that responders wait for the rest (RFC 6762 section
+// 7.2).
+func splitMsg(msg *dns.Msg, limit int) []*dns.Msg {
+	var opt dns.RR
+	var extra []dns.RR
+	for _, rr := range msg.Extra {
+		if _, ok := rr.(*dns.RR_OPT); ok {
+			opt = rr
+		} else {
+			extra = append(extra, rr)
+		}
+	}
+	next := func() *dns.Msg {
+		part := newDnsMsg(msg.ID, msg.Response, msg.Authoritative)
+		part.Opcode, part.Rcode = msg.Opcode, msg.Rcode
+		if opt != nil {
+			part.Extra = append(part.Extra, opt)
+		}
+		return part
+	}
+	part := next()
+	part.Question = msg.Question
+	parts := []*dns.Msg{part}
+	records := 0
+	sections := []struct {
+		rrs []dns.RR
+		in  func(*dns.Msg) *[]dns.RR
+	}{
+		{msg.Answer, func(m *dns.Msg) *[]dns.RR { return &m.Answer }},
+		{msg.NS, func(m *dns.Msg) *[]dns.RR { return &m.NS }},
+		{extra, func(m *dns.Msg) *[]dns.RR { return &m.Extra }},
+	}
+	for _, sec := range sections {
+		for _, rr := range sec.rrs {
+			rrs := sec.in(part)
+			*rrs = append(*rrs, rr)
+			records++
+			if buf, ok := part.Pack(); records > 1 && (!ok || len(buf) > limit) {
+				*rrs = (*rrs)[:len(*rrs)-1]
+				part = next()
+				parts = append(parts, part)
+				rrs = sec.in(part)
+				*rrs = append(*rrs, rr)
+				records = 1
+			}
+		}
+	}
+	if !msg.Response {
+		for _, p := range parts[:len(parts)-1] {
+			p.Truncated = true
+		}
 	}
+	return parts
 }
 
 // Announce the address records for a host.
@@ -177,16 +398,109 @@ func (m *multicastIfc) announceHost(host string, ttl uint32) {
 }
 
 // Announce a service and how to reach it.
-func (m *multicastIfc) announceService(service, host string, port uint16, txt []string, ttl uint32) {
+func (m *multicastIfc) announceService(service, instance, host string, port uint16, txt, subtypes []string, ttl uint32) {
 	msg := newDnsMsg(0, true, true)
-	m.appendDiscoveryRecords(msg, service, host, port, txt, ttl)
+	m.appendDiscoveryRecords(msg, service, instance, host, port, txt, subtypes, ttl)
 	m.sendMessage(msg)
 }
 
+// Announce several services, as many to a message as fit in a packet on the interface.
+func (m *multicastIfc) announceServices(reqs []announceRequest) {
+	msg := newDnsMsg(0, true, true)
+	for _, req := range reqs {
+		n := len(msg.Answer)
+		m.appendDiscoveryRecords(msg, req.service, req.instance, req.host, req.port, req.txt, req.subtypes, m.mdns.serviceTTL(req))
+		if buf, ok := msg.Pack(); n > 0 && (!ok || len(buf) > m.packetLimit()) {
+			rest := msg.Answer[n:]
+			msg.Answer = msg.Answer[:n]
+			m.sendMessage(msg)
+			msg = newDnsMsg(0, true, true)
+			msg.Answer = append(msg.Answer, rest...)
+		}
+	}
+	if len(msg.Answer) > 0 {
+		m.sendMessage(msg)
+	}
+}
+
+// suppress returns the questions we haven't asked within the suppression window and remembers that we
+// are asking them now.  Many callers asking the same thing at once thus cause a single multicast
+// (RFC 6762 section 5.2).
+func (m *multicastIfc) suppress(q []dns.Question) []dns.Question {
+	window := m.mdns.querySuppression
+	if window <= 0 {
+		return q
+	}
+	m.askedLock.Lock()
+	defer m.askedLock.Unlock()
+	now := time.Now()
+	for x, t := range m.asked {
+		if now.Sub(t) >= window {
+			delete(m.asked, x)
+		}
+	}
+	var fresh []dns.Question
+	for _, x := range q {
+		if _, ok := m.asked[x]; ok {
+			if m.mdns.logLevel >= 2 {
+				m.mdns.logger.Printf("suppressing duplicate question %v on %s\n", x, m)
+			}
+			continue
+		}
+		m.asked[x] = now
+		fresh = append(fresh, x)
+	}
+	return fresh
+}
+
 // Ask a question.
 func (m *multicastIfc) sendQuestion(q []dns.Question) {
-	msg := newDnsMsg(0, false, false)
-	msg.Question = q
+	if q = m.suppress(q); len(q) == 0 {
+		return
+	}
+	msg := newQuestionMsg(q)
+	m.sendMessage(msg)
+}
+
+// askAll asks the questions on every interface.  Unlike sendQuestion it may be called from outside the
+// main loop.
+func (s *MDNS) askAll(q []dns.Question) {
+	s.mifcsLock.RLock()
+	defer s.mifcsLock.RUnlock()
+	for _, mifc := range s.mifcs {
+		mifc.sendQuestion(q)
+	}
+}
+
+// Probe for names we would like to claim.  The records we propose to announce go in the authority
+// section so that simultaneous probers can tell whose claim wins (RFC 6762 section 8.2).
+func (m *multicastIfc) sendProbe(q []dns.Question, proposed []dns.RR) {
+	msg := newQuestionMsg(q)
+	msg.NS = proposed
+	m.sendMessage(msg)
+}
+
+// Ask questions and include the answers we already know so that responders need not repeat
+// them.  As many questions go in a message as fit in a packet, each with its known answers.  This reads the
+// cache so must only be called from the main loop.
+func (m *multicastIfc) sendQuestionWithKnownAnswers(q []dns.Question) {
+	if q = m.suppress(q); len(q) == 0 {
+		return
+	}
+	msg := newQuestionMsg(nil)
+	for _, x := range q {
+		n := len(msg.Answer)
+		msg.Question = append(msg.Question, x)
+		msg.Answer = append(msg.Answer, m.cache.KnownAnswers(x.Name, x.Qtype)...)
+		if buf, ok := msg.Pack(); len(msg.Question) > 1 && (!ok || len(buf) > m.packetLimit()) {
+			known := msg.Answer[n:]
+			msg.Question = msg.Question[:len(msg.Question)-1]
+			msg.Answer = msg.Answer[:n]
+			m.sendMessage(msg)
+			msg = newQuestionMsg([]dns.Question{x})
+			msg.Answer = append(msg.Answer, known...)
+		}
+	}
 	m.sendMessage(msg)
 }
 
@@ -194,19 +508,99 @@ type lookupRequest struct {
 	name   string
 	rrtype uint16
 	rc     chan dns.RR
+	count  bool // count it in the cache hits and misses, i.e., it's for a caller rather than us
 }
 
 type announceRequest struct {
-	service string
-	host    string
-	port    uint16
-	txt     []string
+	service  string
+	instance string // the instance's label, host unless renamed
+	host     string // target of the SRV RR
+	port     uint16
+	txt      []string
+	subtypes []string
+	ttl      uint32 // 0 means the MDNS's TTL
+}
+
+type txtUpdateRequest struct {
+	announceRequest
+	errc chan error
+}
+
+type conflictRequest struct {
+	announceRequest
+	rc chan bool
+}
+
+// nameConflict says which of the names needed to announce a service instance someone else is using.
+type nameConflict struct {
+	instance bool // the instance name, i.e., there is a SRV RR for it that isn't ours
+	host     bool // the host name, i.e., there are address RRs for it that aren't ours
+}
+
+type probeRequest struct {
+	announceRequest
+	rc chan nameConflict
 }
 
 type updateRequest struct {
-	done chan struct{}
+	done     chan struct{}
+	host     string
+	ttl      uint32
+	goodbyes bool // say goodbye for all our services
+	stop     bool // exit the main loop
+}
+
+// Pausing or resuming, see Pause.
+type pauseRequest struct {
+	pause  bool
+	repeat bool // the repeat of a pause's goodbyes
+	done   chan struct{}
+}
+
+type sourcesRequest struct {
+	name string
+	rc   chan []InstanceSource
+}
+
+type ipAddrsRequest struct {
+	name   string
+	rrtype uint16
+	rc     chan []net.IPAddr
+}
+
+// A response to send once its random delay is up.
+type delayedResponse struct {
+	mifc *multicastIfc
+	msg  *dns.Msg
+}
+
+// A host to announce with the given addresses.  No addresses means stop announcing it.
+type hostRequest struct {
 	host string
-	ttl  uint32
+	ips  []net.IP
+	done chan struct{}
+}
+
+type flushRequest struct {
+	requery bool
+	done    chan struct{}
+}
+
+type expiringRequest struct {
+	name   string
+	rrtype uint16
+	rc     chan bool
+}
+
+type instancesRequest struct {
+	name    string
+	service string
+	rc      chan []ServiceInstance
+}
+
+type scanReply struct {
+	highesthwaddr string
+	err           error
 }
 
 type watchedService struct {
@@ -215,14 +609,107 @@ type watchedService struct {
 	done bool
 }
 
+// wake tells the watcher that the service may have changed.
+func (w *watchedService) wake() {
+	w.c.L.Lock()
+	w.gen++
+	w.c.L.Unlock()
+	w.c.Broadcast()
+}
+
 type MDNS struct {
 	// Addresses to multicast on.
 	v4addr, v6addr *net.UDPAddr
 
-	// Multicast interfaces to listen on.
+	// Multicast interfaces to listen on.  Only the main loop changes mifcs, under mifcsLock, so
+	// everyone else must hold mifcsLock to look at it.
 	mifcsLock sync.RWMutex
 	mifcs     map[string]*multicastIfc
 
+	// Why we couldn't listen on the interfaces that failed the last scan, keyed like mifcs' names.
+	// Also under mifcsLock.
+	ifcErrs map[string]error
+
+	// If not nil, only interfaces for which this returns true are used.
+	ifcFilter func(net.Interface) bool
+
+	// If not nil, only interfaces for which these return true are received from or sent on.
+	recvFilter, sendFilter func(net.Interface) bool
+
+	// If true, our questions ask for unicast responses.
+	unicastQuestions bool
+
+	// If true, our multicasts are also delivered to listeners on this host.
+	multicastLoopback bool
+
+	// How we reach the networks.
+	transport Transport
+
+	// If true, we only listen, never sending anything.
+	passive bool
+
+	// EDNS0 options to put in every message we send and the function to call with those we receive.
+	ednsOptions []dns.EDNS0Option
+	onEDNS      func(src net.Addr, opts []dns.EDNS0Option)
+
+	// If true, we drop answers from our delayed responses that another responder sends first.
+	duplicateSuppression bool
+
+	// If not 0, the most records each interface's cache holds.
+	maxCacheEntries int
+
+	// How often to look for interface changes.  0 means never.
+	scanInterval time.Duration
+
+	// How long after asking a question we won't ask it again.  0 means always ask.
+	querySuppression time.Duration
+
+	// How long after subscribing to a service we first ask again and the longest we wait between asking,
+	// see SubscriptionRequery.  A first interval of 0 means ask only once.
+	requeryFirst, requeryMax time.Duration
+
+	// If not 0 and not the multicast port, the port to send from.
+	sourcePort int
+
+	// If not 0, the TTL of outgoing multicasts, which must be set or the interface isn't used.
+	multicastTTL int
+
+	// If not 0, the SO_RCVBUF to ask for on our connections.
+	receiveBufferSize int
+
+	// If not 0, the most bytes we put in a message.
+	maxMessageSize int
+
+	// Set to return an instance heard on several interfaces once per interface.
+	separateInstances bool
+
+	// If set, the DNS server Resolve asks when the networks don't answer.
+	unicastServer string
+
+	// Set to keep away from one of the IP versions altogether.
+	noIPv4, noIPv6 bool
+
+	// Multicast groups to join in addition to v4addr and v6addr, as passed to ExtraGroups and parsed.
+	extraGroupAddrs []string
+	extraGroups     []*net.UDPAddr
+
+	// If not 0, the least time between announcements of a service's changed TXT, see TxtUpdateDebounce.
+	txtDebounce time.Duration
+
+	// If not 0, how long a watched instance may be gone before watchers are told, see WatchDedupWindow.
+	watchDedup time.Duration
+
+	// If not nil, called with a copy of every packet we receive, see OnPacket.  The listeners queue
+	// the packets on tapc for a goroutine that makes the calls.
+	tap  func(src net.Addr, data []byte)
+	tapc chan tappedPacket
+
+	// The main loop and the udp listeners.  Stop waits for them to exit.
+	running sync.WaitGroup
+
+	// Makes Stop happen once however often and from however many goroutines it is called.
+	stopOnce sync.Once
+
 	// Set to true to get threads to exit.
 	doneLock sync.Mutex
 	done     bool
@@ -230,14 +717,66 @@ type MDNS struct {
 	// Channel to pass incoming networlmessages to the main loop.
 	fromNet chan *msgFromNet
 
+	// Truncated messages being coalesced, by interface and sender, and the channel
+	// their timers use to tell the main loop to give up waiting.
+	partial     map[string]*partialMsg
+	partialDone chan *partialMsg
+
+	// For debouncing TXT updates: when each service instance, by service and host:port, last had
+	// its TXT announced, which ones have an announcement waiting for the end of the window, and
+	// the channel on which the waiting announcements come due.
+	txtAnnounced map[string]time.Time
+	txtPending   map[string]bool
+	txtDue       chan announceRequest
+
 	// All access methods turn into channel requests to the main loop to make synchronization trivial.
-	announce chan announceRequest
-	goodbye  chan announceRequest
-	lookup   chan lookupRequest
-	update   chan updateRequest
+	announce   chan []announceRequest
+	goodbye    chan announceRequest
+	retransmit chan []announceRequest
+	refreshAll chan chan struct{}
+	updateTxt  chan txtUpdateRequest
+	lookup     chan lookupRequest
+	query      chan []dns.Question
+	conflict   chan probeRequest
+	registered chan conflictRequest
+	update     chan updateRequest
+	cacheStats chan chan cacheStats
+	dump       chan chan []CacheEntry
+	rcvBufs    chan chan map[string]int
+	local      chan chan []ServiceInstance
+	scan       chan chan scanReply
+	sources    chan sourcesRequest
+	ipAddrs    chan ipAddrsRequest
+	instances  chan instancesRequest
+	expiring   chan expiringRequest
+	flush      chan flushRequest
+	addHost    chan hostRequest
+	delayed    chan *delayedResponse
+	pause      chan pauseRequest
+
+	// Delayed responses not yet sent.  Only touched in the main loop.
+	pending []*delayedResponse
+
+	// Set from Pause until Resume.  Only touched in the main loop.
+	paused bool
 
 	refreshAlarm *time.Ticker
 	cleanupAlarm *time.Ticker
+	scanAlarm    *time.Ticker
+
+	// Closed by Stop to tell background goroutines to give up.
+	quit chan struct{}
+
+	// Counters for Stats.  These are atomic so that they can be bumped outside the main loop.
+	packetsSent     atomic.Uint64
+	packetsReceived atomic.Uint64
+	parseFailures   atomic.Uint64
+	queriesAnswered atomic.Uint64
+
+	// Lookups for callers, over all interfaces, that found something in the cache and those that
+	// didn't.  Only the main loop touches these.
+	cacheHits   uint64
+	cacheMisses uint64
 
 	// The host name.
 	hostName string
@@ -246,16 +785,20 @@ type MDNS struct {
 	// Services we are announcing and their hosts and ports.
 	services map[string]map[string]announceRequest
 
-	// Services whose memberships are being watched or subscribed to.
+	// Hosts announced with AddHostAddress and their addresses.
+	hosts map[string][]net.IP
+
+	// Services whose memberships are being watched or subscribed to.  Closing a subscription's channel
+	// stops its repeated queries.
 	watchedLock sync.RWMutex
 	watched     map[string][]*watchedService
-	subscribed  map[string]bool
+	subscribed  map[string]chan struct{}
 
 	// TTL to use for outgoing RRs.
 	ttl uint32
 
-	// TODO: Use a "real" leveled logging module, e.g.
-	// https://github.com/golang/glog.
+	// Where log messages go and how many of them.
+	logger   Logger
 	logLevel int
 	loopback bool
 }
@@ -270,11 +813,16 @@ func losecolons(x string) string {
 	return y
 }
 
-func ipsAreAllMine(ips []net.IP) bool {
+func (s *MDNS) ipsAreAllMine(ips []net.IP) bool {
 	if len(ips) == 0 {
 		return true
 	}
-	addrs, _ := net.InterfaceAddrs()
+	var addrs []net.Addr
+	ifcs, _ := s.transport.Interfaces()
+	for _, ifc := range ifcs {
+		a, _ := s.transport.Addrs(ifc)
+		addrs = append(addrs, a...)
+	}
 	for _, ip := range ips {
 		found := false
 		for _, addr := range addrs {
@@ -309,47 +857,194 @@ func (s *MDNS) isDoppelGanger(rr []dns.RR) bool {
 	if len(ips) == 0 {
 		return false
 	}
-	return !ipsAreAllMine(ips)
+	return !s.ipsAreAllMine(ips)
+}
+
+// qclass returns the class for our questions, with the QU bit set if we want unicast responses.
+func (s *MDNS) qclass() uint16 {
+	if s.unicastQuestions {
+		return dns.ClassINET | unicastResponseBit
+	}
+	return dns.ClassINET
+}
+
+// Errors that callers may want to tell apart.  Those returned may wrap them with more detail so
+// compare with errors.Is.  Errors from the networks themselves are passed on, possibly wrapped, as
+// they come from package net.
+var (
+	// ErrNameConflict is returned when someone else on the network is already using a name we want.
+	ErrNameConflict = errors.New("name in use")
+
+	// ErrInvalidService is returned for malformed service names and subtypes, TXT strings that are too
+	// long, and services whose records don't fit in a message.
+	ErrInvalidService = errors.New("invalid service")
+
+	// ErrInvalidArgument is returned for other bad input, e.g., a missing name, a bad address, or a bad
+	// TXT key.
+	ErrInvalidArgument = errors.New("invalid argument")
+
+	// ErrNotAnnounced is returned when changing a service we aren't announcing.
+	ErrNotAnnounced = errors.New("service not announced")
+
+	// ErrNotFound is returned when nothing on the networks answers for a name we must resolve.
+	ErrNotFound = errors.New("not found")
+
+	// ErrPassive is returned in passive mode for calls that only make sense if we send, e.g., adding a
+	// service.
+	ErrPassive = errors.New("passive mode")
+
+	// ErrInterface is returned by ScanInterfaces when we couldn't listen on some of the interfaces,
+	// e.g., one that can't multicast, and by NewMDNS when we couldn't listen on any.  The rest are
+	// still used and the error also wraps the error for each interface that failed.
+	ErrInterface = errors.New("interface failed")
+
+	// ErrClosed is returned by calls made after Stop.  Calls that only return what we know, e.g.,
+	// ServiceDiscovery, return nil instead.
+	ErrClosed = errors.New("mdns stopped")
+
+	// ErrStopped is the old name for ErrClosed.
+	//
+	// Deprecated: Use ErrClosed.
+	ErrStopped = ErrClosed
+)
+
+// multicastAddr parses addr, which must be a multicast address of the given IP version and a port.
+func multicastAddr(addr string, ipver int) (*net.UDPAddr, error) {
+	a, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidArgument, err)
+	}
+	if !a.IP.IsMulticast() {
+		return nil, fmt.Errorf("%w: %s is not a multicast address", ErrInvalidArgument, addr)
+	}
+	if (a.IP.To4() != nil) != (ipver == 4) {
+		return nil, fmt.Errorf("%w: %s is not an IPv%d address", ErrInvalidArgument, addr, ipver)
+	}
+	if a.Port == 0 {
+		return nil, fmt.Errorf("%w: %s has no port", ErrInvalidArgument, addr)
+	}
+	return a, nil
 }
 
-// Create a new MDNS service.
-func NewMDNS(host, v4addr, v6addr string, loopback bool, logLevel int) (s *MDNS, err error) {
+// The standard mdns multicast groups (RFC 6762 section 3).  NewMDNS uses them when passed empty addresses.
+const (
+	DefaultIPv4Addr = "224.0.0.251:5353"
+	DefaultIPv6Addr = "[FF02::FB]:5353"
+)
+
+// Create a new MDNS service.  Any options are applied before the interfaces are scanned.  If we can't
+// listen on some of the interfaces, the new MDNS uses the rest and InterfaceErrors says why the others
+// failed; if we can't listen on any of them, NewMDNS fails with an error wrapping ErrInterface.
+func NewMDNS(host, v4addr, v6addr string, loopback bool, logLevel int, opts ...Option) (s *MDNS, err error) {
 	s = new(MDNS)
 	if v4addr == "" {
-		v4addr = "224.0.0.251:5353"
+		v4addr = DefaultIPv4Addr
 	}
 	if v6addr == "" {
-		v6addr = "[FF02::FB]:5353"
-	}
-	if s.v4addr, err = net.ResolveUDPAddr("udp", v4addr); err != nil {
-		return nil, err
-	}
-	if s.v6addr, err = net.ResolveUDPAddr("udp", v6addr); err != nil {
-		return nil, err
+		v6addr = DefaultIPv6Addr
 	}
 	s.logLevel = logLevel
 	s.loopback = loopback
 	s.ttl = 120
+	s.multicastLoopback = true
+	s.transport = udpTransport{s}
+	s.duplicateSuppression = true
+	s.logger = log.Default()
+	s.scanInterval = defaultScanInterval
+	s.querySuppression = defaultQuerySuppression
+	s.requeryFirst, s.requeryMax = defaultRequeryFirst, defaultRequeryMax
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.multicastTTL < 0 || s.multicastTTL > 255 {
+		return nil, fmt.Errorf("%w: multicast ttl %d out of range", ErrInvalidArgument, s.multicastTTL)
+	}
+	if s.receiveBufferSize < 0 {
+		return nil, fmt.Errorf("%w: receive buffer size %d", ErrInvalidArgument, s.receiveBufferSize)
+	}
+	if s.maxMessageSize != 0 && (s.maxMessageSize < 512 || s.maxMessageSize > maxPacketSize) {
+		return nil, fmt.Errorf("%w: max packet size %d out of range", ErrInvalidArgument, s.maxMessageSize)
+	}
+	if s.noIPv4 && s.noIPv6 {
+		return nil, fmt.Errorf("%w: both IPv4 and IPv6 are disabled", ErrInvalidArgument)
+	}
+	if !s.noIPv4 {
+		if s.v4addr, err = multicastAddr(v4addr, 4); err != nil {
+			return nil, err
+		}
+	}
+	if !s.noIPv6 {
+		if s.v6addr, err = multicastAddr(v6addr, 6); err != nil {
+			return nil, err
+		}
+	}
+	for _, g := range s.extraGroupAddrs {
+		ipver := 4
+		if strings.HasPrefix(g, "[") {
+			ipver = 6
+		}
+		addr, err := multicastAddr(g, ipver)
+		if err != nil {
+			return nil, err
+		}
+		if (ipver == 4 && s.noIPv4) || (ipver == 6 && s.noIPv6) {
+			return nil, fmt.Errorf("%w: group %s is for a disabled IP version", ErrInvalidArgument, g)
+		}
+		s.extraGroups = append(s.extraGroups, addr)
+	}
 
 	// Allocate channels for communications internal to MDNS
 	s.fromNet = make(chan *msgFromNet, 10)
-	s.announce = make(chan announceRequest)
+	s.partial = make(map[string]*partialMsg)
+	s.partialDone = make(chan *partialMsg)
+	s.txtAnnounced = make(map[string]time.Time)
+	s.txtPending = make(map[string]bool)
+	s.txtDue = make(chan announceRequest)
+	s.announce = make(chan []announceRequest)
 	s.goodbye = make(chan announceRequest)
+	s.retransmit = make(chan []announceRequest)
+	s.refreshAll = make(chan chan struct{})
+	s.quit = make(chan struct{})
+	s.updateTxt = make(chan txtUpdateRequest)
 	s.lookup = make(chan lookupRequest)
+	s.query = make(chan []dns.Question)
+	s.conflict = make(chan probeRequest)
+	s.registered = make(chan conflictRequest)
 	s.update = make(chan updateRequest)
+	s.cacheStats = make(chan chan cacheStats)
+	s.dump = make(chan chan []CacheEntry)
+	s.rcvBufs = make(chan chan map[string]int)
+	s.local = make(chan chan []ServiceInstance)
+	s.scan = make(chan chan scanReply)
+	s.sources = make(chan sourcesRequest)
+	s.ipAddrs = make(chan ipAddrsRequest)
+	s.instances = make(chan instancesRequest)
+	s.expiring = make(chan expiringRequest)
+	s.flush = make(chan flushRequest)
+	s.addHost = make(chan hostRequest)
+	s.delayed = make(chan *delayedResponse)
+	s.pause = make(chan pauseRequest)
+	s.tapc = make(chan tappedPacket, tapQueueLen)
 
 	s.services = make(map[string]map[string]announceRequest, 0)
 	s.watched = make(map[string][]*watchedService, 0)
-	s.subscribed = make(map[string]bool, 0)
+	s.subscribed = make(map[string]chan struct{}, 0)
+	s.hosts = make(map[string][]net.IP)
 	s.mifcs = make(map[string]*multicastIfc, 0)
 
-	highesthwaddr, err := s.ScanInterfaces()
-	if err != nil {
-		log.Fatalf("scanning interfaces: %s", err)
+	// Carry on without any interfaces we can't listen on.  InterfaceErrors tells about them.
+	highesthwaddr, _, err := s.scanInterfaces()
+	if err != nil && (!errors.Is(err, ErrInterface) || len(s.mifcs) == 0) {
+		return nil, fmt.Errorf("scanning interfaces: %w", err)
 	}
 
 	s.setAlarms()
+	s.running.Add(1)
 	go s.mainLoop()
+	if s.tap != nil {
+		s.running.Add(1)
+		go s.tapLoop()
+	}
 
 	// If the name ends in a '()', tack on our hwaddr.
 	if len(host) != 0 {
@@ -359,10 +1054,10 @@ func NewMDNS(host, v4addr, v6addr string, loopback bool, logLevel int) (s *MDNS,
 
 		// Make sure someone else isn't using our name already.
 		ips, _ := s.ResolveAddress(host)
-		if !ipsAreAllMine(ips) {
+		if !s.ipsAreAllMine(ips) {
 			// Close down our multicasts ifcs.
 			s.Stop()
-			return nil, errors.New("host name in use")
+			return nil, fmt.Errorf("host %s: %w", host, ErrNameConflict)
 		}
 		// Request the host update and wait until it is updated.
 		req := updateRequest{done: make(chan struct{}), host: host}
@@ -391,23 +1086,79 @@ L:
 	return true
 }
 
+// How long we suppress duplicate questions unless told otherwise.
+const defaultQuerySuppression = time.Second
+
+// How long after subscribing we first ask again and the cap on the doubling intervals after that unless
+// told otherwise (RFC 6762 section 5.2).
+const (
+	defaultRequeryFirst = time.Second
+	defaultRequeryMax   = time.Minute
+)
+
+// How often we look for interface changes unless told otherwise.
+const defaultScanInterval = 10 * time.Second
+
 // ScanInterfaces looks for changes in the interface list and makes sure we are using them
-// for mdns.
+// for mdns.  Our host and services are announced on any interfaces that are new or have new
+// addresses.  This happens periodically anyway unless turned off with InterfaceScanInterval.
+// If we couldn't listen on some of the interfaces, the error wraps ErrInterface; the others
+// are used regardless.
 func (s *MDNS) ScanInterfaces() (string, error) {
+	rc := make(chan scanReply, 1)
+	select {
+	case s.scan <- rc:
+		r := <-rc
+		return r.highesthwaddr, r.err
+	case <-s.quit:
+		return "", ErrClosed
+	}
+}
+
+// rescan looks for interface changes and announces ourselves on the interfaces it adds.  Called
+// only from the main loop.
+func (s *MDNS) rescan() (string, error) {
+	highesthwaddr, added, err := s.scanInterfaces()
+	if err != nil {
+		if s.logLevel >= 1 {
+			s.logger.Printf("scanning interfaces: %s", err)
+		}
+		if !errors.Is(err, ErrInterface) {
+			return "", err
+		}
+	}
+	for _, mifc := range added {
+		s.refreshIfc(mifc)
+	}
+	return highesthwaddr, err
+}
+
+// scanInterfaces does the work for ScanInterfaces.  It returns the highest hardware address and
+// the multicast interfaces that were added.  If some interfaces couldn't be listened on, the others
+// are still added and the error wraps ErrInterface.  Before the main loop starts it is called from
+// NewMDNS, after that only from the main loop.
+func (s *MDNS) scanInterfaces() (string, []*multicastIfc, error) {
 	highesthwaddr := ""
 
 	// Figure out which interfaces we have that we need to listen on.
-	ifcs, err := net.Interfaces()
+	ifcs, err := s.transport.Interfaces()
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 	newmifcs := make(map[string]*multicastIfc, 0)
 
 	for _, ifc := range ifcs {
-		addresses, addrErr := ifc.Addrs()
+		if (s.ifcFilter != nil && !s.ifcFilter(ifc)) ||
+			(s.recvFilter != nil && !s.recvFilter(ifc) && s.sendFilter != nil && !s.sendFilter(ifc)) {
+			if s.logLevel >= 1 {
+				s.logger.Printf("filtering out ifc %d %s\n", ifc.Index, ifc.Name)
+			}
+			continue
+		}
+		addresses, addrErr := s.transport.Addrs(ifc)
 		if addrErr != nil {
 			if s.logLevel >= 1 {
-				log.Printf("Addrs() failed: %s", addrErr)
+				s.logger.Printf("Addrs() failed: %s", addrErr)
 			}
 			continue
 		}
@@ -425,10 +1176,13 @@ func (s *MDNS) ScanInterfaces() (string, error) {
 		for _, address := range addresses {
 			switch address := address.(type) {
 			case *net.IPNet:
+				if (address.IP.To4() != nil && s.noIPv4) || (address.IP.To4() == nil && s.noIPv6) {
+					continue
+				}
 				// We either use loopback or non-loopback interfaces (generally loopback is for testing).
 				if (address.IP.IsLoopback() && !s.loopback) || (!address.IP.IsLoopback() && s.loopback) {
 					if s.logLevel >= 1 {
-						log.Printf("skipping ifc %d %s %s\n", ifc.Index, ifc.Name, address)
+						s.logger.Printf("skipping ifc %d %s %s\n", ifc.Index, ifc.Name, address)
 					}
 					continue
 				}
@@ -450,6 +1204,14 @@ func (s *MDNS) ScanInterfaces() (string, error) {
 		if hasv6 {
 			newmifcs["6+"+key] = newMulticastIfc(6, ifc, s.v6addr, okAddresses, s)
 		}
+		// Each extra group gets its own multicastIfc, i.e., connection and cache, on the interface.
+		for _, g := range s.extraGroups {
+			if g.IP.To4() != nil && hasv4 {
+				newmifcs["4+"+g.String()+"+"+key] = newMulticastIfc(4, ifc, g, okAddresses, s)
+			} else if g.IP.To4() == nil && hasv6 {
+				newmifcs["6+"+g.String()+"+"+key] = newMulticastIfc(6, ifc, g, okAddresses, s)
+			}
+		}
 	}
 
 	// If any interfaces disappeared or changed addresses, remove them.
@@ -463,36 +1225,51 @@ func (s *MDNS) ScanInterfaces() (string, error) {
 		}
 		m.stop()
 		if s.logLevel >= 1 {
-			log.Printf("removing ifc %s", m)
+			s.logger.Printf("removing ifc %s", m)
+		}
+		// Closing the connections gets the udpListeners to exit.
+		m.conn.Close()
+		if m.sendConn != nil {
+			m.sendConn.Close()
 		}
 		delete(s.mifcs, k)
 	}
 
 	// Create any missing interfaces.
+	var added []*multicastIfc
+	var failed []error
+	s.ifcErrs = make(map[string]error)
 	for k, newm := range newmifcs {
 		if _, ok := s.mifcs[k]; ok {
 			continue
 		}
-		conn, err := net.ListenMulticastUDP("udp", &newm.ifc, newm.addr)
+		conn, err := s.listen(newm, newm.addr)
 		if err != nil {
-			if s.logLevel >= 1 {
-				log.Printf("ListenMulticastUDP %s: %v\n", newm, err)
-			}
+			failed = append(failed, fmt.Errorf("%s: %w", newm, err))
+			s.ifcErrs[newm.String()] = err
 			continue
 		}
-		if err := SetMulticastTTL(conn, newm.ipver, 255); err != nil {
-			if s.logLevel >= 1 {
-				log.Printf("SetMulticastTTL %s: %v\n", newm, err)
+		newm.conn = conn
+		if uc, ok := conn.(*udpConn); ok {
+			if n, err := ReceiveBuffer(uc.UDPConn); err == nil {
+				newm.rcvBuf = n
 			}
 		}
-		if err := SetMulticastLoopback(conn, newm.ipver, true); err != nil {
-			if s.logLevel >= 1 {
-				log.Printf("SetMulticastLoopback %s: %v\n", newm, err)
+		if s.sourcePort != 0 && s.sourcePort != newm.addr.Port {
+			// Send from the requested port.  Replies sent directly to us will arrive there
+			// too so we listen on it as well.  If we can't get the port, we fall back to
+			// sending from the multicast port.
+			addr := &net.UDPAddr{IP: newm.addr.IP, Port: s.sourcePort, Zone: newm.addr.Zone}
+			if sendConn, err := s.listen(newm, addr); err == nil {
+				newm.sendConn = sendConn
+				s.running.Add(1)
+				go s.udpListener(newm, sendConn)
 			}
 		}
-		newm.conn = conn
 		s.mifcs[k] = newm
-		go s.udpListener(newm)
+		added = append(added, newm)
+		s.running.Add(1)
+		go s.udpListener(newm, conn)
 
 		// Broadcast a request for any services to which we are subscribed.  If we are
 		// also an instance of the service we will respond to our own request with a
@@ -500,51 +1277,190 @@ func (s *MDNS) ScanInterfaces() (string, error) {
 		// by the responses.
 		s.watchedLock.RLock()
 		for sdn := range s.subscribed {
-			newm.sendQuestion([]dns.Question{{sdn, dns.TypePTR, dns.ClassINET}})
+			newm.sendQuestion([]dns.Question{{sdn, dns.TypePTR, s.qclass()}})
 		}
 		s.watchedLock.RUnlock()
 	}
-	return highesthwaddr, nil
+	if len(failed) > 0 {
+		sort.Slice(failed, func(i, j int) bool { return failed[i].Error() < failed[j].Error() })
+		return highesthwaddr, added, fmt.Errorf("%w: %d of %d: %w", ErrInterface, len(failed), len(newmifcs), errors.Join(failed...))
+	}
+	return highesthwaddr, added, nil
 }
 
-// Change the ttl for outgoing records to something other than the default.
-func (s *MDNS) SetOutgoingTTL(ttl uint32) {
-	s.update <- updateRequest{ttl: ttl}
+// listen opens a connection for a multicast interface bound to addr's port, with the group in addr
+// joined.
+func (s *MDNS) listen(m *multicastIfc, addr *net.UDPAddr) (PacketConn, error) {
+	conn, err := s.transport.Listen(m.ifc, addr, m.ipver)
+	if err != nil {
+		if s.logLevel >= 1 {
+			s.logger.Printf("listen %s port %d: %v\n", m, addr.Port, err)
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// listenUDP opens a UDP connection on ifc bound to addr's port, with the group in addr joined, and sets
+// it up for sending multicasts.
+func (s *MDNS) listenUDP(ifc net.Interface, addr *net.UDPAddr, ipver int) (*net.UDPConn, error) {
+	m := fmt.Sprintf("%d v%d %s", ifc.Index, ipver, ifc.Name)
+	// Joining on ifc also makes it the interface we send from.  The group's zone, if any, only
+	// matters when sending.
+	conn, err := net.ListenMulticastUDP("udp", &ifc, &net.UDPAddr{IP: addr.IP, Port: addr.Port})
+	if err != nil {
+		return nil, err
+	}
+	ttl := s.multicastTTL
+	if ttl == 0 {
+		ttl = 255
+	}
+	if err := SetMulticastTTL(conn, ipver, ttl); err != nil {
+		if s.logLevel >= 1 {
+			s.logger.Printf("SetMulticastTTL %s: %v\n", m, err)
+		}
+		// Better not to use the interface than to send further than asked.
+		if s.multicastTTL != 0 {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if err := SetMulticastLoopback(conn, ipver, s.multicastLoopback); err != nil {
+		if s.logLevel >= 1 {
+			s.logger.Printf("SetMulticastLoopback %s: %v\n", m, err)
+		}
+	}
+	if err := SetPacketInfo(conn, ipver); err != nil {
+		if s.logLevel >= 1 {
+			s.logger.Printf("SetPacketInfo %s: %v\n", m, err)
+		}
+	}
+	if s.receiveBufferSize != 0 {
+		if err := SetReceiveBuffer(conn, s.receiveBufferSize); err != nil {
+			if s.logLevel >= 1 {
+				s.logger.Printf("SetReceiveBuffer %s: %v\n", m, err)
+			}
+		}
+	}
+	return conn, nil
+}
+
+// Change the ttl for outgoing records to something other than the default.
+func (s *MDNS) SetOutgoingTTL(ttl uint32) {
+	select {
+	case s.update <- updateRequest{ttl: ttl}:
+	case <-s.quit:
+	}
 }
 
 // A go routine to listen for packets on a network.  Pass to the main loop with sufficient information to
 // answer on the same interface.
-func (s *MDNS) udpListener(ifc *multicastIfc) {
+func (s *MDNS) udpListener(ifc *multicastIfc, conn PacketConn) {
+	defer s.running.Done()
 	if s.logLevel >= 1 {
-		log.Printf("MDNS listening on %s with %v", ifc, ifc.addresses)
+		s.logger.Printf("MDNS listening on %s at %s with %v", ifc, conn.LocalAddr(), ifc.addresses)
 	}
 
-	b := make([]byte, 2048)
+	b := make([]byte, maxPacketSize)
 	for ifc.run() && s.run() {
-		n, a, err := ifc.conn.ReadFromUDP(b)
+		n, a, i, err := conn.ReadPacket(b)
 		if err != nil {
 			if s.logLevel >= 1 {
-				log.Printf("error reading from udp: %v", err)
+				s.logger.Printf("error reading from udp: %v", err)
+			}
+			continue
+		}
+
+		// The system may hand us packets for the group from other interfaces too.  We only want the
+		// ones from our own link so that we never learn from, or answer onto, another one.
+		if i != 0 && ifc.ifc.Index != 0 && i != ifc.ifc.Index {
+			if s.logLevel >= 3 {
+				s.logger.Printf("%s: ignoring packet from %v that arrived on interface %d", ifc, a, i)
+			}
+			continue
+		}
+		if ifc.noReceive {
+			if s.logLevel >= 3 {
+				s.logger.Printf("%s: send only, ignoring packet from %v", ifc, a)
+			}
+			continue
+		}
+
+		s.packetsReceived.Add(1)
+		if s.tap != nil {
+			select {
+			case s.tapc <- tappedPacket{a, append([]byte(nil), b[:n]...)}:
+			default:
+				// Never hold up the listener; the tap will miss this one.
 			}
 		}
 
 		// convert to dns packet
 		msg := new(dns.Msg)
-		if !msg.Unpack(b[0:n]) {
+		if err := msg.UnpackErr(b[0:n]); err != nil {
+			s.parseFailures.Add(1)
 			if s.logLevel >= 1 {
-				log.Printf("couldn't unpack %d byte dns msg from %v", n, a)
+				s.logger.Printf("couldn't unpack %d byte dns msg from %v: %v", n, a, err)
 			}
 		} else {
-			s.fromNet <- &msgFromNet{ifc, a, msg}
+			if s.onEDNS != nil {
+				if opts := edns0Options(msg); len(opts) > 0 {
+					s.onEDNS(a, opts)
+				}
+			}
+			select {
+			case s.fromNet <- &msgFromNet{ifc, a, msg}:
+			case <-s.quit:
+			}
+		}
+	}
+}
+
+// A packet on its way to the OnPacket function.
+type tappedPacket struct {
+	src  net.Addr
+	data []byte
+}
+
+// How many packets may wait for the OnPacket function before we drop them.
+const tapQueueLen = 100
+
+// tapLoop passes received packets to the OnPacket function, in order, until Stop.
+func (s *MDNS) tapLoop() {
+	defer s.running.Done()
+	for {
+		select {
+		case p := <-s.tapc:
+			s.tap(p.src, p.data)
+		case <-s.quit:
+			return
 		}
 	}
 }
 
+// serviceTTL returns the TTL for the records of a service we are announcing.
+func (s *MDNS) serviceTTL(req announceRequest) uint32 {
+	if req.ttl != 0 {
+		return req.ttl
+	}
+	return s.ttl
+}
+
 // setAlarms sets alarms to wake up the main loop periodically.  We need this
-// to 'refresh' what we have advertised to the network.
+// to 'refresh' what we have advertised to the network often enough for the
+// shortest TTL we use.
 func (s *MDNS) setAlarms() {
 	s.stopAlarms()
-	alarm := (s.ttl - 1) / 2
+	ttl := s.ttl
+	for _, set := range s.services {
+		for _, req := range set {
+			if t := s.serviceTTL(req); t < ttl {
+				ttl = t
+			}
+		}
+	}
+	// Look often enough to reannounce records between reannounceFraction and 90% of their TTL.
+	alarm := ttl / 10
 	if alarm == 0 {
 		alarm = 1
 	}
@@ -554,6 +1470,9 @@ func (s *MDNS) setAlarms() {
 		alarm = 3
 	}
 	s.cleanupAlarm = time.NewTicker(time.Duration(alarm) * time.Second)
+	if s.scanInterval > 0 {
+		s.scanAlarm = time.NewTicker(s.scanInterval)
+	}
 }
 
 func (s *MDNS) stopAlarms() {
@@ -563,8 +1482,22 @@ func (s *MDNS) stopAlarms() {
 	if s.cleanupAlarm != nil {
 		s.cleanupAlarm.Stop()
 	}
+	if s.scanAlarm != nil {
+		s.scanAlarm.Stop()
+	}
+}
+
+// scanTick returns the channel the interface scan alarm ticks on, or nil if we aren't scanning.
+func (s *MDNS) scanTick() <-chan time.Time {
+	if s.scanAlarm == nil {
+		return nil
+	}
+	return s.scanAlarm.C
 }
 
+// The DNS-SD meta-query name used to enumerate service types (RFC 6763 section 9).
+const serviceTypesFQDN = "_services._dns-sd._udp.local."
+
 func serviceFQDN(service string) string {
 	if strings.HasSuffix(service, ".") {
 		return service
@@ -572,6 +1505,26 @@ func serviceFQDN(service string) string {
 	return "_" + service + "._tcp.local."
 }
 
+// checkServiceName makes sure a service name is either a single label, e.g., "http", or a domain name
+// starting with a service label and a protocol label, e.g., "_http._tcp.local." or, for a subtype,
+// "_printer._sub._http._tcp.local." (RFC 6763 section 7).
+func checkServiceName(service string) error {
+	if len(service) == 0 {
+		return fmt.Errorf("%w: service name cannot be null", ErrInvalidService)
+	}
+	if !strings.HasSuffix(service, ".") {
+		if strings.Contains(service, ".") || strings.HasPrefix(service, "_") || len(service) > 63 {
+			return fmt.Errorf("%w: service name %q should be a single label like \"http\" or a domain name like \"_http._tcp.local.\"", ErrInvalidService, service)
+		}
+		return nil
+	}
+	labels := strings.Split(baseServiceFQDN(service), ".")
+	if len(labels) < 4 || len(labels[0]) < 2 || labels[0][0] != '_' || (labels[1] != "_tcp" && labels[1] != "_udp") {
+		return fmt.Errorf("%w: service name %q doesn't start with _<service>._tcp or _<service>._udp", ErrInvalidService, service)
+	}
+	return nil
+}
+
 func instanceFQDN(instance, service string) string {
 	if strings.HasSuffix(instance, ".") {
 		return instance
@@ -579,8 +1532,25 @@ func instanceFQDN(instance, service string) string {
 	return instance + "." + serviceFQDN(service)
 }
 
+// SubtypeService returns the name of a subtype of a service (RFC 6763 section 7.1), e.g.,
+// "_printer._sub._http._tcp.local." for subtype "printer" of service "http".  It can be passed to
+// any of the routines that browse for a service to find only the instances with that subtype.
+func SubtypeService(subtype, service string) string {
+	return "_" + subtype + "._sub." + serviceFQDN(service)
+}
+
+// baseServiceFQDN returns the FQDN of the service a subtype belongs to or, for anything else, the
+// service's own FQDN.
+func baseServiceFQDN(service string) string {
+	dn := serviceFQDN(service)
+	if i := strings.Index(dn, "._sub."); i >= 0 {
+		return dn[i+len("._sub."):]
+	}
+	return dn
+}
+
 func instanceUnqualify(instance, service string) string {
-	return strings.TrimSuffix(instance, "."+serviceFQDN(service))
+	return strings.TrimSuffix(instance, "."+baseServiceFQDN(service))
 }
 
 func hostFQDN(host string) string {
@@ -607,52 +1577,108 @@ func serviceFQDNFromInstanceFQDN(instance string) string {
 	return pieces[1]
 }
 
-func (s *MDNS) answerA(m *msgFromNet, q dns.Question, msg *dns.Msg) {
+// answerAddress appends our addresses of type rrtype, A or AAAA, for the host q asks about, if it is
+// one of ours, along with the NSEC saying which address types it has.
+func (s *MDNS) answerAddress(m *msgFromNet, q dns.Question, msg *dns.Msg, rrtype uint16) {
+	answer := func(host string) {
+		m.mifc.appendHostAddresses(msg, host, int(rrtype), s.ttl)
+		m.mifc.appendHostNsec(msg, host, rrtype, s.ttl)
+	}
 	if q.Name == hostFQDN(s.hostName) {
-		m.mifc.appendHostAddresses(msg, s.hostName, dns.TypeA, s.ttl)
+		answer(s.hostName)
 		return
 	}
+	for host := range s.hosts {
+		if q.Name == hostFQDN(host) {
+			answer(host)
+			return
+		}
+	}
 	for _, set := range s.services {
 		for _, req := range set {
 			if q.Name == hostFQDN(req.host) && req.port > 0 {
-				m.mifc.appendHostAddresses(msg, req.host, dns.TypeA, s.ttl)
+				answer(req.host)
 				return
 			}
 		}
 	}
 }
 
-func (s *MDNS) answerAAAA(m *msgFromNet, q dns.Question, msg *dns.Msg) {
-	if q.Name == hostFQDN(s.hostName) {
-		m.mifc.appendHostAddresses(msg, s.hostName, dns.TypeAAAA, s.ttl)
-		return
+// answerReverse answers a PTR question for an in-addr.arpa. or ip6.arpa. name if the address is one of
+// the hosts we announce.
+func (s *MDNS) answerReverse(m *msgFromNet, q dns.Question, msg *dns.Msg) {
+	hosts := make(map[string]bool)
+	if s.hostName != "" {
+		hosts[s.hostName] = true
+	}
+	for host := range s.hosts {
+		hosts[host] = true
 	}
 	for _, set := range s.services {
 		for _, req := range set {
-			if q.Name == hostFQDN(req.host) && req.port > 0 {
-				m.mifc.appendHostAddresses(msg, req.host, dns.TypeAAAA, s.ttl)
-				return
+			if req.port > 0 {
+				hosts[req.host] = true
+			}
+		}
+	}
+	for host := range hosts {
+		for _, ip := range m.mifc.hostIPs(host) {
+			if arpa, err := dns.ReverseAddr(ip.String()); err == nil && arpa == q.Name {
+				msg.Answer = append(msg.Answer, NewPtrRR(q.Name, cacheFlushBit|dns.ClassINET, s.ttl, hostFQDN(host)))
 			}
 		}
 	}
 }
 
 func (s *MDNS) answerPTR(m *msgFromNet, q dns.Question, msg *dns.Msg) {
+	if strings.HasSuffix(q.Name, ".in-addr.arpa.") || strings.HasSuffix(q.Name, ".ip6.arpa.") {
+		s.answerReverse(m, q, msg)
+		return
+	}
+	if q.Name == serviceTypesFQDN {
+		for service := range s.services {
+			msg.Answer = append(msg.Answer, NewPtrRR(serviceTypesFQDN, dns.ClassINET, s.ttl, serviceFQDN(service)))
+		}
+		return
+	}
 	for service, set := range s.services {
 		if q.Name == serviceFQDN(service) {
 			for _, req := range set {
-				m.mifc.appendDiscoveryRecords(msg, service, req.host, req.port, req.txt, s.ttl)
+				// If the querier already knows about this instance, don't tell it again.
+				ttl := s.serviceTTL(req)
+				if s.isKnownAnswer(m, NewPtrRR(q.Name, dns.ClassINET, ttl, instanceFQDN(req.instance, service))) {
+					continue
+				}
+				m.mifc.appendDiscoveryRecords(msg, service, req.instance, req.host, req.port, req.txt, req.subtypes, ttl)
 			}
 			return
 		}
+		for _, req := range set {
+			for _, subtype := range req.subtypes {
+				if q.Name != SubtypeService(subtype, service) {
+					continue
+				}
+				ttl := s.serviceTTL(req)
+				ptr := NewPtrRR(q.Name, dns.ClassINET, ttl, instanceFQDN(req.instance, service))
+				if s.isKnownAnswer(m, ptr) {
+					continue
+				}
+				msg.Answer = append(msg.Answer, ptr)
+				m.mifc.appendTxtRR(msg, service, req.instance, req.txt, ttl)
+				m.mifc.appendSrvRR(msg, service, req.instance, req.host, req.port, ttl)
+				if req.port > 0 {
+					m.mifc.appendHostAddresses(msg, req.host, dns.TypeALL, s.ttl)
+				}
+			}
+		}
 	}
 }
 
 func (s *MDNS) answerSRV(m *msgFromNet, q dns.Question, msg *dns.Msg) {
 	for service, set := range s.services {
 		for _, req := range set {
-			if q.Name == instanceFQDN(req.host, service) {
-				m.mifc.appendSrvRR(msg, service, req.host, req.port, s.ttl)
+			if q.Name == instanceFQDN(req.instance, service) {
+				m.mifc.appendSrvRR(msg, service, req.instance, req.host, req.port, s.serviceTTL(req))
 				if req.port > 0 {
 					m.mifc.appendHostAddresses(msg, req.host, dns.TypeALL, s.ttl)
 				}
@@ -664,207 +1690,1493 @@ func (s *MDNS) answerSRV(m *msgFromNet, q dns.Question, msg *dns.Msg) {
 func (s *MDNS) answerTXT(m *msgFromNet, q dns.Question, msg *dns.Msg) {
 	for service, set := range s.services {
 		for _, req := range set {
-			if q.Name == instanceFQDN(req.host, service) {
-				m.mifc.appendTxtRR(msg, service, req.host, req.txt, s.ttl)
+			if q.Name == instanceFQDN(req.instance, service) {
+				m.mifc.appendTxtRR(msg, service, req.instance, req.txt, s.serviceTTL(req))
 			}
 		}
 	}
 }
 
-// Answer a question received from the network if it is for our host address or a service we know about.
+// isKnownAnswer returns true if rr is among the answers included in a question and they have at least
+// half of rr's TTL remaining (RFC 6762 section 7.1).
+func (s *MDNS) isKnownAnswer(m *msgFromNet, rr dns.RR) bool {
+	for _, known := range m.msg.Answer {
+		if known.Header().Name == rr.Header().Name && known.Header().Ttl >= rr.Header().Ttl/2 && sameRRData(known, rr) {
+			return true
+		}
+	}
+	return false
+}
+
+// How recently we must have multicast a record to answer a question with the QU bit for it by unicast,
+// as a fraction of its TTL (RFC 6762 section 5.4).
+const unicastFraction = 0.25
+
+// Answer the questions received from the network that are for our host address or a service we know
+// about.  Those with the QU bit set asked for a unicast response, the rest for a multicast one (RFC 6762
+// section 5.4).  Even when asked for a unicast response we multicast the records we haven't multicast
+// within a quarter of their TTL, so that everyone's caches stay fresh.
 func (s *MDNS) answerQuestionFromNet(m *msgFromNet) {
 	msg := newDnsMsg(0, true, true)
+	umsg := newDnsMsg(0, true, true)
 	for _, q := range m.msg.Question {
-		switch q.Qtype {
-		case dns.TypeA:
-			s.answerA(m, q, msg)
-		case dns.TypeAAAA:
-			s.answerAAAA(m, q, msg)
-		case dns.TypePTR:
-			s.answerPTR(m, q, msg)
-		case dns.TypeSRV:
-			s.answerSRV(m, q, msg)
-		case dns.TypeTXT:
-			s.answerTXT(m, q, msg)
-		case dns.TypeALL:
-			s.answerA(m, q, msg)
-			s.answerAAAA(m, q, msg)
-			s.answerPTR(m, q, msg)
-			s.answerSRV(m, q, msg)
-			s.answerTXT(m, q, msg)
+		if q.Qclass&unicastResponseBit != 0 && m.sender != nil {
+			s.answerQuestion(m, q, umsg)
+		} else {
+			s.answerQuestion(m, q, msg)
 		}
 	}
-	if len(msg.Answer) > 0 {
+	s.dropKnownAnswers(m, msg)
+	s.dropKnownAnswers(m, umsg)
+	answers := umsg.Answer[:0]
+	for _, rr := range umsg.Answer {
+		if m.mifc.cache.MulticastRecently(rr, unicastFraction) {
+			answers = append(answers, rr)
+		} else if !givesAnswer(msg.Answer, rr) {
+			msg.Answer = append(msg.Answer, rr)
+		}
+	}
+	umsg.Answer = answers
+	if len(umsg.Answer) == 0 {
+		msg.Extra = append(msg.Extra, umsg.Extra...)
+		umsg.Extra = nil
+	}
+
+	answered := false
+	if len(umsg.Answer) > 0 {
+		m.mifc.sendMessageTo(umsg, m.sender)
+		answered = true
+	}
+	if len(msg.Answer) == 0 && len(msg.Extra) == 0 {
+		if answered {
+			s.queriesAnswered.Add(1)
+		}
+		return
+	}
+	if hasSharedRR(msg) {
+		// Others may answer too so wait a bit to avoid answering all at once (RFC 6762 section 6).
+		d := &delayedResponse{m.mifc, msg}
+		s.pending = append(s.pending, d)
+		time.AfterFunc(randomDelay(), func() {
+			select {
+			case s.delayed <- d:
+			case <-s.quit:
+			}
+		})
+	} else {
 		m.mifc.sendMessage(msg)
 	}
+	s.queriesAnswered.Add(1)
+}
+
+// answerQuestion appends our answers to q to msg.
+func (s *MDNS) answerQuestion(m *msgFromNet, q dns.Question, msg *dns.Msg) {
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		s.answerAddress(m, q, msg, q.Qtype)
+	case dns.TypePTR:
+		s.answerPTR(m, q, msg)
+	case dns.TypeSRV:
+		s.answerSRV(m, q, msg)
+	case dns.TypeTXT:
+		s.answerTXT(m, q, msg)
+	case dns.TypeALL:
+		s.answerAddress(m, q, msg, dns.TypeA)
+		s.answerAddress(m, q, msg, dns.TypeAAAA)
+		s.answerPTR(m, q, msg)
+		s.answerSRV(m, q, msg)
+		s.answerTXT(m, q, msg)
+	}
+}
+
+// dropKnownAnswers removes from msg anything the querier already knows.
+func (s *MDNS) dropKnownAnswers(m *msgFromNet, msg *dns.Msg) {
+	if len(m.msg.Answer) == 0 {
+		return
+	}
+	answers := msg.Answer[:0]
+	for _, rr := range msg.Answer {
+		if !s.isKnownAnswer(m, rr) {
+			answers = append(answers, rr)
+		}
+	}
+	msg.Answer = answers
+}
+
+// suppressDuplicates drops from our delayed responses on m's interface any answers m already gives with
+// at least half our TTL, so that the network doesn't hear them twice (RFC 6762 section 7.4).  Called
+// only from the main loop.
+func (s *MDNS) suppressDuplicates(m *msgFromNet) {
+	for _, d := range s.pending {
+		if d.mifc != m.mifc {
+			continue
+		}
+		answers := d.msg.Answer[:0]
+		for _, rr := range d.msg.Answer {
+			if !givesAnswer(m.msg.Answer, rr) {
+				answers = append(answers, rr)
+			} else if s.logLevel >= 2 {
+				s.logger.Printf("%s: %s already answered with %v\n", s.hostName, m.sender, rr)
+			}
+		}
+		d.msg.Answer = answers
+	}
+}
+
+// givesAnswer returns true if one of answers is rr with at least half its TTL.
+func givesAnswer(answers []dns.RR, rr dns.RR) bool {
+	h := rr.Header()
+	for _, a := range answers {
+		ah := a.Header()
+		if strings.EqualFold(ah.Name, h.Name) && ah.Rrtype == h.Rrtype && rrClass(a) == rrClass(rr) &&
+			ah.Ttl >= h.Ttl/2 && sameRRData(a, rr) {
+			return true
+		}
+	}
+	return false
+}
+
+// The range of the random delays before multicast responses with shared RRs and before the first
+// query for a service (RFC 6762 sections 5.2 and 6).
+const (
+	minRandomDelay = 20 * time.Millisecond
+	maxRandomDelay = 120 * time.Millisecond
+)
+
+// randomDelay returns a delay chosen uniformly from minRandomDelay to maxRandomDelay.
+func randomDelay() time.Duration {
+	return minRandomDelay + time.Duration(rand.Int63n(int64(maxRandomDelay-minRandomDelay)+1))
+}
+
+// hasSharedRR returns true if msg answers with any RRs, e.g., PTRs, that others may also be answering
+// with, i.e., without the cache flush bit.
+func hasSharedRR(msg *dns.Msg) bool {
+	for _, rr := range msg.Answer {
+		if rr.Header().Class&cacheFlushBit == 0 {
+			return true
+		}
+	}
+	return false
 }
 
 // refresh reannounces all services.  We need to do this before the TTLs run out.
 // As a side effect this reannounces the host address RRs.
 func (s *MDNS) refresh() {
+	for _, mifc := range s.mifcs {
+		s.refreshIfc(mifc)
+	}
+}
+
+// refreshIfc reannounces all services, or just the host if there are none, on one interface.
+func (s *MDNS) refreshIfc(mifc *multicastIfc) {
 	if len(s.services) > 0 {
-		for service, set := range s.services {
+		var reqs []announceRequest
+		for _, set := range s.services {
 			for _, req := range set {
-				for _, mifc := range s.mifcs {
-					mifc.announceService(service, req.host, req.port, req.txt, s.ttl)
-				}
+				reqs = append(reqs, req)
 			}
 		}
+		mifc.announceServices(reqs)
 	} else if len(s.hostName) > 0 {
-		for _, mifc := range s.mifcs {
-			mifc.announceHost(s.hostName, s.ttl)
-		}
+		mifc.announceHost(s.hostName, s.ttl)
+	}
+	for host := range s.hosts {
+		mifc.announceHost(host, s.ttl)
 	}
 }
 
-// Main loop, acts on incoming messages and resolution requests and announcements.  We do pretty much everything
-// in this loop to sequentialize all structure access.
-func (s *MDNS) mainLoop() {
-	for s.run() {
-		select {
-		case m := <-s.fromNet:
-			if m.msg.Response {
-				// Cache the information.
-				if s.logLevel >= 2 {
-					log.Printf("%s: response %v\n", s.hostName, m.msg)
-				}
-				if s.isDoppelGanger(m.msg.Answer) {
-					if s.logLevel >= 1 {
-						log.Printf("%s: name collision, %s also claims to be %s\n", s.hostName, m.sender, s.hostFQDN)
-					}
-					continue
+// How far into their TTL we reannounce our records if we haven't multicast them since (RFC 6762
+// section 5.2 has queriers ask again from 80% on).
+const reannounceFraction = 0.8
+
+// refreshDue reannounces, on each interface, the services and hosts with records we haven't multicast
+// within reannounceFraction of their TTL.  Each record's TTL sets when it is due so long-lived services
+// aren't announced as often as the host addresses.  Called only from the main loop.
+func (s *MDNS) refreshDue() {
+	for _, mifc := range s.mifcs {
+		var reqs []announceRequest
+		hosts := make(map[string]bool)
+		if len(s.hostName) > 0 {
+			hosts[s.hostName] = true
+		}
+		for host := range s.hosts {
+			hosts[host] = true
+		}
+		for _, set := range s.services {
+			for _, req := range set {
+				if req.port > 0 {
+					hosts[req.host] = true
 				}
-				for _, rr := range m.msg.Answer {
-					if m.mifc.cache.Add(rr) {
-						s.changedRR(rr)
+				// The host's addresses are checked on their own.
+				msg := newDnsMsg(0, true, true)
+				mifc.appendDiscoveryRecords(msg, req.service, req.instance, req.host, req.port, req.txt, req.subtypes, s.serviceTTL(req))
+				var rrs []dns.RR
+				for _, rr := range msg.Answer {
+					if t := rr.Header().Rrtype; t != dns.TypeA && t != dns.TypeAAAA {
+						rrs = append(rrs, rr)
 					}
 				}
-			} else {
-				// Answer the question (only if we have a host name)
-				if s.hostName == "" {
-					break
-				}
-				if s.logLevel >= 2 {
-					log.Printf("%s: question %v\n", s.hostName, m.msg)
+				if mifc.stale(rrs) {
+					reqs = append(reqs, req)
 				}
-				s.answerQuestionFromNet(m)
-			}
-		case req := <-s.announce:
-			// Adding a service
-			set := s.services[req.service]
-			if set == nil {
-				set = make(map[string]announceRequest)
-				s.services[req.service] = set
-			}
-			set[hostport(req.host, req.port)] = req
-			if s.logLevel >= 1 {
-				log.Printf("adding service %s %s %d\n", req.service, req.host, req.port)
-			}
-
-			// Tell all the networks about the name
-			for _, mifc := range s.mifcs {
-				mifc.announceService(req.service, req.host, req.port, req.txt, s.ttl)
-			}
-		case req := <-s.goodbye:
-			// Removing a service
-			set := s.services[req.service]
-			if set != nil {
-				delete(set, hostport(req.host, req.port))
-			}
-			if len(set) == 0 {
-				delete(s.services, req.service)
 			}
-			if s.logLevel >= 1 {
-				log.Printf("removing service %s %s %d\n", req.service, req.host, req.port)
+		}
+		if len(reqs) > 0 {
+			mifc.announceServices(reqs)
+		}
+		for host := range hosts {
+			msg := newDnsMsg(0, true, true)
+			mifc.appendHostAddresses(msg, host, dns.TypeALL, s.ttl)
+			if mifc.stale(msg.Answer) {
+				mifc.announceHost(host, s.ttl)
 			}
+		}
+	}
+}
 
-			// Tell all the networks about the goodbye
-			for _, mifc := range s.mifcs {
-				mifc.announceService(req.service, req.host, req.port, req.txt, 0)
-			}
-		case req := <-s.lookup:
-			// Reply with all matching requests from all interfaces and then close the channel.
-			for _, mifc := range s.mifcs {
-				mifc.cache.Lookup(req.name, req.rrtype, req.rc)
-			}
-			close(req.rc)
-		case req := <-s.update:
-			if len(req.host) > 0 {
-				s.hostName = req.host
-				s.hostFQDN = hostFQDN(s.hostName)
-				s.refresh()
-			}
-			if req.ttl > 0 && req.ttl != s.ttl {
-				s.ttl = req.ttl
-				s.setAlarms()
-			}
-			if req.done != nil {
-				close(req.done)
+// conflicts returns which of the names we need to announce a service instance the cache shows someone else
+// using.  Our own host name is never in conflict.
+func (s *MDNS) conflicts(service, instance, host string, port uint16) nameConflict {
+	var c nameConflict
+	ports := map[uint16]bool{port: true}
+	for _, req := range s.services[service] {
+		if req.instance == instance {
+			ports[req.port] = true
+		}
+	}
+	var ips []net.IP
+	for _, mifc := range s.mifcs {
+		for _, rr := range mifc.cache.Records(instanceFQDN(instance, service), dns.TypeSRV) {
+			if rr, ok := rr.(*dns.RR_SRV); ok && (rr.Target != hostFQDN(host) || !ports[rr.Port]) {
+				c.instance = true
 			}
-		case <-s.refreshAlarm.C:
-			s.refresh()
-		case <-s.cleanupAlarm.C:
-			for _, mifc := range s.mifcs {
-				rrs := mifc.cache.CleanExpired()
-				for _, rr := range rrs {
-					s.changedRR(rr)
-				}
+		}
+		if host == s.hostName {
+			// We already made sure our host name was ours in NewMDNS.
+			continue
+		}
+		for _, rr := range mifc.cache.Records(hostFQDN(host), dns.TypeALL) {
+			switch rr := rr.(type) {
+			case *dns.RR_A:
+				ips = append(ips, AtoIP(rr))
+			case *dns.RR_AAAA:
+				ips = append(ips, AAAAtoIP(rr))
 			}
 		}
 	}
+	c.host = !s.ipsAreAllMine(ips)
+	return c
 }
 
-// Stop all udpListeners.
-func (s *MDNS) Stop() {
-	s.doneLock.Lock()
-	s.done = true
-	s.doneLock.Unlock()
-	s.update <- updateRequest{}
-	s.stopAlarms()
-	for _, mifc := range s.mifcs {
-		mifc.conn.Close()
+// sameAnnouncement returns true if announcing b would send the same records as announcing a.
+func sameAnnouncement(a, b announceRequest) bool {
+	equal := func(x, y []string) bool {
+		if len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if x[i] != y[i] {
+				return false
+			}
+		}
+		return true
 	}
+	return a.service == b.service && a.instance == b.instance && a.host == b.host && a.port == b.port && a.ttl == b.ttl &&
+		equal(a.txt, b.txt) && equal(a.subtypes, b.subtypes)
 }
 
-func (s *MDNS) run() bool {
-	s.doneLock.Lock()
-	defer s.doneLock.Unlock()
-	return !s.done
+// isRegistered returns true if we are already announcing the service instance.
+func (s *MDNS) isRegistered(service, instance string, port uint16) bool {
+	req := conflictRequest{announceRequest{service, instance, instance, port, nil, nil, 0}, make(chan bool)}
+	select {
+	case s.registered <- req:
+		return <-req.rc
+	case <-s.quit:
+		return false
+	}
 }
 
-// Announce a service.  If the host name is empty, we just use the host name from NewMDNS.  If the host name ends in .local. we strip it off.
-// If the port is zero, we do not announce the host addresses.
+// probe asks the networks three times, 250 ms apart, whether anyone else is using the names needed to
+// announce a service instance (RFC 6762 section 8.1).  It returns which of them are.
+func (s *MDNS) probe(service, instance, host string, port uint16) nameConflict {
+	dn := instanceFQDN(instance, service)
+	q := []dns.Question{{dn, dns.TypeALL, dns.ClassINET}}
+	if host != s.hostName {
+		q = append(q, dns.Question{hostFQDN(host), dns.TypeALL, dns.ClassINET})
+	}
+	proposed := []dns.RR{NewSrvRR(dn, dns.ClassINET, s.ttl, hostFQDN(host), port, 0, 0)}
+	for i := 0; i < 3; i++ {
+		s.mifcsLock.RLock()
+		for _, mifc := range s.mifcs {
+			mifc.sendProbe(q, proposed)
+		}
+		s.mifcsLock.RUnlock()
+		time.Sleep(250 * time.Millisecond)
+
+		req := probeRequest{announceRequest{service, instance, host, port, nil, nil, 0}, make(chan nameConflict)}
+		select {
+		case s.conflict <- req:
+		case <-s.quit:
+			return nameConflict{}
+		}
+		if c := <-req.rc; c.instance || c.host {
+			if s.logLevel >= 1 {
+				s.logger.Printf("%s: name conflict for service %s instance %s host %s: %+v\n", s.hostName, service, instance, host, c)
+			}
+			return c
+		}
+	}
+	return nameConflict{}
+}
+
+// How long to wait before each repeat of an announcement (RFC 6762 section 8.3).
+var announceIntervals = []time.Duration{1 * time.Second, 2 * time.Second}
+
+// updateTxtAnnounce announces the changed TXT of a service instance, at once unless it was announced
+// less than txtDebounce ago.  Then the announcement waits for the end of the window, when it is made with
+// whatever the TXT is by then, so that a burst of updates causes one announcement of the final value.
+// Called only from the main loop.
+func (s *MDNS) updateTxtAnnounce(req announceRequest) {
+	key := req.service + " " + hostport(req.instance, req.port)
+	if s.txtPending[key] {
+		return
+	}
+	wait := s.txtDebounce - time.Since(s.txtAnnounced[key])
+	if s.txtDebounce == 0 || wait <= 0 {
+		s.announceTxt(key, req)
+		return
+	}
+	s.txtPending[key] = true
+	time.AfterFunc(wait, func() {
+		select {
+		case s.txtDue <- req:
+		case <-s.quit:
+		}
+	})
+}
+
+// announceTxt announces a service instance with its current TXT.  The TXT RRs have the cache flush bit
+// set so they replace the old ones.  Called only from the main loop.
+func (s *MDNS) announceTxt(key string, req announceRequest) {
+	s.txtAnnounced[key] = time.Now()
+	for _, mifc := range s.mifcs {
+		mifc.announceService(req.service, req.instance, req.host, req.port, req.txt, req.subtypes, s.serviceTTL(req))
+	}
+	go s.reannounce([]announceRequest{req})
+}
+
+// reannounce asks the main loop to repeat an announcement on schedule so that anyone who missed the
+// first one still learns of the services.  The main loop ignores the services that have been removed in
+// the meantime.
+func (s *MDNS) reannounce(reqs []announceRequest) {
+	for _, d := range announceIntervals {
+		select {
+		case <-time.After(d):
+		case <-s.quit:
+			return
+		}
+		select {
+		case s.retransmit <- reqs:
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// coalesce holds onto queries with the TC bit set and merges in the known answers of following queries
+// from the same sender (RFC 6762 section 7.2).  It returns the message to act on or nil if we are
+// still waiting for more.  TC means nothing in a response (section 18.5) so responses are acted on
+// at once and never merged into a query.  Called only from the main loop.
+func (s *MDNS) coalesce(m *msgFromNet) *msgFromNet {
+	if m.msg.Response {
+		return m
+	}
+	key := m.mifc.String() + " " + m.sender.String()
+	if p, ok := s.partial[key]; ok {
+		p.m.msg.Question = append(p.m.msg.Question, m.msg.Question...)
+		p.m.msg.Answer = append(p.m.msg.Answer, m.msg.Answer...)
+		p.m.msg.NS = append(p.m.msg.NS, m.msg.NS...)
+		p.m.msg.Extra = append(p.m.msg.Extra, m.msg.Extra...)
+		if m.msg.Truncated {
+			return nil
+		}
+		p.timer.Stop()
+		delete(s.partial, key)
+		p.m.msg.Truncated = false
+		return p.m
+	}
+	if !m.msg.Truncated {
+		return m
+	}
+	p := &partialMsg{key: key, m: m}
+	p.timer = time.AfterFunc(truncatedWait, func() {
+		select {
+		case s.partialDone <- p:
+		case <-s.quit:
+		}
+	})
+	s.partial[key] = p
+	return nil
+}
+
+// handleMsg acts on a message from the network.  Called only from the main loop.
+func (s *MDNS) handleMsg(m *msgFromNet) {
+	if m.msg.Response {
+		if s.duplicateSuppression {
+			s.suppressDuplicates(m)
+		}
+		// Cache the information.
+		if s.logLevel >= 2 {
+			s.logger.Printf("%s: response %v\n", s.hostName, m.msg)
+		}
+		if s.isDoppelGanger(m.msg.Answer) || s.isDoppelGanger(m.msg.Extra) {
+			if s.logLevel >= 1 {
+				s.logger.Printf("%s: name collision, %s also claims to be %s\n", s.hostName, m.sender, s.hostFQDN)
+			}
+			return
+		}
+		for _, rr := range m.msg.Answer {
+			if s.isEcho(m, rr) {
+				continue
+			}
+			if m.mifc.cache.AddFrom(rr, m.sender.IP) {
+				s.changedRR(rr)
+			}
+		}
+		// Records that came along with the answers, e.g., the addresses of an SRV target, save us
+		// asking for them later.
+		for _, section := range [][]dns.RR{m.msg.NS, m.msg.Extra} {
+			for _, rr := range section {
+				if s.isEcho(m, rr) {
+					continue
+				}
+				switch rr.(type) {
+				case *dns.RR_OPT:
+					// Says something about the message, not a name.
+				case *dns.RR_NSEC:
+					// Remember what doesn't exist so that we don't keep asking.
+					m.mifc.cache.AddExtraFrom(rr, m.sender.IP)
+				default:
+					if m.mifc.cache.AddExtraFrom(rr, m.sender.IP) {
+						s.changedRR(rr)
+					}
+				}
+			}
+		}
+	} else {
+		// Answer the question (only if we have a host name and aren't paused)
+		if s.hostName == "" || s.paused {
+			return
+		}
+		if s.logLevel >= 2 {
+			s.logger.Printf("%s: question %v\n", s.hostName, m.msg)
+		}
+		s.answerQuestionFromNet(m)
+	}
+}
+
+// isEcho returns true if rr is one of the records we are authoritative for, e.g., heard back from our own
+// announcement when we are also looking for the service.  We already know it better than the network
+// does so caching it again would only muddle who it came from and when it expires, and a goodbye for
+// it from someone else mustn't make it go away.  Called only from the main loop.
+func (s *MDNS) isEcho(m *msgFromNet, rr dns.RR) bool {
+	if !m.mifc.cache.IsOwn(rr) {
+		return false
+	}
+	if s.logLevel >= 2 {
+		s.logger.Printf("%s: ignoring our own %v from %s\n", s.hostName, rr, m.sender)
+	}
+	return true
+}
+
+// Main loop, acts on incoming messages and resolution requests and announcements.  We do pretty much everything
+// in this loop to sequentialize all structure access.  It runs until stop sends it an updateRequest with
+// stop set.
+func (s *MDNS) mainLoop() {
+	defer s.running.Done()
+	for {
+		select {
+		case m := <-s.fromNet:
+			if m = s.coalesce(m); m != nil {
+				s.handleMsg(m)
+			}
+		case p := <-s.partialDone:
+			// Waited long enough for the rest of a truncated message.
+			if s.partial[p.key] == p {
+				delete(s.partial, p.key)
+				s.handleMsg(p.m)
+			}
+		case reqs := <-s.announce:
+			// Adding services.  Adding one we already have with the same records does nothing.
+			var added []announceRequest
+			ttls := false
+			for _, req := range reqs {
+				set := s.services[req.service]
+				if set == nil {
+					set = make(map[string]announceRequest)
+					s.services[req.service] = set
+				}
+				if cur, ok := set[hostport(req.instance, req.port)]; ok && sameAnnouncement(cur, req) {
+					if s.logLevel >= 1 {
+						s.logger.Printf("already announcing service %s %s %d\n", req.service, req.instance, req.port)
+					}
+					continue
+				}
+				set[hostport(req.instance, req.port)] = req
+				if s.logLevel >= 1 {
+					s.logger.Printf("adding service %s %s %d\n", req.service, req.instance, req.port)
+				}
+				added = append(added, req)
+				ttls = ttls || req.ttl != 0
+			}
+			if len(added) == 0 {
+				break
+			}
+
+			// Tell all the networks about the names
+			for _, mifc := range s.mifcs {
+				mifc.announceServices(added)
+			}
+			go s.reannounce(added)
+			if ttls {
+				s.setAlarms()
+			}
+		case reqs := <-s.retransmit:
+			// Repeat announcements, with the current TXT, of the services we are still announcing.
+			var cur []announceRequest
+			for _, req := range reqs {
+				if c, ok := s.services[req.service][hostport(req.instance, req.port)]; ok {
+					cur = append(cur, c)
+				}
+			}
+			if len(cur) == 0 {
+				break
+			}
+			for _, mifc := range s.mifcs {
+				mifc.announceServices(cur)
+			}
+		case done := <-s.refreshAll:
+			s.announceAll()
+			close(done)
+		case req := <-s.goodbye:
+			// Removing a service.  Say goodbye for the subtypes it was added with.
+			set := s.services[req.service]
+			if cur, ok := set[hostport(req.instance, req.port)]; ok {
+				req.host = cur.host
+				req.subtypes = cur.subtypes
+				req.ttl = cur.ttl
+				delete(set, hostport(req.instance, req.port))
+				delete(s.txtAnnounced, req.service+" "+hostport(req.instance, req.port))
+			}
+			if len(set) == 0 {
+				delete(s.services, req.service)
+			}
+			if req.ttl != 0 {
+				s.setAlarms()
+			}
+			if s.logLevel >= 1 {
+				s.logger.Printf("removing service %s %s %d\n", req.service, req.instance, req.port)
+			}
+
+			// Tell all the networks about the goodbye
+			for _, mifc := range s.mifcs {
+				mifc.announceService(req.service, req.instance, req.host, req.port, req.txt, req.subtypes, 0)
+			}
+		case req := <-s.updateTxt:
+			// Changing the TXT records of a service we are already announcing.
+			set := s.services[req.service]
+			old, ok := set[hostport(req.instance, req.port)]
+			if !ok {
+				req.errc <- fmt.Errorf("%w: %s %s %d", ErrNotAnnounced, req.service, req.instance, req.port)
+				break
+			}
+			old.txt = req.txt
+			set[hostport(req.instance, req.port)] = old
+			if s.logLevel >= 1 {
+				s.logger.Printf("updating txt for service %s %s %d\n", req.service, req.instance, req.port)
+			}
+			s.updateTxtAnnounce(old)
+			req.errc <- nil
+		case req := <-s.txtDue:
+			// The end of a debounce window, announce the latest TXT if we still have the service.
+			key := req.service + " " + hostport(req.instance, req.port)
+			delete(s.txtPending, key)
+			if cur, ok := s.services[req.service][hostport(req.instance, req.port)]; ok {
+				s.announceTxt(key, cur)
+			}
+		case req := <-s.conflict:
+			req.rc <- s.conflicts(req.service, req.instance, req.host, req.port)
+		case req := <-s.registered:
+			_, ok := s.services[req.service][hostport(req.instance, req.port)]
+			req.rc <- ok
+		case q := <-s.query:
+			// Ask the networks, telling them what we already know.
+			for _, mifc := range s.mifcs {
+				mifc.sendQuestionWithKnownAnswers(q)
+			}
+		case rc := <-s.local:
+			rc <- s.localServices()
+		case req := <-s.sources:
+			req.rc <- s.instanceSources(req.name)
+		case req := <-s.ipAddrs:
+			addrs := s.cachedIPAddrs(req.name, req.rrtype)
+			s.countLookup(len(addrs))
+			req.rc <- addrs
+		case req := <-s.instances:
+			instances := s.cachedInstances(req.name, req.service)
+			s.countLookup(len(instances))
+			req.rc <- instances
+		case req := <-s.expiring:
+			expiring := false
+			for _, mifc := range s.mifcs {
+				if mifc.cache.Expiring(req.name, req.rrtype, refreshFraction) {
+					expiring = true
+				}
+			}
+			req.rc <- expiring
+		case rc := <-s.cacheStats:
+			cs := cacheStats{hits: s.cacheHits, misses: s.cacheMisses}
+			for _, mifc := range s.mifcs {
+				cs.size += mifc.cache.Size()
+			}
+			rc <- cs
+		case d := <-s.delayed:
+			for i, p := range s.pending {
+				if p == d {
+					s.pending = append(s.pending[:i], s.pending[i+1:]...)
+					break
+				}
+			}
+			// The interface may have gone away while we waited, and others may have given all
+			// the answers.
+			if d.mifc.run() && len(d.msg.Answer) > 0 {
+				d.mifc.sendMessage(d.msg)
+			}
+		case req := <-s.addHost:
+			if req.ips == nil {
+				if _, ok := s.hosts[req.host]; ok {
+					for _, mifc := range s.mifcs {
+						mifc.announceHost(req.host, 0)
+					}
+					delete(s.hosts, req.host)
+				}
+			} else {
+				s.hosts[req.host] = req.ips
+				for _, mifc := range s.mifcs {
+					mifc.announceHost(req.host, s.ttl)
+				}
+			}
+			close(req.done)
+		case req := <-s.flush:
+			s.flushCache(req.requery)
+			close(req.done)
+		case rc := <-s.dump:
+			var entries []CacheEntry
+			for _, mifc := range s.mifcs {
+				for _, e := range mifc.cache.Entries() {
+					e.Interface = mifc.String()
+					entries = append(entries, e)
+				}
+			}
+			rc <- entries
+		case rc := <-s.rcvBufs:
+			sizes := make(map[string]int)
+			for _, mifc := range s.mifcs {
+				sizes[mifc.String()] = mifc.rcvBuf
+			}
+			rc <- sizes
+		case req := <-s.lookup:
+			// Reply with all matching requests from all interfaces and then close the channel.
+			n := 0
+			for _, mifc := range s.mifcs {
+				n += mifc.cache.Lookup(req.name, req.rrtype, req.rc)
+			}
+			close(req.rc)
+			if req.count {
+				s.countLookup(n)
+			}
+		case req := <-s.update:
+			if req.stop {
+				close(req.done)
+				return
+			}
+			if len(req.host) > 0 {
+				s.hostName = req.host
+				s.hostFQDN = hostFQDN(s.hostName)
+				s.refresh()
+			}
+			if req.ttl > 0 && req.ttl != s.ttl {
+				s.ttl = req.ttl
+				s.setAlarms()
+			}
+			if req.goodbyes {
+				s.sayGoodbyes()
+			}
+			if req.done != nil {
+				close(req.done)
+			}
+		case req := <-s.pause:
+			switch {
+			case req.repeat:
+				// Unless we've been resumed since.
+				if s.paused {
+					s.sayGoodbyes()
+				}
+			case req.pause && !s.paused:
+				s.paused = true
+				s.sayGoodbyes()
+				time.AfterFunc(goodbyeInterval, func() {
+					select {
+					case s.pause <- pauseRequest{pause: true, repeat: true}:
+					case <-s.quit:
+					}
+				})
+			case !req.pause && s.paused:
+				s.paused = false
+				s.announceAll()
+			}
+			if req.done != nil {
+				close(req.done)
+			}
+		case <-s.refreshAlarm.C:
+			if !s.paused {
+				s.refreshDue()
+			}
+		case rc := <-s.scan:
+			highesthwaddr, err := s.rescan()
+			rc <- scanReply{highesthwaddr, err}
+		case <-s.scanTick():
+			s.rescan()
+		case <-s.cleanupAlarm.C:
+			for _, mifc := range s.mifcs {
+				rrs := mifc.cache.CleanExpired()
+				for _, rr := range rrs {
+					s.changedRR(rr)
+				}
+			}
+		}
+	}
+}
+
+// announceAll announces everything again, repeating on schedule as for new services.  Called only from
+// the main loop.
+func (s *MDNS) announceAll() {
+	s.refresh()
+	var reqs []announceRequest
+	for _, set := range s.services {
+		for _, req := range set {
+			reqs = append(reqs, req)
+		}
+	}
+	if len(reqs) > 0 {
+		go s.reannounce(reqs)
+	}
+}
+
+// sayGoodbyes says goodbye for all our services and hosts on every interface.  Called only from the
+// main loop.
+func (s *MDNS) sayGoodbyes() {
+	for _, set := range s.services {
+		for _, a := range set {
+			for _, mifc := range s.mifcs {
+				mifc.announceService(a.service, a.instance, a.host, a.port, a.txt, a.subtypes, 0)
+			}
+		}
+	}
+	for host := range s.hosts {
+		for _, mifc := range s.mifcs {
+			mifc.announceHost(host, 0)
+		}
+	}
+}
+
+// How long Stop waits before repeating its goodbyes (RFC 6762 section 10.1).
+const goodbyeInterval = 250 * time.Millisecond
+
+// Stop all udpListeners.  Before closing the connections, we say goodbye for all our services, twice,
+// so that others don't keep stale entries around until they time out.  Stop returns once the main loop
+// and the udpListeners have exited.  It may be called more than once and from several goroutines at a
+// time; all but the first call just wait for the first to finish.  Calls that need the main loop fail with
+// ErrClosed once Stop has been called.
+func (s *MDNS) Stop() {
+	s.stopOnce.Do(s.stop)
+}
+
+func (s *MDNS) stop() {
+	close(s.quit)
+	for i := 0; i < 2; i++ {
+		if i != 0 {
+			time.Sleep(goodbyeInterval)
+		}
+		req := updateRequest{done: make(chan struct{}), goodbyes: true}
+		s.update <- req
+		<-req.done
+	}
+	s.doneLock.Lock()
+	s.done = true
+	s.doneLock.Unlock()
+	req := updateRequest{done: make(chan struct{}), stop: true}
+	s.update <- req
+	<-req.done
+	s.stopAlarms()
+	s.mifcsLock.RLock()
+	for _, mifc := range s.mifcs {
+		mifc.conn.Close()
+		if mifc.sendConn != nil {
+			mifc.sendConn.Close()
+		}
+	}
+	s.mifcsLock.RUnlock()
+	s.running.Wait()
+}
+
+// NewStandardMDNS is NewMDNS on the standard mdns groups, DefaultIPv4Addr and DefaultIPv6Addr.  If debug
+// is set we log at level 1.
+func NewStandardMDNS(host string, loopback, debug bool, opts ...Option) (*MDNS, error) {
+	return NewMDNS(host, DefaultIPv4Addr, DefaultIPv6Addr, loopback, boolint(debug), opts...)
+}
+
+// DiscoverOnce is for programs that want to look up a service once without keeping an MDNS around.  It
+// starts one without announcing a host, asks the networks for the instances of service the way
+// ServiceDiscoveryTimeout does, and stops it, closing its sockets and waiting for its goroutines, before
+// returning.  Any options are passed to NewMDNS.
+func DiscoverOnce(service string, timeout time.Duration, opts ...Option) ([]ServiceInstance, error) {
+	if err := checkServiceName(service); err != nil {
+		return nil, err
+	}
+	s, err := NewMDNS("", "", "", false, 0, append([]Option{InterfaceScanInterval(0)}, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Stop()
+	return s.ServiceDiscoveryTimeout(service, timeout), nil
+}
+
+// MDNSStats is a snapshot of an MDNS's counters.
+type MDNSStats struct {
+	PacketsSent     uint64 // messages successfully written to the networks
+	PacketsReceived uint64 // messages read from the networks
+	ParseFailures   uint64 // received messages that couldn't be unpacked
+	QueriesAnswered uint64 // questions from the networks that we sent answers to
+	CacheSize       int    // records cached over all interfaces
+
+	// Cache lookups made for callers, e.g., by ResolveRR or ServiceDiscovery, that found records
+	// on any interface and those that found none, e.g., so that a question had to be asked.  Each
+	// lookup counts once however many interfaces there are.
+	CacheHits   uint64
+	CacheMisses uint64
+}
+
+// The cache's part of MDNSStats, its size summed over the interfaces.
+type cacheStats struct {
+	size   int
+	hits   uint64
+	misses uint64
+}
+
+// countLookup counts a lookup for a caller that found n things as a cache hit or miss.  Called only from
+// the main loop.
+func (s *MDNS) countLookup(n int) {
+	if n > 0 {
+		s.cacheHits++
+	} else {
+		s.cacheMisses++
+	}
+}
+
+// Stats returns the current values of the counters.  After Stop, the cache counts are zero.
+func (s *MDNS) Stats() MDNSStats {
+	stats := MDNSStats{
+		PacketsSent:     s.packetsSent.Load(),
+		PacketsReceived: s.packetsReceived.Load(),
+		ParseFailures:   s.parseFailures.Load(),
+		QueriesAnswered: s.queriesAnswered.Load(),
+	}
+	rc := make(chan cacheStats, 1)
+	select {
+	case s.cacheStats <- rc:
+		cs := <-rc
+		stats.CacheSize, stats.CacheHits, stats.CacheMisses = cs.size, cs.hits, cs.misses
+	case <-s.quit:
+	}
+	return stats
+}
+
+// CacheEntry is a snapshot of one cached record, see DumpCache.
+type CacheEntry struct {
+	Interface string    // the multicast interface whose cache holds the record
+	Record    dns.RR    // a copy of the record with its TTL set to the time remaining
+	Expires   time.Time // when the record will be dropped unless refreshed
+	Added     time.Time // when the record was last added or refreshed
+	TTL       uint32    // the record's TTL when it was added, at most 4500; Record's is what's left of it
+	Own       bool      // one of the records we are announcing, i.e., we are authoritative for it
+	Sender    net.IP    // who sent us the record, nil if we don't know
+
+	// The record only came along with answers, in the authority or additional section, e.g., the
+	// address of an SRV target, rather than as an answer itself.
+	Additional bool
+}
+
+// flushCache drops everything learned from the networks, telling watchers, and forgets which questions
+// were asked recently.  If requery is set, the subscribed services are asked for again.  Called only from
+// the main loop.
+func (s *MDNS) flushCache(requery bool) {
+	for _, mifc := range s.mifcs {
+		for _, rr := range mifc.cache.Flush() {
+			s.changedRR(rr)
+		}
+		mifc.askedLock.Lock()
+		mifc.asked = make(map[dns.Question]time.Time)
+		mifc.askedLock.Unlock()
+	}
+	if !requery {
+		return
+	}
+	var q []dns.Question
+	s.watchedLock.RLock()
+	for sdn := range s.subscribed {
+		q = append(q, dns.Question{sdn, dns.TypePTR, s.qclass()})
+	}
+	s.watchedLock.RUnlock()
+	if q == nil {
+		return
+	}
+	for _, mifc := range s.mifcs {
+		mifc.sendQuestion(q)
+	}
+}
+
+// Announce multicasts all of our records again on every interface, e.g., when we know the network was
+// disrupted and others may have forgotten us, without touching the services.  As when a service is added,
+// the announcement is repeated in case the first is lost.  Services are packed as many to a message as
+// fit.  It returns once the first announcement has been sent.
+func (s *MDNS) Announce() {
+	done := make(chan struct{})
+	select {
+	case s.refreshAll <- done:
+		<-done
+	case <-s.quit:
+	}
+}
+
+// Pause stops announcing us without stopping the MDNS, e.g., for a maintenance window.  It says goodbye
+// for all our services and hosts, repeating it shortly in case it is lost, and until Resume sends no
+// announcements and answers no questions.  Services and hosts may still be added and removed while
+// paused; they are announced on Resume.  Subscriptions, watchers and the cache carry on as usual so
+// nothing needs rediscovering afterwards.  Pausing when already paused does nothing.
+func (s *MDNS) Pause() {
+	s.setPaused(true)
+}
+
+// Resume undoes Pause, announcing all our services and hosts again, repeated on schedule as for new
+// services, and answering questions again.  Resuming when not paused does nothing.
+func (s *MDNS) Resume() {
+	s.setPaused(false)
+}
+
+func (s *MDNS) setPaused(pause bool) {
+	req := pauseRequest{pause: pause, done: make(chan struct{})}
+	select {
+	case s.pause <- req:
+		<-req.done
+	case <-s.quit:
+	}
+}
+
+// FlushCache forgets all the records learned from the networks, e.g., after moving to another network
+// where they are surely stale.  The records we announce ourselves are kept.  If requery is set, the
+// services we are subscribed to are asked for again so that their instances are rediscovered.
+func (s *MDNS) FlushCache(requery bool) {
+	req := flushRequest{requery, make(chan struct{})}
+	select {
+	case s.flush <- req:
+		<-req.done
+	case <-s.quit:
+	}
+}
+
+// DumpCache returns a copy of everything cached on all interfaces, sorted by interface, name and type.
+// It is meant for debugging.  After Stop it returns nil.
+func (s *MDNS) DumpCache() []CacheEntry {
+	rc := make(chan []CacheEntry, 1)
+	var entries []CacheEntry
+	select {
+	case s.dump <- rc:
+		entries = <-rc
+	case <-s.quit:
+		return nil
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.Interface != b.Interface {
+			return a.Interface < b.Interface
+		}
+		if a.Record.Header().Name != b.Record.Header().Name {
+			return a.Record.Header().Name < b.Record.Header().Name
+		}
+		return a.Record.Header().Rrtype < b.Record.Header().Rrtype
+	})
+	return entries
+}
+
+// Interfaces returns the interfaces we are listening on, sorted, named as in DumpCache.  Those we
+// couldn't listen on, see InterfaceErrors, are left out.  After Stop it returns nil.
+func (s *MDNS) Interfaces() []string {
+	select {
+	case <-s.quit:
+		return nil
+	default:
+	}
+	s.mifcsLock.RLock()
+	defer s.mifcsLock.RUnlock()
+	names := make([]string, 0, len(s.mifcs))
+	for _, mifc := range s.mifcs {
+		names = append(names, mifc.String())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// InterfaceErrors returns why we couldn't listen on the interfaces that failed the last scan, keyed
+// by the names Interfaces would have given them.  It is empty if none failed and nil after Stop.
+func (s *MDNS) InterfaceErrors() map[string]error {
+	select {
+	case <-s.quit:
+		return nil
+	default:
+	}
+	s.mifcsLock.RLock()
+	defer s.mifcsLock.RUnlock()
+	errs := make(map[string]error, len(s.ifcErrs))
+	for name, err := range s.ifcErrs {
+		errs[name] = err
+	}
+	return errs
+}
+
+// ReceiveBufferSizes returns the effective socket receive buffer size of each interface we listen on,
+// keyed by the same interface names as DumpCache, whether or not it was set with ReceiveBufferSize.
+// A size of 0 means it couldn't be read.  After Stop it returns nil.
+func (s *MDNS) ReceiveBufferSizes() map[string]int {
+	rc := make(chan map[string]int, 1)
+	select {
+	case s.rcvBufs <- rc:
+		return <-rc
+	case <-s.quit:
+		return nil
+	}
+}
+
+func (s *MDNS) run() bool {
+	s.doneLock.Lock()
+	defer s.doneLock.Unlock()
+	return !s.done
+}
+
+// checkService makes sure that the records announcing a service instance are legal and fit in a message.
+func checkService(service, host string, port uint16, txt, subtypes []string) error {
+	for _, t := range txt {
+		if len(t) > 255 {
+			return fmt.Errorf("%w: txt string %.20q... is longer than 255 bytes", ErrInvalidService, t)
+		}
+	}
+	msg := newDnsMsg(0, true, true)
+	msg.Answer = append(msg.Answer, NewPtrRR(serviceFQDN(service), dns.ClassINET, 0, instanceFQDN(host, service)))
+	for _, subtype := range subtypes {
+		if len(subtype) == 0 || strings.Contains(subtype, ".") {
+			return fmt.Errorf("%w: bad subtype %q", ErrInvalidService, subtype)
+		}
+		msg.Answer = append(msg.Answer, NewPtrRR(SubtypeService(subtype, service), dns.ClassINET, 0, instanceFQDN(host, service)))
+	}
+	msg.Answer = append(msg.Answer, NewSrvRR(instanceFQDN(host, service), dns.ClassINET, 0, hostFQDN(host), port, 0, 0))
+	msg.Answer = append(msg.Answer, NewTxtRR(instanceFQDN(host, service), dns.ClassINET, 0, txt))
+	if _, ok := msg.Pack(); !ok {
+		return fmt.Errorf("%w: can't pack records for service %s host %s", ErrInvalidService, service, host)
+	}
+	return nil
+}
+
+// Announce a service.  If the host name is empty, we just use the host name from NewMDNS.  If the host name ends in .local. we strip it off.
+// If the port is zero, we do not announce the host addresses.  An error is returned if the names are malformed or the records
+// don't fit in a message.  Before announcing, we probe the networks and return ErrNameConflict if someone else is using the names.
+// Adding a service instance we are already announcing is not an error: if the records are the same nothing happens, otherwise
+// the new ones are announced in place of the old.
 func (s *MDNS) AddService(service, host string, port uint16, txt ...string) error {
+	return s.AddServiceWithOptions(service, host, port, ServiceOptions{}, txt...)
+}
+
+// AddServiceWithSubtypes is AddService but also announces the instance under each of the subtypes
+// (RFC 6763 section 7.1), e.g., "printer" for a printer offering the "http" service.  Browsers of the
+// base service still see the instance; browsers of SubtypeService(subtype, service) see only instances
+// with that subtype.
+func (s *MDNS) AddServiceWithSubtypes(service, host string, port uint16, subtypes []string, txt ...string) error {
+	return s.AddServiceWithOptions(service, host, port, ServiceOptions{Subtypes: subtypes}, txt...)
+}
+
+// AddServiceMap is AddService with the TXT record given as key/value pairs.  Each pair becomes a
+// "key=value" string, in order of their keys so that the record is the same every time.  An empty value
+// still gets its '=' (RFC 6763 section 6.4).  ErrInvalidArgument is returned if a key is empty, contains
+// '=' or anything but printable ASCII, or differs from another key only in case.
+func (s *MDNS) AddServiceMap(service, host string, port uint16, txt map[string]string) error {
+	strs, err := txtFromMap(txt)
+	if err != nil {
+		return err
+	}
+	return s.AddService(service, host, port, strs...)
+}
+
+// txtFromMap returns the TXT strings for the key/value pairs, sorted by key.
+func txtFromMap(txt map[string]string) ([]string, error) {
+	keys := make([]string, 0, len(txt))
+	seen := make(map[string]bool)
+	for key := range txt {
+		if len(key) == 0 {
+			return nil, fmt.Errorf("%w: empty txt key", ErrInvalidArgument)
+		}
+		for i := 0; i < len(key); i++ {
+			if key[i] < 0x20 || key[i] > 0x7e || key[i] == '=' {
+				return nil, fmt.Errorf("%w: bad txt key %q", ErrInvalidArgument, key)
+			}
+		}
+		if seen[strings.ToLower(key)] {
+			return nil, fmt.Errorf("%w: txt key %q appears twice", ErrInvalidArgument, key)
+		}
+		seen[strings.ToLower(key)] = true
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	strs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		strs = append(strs, key+"="+txt[key])
+	}
+	return strs, nil
+}
+
+// ServiceOptions are the less common settings for a service being added.  The zero value gives
+// AddService's behavior.
+type ServiceOptions struct {
+	// Subtypes to also announce the instance under, see AddServiceWithSubtypes.
+	Subtypes []string
+
+	// TTL for the service's PTR, SRV and TXT records.  If 0, the MDNS's TTL, 120 seconds unless
+	// changed with SetOutgoingTTL, is used.  RFC 6762 section 10 recommends 120 seconds for records
+	// naming a host and 4500 for the rest, so a long-lived service might use 4500 while a mobile
+	// device wants something short.  The host's address records never get a TTL longer than the
+	// MDNS's.
+	TTL uint32
+
+	// If not 0, txtvers=Txtvers is put first in the TXT record, replacing any txtvers in txt, so that
+	// clients can tell which version of the TXT schema the instance uses (RFC 6763 section 6.7).
+	Txtvers int
+
+	// If true, rather than failing with ErrNameConflict when someone else is using the instance
+	// name, try the instance names "<host> (2)", "<host> (3)", ..., as RFC 6762 section 9 suggests,
+	// and, if someone else is using the host name, the host names <host>-2, <host>-3, ..., probing
+	// each, up to 10 new names in all.  Use RegisterService to learn which instance name was used.
+	Rename bool
+}
+
+// AddServiceWithOptions is AddService with the settings in opts.
+func (s *MDNS) AddServiceWithOptions(service, host string, port uint16, opts ServiceOptions, txt ...string) error {
+	_, err := s.RegisterService(service, host, port, opts, txt...)
+	return err
+}
+
+// RegisterService is AddServiceWithOptions but also returns the instance name announced, which differs
+// from host only if opts.Rename picked another one.
+func (s *MDNS) RegisterService(service, host string, port uint16, opts ServiceOptions, txt ...string) (string, error) {
+	req, err := s.claimService(service, host, port, opts, txt)
+	if err != nil {
+		return "", err
+	}
+	select {
+	case s.announce <- []announceRequest{req}:
+		return req.instance, nil
+	case <-s.quit:
+		return "", ErrClosed
+	}
+}
+
+// claimService checks a service being added and probes for its names, renaming it if opts allow.  It
+// returns the request to announce it with.
+func (s *MDNS) claimService(service, host string, port uint16, opts ServiceOptions, txt []string) (announceRequest, error) {
+	var req announceRequest
+	if s.passive {
+		return req, fmt.Errorf("%w: can't announce service %s", ErrPassive, service)
+	}
+	subtypes := opts.Subtypes
+	if opts.Txtvers != 0 {
+		rr := &dns.RR_TXT{Txt: txt}
+		rr.SetTxtvers(opts.Txtvers)
+		txt = rr.Txt
+	}
+	if err := checkServiceName(service); err != nil {
+		return req, err
+	}
+	if len(host) == 0 {
+		if s.hostName == "" {
+			return req, fmt.Errorf("%w: AddService requires a host name", ErrInvalidArgument)
+		}
+		host = s.hostName
+	} else {
+		host = hostUnqualify(host)
+	}
+	// The instance and host names are renamed separately, each only if someone else has it.
+	name, target := host, host
+	ni, nh := 1, 1
+	for renames := 0; ; renames++ {
+		if err := checkService(service, name, port, txt, subtypes); err != nil {
+			return req, err
+		}
+		// There's no need to probe for names we already own.  Adding the same service again
+		// does nothing and adding it with different records announces the new ones.
+		if s.isRegistered(service, name, port) {
+			break
+		}
+		c := s.probe(service, name, target, port)
+		if !c.instance && !c.host {
+			break
+		}
+		if !opts.Rename || renames == maxRenames {
+			return req, ErrNameConflict
+		}
+		if c.instance {
+			ni++
+			name = renamed(host, ni, true)
+		}
+		if c.host {
+			nh++
+			target = renamed(host, nh, false)
+		}
+	}
+	return announceRequest{service, name, target, port, txt, subtypes, opts.TTL}, nil
+}
+
+// ServiceSpec is one of the services to add with AddServices.
+type ServiceSpec struct {
+	Service string
+	Host    string // if empty, the host name from NewMDNS
+	Port    uint16
+	Txt     []string
+	Options ServiceOptions
+}
+
+// AddServices adds several services at once.  They are probed for together and then announced
+// together, with as many to a message as fit, rather than a message or more per service.  Either all
+// are added or none are; in the latter case the error names each service that failed and wraps the
+// first failure, so errors.Is still tells, e.g., ErrNameConflict.
+func (s *MDNS) AddServices(specs []ServiceSpec) error {
+	if len(specs) == 0 {
+		return nil
+	}
+	reqs := make([]announceRequest, len(specs))
+	errs := make([]error, len(specs))
+	var wg sync.WaitGroup
+	for i := range specs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			spec := specs[i]
+			reqs[i], errs[i] = s.claimService(spec.Service, spec.Host, spec.Port, spec.Options, spec.Txt)
+		}(i)
+	}
+	wg.Wait()
+	var first error
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			failed = append(failed, fmt.Sprintf("service %s host %s port %d: %v", specs[i].Service, specs[i].Host, specs[i].Port, err))
+		}
+	}
+	if first != nil {
+		return fmt.Errorf("%w: %d of %d services not added: %s", first, len(failed), len(specs), strings.Join(failed, "; "))
+	}
+	select {
+	case s.announce <- reqs:
+		return nil
+	case <-s.quit:
+		return ErrClosed
+	}
+}
+
+// localServices returns the services we are announcing.  Called only from the main loop.
+func (s *MDNS) localServices() []ServiceInstance {
+	var local []ServiceInstance
+	for service, set := range s.services {
+		for _, req := range set {
+			dn := instanceFQDN(req.instance, service)
+			local = append(local, ServiceInstance{
+				Name:    req.instance,
+				Service: service,
+				SrvRRs:  []*dns.RR_SRV{NewSrvRR(dn, cacheFlushBit|dns.ClassINET, s.serviceTTL(req), hostFQDN(req.host), req.port, 0, 0).(*dns.RR_SRV)},
+				TxtRRs:  []*dns.RR_TXT{NewTxtRR(dn, cacheFlushBit|dns.ClassINET, s.serviceTTL(req), req.txt).(*dns.RR_TXT)},
+			})
+		}
+	}
+	sort.Slice(local, func(i, j int) bool {
+		if local[i].Service != local[j].Service {
+			return local[i].Service < local[j].Service
+		}
+		return local[i].Name < local[j].Name
+	})
+	return local
+}
+
+// LocalServices returns the service instances we are announcing, i.e., those added with AddService and not yet
+// removed, sorted by service and then host name.  After Stop it returns nil.
+func (s *MDNS) LocalServices() []ServiceInstance {
+	rc := make(chan []ServiceInstance, 1)
+	select {
+	case s.local <- rc:
+		return <-rc
+	case <-s.quit:
+		return nil
+	}
+}
+
+// The most new names AddServiceWithRename and ServiceOptions.Rename try after the one asked for.
+const maxRenames = 10
+
+// AddServiceWithRename is RegisterService with ServiceOptions.Rename set: rather than failing on a
+// name conflict, it picks new instance and host names as RFC 6762 section 9 suggests.  It returns the
+// instance name it finally used, the one to give RemoveService and UpdateServiceTxt.
+func (s *MDNS) AddServiceWithRename(service, host string, port uint16, txt ...string) (string, error) {
+	return s.RegisterService(service, host, port, ServiceOptions{Rename: true}, txt...)
+}
+
+// renamed returns the nth name to try for name after it was taken (RFC 6762 section 9): "<name> (n)" for a
+// service instance label, which can be any text (RFC 6763 section 4.1.1), and "<name>-n" for a host name,
+// which can't hold spaces or parentheses.
+func renamed(name string, n int, instance bool) string {
+	if instance {
+		return fmt.Sprintf("%s (%d)", name, n)
+	}
+	return fmt.Sprintf("%s-%d", name, n)
+}
+
+// Remove a service.  If the host name is empty, we just use the host name from NewMDNS.  If the host name ends in .local. we strip it off.
+func (s *MDNS) RemoveService(service, host string, port uint16, txt ...string) error {
+	if len(service) == 0 {
+		return fmt.Errorf("%w: service name cannot be null", ErrInvalidService)
+	}
+	if len(host) == 0 {
+		if s.hostName == "" {
+			return fmt.Errorf("%w: RemoveService requires a host name", ErrInvalidArgument)
+		}
+		host = s.hostName
+	} else {
+		host = hostUnqualify(host)
+	}
+	select {
+	case s.goodbye <- announceRequest{service, host, host, port, txt, nil, 0}:
+		return nil
+	case <-s.quit:
+		return ErrClosed
+	}
+}
+
+// AddHostAddress announces A and AAAA RRs giving ips as the addresses of host, and answers questions for
+// them and for the matching reverse PTR RRs, e.g., for a device we speak for.  Unlike AddService, it doesn't
+// probe first.  The ips replace any given before for the host.  If the host name ends in .local. we strip it off.
+func (s *MDNS) AddHostAddress(host string, ips ...net.IP) error {
+	host = hostUnqualify(host)
+	if len(host) == 0 {
+		return fmt.Errorf("%w: AddHostAddress requires a host name", ErrInvalidArgument)
+	}
+	if len(ips) == 0 {
+		return fmt.Errorf("%w: AddHostAddress requires an address", ErrInvalidArgument)
+	}
+	for _, ip := range ips {
+		if ip.To16() == nil {
+			return fmt.Errorf("%w: bad address %v", ErrInvalidArgument, ip)
+		}
+	}
+	if s.passive {
+		return fmt.Errorf("%w: can't announce host %s", ErrPassive, host)
+	}
+	return s.hostRequest(hostRequest{host, append([]net.IP(nil), ips...), make(chan struct{})})
+}
+
+// RemoveHostAddress stops announcing a host added with AddHostAddress, saying goodbye for its addresses.
+func (s *MDNS) RemoveHostAddress(host string) error {
+	host = hostUnqualify(host)
+	if len(host) == 0 {
+		return fmt.Errorf("%w: RemoveHostAddress requires a host name", ErrInvalidArgument)
+	}
+	return s.hostRequest(hostRequest{host, nil, make(chan struct{})})
+}
+
+func (s *MDNS) hostRequest(req hostRequest) error {
+	select {
+	case s.addHost <- req:
+		<-req.done
+		return nil
+	case <-s.quit:
+		return ErrClosed
+	}
+}
+
+// UpdateServiceTxt changes the TXT records of a service previously added with AddService.  Rather than
+// removing and re-adding the service, the new TXT records are announced with the cache flush bit set
+// so that watchers see a change rather than a removal followed by an addition.
+func (s *MDNS) UpdateServiceTxt(service, host string, port uint16, txt ...string) error {
 	if len(service) == 0 {
-		return errors.New("service name cannot be null")
+		return fmt.Errorf("%w: service name cannot be null", ErrInvalidService)
 	}
 	if len(host) == 0 {
 		if s.hostName == "" {
-			return errors.New("AddService requires a host name")
+			return fmt.Errorf("%w: UpdateServiceTxt requires a host name", ErrInvalidArgument)
 		}
 		host = s.hostName
 	} else {
 		host = hostUnqualify(host)
 	}
-	s.announce <- announceRequest{service, host, port, txt}
-	return nil
+	if err := checkService(service, host, port, txt, nil); err != nil {
+		return err
+	}
+	req := txtUpdateRequest{announceRequest{service, host, host, port, txt, nil, 0}, make(chan error, 1)}
+	select {
+	case s.updateTxt <- req:
+		return <-req.errc
+	case <-s.quit:
+		return ErrClosed
+	}
 }
 
-// Remove a service.  If the host name is empty, we just use the host name from NewMDNS.  If the host name ends in .local. we strip it off.
-func (s *MDNS) RemoveService(service, host string, port uint16, txt ...string) error {
-	if len(service) == 0 {
-		return errors.New("service name cannot be null")
+// lookupCache passes a lookup to the main loop.  After Stop, when nobody will answer, it closes
+// req.rc itself so that the caller sees no RRs.
+func (s *MDNS) lookupCache(req lookupRequest) {
+	select {
+	case s.lookup <- req:
+	case <-s.quit:
+		close(req.rc)
 	}
-	if len(host) == 0 {
-		if s.hostName == "" {
-			return errors.New("RemoveService requires a host name")
+}
+
+// knownAbsent returns true if a cached NSEC RR says that dn has no RRs of any of the types.
+func (s *MDNS) knownAbsent(dn string, rrtypes ...uint16) bool {
+	if len(rrtypes) == 1 && rrtypes[0] == dns.TypeALL {
+		return false
+	}
+	req := lookupRequest{dn, dns.TypeNSEC, make(chan dns.RR, 10), false}
+	s.lookupCache(req)
+	absent := false
+	for rr := <-req.rc; rr != nil; rr = <-req.rc {
+		nsec, ok := rr.(*dns.RR_NSEC)
+		if !ok || absent {
+			continue
+		}
+		absent = true
+		for _, t := range rrtypes {
+			if nsec.HasType(t) {
+				absent = false
+			}
 		}
-		host = s.hostName
-	} else {
-		host = hostUnqualify(host)
 	}
-	s.goodbye <- announceRequest{service, host, port, txt}
-	return nil
+	return absent
 }
 
 // Resolve a particular RR type.
@@ -873,105 +3185,833 @@ func (s *MDNS) ResolveRR(dn string, rrtype uint16) []dns.RR {
 	rrs := make([]dns.RR, 0)
 	for i := 0; i < 3; i++ {
 		// Try cache.
-		req := lookupRequest{dn, rrtype, make(chan dns.RR, 10)}
-		s.lookup <- req
+		req := lookupRequest{dn, rrtype, make(chan dns.RR, 10), true}
+		s.lookupCache(req)
+		for rr := <-req.rc; rr != nil; rr = <-req.rc {
+			rrs = append(rrs, rr)
+		}
+		if len(rrs) > 0 || i >= 3 || s.knownAbsent(dn, rrtype) {
+			break
+		}
+
+		// Ask the net to resolve it
+		q := make([]dns.Question, 1)
+		q[0] = dns.Question{dn, rrtype, s.qclass()}
+		s.askAll(q)
+		time.Sleep(50 * time.Millisecond)
+	}
+	return rrs
+}
+
+// How long Query waits for answers to arrive.
+const queryWait = 200 * time.Millisecond
+
+// Query asks the networks for RRs of type rrtype, or all types for dns.TypeALL, for a domain name, waits a short
+// while for the answers, and then returns all matching RRs we know of.  The name is used as is if it ends in
+// a '.', otherwise .local. is appended.  No matches is not an error.
+func (s *MDNS) Query(dn string, rrtype uint16) ([]dns.RR, error) {
+	if len(dn) == 0 {
+		return nil, fmt.Errorf("%w: Query requires a name", ErrInvalidArgument)
+	}
+	dn = hostFQDN(dn)
+	select {
+	case s.query <- []dns.Question{{dn, rrtype, s.qclass()}}:
+	case <-s.quit:
+		return nil, ErrClosed
+	}
+	time.Sleep(queryWait)
+
+	req := lookupRequest{dn, rrtype, make(chan dns.RR, 10), true}
+	select {
+	case s.lookup <- req:
+	case <-s.quit:
+		return nil, ErrClosed
+	}
+	var rrs []dns.RR
+	for rr := <-req.rc; rr != nil; rr = <-req.rc {
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+// QueryMulti is Query for several names at once.  All the questions are asked together, in as few
+// messages as they fit in, e.g., to look for a dozen service types at startup without a packet for
+// each.  It returns the cached RRs of all the names after waiting for answers.
+func (s *MDNS) QueryMulti(names []string, rrtype uint16) ([]dns.RR, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("%w: QueryMulti requires a name", ErrInvalidArgument)
+	}
+	var q []dns.Question
+	asked := make(map[string]bool)
+	for _, name := range names {
+		if len(name) == 0 {
+			return nil, fmt.Errorf("%w: QueryMulti requires nonempty names", ErrInvalidArgument)
+		}
+		dn := hostFQDN(name)
+		if !asked[dn] {
+			asked[dn] = true
+			q = append(q, dns.Question{dn, rrtype, s.qclass()})
+		}
+	}
+	select {
+	case s.query <- q:
+	case <-s.quit:
+		return nil, ErrClosed
+	}
+	time.Sleep(queryWait)
+
+	var rrs []dns.RR
+	for _, x := range q {
+		req := lookupRequest{x.Name, rrtype, make(chan dns.RR, 10), true}
+		select {
+		case s.lookup <- req:
+		case <-s.quit:
+			return nil, ErrClosed
+		}
 		for rr := <-req.rc; rr != nil; rr = <-req.rc {
 			rrs = append(rrs, rr)
 		}
-		if len(rrs) > 0 || i >= 3 {
+	}
+	return rrs, nil
+}
+
+// How long ResolveUnicast waits for each reply and how many times it asks.
+const (
+	unicastTimeout  = 2 * time.Second
+	unicastAttempts = 2
+)
+
+// ResolveUnicast asks the DNS server at server, "host:port" or just an address for port 53, for the RRs of
+// type rrtype for name using ordinary unicast DNS, e.g., to find services in a unicast DNS-SD zone (RFC 6763
+// section 11).  A '.' is appended to name if it doesn't already end in one.  CNAMEs are followed, and a truncated
+// reply is asked for again over TCP.  If the name or its RRs of that type don't exist, the error is a *dns.Error
+// with IsNotFound set.
+func (s *MDNS) ResolveUnicast(name string, rrtype uint16, server string) ([]dns.RR, error) {
+	if len(name) == 0 {
+		return nil, fmt.Errorf("%w: ResolveUnicast requires a name", ErrInvalidArgument)
+	}
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	if s.passive {
+		return nil, fmt.Errorf("%w: can't ask %s", ErrPassive, server)
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	out := new(dns.Msg)
+	out.ID = uint16(rand.Int())
+	out.Question = []dns.Question{{name, rrtype, dns.ClassINET}}
+	out.RecursionDesired = true
+	b, ok := out.Pack()
+	if !ok {
+		return nil, fmt.Errorf("%w: can't pack question for %s", ErrInvalidArgument, name)
+	}
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	buf := make([]byte, maxPacketSize)
+	for attempt := 0; attempt < unicastAttempts; attempt++ {
+		if _, err := conn.Write(b); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(unicastTimeout))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if e, ok := err.(net.Error); ok && e.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			in := new(dns.Msg)
+			if !in.Unpack(buf[:n]) || in.ID != out.ID || !in.Response {
+				if s.logLevel >= 2 {
+					s.logger.Printf("ResolveUnicast %s: ignoring bad reply from %s\n", name, server)
+				}
+				continue
+			}
+			if in.Truncated {
+				// The whole answer didn't fit in a datagram (RFC 7766 section 5).
+				if in, err = s.unicastTCP(b, out.ID, server); err != nil {
+					return nil, err
+				}
+			}
+			_, rrs, err := dns.Answer(name, rrtype, in, server)
+			return rrs, err
+		}
+	}
+	return nil, &dns.Error{Err: "no answer from server", Name: name, Server: server, IsTimeout: true}
+}
+
+// unicastTCP asks server the question packed in b again over TCP, where each message is preceded by its
+// two byte length (RFC 1035 section 4.2.2), and returns the reply.
+func (s *MDNS) unicastTCP(b []byte, id uint16, server string) (*dns.Msg, error) {
+	conn, err := net.DialTimeout("tcp", server, unicastTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(unicastAttempts * unicastTimeout))
+	if _, err := conn.Write(append([]byte{byte(len(b) >> 8), byte(len(b))}, b...)); err != nil {
+		return nil, err
+	}
+	var l [2]byte
+	if _, err := io.ReadFull(conn, l[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, int(l[0])<<8|int(l[1]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	in := new(dns.Msg)
+	if err := in.UnpackErr(buf); err != nil {
+		return nil, err
+	}
+	if in.ID != id || !in.Response {
+		return nil, &dns.Error{Err: "bad reply from server", Server: server}
+	}
+	return in, nil
+}
+
+// Resolve returns the RRs of type rrtype for name, first trying the networks the way ResolveRR does and then,
+// if nothing was found and a server was set with the UnicastFallback option, asking that server with
+// ResolveUnicast.  No matches is not an error.
+func (s *MDNS) Resolve(name string, rrtype uint16) ([]dns.RR, error) {
+	if len(name) == 0 {
+		return nil, fmt.Errorf("%w: Resolve requires a name", ErrInvalidArgument)
+	}
+	if rrs := s.ResolveRR(name, rrtype); len(rrs) > 0 || s.unicastServer == "" {
+		return rrs, nil
+	}
+	rrs, err := s.ResolveUnicast(name, rrtype, s.unicastServer)
+	var e *dns.Error
+	if errors.As(err, &e) && e.IsNotFound {
+		return nil, nil
+	}
+	return rrs, err
+}
+
+// ReverseLookup returns the names that the networks advertise for an IP address, i.e., the targets of PTR RRs for
+// the address's in-addr.arpa. or ip6.arpa. name.
+func (s *MDNS) ReverseLookup(ip net.IP) ([]string, error) {
+	if ip == nil {
+		return nil, fmt.Errorf("%w: ReverseLookup requires an address", ErrInvalidArgument)
+	}
+	arpa, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return nil, err
+	}
+	rrs, err := s.Query(arpa, dns.TypePTR)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	seen := make(map[string]bool)
+	for _, rr := range rrs {
+		if rr, ok := rr.(*dns.RR_PTR); ok && !seen[rr.Ptr] {
+			seen[rr.Ptr] = true
+			names = append(names, rr.Ptr)
+		}
+	}
+	return names, nil
+}
+
+// Resolve an address from the cache.  New addresses are appended to ips in the order the cache returns them.
+func (s *MDNS) resolveAddressFromCache(ctx context.Context, dn string, rrtype uint16, ips []net.IP, minttl uint32) ([]net.IP, uint32, error) {
+	req := lookupRequest{dn, rrtype, make(chan dns.RR, 10), true}
+	select {
+	case s.lookup <- req:
+	case <-ctx.Done():
+		return ips, minttl, ctx.Err()
+	case <-s.quit:
+		return ips, minttl, ErrClosed
+	}
+	// Once the main loop has the request we always drain the reply channel so that the main
+	// loop is never left blocked writing to it.
+	for rr := <-req.rc; rr != nil; rr = <-req.rc {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.RR_A:
+			ip = AtoIP(rr)
+		case *dns.RR_AAAA:
+			ip = AAAAtoIP(rr)
+		default:
+			continue
+		}
+		if rr.Header().Ttl < minttl {
+			minttl = rr.Header().Ttl
+		}
+		dup := false
+		for _, x := range ips {
+			if x.Equal(ip) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, minttl, nil
+}
+
+// When cached address RRs have less than this fraction of their TTL left, resolveAddress asks the
+// networks for fresh ones and waits refreshWait for them before answering (RFC 6762 section 5.2).
+const (
+	refreshFraction = 0.2
+	refreshWait     = 100 * time.Millisecond
+)
+
+// addressesExpiring asks the main loop whether any of the cached RRs of the given types for dn are
+// about to expire.
+func (s *MDNS) addressesExpiring(ctx context.Context, dn string, rrtypes ...uint16) bool {
+	for _, t := range rrtypes {
+		req := expiringRequest{dn, t, make(chan bool, 1)}
+		select {
+		case s.expiring <- req:
+		case <-ctx.Done():
+			return false
+		case <-s.quit:
+			return false
+		}
+		if <-req.rc {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveAddress does the work for the ResolveAddress calls.  rrtype is dns.TypeA, dns.TypeAAAA, or
+// dns.TypeALL for both.
+func (s *MDNS) resolveAddress(ctx context.Context, dn string, rrtype uint16) ([]net.IP, uint32, error) {
+	dn = hostFQDN(dn)
+	var ips []net.IP
+	minttl := uint32(7 * 24 * 60 * 60)
+	for i := 0; i < 3; i++ {
+		var err error
+		if ips, minttl, err = s.resolveAddressFromCache(ctx, dn, rrtype, ips, minttl); err != nil {
+			return nil, minttl, err
+		}
+		types := []uint16{rrtype}
+		if rrtype == dns.TypeALL {
+			types = []uint16{dns.TypeA, dns.TypeAAAA}
+		}
+		var q []dns.Question
+		if rrtype != dns.TypeAAAA {
+			q = append(q, dns.Question{dn, dns.TypeA, s.qclass()})
+		}
+		if rrtype != dns.TypeA {
+			q = append(q, dns.Question{dn, dns.TypeAAAA, s.qclass()})
+		}
+		if len(ips) != 0 {
+			// Keep the answer warm: if it is about to expire, give the owner a chance to refresh it.
+			if i == 0 && s.addressesExpiring(ctx, dn, types...) {
+				s.askAll(q)
+				select {
+				case <-time.After(refreshWait):
+				case <-ctx.Done():
+					return nil, minttl, ctx.Err()
+				}
+				fresh, freshttl, err := s.resolveAddressFromCache(ctx, dn, rrtype, nil, uint32(7*24*60*60))
+				if err != nil {
+					return nil, minttl, err
+				}
+				if len(fresh) != 0 {
+					ips, minttl = fresh, freshttl
+				}
+			}
+			break
+		}
+		if i >= 3 || s.knownAbsent(dn, types...) {
 			break
 		}
 
-		// Ask the net to resolve it
-		q := make([]dns.Question, 1)
-		q[0] = dns.Question{dn, rrtype, dns.ClassINET}
-		for _, mifc := range s.mifcs {
-			mifc.sendQuestion(q)
+		// if the cache has no answers, ask the nets and wait for replies to be collected
+		s.askAll(q)
+		select {
+		case <-time.After(50 * time.Millisecond):
+		case <-ctx.Done():
+			return nil, minttl, ctx.Err()
+		}
+	}
+	return ips, minttl, nil
+}
+
+// ResolveToAddress return all IP addresses for a domain name (from all interfaces).  These come from A and AAAA RR's for the name <host>.local.
+// Duplicates are removed.  It also returns the lowest TTL of all the address records.
+func (s *MDNS) ResolveAddress(dn string) ([]net.IP, uint32) {
+	ips, minttl, _ := s.resolveAddress(context.Background(), dn, dns.TypeALL)
+	return ips, minttl
+}
+
+// ResolveAddress4 is ResolveAddress but only returns IPv4 addresses, i.e., from A RRs.  The addresses are
+// in the order they were cached so repeated calls return them in the same order.
+func (s *MDNS) ResolveAddress4(dn string) ([]net.IP, uint32) {
+	ips, minttl, _ := s.resolveAddress(context.Background(), dn, dns.TypeA)
+	return ips, minttl
+}
+
+// ResolveAddress6 is ResolveAddress but only returns IPv6 addresses, i.e., from AAAA RRs.  The addresses are
+// in the order they were cached so repeated calls return them in the same order.
+func (s *MDNS) ResolveAddress6(dn string) ([]net.IP, uint32) {
+	ips, minttl, _ := s.resolveAddress(context.Background(), dn, dns.TypeAAAA)
+	return ips, minttl
+}
+
+// ResolveAddressContext is ResolveAddress but gives up and returns ctx.Err() if ctx is cancelled
+// before the resolution completes.
+func (s *MDNS) ResolveAddressContext(ctx context.Context, dn string) ([]net.IP, error) {
+	ips, _, err := s.resolveAddress(ctx, dn, dns.TypeALL)
+	return ips, err
+}
+
+// cachedIPAddrs returns the cached addresses of dn from its A and/or AAAA RRs, rrtype being dns.TypeA,
+// dns.TypeAAAA, or dns.TypeALL.  IPv6 link local ones are zoned with the interface they were learned on.
+// Called only from the main loop.
+func (s *MDNS) cachedIPAddrs(dn string, rrtype uint16) []net.IPAddr {
+	var addrs []net.IPAddr
+	for _, mifc := range s.mifcs {
+		for _, t := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			if rrtype != dns.TypeALL && rrtype != t {
+				continue
+			}
+			for _, rr := range mifc.cache.Records(dn, t) {
+				var addr net.IPAddr
+				switch rr := rr.(type) {
+				case *dns.RR_A:
+					addr.IP = AtoIP(rr)
+				case *dns.RR_AAAA:
+					addr.IP = AAAAtoIP(rr)
+					if addr.IP.To4() == nil && addr.IP.IsLinkLocalUnicast() {
+						addr.Zone = mifc.ifc.Name
+					}
+				default:
+					continue
+				}
+				dup := false
+				for _, x := range addrs {
+					if x.IP.Equal(addr.IP) && x.Zone == addr.Zone {
+						dup = true
+						break
+					}
+				}
+				if !dup {
+					addrs = append(addrs, addr)
+				}
+			}
+		}
+	}
+	return addrs
+}
+
+// ResolveIPAddr is ResolveAddress but returns net.IPAddrs so that IPv6 link local addresses can carry the
+// name of the interface they were learned on as their zone.  Without one they can't be dialed.  A link
+// local address heard on several interfaces is returned once for each.
+func (s *MDNS) ResolveIPAddr(dn string) ([]net.IPAddr, uint32) {
+	addrs, minttl, _ := s.resolveIPAddr(context.Background(), dn)
+	return addrs, minttl
+}
+
+// ResolveIPAddrContext is ResolveIPAddr but gives up and returns ctx.Err() if ctx is cancelled before
+// the resolution completes.
+func (s *MDNS) ResolveIPAddrContext(ctx context.Context, dn string) ([]net.IPAddr, error) {
+	addrs, _, err := s.resolveIPAddr(ctx, dn)
+	return addrs, err
+}
+
+func (s *MDNS) resolveIPAddr(ctx context.Context, dn string) ([]net.IPAddr, uint32, error) {
+	// Let resolveAddress do the asking, then read back from the cache where the answers came from.
+	ips, minttl, err := s.resolveAddress(ctx, dn, dns.TypeALL)
+	if err != nil || len(ips) == 0 {
+		return nil, minttl, err
+	}
+	req := ipAddrsRequest{hostFQDN(dn), dns.TypeALL, make(chan []net.IPAddr, 1)}
+	select {
+	case s.ipAddrs <- req:
+		return <-req.rc, minttl, nil
+	case <-ctx.Done():
+		return nil, minttl, ctx.Err()
+	case <-s.quit:
+		return nil, minttl, ErrClosed
+	}
+}
+
+// SubscriberToService declares our interest in a service.  This should elicit responses from everyone implementing that service.  This is
+// orthogonal to offering the service ourselves.  An error is returned if the service name is malformed.
+//
+// We keep asking, after 1 second, then 2, 4, and so on up to once a minute, so that instances that come
+// up later are found even if they don't announce themselves where we hear them (RFC 6762 section 5.2).
+// Known answers go with the questions so that those already found needn't answer again.
+// SubscriptionRequery changes the intervals.  Subscribing again starts over from the first interval.
+func (s *MDNS) SubscribeToService(service string) error {
+	if err := checkServiceName(service); err != nil {
+		return err
+	}
+	s.subscribe(serviceFQDN(service))
+	return nil
+}
+
+// subscribe does the work for SubscribeToService once the name has been checked.
+func (s *MDNS) subscribe(serviceDN string) {
+	q := []dns.Question{{serviceDN, dns.TypePTR, s.qclass()}}
+	stop := make(chan struct{})
+	s.watchedLock.Lock()
+	if old, ok := s.subscribed[serviceDN]; ok {
+		close(old)
+	}
+	s.subscribed[serviceDN] = stop
+	s.watchedLock.Unlock()
+
+	// Wait a little before asking so that hosts starting together don't all ask at once (RFC 6762
+	// section 5.2).  The caller needn't wait with us.
+	go s.requery(q, randomDelay(), stop)
+}
+
+// requery asks q after wait and then again at doubling intervals until stop is closed.
+func (s *MDNS) requery(q []dns.Question, wait time.Duration, stop chan struct{}) {
+	interval := s.requeryFirst
+	for {
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-stop:
+			t.Stop()
+			return
+		case <-s.quit:
+			t.Stop()
+			return
+		}
+		select {
+		case s.query <- q:
+		case <-stop:
+			return
+		case <-s.quit:
+			return
+		}
+		if interval <= 0 {
+			return
+		}
+		wait, interval = interval, interval*2
+		if interval > s.requeryMax {
+			interval = s.requeryMax
+		}
+	}
+}
+
+// UnsubscribeFromService withholds our interest in a service.  We stop asking for it.
+func (s *MDNS) UnsubscribeFromService(service string) {
+	serviceDN := serviceFQDN(service)
+	s.watchedLock.Lock()
+	if stop, ok := s.subscribed[serviceDN]; ok {
+		close(stop)
+		delete(s.subscribed, serviceDN)
+	}
+	s.watchedLock.Unlock()
+}
+
+type ServiceInstance struct {
+	Name    string
+	Service string // the service name as passed in by the caller
+	SrvRRs  []*dns.RR_SRV
+	TxtRRs  []*dns.RR_TXT
+	Sources []InstanceSource // where the SRV RRs were learned, sorted by interface index
+
+	// Set by watchers when the instance is no longer a member.  For compatibility, SrvRRs and
+	// TxtRRs are also nil in that case but that use is deprecated.
+	Removed bool
+
+	// When the first of the instance's SRV and TXT records will expire from the cache unless
+	// refreshed.  Zero if the instance has no records.
+	Expiry time.Time
+}
+
+// Txtvers returns the TXT schema version the instance announces with its txtvers key, see
+// ServiceOptions.Txtvers.  ok is false if none of its TXT records has a valid one, e.g., so that
+// the caller can skip instances it can't parse rather than misreading their TXT.
+func (si ServiceInstance) Txtvers() (v int, ok bool) {
+	for _, rr := range si.TxtRRs {
+		if v, ok := rr.Txtvers(); ok {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// MergedTxt returns the strings of all of the instance's TXT RRs as one list.  An instance should have
+// a single TXT RR (RFC 6763 section 6) but a buggy responder may send several, or change it while an
+// older copy is still cached.  To get the same answer however the RRs arrived, identical RRs count once
+// and the rest are taken in order of their contents.  Keys are compared ignoring case and only the
+// first string for each key is kept, as RFC 6763 section 6.4 says.  Empty strings and strings without
+// a key are dropped.
+func (si ServiceInstance) MergedTxt() []string {
+	var sets [][]string
+	for _, rr := range si.TxtRRs {
+		dup := false
+		for _, set := range sets {
+			if reflect.DeepEqual(set, rr.Txt) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			sets = append(sets, rr.Txt)
+		}
+	}
+	sort.Slice(sets, func(i, j int) bool {
+		a, b := sets[i], sets[j]
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+
+	var merged []string
+	keys := make(map[string]bool)
+	for _, set := range sets {
+		for _, t := range set {
+			key := t
+			if i := strings.IndexByte(t, '='); i >= 0 {
+				key = t[:i]
+			}
+			key = strings.ToLower(key)
+			if len(key) == 0 || keys[key] {
+				continue
+			}
+			keys[key] = true
+			merged = append(merged, t)
+		}
+	}
+	return merged
+}
+
+// TxtValue returns the value of key in the instance's merged TXT, see MergedTxt.  The key is compared
+// ignoring case.  ok is false if the key is absent; a bare key has a nil value.
+func (si ServiceInstance) TxtValue(key string) (value []byte, ok bool) {
+	value, ok = (&dns.RR_TXT{Txt: si.MergedTxt()}).Pairs()[strings.ToLower(key)]
+	return value, ok
+}
+
+// setExpiry computes the instance's expiry from its records.  The cache sets each record's Ttl to the
+// time remaining when it was looked up so now should be taken just before the lookup.
+func (si *ServiceInstance) setExpiry(now time.Time) {
+	var rrs []dns.RR
+	for _, rr := range si.SrvRRs {
+		rrs = append(rrs, rr)
+	}
+	for _, rr := range si.TxtRRs {
+		rrs = append(rrs, rr)
+	}
+	si.Expiry = time.Time{}
+	for _, rr := range rrs {
+		e := now.Add(time.Duration(rr.Header().Ttl) * time.Second)
+		if si.Expiry.IsZero() || e.Before(si.Expiry) {
+			si.Expiry = e
 		}
-		time.Sleep(50 * time.Millisecond)
 	}
-	return rrs
 }
 
-// Resolve an address from the cache.
-func (s *MDNS) resolveAddressFromCache(dn string, rrmap map[string]net.IP, minttl uint32) uint32 {
-	req := lookupRequest{dn, dns.TypeALL, make(chan dns.RR, 10)}
-	s.lookup <- req
-	for rr := <-req.rc; rr != nil; rr = <-req.rc {
-		switch rr := rr.(type) {
-		case *dns.RR_A:
-			ip := AtoIP(rr)
-			rrmap[ip.String()] = ip
-		case *dns.RR_AAAA:
-			ip := AAAAtoIP(rr)
-			rrmap[ip.String()] = ip
-		}
+// PickSRV returns the instance RFC 2782 says a client should try first: one of those with the lowest
+// priority, drawn with chances proportional to their weights, where instances of weight 0 have a small
+// chance of being picked.  It is the first instance after SortBySRV but instances itself isn't reordered.
+// If rnd is nil, the default source from math/rand is used.  PickSRV returns the zero ServiceInstance
+// if instances is empty.
+func PickSRV(instances []ServiceInstance, rnd *rand.Rand) ServiceInstance {
+	if len(instances) == 0 {
+		return ServiceInstance{}
 	}
-	return minttl
+	sorted := append([]ServiceInstance(nil), instances...)
+	SortBySRV(sorted, rnd)
+	return sorted[0]
 }
 
-// ResolveToAddress return all IP addresses for a domain name (from all interfaces).  These come from A and AAAA RR's for the name <host>.local.
-// We use a map to dedup replies and then make a slice out of the map values. It also returns the lowest TTL of all the address records.
-func (s *MDNS) ResolveAddress(dn string) ([]net.IP, uint32) {
-	dn = hostFQDN(dn)
-	rrmap := make(map[string]net.IP, 0)
-	minttl := uint32(7 * 24 * 60 * 60)
-	for i := 0; i < 3; i++ {
-		minttl = s.resolveAddressFromCache(dn, rrmap, minttl)
-		if len(rrmap) != 0 || i >= 3 {
-			break
+// SortBySRV orders instances the way RFC 2782 says clients should try them: by ascending priority and,
+// within a priority, randomly with each instance's chance of going next proportional to its weight.  An
+// instance with several SRV records is ordered by its lowest priority one.  Instances without SRV records
+// go last.  If rnd is nil, the default source from math/rand is used.
+func SortBySRV(instances []ServiceInstance, rnd *rand.Rand) {
+	intn := rand.Intn
+	if rnd != nil {
+		intn = rnd.Intn
+	}
+	type entry struct {
+		si  ServiceInstance
+		srv *dns.RR_SRV
+	}
+	entries := make([]entry, len(instances))
+	for i, si := range instances {
+		entries[i].si = si
+		for _, rr := range si.SrvRRs {
+			if entries[i].srv == nil || rr.Priority < entries[i].srv.Priority {
+				entries[i].srv = rr
+			}
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].srv == nil || entries[j].srv == nil {
+			return entries[j].srv == nil && entries[i].srv != nil
 		}
+		return entries[i].srv.Priority < entries[j].srv.Priority
+	})
 
-		// if the cache has no answers, ask the nets and wait for replies to be collected
-		q := make([]dns.Question, 2)
-		q[0] = dns.Question{dn, dns.TypeA, dns.ClassINET}
-		q[1] = dns.Question{dn, dns.TypeAAAA, dns.ClassINET}
-		for _, mifc := range s.mifcs {
-			mifc.sendQuestion(q)
+	// Shuffle each run of equal priorities.
+	for i := 0; i < len(entries) && entries[i].srv != nil; {
+		j := i + 1
+		for j < len(entries) && entries[j].srv != nil && entries[j].srv.Priority == entries[i].srv.Priority {
+			j++
 		}
-		time.Sleep(50 * time.Millisecond)
+		for k := i; k < j; k++ {
+			// Put the zero weight entries first so that they get a small chance of being picked.
+			rest := entries[k:j]
+			sort.SliceStable(rest, func(a, b int) bool { return rest[a].srv.Weight == 0 && rest[b].srv.Weight != 0 })
+			sum := 0
+			for _, e := range rest {
+				sum += int(e.srv.Weight)
+			}
+			r := intn(sum + 1)
+			sum = 0
+			for n, e := range rest {
+				sum += int(e.srv.Weight)
+				if sum >= r {
+					rest[0], rest[n] = rest[n], rest[0]
+					break
+				}
+			}
+		}
+		i = j
 	}
-
-	var ips []net.IP
-	for _, ip := range rrmap {
-		ips = append(ips, ip)
+	for i, e := range entries {
+		instances[i] = e.si
 	}
-	return ips, minttl
 }
 
-// SubscriberToService declares our interest in a service.  This should elicit responses from everyone implementing that service.  This is
-// orthogonal to offering the service ourselves.
-func (s *MDNS) SubscribeToService(service string) {
-	serviceDN := serviceFQDN(service)
-	q := []dns.Question{{serviceDN, dns.TypePTR, dns.ClassINET}}
-	s.watchedLock.Lock()
-	s.subscribed[serviceDN] = true
-	s.watchedLock.Unlock()
-	s.mifcsLock.RLock()
-	defer s.mifcsLock.RUnlock()
-	for _, mifc := range s.mifcs {
-		mifc.sendQuestion(q)
+// VerifyReachable tries to open a TCP connection to the instance, e.g., to skip instances whose
+// device has crashed but whose records haven't yet expired.  Each SRV target is resolved and its
+// addresses tried in turn; the first connection that succeeds is closed and true returned.  It gives
+// up and returns false once timeout has passed.  Nothing calls it for us, so no connections are made
+// that the caller didn't ask for.
+func (s *MDNS) VerifyReachable(inst ServiceInstance, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var d net.Dialer
+	for _, srv := range inst.SrvRRs {
+		if srv.Target == "." {
+			// The service is decidedly not available (RFC 2782).
+			continue
+		}
+		addrs, err := s.ResolveIPAddrContext(ctx, srv.Target)
+		if err != nil {
+			return false
+		}
+		for _, ip := range addrs {
+			addr := &net.TCPAddr{IP: ip.IP, Port: int(srv.Port), Zone: ip.Zone}
+			conn, err := d.DialContext(ctx, "tcp", addr.String())
+			if err == nil {
+				conn.Close()
+				return true
+			}
+			if s.logLevel >= 2 {
+				s.logger.Printf("%s: %v\n", inst.Name, err)
+			}
+			if ctx.Err() != nil {
+				return false
+			}
+		}
 	}
+	return false
 }
 
-// UnsubscribeFromService withholds our interest in a service.
-func (s *MDNS) UnsubscribeFromService(service string) {
-	serviceDN := serviceFQDN(service)
-	s.watchedLock.Lock()
-	delete(s.subscribed, serviceDN)
-	s.watchedLock.Unlock()
+// How long ResolveService waits between asks for the SRV RRs of an instance.
+const resolveServiceRetry = 250 * time.Millisecond
+
+// A ResolvedService is what ResolveService learned about a service instance.
+type ResolvedService struct {
+	Instance ServiceInstance   // the instance's records
+	Targets  []ResolvedTarget  // one per SRV RR, in the order RFC 2782 says to try them
+	Txt      map[string][]byte // the instance's TXT key/value pairs, see dns.RR_TXT.Pairs
 }
 
-type ServiceInstance struct {
-	Name   string
-	SrvRRs []*dns.RR_SRV
-	TxtRRs []*dns.RR_TXT
+// A ResolvedTarget is where one of the SRV RRs of a service instance points.
+type ResolvedTarget struct {
+	Host  string // the SRV target, e.g., "printer.local."
+	Port  uint16
+	Addrs []net.IPAddr // the host's addresses, IPv6 link local ones with their zone
+}
+
+// ResolveService finds everything needed to connect to a service instance, e.g.,
+// "Living Room._http._tcp.local.", in one call: its SRV and TXT records and the addresses of each SRV
+// target, which are resolved concurrently.  .local. is appended to the name if it doesn't end in a '.'.
+// It returns an error wrapping ErrNotFound if the instance or the addresses of all its targets can't be
+// found before timeout has passed.
+func (s *MDNS) ResolveService(instanceName string, timeout time.Duration) (*ResolvedService, error) {
+	dn := hostFQDN(instanceName)
+	service := serviceFQDNFromInstanceFQDN(dn)
+	if err := checkServiceName(service); err != nil {
+		return nil, fmt.Errorf("%w: %s is not a service instance name", ErrInvalidArgument, instanceName)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var si ServiceInstance
+	for {
+		if si = s.ResolveInstance(dn, service); len(si.SrvRRs) > 0 {
+			break
+		}
+		select {
+		case <-time.After(resolveServiceRetry):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: no SRV record for %s", ErrNotFound, dn)
+		case <-s.quit:
+			return nil, ErrClosed
+		}
+	}
+	rs := &ResolvedService{Instance: si, Txt: (&dns.RR_TXT{Txt: si.MergedTxt()}).Pairs()}
+
+	// SortBySRV orders instances so give it one per SRV RR.
+	bySRV := make([]ServiceInstance, len(si.SrvRRs))
+	for i, srv := range si.SrvRRs {
+		bySRV[i] = ServiceInstance{SrvRRs: []*dns.RR_SRV{srv}}
+	}
+	SortBySRV(bySRV, nil)
+	rs.Targets = make([]ResolvedTarget, len(bySRV))
+	var wg sync.WaitGroup
+	for i, x := range bySRV {
+		srv := x.SrvRRs[0]
+		rs.Targets[i] = ResolvedTarget{Host: srv.Target, Port: srv.Port}
+		if srv.Target == "." {
+			// The service is decidedly not available (RFC 2782).
+			continue
+		}
+		wg.Add(1)
+		go func(t *ResolvedTarget) {
+			defer wg.Done()
+			t.Addrs, _ = s.ResolveIPAddrContext(ctx, t.Host)
+		}(&rs.Targets[i])
+	}
+	wg.Wait()
+	for _, t := range rs.Targets {
+		if len(t.Addrs) > 0 {
+			return rs, nil
+		}
+	}
+	select {
+	case <-s.quit:
+		return nil, ErrClosed
+	default:
+	}
+	return nil, fmt.Errorf("%w: no addresses for the targets of %s", ErrNotFound, dn)
 }
 
 // ResolveInstance returns the address records, the port, and the min ttl for a single service instance.
 func (s *MDNS) ResolveInstance(instance, service string) ServiceInstance {
-	si := ServiceInstance{Name: instanceUnqualify(instance, service)}
+	si := ServiceInstance{Name: instanceUnqualify(instance, service), Service: service}
 	dn := instanceFQDN(instance, service)
+	now := time.Now()
 	for _, rr := range s.ResolveRR(dn, dns.TypeSRV) {
 		switch rr := rr.(type) {
 		case *dns.RR_SRV:
@@ -984,17 +4024,168 @@ func (s *MDNS) ResolveInstance(instance, service string) ServiceInstance {
 			si.TxtRRs = append(si.TxtRRs, rr)
 		}
 	}
+	if len(si.SrvRRs) > 0 {
+		si.Sources = s.lookupSources(dn)
+	}
+	si.setExpiry(now)
 	return si
 }
 
-// ServiceMemberDiscovery returns all the members of a service (i.e. with a PTR record).
+// InstanceSource says where a service instance was learned: the interface its SRV RR arrived on and
+// the address of the sender.  Addr may be nil for instances we are announcing ourselves.
+type InstanceSource struct {
+	Interface net.Interface
+	Addr      net.IP
+}
+
+// instanceSources returns where the SRV RRs for the instance dn were learned.  Called only from the main loop.
+func (s *MDNS) instanceSources(dn string) []InstanceSource {
+	var sources []InstanceSource
+	for _, mifc := range s.mifcs {
+		if addr, ok := mifc.cache.Sender(dn, dns.TypeSRV); ok {
+			sources = append(sources, InstanceSource{mifc.ifc, addr})
+		}
+	}
+	sortSources(sources)
+	return sources
+}
+
+func sortSources(sources []InstanceSource) {
+	sort.Slice(sources, func(i, j int) bool {
+		if sources[i].Interface.Index != sources[j].Interface.Index {
+			return sources[i].Interface.Index < sources[j].Interface.Index
+		}
+		return sources[i].Addr.String() < sources[j].Addr.String()
+	})
+}
+
+// cachedRRs returns the cached RRs for name of the given rrtype with their TTLs set to the time remaining.
+// Called only from the main loop.
+func cachedRRs(c *rrCache, name string, rrtype uint16) []dns.RR {
+	rc := make(chan dns.RR, len(c.Records(name, rrtype)))
+	c.Lookup(name, rrtype, rc)
+	close(rc)
+	var rrs []dns.RR
+	for rr := range rc {
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+// cachedInstances returns the instance dn of service as cached on each interface that has both SRV
+// and TXT RRs for it.  Unless we were asked to keep them separate, instances with the same SRV targets
+// and ports and the same TXT, i.e., the same responder heard on several interfaces, are merged into one
+// listing all the sources.  Called only from the main loop.
+func (s *MDNS) cachedInstances(dn, service string) []ServiceInstance {
+	var mifcs []*multicastIfc
+	for _, mifc := range s.mifcs {
+		mifcs = append(mifcs, mifc)
+	}
+	sort.Slice(mifcs, func(i, j int) bool {
+		if mifcs[i].ifc.Index != mifcs[j].ifc.Index {
+			return mifcs[i].ifc.Index < mifcs[j].ifc.Index
+		}
+		return mifcs[i].ipver < mifcs[j].ipver
+	})
+
+	var instances []ServiceInstance
+	var keys []string
+	now := time.Now()
+	for _, mifc := range mifcs {
+		si := ServiceInstance{Name: instanceUnqualify(dn, service), Service: service}
+		// It is a mistake to have two srv rrs with the same target so we just remember the last seen.
+		srvmap := make(map[string]*dns.RR_SRV)
+		for _, rr := range cachedRRs(mifc.cache, dn, dns.TypeSRV) {
+			if rr, ok := rr.(*dns.RR_SRV); ok {
+				srvmap[rr.Target] = rr
+			}
+		}
+		var srvkeys []string
+		for _, rr := range srvmap {
+			si.SrvRRs = append(si.SrvRRs, rr)
+			srvkeys = append(srvkeys, fmt.Sprintf("%s:%d", rr.Target, rr.Port))
+		}
+		sort.Strings(srvkeys)
+		var txtkeys []string
+		for _, rr := range cachedRRs(mifc.cache, dn, dns.TypeTXT) {
+			rr, ok := rr.(*dns.RR_TXT)
+			if !ok {
+				continue
+			}
+			key := fmt.Sprintf("%q", rr.Txt)
+			found := false
+			for _, k := range txtkeys {
+				if k == key {
+					found = true
+					break
+				}
+			}
+			if !found {
+				si.TxtRRs = append(si.TxtRRs, rr)
+				txtkeys = append(txtkeys, key)
+			}
+		}
+		if si.SrvRRs == nil || si.TxtRRs == nil {
+			continue
+		}
+		sort.Strings(txtkeys)
+		addr, _ := mifc.cache.Sender(dn, dns.TypeSRV)
+		si.Sources = []InstanceSource{{mifc.ifc, addr}}
+		si.setExpiry(now)
+
+		key := strings.Join(srvkeys, " ") + "|" + strings.Join(txtkeys, " ")
+		merged := false
+		for i := range instances {
+			if s.separateInstances || keys[i] != key {
+				continue
+			}
+			instances[i].Sources = append(instances[i].Sources, si.Sources...)
+			sortSources(instances[i].Sources)
+			if si.Expiry.After(instances[i].Expiry) {
+				instances[i].Expiry = si.Expiry
+			}
+			merged = true
+			break
+		}
+		if !merged {
+			instances = append(instances, si)
+			keys = append(keys, key)
+		}
+	}
+	return instances
+}
+
+// lookupInstances asks the main loop for the cached instances dn of service.
+func (s *MDNS) lookupInstances(dn, service string) []ServiceInstance {
+	req := instancesRequest{dn, service, make(chan []ServiceInstance, 1)}
+	select {
+	case s.instances <- req:
+		return <-req.rc
+	case <-s.quit:
+		return nil
+	}
+}
+
+// lookupSources asks the main loop where the SRV RRs for the instance dn were learned.
+func (s *MDNS) lookupSources(dn string) []InstanceSource {
+	req := sourcesRequest{dn, make(chan []InstanceSource, 1)}
+	select {
+	case s.sources <- req:
+		return <-req.rc
+	case <-s.quit:
+		return nil
+	}
+}
+
+// ServiceMemberDiscovery returns all the members of a service (i.e. with a PTR record).  After Stop it
+// returns nil.
 func (s *MDNS) ServiceMemberDiscovery(service string) []string {
 	dn := serviceFQDN(service)
 
 	// Conmpute all unique members.
 	memberMap := make(map[string]struct{}, 0)
-	req := lookupRequest{dn, dns.TypePTR, make(chan dns.RR, 10)}
-	s.lookup <- req
+	req := lookupRequest{dn, dns.TypePTR, make(chan dns.RR, 10), true}
+	s.lookupCache(req)
 	for rr := <-req.rc; rr != nil; rr = <-req.rc {
 		switch rr := rr.(type) {
 		case *dns.RR_PTR:
@@ -1009,10 +4200,50 @@ func (s *MDNS) ServiceMemberDiscovery(service string) []string {
 	return reply
 }
 
+// DiscoverServiceTypes asks the networks which service types are being offered and returns the
+// distinct types seen, e.g., "_veyronns._tcp.local.".  The returned names can be passed to any
+// of the routines that take a service name.
+func (s *MDNS) DiscoverServiceTypes() []string {
+	q := []dns.Question{{serviceTypesFQDN, dns.TypePTR, s.qclass()}}
+	s.askAll(q)
+
+	// Give the networks a little time to answer.
+	var reply []string
+	for i := 0; i < 3 && len(reply) == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+		reply = s.cachedServiceTypes()
+	}
+	return reply
+}
+
+// cachedServiceTypes returns the distinct service types in the cache.
+func (s *MDNS) cachedServiceTypes() []string {
+	typeMap := make(map[string]struct{}, 0)
+	req := lookupRequest{serviceTypesFQDN, dns.TypePTR, make(chan dns.RR, 10), true}
+	s.lookupCache(req)
+	for rr := <-req.rc; rr != nil; rr = <-req.rc {
+		switch rr := rr.(type) {
+		case *dns.RR_PTR:
+			typeMap[rr.Ptr] = struct{}{}
+		}
+	}
+	var reply []string
+	for t := range typeMap {
+		reply = append(reply, t)
+	}
+	return reply
+}
+
 // ServiceDiscovery returns all current instances of a service (i.e. with a SRV record).
 // We assume the user has already subscribed to the service to get systems on
-// the network to multicast their entries.
+// the network to multicast their entries.  After Stop it returns nil.
 func (s *MDNS) ServiceDiscovery(service string) []ServiceInstance {
+	select {
+	case <-s.quit:
+		return nil
+	default:
+	}
+
 	// Get the current set of members.
 	members := s.ServiceMemberDiscovery(service)
 
@@ -1027,47 +4258,14 @@ func (s *MDNS) ServiceDiscovery(service string) []ServiceInstance {
 		var unresolved []string
 		// First get what the is in the cache.
 		for _, member := range members {
-			var txtRRs []*dns.RR_TXT
-			srvmap := make(map[string]*dns.RR_SRV, 0)
-			req := lookupRequest{member, dns.TypeALL, make(chan dns.RR, 10)}
-			s.lookup <- req
-			for rr := <-req.rc; rr != nil; rr = <-req.rc {
-				switch rr := rr.(type) {
-				case *dns.RR_SRV:
-					// It is a mistake to have two srv rrs with the
-					// same target so we just remember the last seen.
-					srvmap[rr.Target] = rr
-				case *dns.RR_TXT:
-					// We may get the same text record from multiple networks so
-					// we need to suppress dups.
-					found := false
-					for _, txtRR := range txtRRs {
-						if reflect.DeepEqual(rr.Txt, txtRR.Txt) {
-							found = true
-							break
-						}
-					}
-					if !found {
-						txtRRs = append(txtRRs, rr)
-					}
-				}
-			}
-			// We need at least one of each flavor or we'll ask the net for more records.
-			if len(srvmap) == 0 || txtRRs == nil {
+			// We need an interface with at least one of each flavor or we'll ask the net for more records.
+			instances := s.lookupInstances(member, service)
+			if instances == nil {
 				unresolved = append(unresolved, member)
-				if len(srvmap) == 0 {
-					q = append(q, dns.Question{member, dns.TypeSRV, dns.ClassINET})
-				}
-				if txtRRs == nil {
-					q = append(q, dns.Question{member, dns.TypeTXT, dns.ClassINET})
-				}
-			} else {
-				var srvRRs []*dns.RR_SRV
-				for _, rr := range srvmap {
-					srvRRs = append(srvRRs, rr)
-				}
-				resolved = append(resolved, ServiceInstance{Name: instanceUnqualify(member, service), SrvRRs: srvRRs, TxtRRs: txtRRs})
+				q = append(q, dns.Question{member, dns.TypeSRV, s.qclass()}, dns.Question{member, dns.TypeTXT, s.qclass()})
+				continue
 			}
+			resolved = append(resolved, instances...)
 		}
 		if q == nil {
 			// Nothing left to ask for.
@@ -1081,13 +4279,69 @@ func (s *MDNS) ServiceDiscovery(service string) []ServiceInstance {
 		// Note that we may ask but not wait around for the answer (should the loopterminate).
 		// That is purposeful, i.e., priming the pump should the caller retry.
 		members = unresolved
-		for _, mifc := range s.mifcs {
-			mifc.sendQuestion(q)
-		}
+		s.askAll(q)
 	}
 	return resolved
 }
 
+// ServiceDiscoveryExcludingSelf is ServiceDiscovery without the instances we are announcing
+// ourselves, e.g., to build a list of our peers.  Instance names are unique on the link so ours
+// are those with the names we announce the service with.
+func (s *MDNS) ServiceDiscoveryExcludingSelf(service string) []ServiceInstance {
+	serviceDN := serviceFQDN(service)
+	ours := make(map[string]bool)
+	for _, local := range s.LocalServices() {
+		if serviceFQDN(local.Service) == serviceDN {
+			ours[strings.ToLower(local.Name)] = true
+		}
+	}
+	var others []ServiceInstance
+	for _, inst := range s.ServiceDiscovery(service) {
+		if !ours[strings.ToLower(inst.Name)] {
+			others = append(others, inst)
+		}
+	}
+	return others
+}
+
+// How long ServiceDiscoveryTimeout waits without hearing anything new before deciding that all the answers are in.
+const quiescentPeriod = 200 * time.Millisecond
+
+// ServiceDiscoveryTimeout asks the networks for all instances of a service and waits for the answers.  It
+// returns when no new answers have arrived for a short while or when d has elapsed, whichever comes first.
+func (s *MDNS) ServiceDiscoveryTimeout(service string, d time.Duration) []ServiceInstance {
+	serviceDN := serviceFQDN(service)
+
+	// Watch the service so that we can tell when answers arrive.
+	w := s.watch(serviceDN)
+	defer s.unwatch(serviceDN, w)
+	select {
+	case s.query <- []dns.Question{{serviceDN, dns.TypePTR, s.qclass()}}:
+	case <-s.quit:
+		return nil
+	}
+
+	deadline := time.Now().Add(d)
+	heard := time.Now()
+	w.c.L.Lock()
+	gen := w.gen
+	w.c.L.Unlock()
+	for now := time.Now(); now.Before(deadline) && now.Sub(heard) < quiescentPeriod; now = time.Now() {
+		nap := quiescentPeriod / 4
+		if left := deadline.Sub(now); left < nap {
+			nap = left
+		}
+		time.Sleep(nap)
+		w.c.L.Lock()
+		if w.gen != gen {
+			gen = w.gen
+			heard = time.Now()
+		}
+		w.c.L.Unlock()
+	}
+	return s.ServiceDiscovery(service)
+}
+
 // changedRR is called after we add a new record to the cache.  Check to see if a watched service
 // has changed and wake up the corresponding watcher routines.
 func (s *MDNS) changedRR(rr dns.RR) {
@@ -1109,14 +4363,17 @@ func (s *MDNS) changedRR(rr dns.RR) {
 		return
 	}
 	if s.logLevel >= 2 {
-		log.Printf("%s: changed %v\n", s.hostName, rr)
+		s.logger.Printf("%s: changed %v\n", s.hostName, rr)
 	}
 	s.watchedLock.RLock()
-	for _, w := range s.watched[dn] {
-		w.c.L.Lock()
-		w.gen++
-		w.c.L.Unlock()
-		w.c.Broadcast()
+	for sdn, ws := range s.watched {
+		// Watchers of a subtype care about changes to instances of the base service.
+		if sdn != dn && baseServiceFQDN(sdn) != dn {
+			continue
+		}
+		for _, w := range ws {
+			w.wake()
+		}
 	}
 	s.watchedLock.RUnlock()
 }
@@ -1160,37 +4417,63 @@ func deepEqual(a, b *ServiceInstance) bool {
 }
 
 // serviceMemberWatcher gets signalled each time membership might have changed.
-func (s *MDNS) serviceMemberWatcher(service string, w *watchedService, reply chan ServiceInstance) {
-	var old map[string]ServiceInstance
+// If pred isn't nil, only instances it accepts count as members, so one that stops matching is
+// reported as removed.
+//
+// Each instance is compared with what was last delivered for it so that only real changes are.  With a
+// watchDedup window, an instance that disappears is only reported removed if it hasn't come back by the
+// end of the window, and not at all if it comes back unchanged.
+func (s *MDNS) serviceMemberWatcher(service string, pred func(ServiceInstance) bool, w *watchedService, reply chan ServiceInstance) {
+	delivered := make(map[string]ServiceInstance)
+	missing := make(map[string]time.Time) // when we give up on a disappeared instance coming back
 
 	// Loop waiting for changes and tell any to client.
 	for gen, done := 0, false; !done; {
 		// Get current membership.
 		current := make(map[string]ServiceInstance, 0)
 		for _, x := range s.ServiceDiscovery(service) {
-			current[x.Name] = x
+			if pred == nil || pred(x) {
+				current[x.Name] = x
+			}
 		}
 
-		for okey, oval := range old {
-			if cval, ok := current[okey]; !ok {
-				// Entry disappeared.  A message with nil pointers is the signal.
-				oval.SrvRRs = nil
-				oval.TxtRRs = nil
-				reply <- oval
-			} else {
+		now := time.Now()
+		for name, dval := range delivered {
+			if cval, ok := current[name]; ok {
+				delete(missing, name)
 				// See if anything changed other than TTLs.
-				if !deepEqual(&oval, &cval) {
+				if !deepEqual(&dval, &cval) {
 					reply <- cval
+					delivered[name] = cval
+				}
+				continue
+			}
+			// Entry disappeared.
+			if s.watchDedup > 0 {
+				deadline, ok := missing[name]
+				if !ok {
+					deadline = now.Add(s.watchDedup)
+					missing[name] = deadline
+					time.AfterFunc(s.watchDedup, w.wake)
 				}
+				if now.Before(deadline) {
+					continue
+				}
+				delete(missing, name)
 			}
+			dval.SrvRRs = nil
+			dval.TxtRRs = nil
+			dval.Removed = true
+			reply <- dval
+			delete(delivered, name)
 		}
-		for ckey, cval := range current {
-			if _, ok := old[ckey]; !ok {
+		for name, cval := range current {
+			if _, ok := delivered[name]; !ok {
 				// A new instance.
 				reply <- cval
+				delivered[name] = cval
 			}
 		}
-		old = current
 
 		// Wait for the next change.
 		w.c.L.Lock()
@@ -1201,8 +4484,21 @@ func (s *MDNS) serviceMemberWatcher(service string, w *watchedService, reply cha
 		w.c.L.Unlock()
 	}
 
-	// Remove the watched service.
-	serviceDN := serviceFQDN(service)
+	s.unwatch(serviceFQDN(service), w)
+	close(reply)
+}
+
+// watch adds a watcher for a service.  Its generation is incremented whenever the service's records change.
+func (s *MDNS) watch(serviceDN string) *watchedService {
+	w := &watchedService{c: sync.NewCond(new(sync.Mutex))}
+	s.watchedLock.Lock()
+	s.watched[serviceDN] = append(s.watched[serviceDN], w)
+	s.watchedLock.Unlock()
+	return w
+}
+
+// unwatch removes a watcher added by watch.
+func (s *MDNS) unwatch(serviceDN string, w *watchedService) {
 	s.watchedLock.Lock()
 	watched := s.watched[serviceDN]
 	for i, e := range watched {
@@ -1216,21 +4512,26 @@ func (s *MDNS) serviceMemberWatcher(service string, w *watchedService, reply cha
 	}
 	s.watched[serviceDN] = watched
 	s.watchedLock.Unlock()
-	close(reply)
 }
 
 // ServiceMemberWatch returns a reply channel over which membership changes are announced.
-// The returned function stops watching and closes the reply channel. A zero SRV and TXT
-// record means that the instance is no longer a member.
+// The returned function stops watching and closes the reply channel.  An instance with
+// Removed set is no longer a member.
 func (s *MDNS) ServiceMemberWatch(service string) (<-chan ServiceInstance, func()) {
+	return s.ServiceMemberWatchFilter(service, nil)
+}
+
+// ServiceMemberWatchFilter is like ServiceMemberWatch but only delivers instances for which pred
+// returns true, e.g., those whose TXT has role=primary.  pred is called with each instance's SRV and
+// TXT records, see ServiceInstance.TxtValue, every time the service changes, so it should be quick.
+// An instance that was delivered and then stops matching is reported with Removed set, as though it
+// had gone away.  A nil pred matches every instance.
+func (s *MDNS) ServiceMemberWatchFilter(service string, pred func(ServiceInstance) bool) (<-chan ServiceInstance, func()) {
 	serviceDN := serviceFQDN(service)
 
 	// Add a new watcher.
 	c := make(chan ServiceInstance, 20)
-	w := &watchedService{c: sync.NewCond(new(sync.Mutex))}
-	s.watchedLock.Lock()
-	s.watched[serviceDN] = append(s.watched[serviceDN], w)
-	s.watchedLock.Unlock()
+	w := s.watch(serviceDN)
 	stop := func() {
 		w.c.L.Lock()
 		w.done = true
@@ -1240,10 +4541,142 @@ func (s *MDNS) ServiceMemberWatch(service string) (<-chan ServiceInstance, func(
 
 	// Fire off a go routine to do the actual watching. This lives until the stop
 	// function is called.
-	go s.serviceMemberWatcher(service, w, c)
+	go s.serviceMemberWatcher(service, pred, w, c)
+	return c, stop
+}
+
+// ServiceMemberCallback calls fn for each membership change of a service.  The bool is true if the
+// instance was added or changed and false if it was removed.  fn is called serially from a goroutine
+// of its own so a slow fn can't block the network.  The returned function stops the callbacks.
+func (s *MDNS) ServiceMemberCallback(service string, fn func(ServiceInstance, bool)) func() {
+	c, stop := s.ServiceMemberWatch(service)
+	go func() {
+		for inst := range c {
+			fn(inst, !inst.Removed)
+		}
+	}()
+	return stop
+}
+
+// SubscribeToAll subscribes to every service type on the networks: it asks for the types with the DNS-SD
+// meta-query (RFC 6763 section 9), as DiscoverServiceTypes does, and subscribes to each one found,
+// including those that turn up later.  Membership changes of all of them are announced over the returned
+// channel as with ServiceMemberWatch; an instance's Service is its type, e.g., "_http._tcp.local.".  The
+// returned function stops watching, unsubscribes from the types SubscribeToAll subscribed to, and closes
+// the channel.
+func (s *MDNS) SubscribeToAll() (<-chan ServiceInstance, func()) {
+	c := make(chan ServiceInstance, 20)
+	w := s.watch(serviceTypesFQDN)
+	s.subscribe(serviceTypesFQDN)
+	stop := func() {
+		w.c.L.Lock()
+		w.done = true
+		w.c.L.Unlock()
+		w.c.Broadcast()
+	}
+	go s.allServicesWatcher(w, c)
 	return c, stop
 }
 
+// allServicesWatcher gets signalled each time the service types might have changed.  It watches each
+// new type, passing its membership changes on to reply.
+func (s *MDNS) allServicesWatcher(w *watchedService, reply chan ServiceInstance) {
+	var forwarders sync.WaitGroup
+	stops := make(map[string]func())
+	var ours []string // the types we subscribed to
+	for gen, done := 0, false; !done; {
+		for _, t := range s.cachedServiceTypes() {
+			if _, ok := stops[t]; ok {
+				continue
+			}
+			// Others may advertise types we can't browse.
+			stops[t] = func() {}
+			if checkServiceName(t) != nil {
+				continue
+			}
+			s.watchedLock.RLock()
+			_, subscribed := s.subscribed[t]
+			s.watchedLock.RUnlock()
+			if !subscribed {
+				s.subscribe(t)
+				ours = append(ours, t)
+			}
+			var c <-chan ServiceInstance
+			c, stops[t] = s.ServiceMemberWatch(t)
+			forwarders.Add(1)
+			go func() {
+				defer forwarders.Done()
+				for inst := range c {
+					reply <- inst
+				}
+			}()
+		}
+
+		// Wait for the next change.
+		w.c.L.Lock()
+		for gen == w.gen && !w.done {
+			w.c.Wait()
+		}
+		gen, done = w.gen, w.done
+		w.c.L.Unlock()
+	}
+
+	for _, stop := range stops {
+		stop()
+	}
+	forwarders.Wait()
+	for _, t := range ours {
+		s.UnsubscribeFromService(t)
+	}
+	s.unwatch(serviceTypesFQDN, w)
+	s.watchedLock.RLock()
+	last := len(s.watched[serviceTypesFQDN]) == 0
+	s.watchedLock.RUnlock()
+	if last {
+		s.UnsubscribeFromService(serviceTypesFQDN)
+	}
+	close(reply)
+}
+
+// WaitForInstance waits for the instance of service named instanceName, e.g., the host given to
+// AddService, to be discovered and returns it.  If it is already cached, it is returned at once.
+// Otherwise we ask for the service and wait up to timeout for the instance to show up, returning
+// an error wrapping ErrNotFound if it doesn't.
+func (s *MDNS) WaitForInstance(service, instanceName string, timeout time.Duration) (ServiceInstance, error) {
+	if instanceName == "" {
+		return ServiceInstance{}, fmt.Errorf("%w: no instance name", ErrInvalidArgument)
+	}
+	c, stop := s.ServiceMemberWatchFilter(service, func(inst ServiceInstance) bool {
+		return strings.EqualFold(inst.Name, instanceName)
+	})
+	defer func() {
+		stop()
+		for range c {
+		}
+	}()
+
+	// The watcher's first look is at the cache so the question only matters if it isn't there.
+	select {
+	case s.query <- []dns.Question{{serviceFQDN(service), dns.TypePTR, s.qclass()}}:
+	case <-s.quit:
+		return ServiceInstance{}, ErrClosed
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case inst := <-c:
+			if !inst.Removed {
+				return inst, nil
+			}
+		case <-timer.C:
+			return ServiceInstance{}, fmt.Errorf("%w: %s of %s not seen within %v", ErrNotFound, instanceName, service, timeout)
+		case <-s.quit:
+			return ServiceInstance{}, ErrClosed
+		}
+	}
+}
+
 // Hostname return our chosen host name.
 func (s *MDNS) Hostname() string {
 	return s.hostName
@@ -4,14 +4,26 @@
 package mdns
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
 	"net"
 	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/presotto/go-mdns-sd/go_dns"
 )
 
 var (
@@ -25,12 +37,14 @@ type instance struct {
 	txt  []string
 }
 
-func createInstance(service string, inst instance) *MDNS {
+func createInstance(t *testing.T, service string, inst instance) *MDNS {
 	s, err := NewMDNS(inst.host, "224.0.0.254:9999", "[FF02::FF]:9998", true, *logLevelFlag)
 	if err != nil {
-		log.Fatal("can't translate address: %v", err)
+		t.Fatalf("can't create mdns: %v", err)
+	}
+	if err := s.AddService(service, inst.host, inst.port, inst.txt...); err != nil {
+		t.Fatalf("can't add service: %v", err)
 	}
-	s.AddService(service, inst.host, inst.port, inst.txt...)
 	return s
 }
 
@@ -44,7 +58,10 @@ func checkDiscovered(host string, discovered []ServiceInstance, instances ...ins
 	foundsrv := make(map[int]bool)
 	foundtxt := make(map[int]bool)
 	for _, x := range discovered {
-		if len(x.SrvRRs) == 0 && len(x.TxtRRs) == 0 {
+		if x.Removed {
+			if len(x.SrvRRs) != 0 || len(x.TxtRRs) != 0 {
+				return fmt.Errorf("%s found removed instance %s with records", host, x.Name)
+			}
 			for i, inst := range instances {
 				if x.Name == inst.host && inst.port == 0 && len(inst.txt) == 0 {
 					foundsrv[i] = true
@@ -53,6 +70,12 @@ func checkDiscovered(host string, discovered []ServiceInstance, instances ...ins
 			}
 			continue
 		}
+		if now := time.Now(); !x.Expiry.After(now) || x.Expiry.After(now.Add(121*time.Second)) {
+			return fmt.Errorf("%s found instance %s with bad expiry %v", host, x.Name, x.Expiry)
+		}
+		if len(x.Sources) == 0 || x.Sources[0].Interface.Name == "" {
+			return fmt.Errorf("%s found instance %s with bad sources %v", host, x.Name, x.Sources)
+		}
 
 		for _, rr := range x.SrvRRs {
 			found := false
@@ -127,22 +150,33 @@ func TestMdns(t *testing.T) {
 	}
 
 	// Create two mdns instances.
-	s1 := createInstance("veyronns", instances[0])
+	s1 := createInstance(t, "veyronns", instances[0])
 	w1, _ := s1.ServiceMemberWatch("veyronns")
 	if err := watchFor(instances[0].host, w1, instances[0]); err != nil {
 		t.Error(err)
 	}
-	s2 := createInstance("veyronns", instances[1])
+	s2 := createInstance(t, "veyronns", instances[1])
 
-	// Multicast on each interface our desire to know about veyronns instances.
-	s1.SubscribeToService("veyronns")
-	s2.SubscribeToService("veyronns")
+	// Make sure bad services are rejected.
+	if err := s2.AddService("", "", 668); err == nil {
+		t.Errorf("AddService accepted an empty service name")
+	}
+	if err := s2.AddService("veyronns", strings.Repeat("x", 64), 668); err == nil {
+		t.Errorf("AddService accepted a 64 character host label")
+	}
+	if err := s2.AddService("veyronns", "", 668, strings.Repeat("x", 300)); err == nil {
+		t.Errorf("AddService accepted a 300 byte txt string")
+	}
 
-	// Wait for all messages to get out and get reflected back.
-	time.Sleep(3 * time.Second)
+	// Multicast on each interface our desire to know about veyronns instances.
+	for _, s := range []*MDNS{s1, s2} {
+		if err := s.SubscribeToService("veyronns"); err != nil {
+			t.Fatal(err)
+		}
+	}
 
-	// Make sure service discovery returns both instances.
-	discovered := s1.ServiceDiscovery("veyronns")
+	// Make sure service discovery returns both instances once all messages get out and get reflected back.
+	discovered := s1.ServiceDiscoveryTimeout("veyronns", 3*time.Second)
 	if err := checkDiscovered(instances[0].host, discovered, instances...); err != nil {
 		t.Error(err)
 	}
@@ -151,6 +185,12 @@ func TestMdns(t *testing.T) {
 		t.Error(err)
 	}
 
+	// Make sure the service type is advertised.
+	types := s2.DiscoverServiceTypes()
+	if !reflect.DeepEqual(types, []string{serviceFQDN("veyronns")}) {
+		t.Errorf("DiscoverServiceTypes returned %v", types)
+	}
+
 	// Look up addresses for both systems.
 	ips, _ := s1.ResolveAddress(instances[1].host)
 	if err := checkIps(ips); err != nil {
@@ -165,6 +205,67 @@ func TestMdns(t *testing.T) {
 		t.Error(err)
 	}
 
+	// Look up each family separately.  The order within a family should be stable.
+	all := len(ips)
+	ips4, _ := s2.ResolveAddress4(instances[0].host)
+	ips6, _ := s2.ResolveAddress6(instances[0].host)
+	if len(ips4)+len(ips6) != all {
+		t.Errorf("ResolveAddress4 %v and ResolveAddress6 %v don't add up to ResolveAddress %v", ips4, ips6, ips)
+	}
+	for _, ip := range ips4 {
+		if ip.To4() == nil {
+			t.Errorf("ResolveAddress4 returned %v", ip)
+		}
+	}
+	for _, ip := range ips6 {
+		if ip.To4() != nil {
+			t.Errorf("ResolveAddress6 returned %v", ip)
+		}
+	}
+	if again, _ := s2.ResolveAddress4(instances[0].host); !reflect.DeepEqual(again, ips4) {
+		t.Errorf("ResolveAddress4 returned %v then %v", ips4, again)
+	}
+
+	// Ask for a single record type.
+	rrs, err := s1.Query(instanceFQDN(instances[1].host, "veyronns"), dns.TypeTXT)
+	if err != nil || len(rrs) != 1 {
+		t.Errorf("Query returned %v, %v", rrs, err)
+	} else if txt, ok := rrs[0].(*dns.RR_TXT); !ok || !reflect.DeepEqual(txt.Txt, instances[1].txt) {
+		t.Errorf("Query returned %v, wanted TXT %v", rrs[0], instances[1].txt)
+	}
+	if rrs, err := s1.Query("nosuchsystem", dns.TypeA); err != nil || len(rrs) != 0 {
+		t.Errorf("Query for nonexistent name returned %v, %v", rrs, err)
+	}
+
+	// Our hosts answer for the reverse names of their addresses.
+	if ips, _ := s2.ResolveAddress(instances[0].host); len(ips) == 0 {
+		t.Errorf("no addresses for %s", instances[0].host)
+	} else {
+		names, err := s2.ReverseLookup(ips[0])
+		found := false
+		for _, name := range names {
+			found = found || name == hostFQDN(instances[0].host)
+		}
+		if err != nil || !found {
+			t.Errorf("ReverseLookup(%v) returned %v, %v; wanted %s", ips[0], names, err, hostFQDN(instances[0].host))
+		}
+	}
+
+	// Nobody has a documentation address so nobody answers for its reverse name.
+	if names, err := s1.ReverseLookup(net.IPv4(192, 0, 2, 1)); err != nil || len(names) != 0 {
+		t.Errorf("ReverseLookup returned %v, %v", names, err)
+	}
+	if _, err := s1.ReverseLookup(nil); err == nil {
+		t.Errorf("ReverseLookup accepted a nil address")
+	}
+
+	// Make sure a cancelled lookup gives up.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s1.ResolveAddressContext(ctx, "nosuchsystem"); err != context.Canceled {
+		t.Errorf("ResolveAddressContext returned %v, expected %v", err, context.Canceled)
+	}
+
 	// Make sure the watcher learned about both systems.
 	if err := watchFor(instances[0].host, w1, instances[1]); err != nil {
 		t.Error(err)
@@ -181,6 +282,18 @@ func TestMdns(t *testing.T) {
 		t.Errorf("watcher didn't close the channel")
 	}
 
+	// Make sure callbacks work as well.
+	cbc := make(chan ServiceInstance, 20)
+	stopcb := s1.ServiceMemberCallback("veyronns", func(inst ServiceInstance, added bool) {
+		if added {
+			cbc <- inst
+		}
+	})
+	if err := watchFor(instances[0].host, cbc, instances...); err != nil {
+		t.Error(err)
+	}
+	stopcb()
+
 	// Remove a service from one of the mdns instances.
 	s1.RemoveService("veyronns", instances[0].host, instances[0].port, instances[0].txt...)
 
@@ -202,6 +315,2438 @@ func TestMdns(t *testing.T) {
 		t.Error(err)
 	}
 
+	// Change the TXT records of a service.  The watcher should see the change without a removal.  Let
+	// system2's repeated announcements finish first since a cache won't flush records it got within
+	// the last second.
+	time.Sleep(time.Second)
+	updated := instance{instances[1].host, instances[1].port, []string{"updated"}}
+	if err := s2.UpdateServiceTxt("veyronns", updated.host, updated.port, updated.txt...); err != nil {
+		t.Error(err)
+	}
+	if err := watchFor(instances[0].host, w1, updated); err != nil {
+		t.Error(err)
+	}
+	discovered = s2.ServiceDiscovery("veyronns")
+	if err := checkDiscovered(instances[1].host, discovered, updated); err != nil {
+		t.Error(err)
+	}
+	if err := s2.UpdateServiceTxt("veyronns", "nosuchsystem", 1); err == nil {
+		t.Errorf("UpdateServiceTxt succeeded for a service that wasn't added")
+	}
+
+	// Make sure we can't steal someone else's name, but can rename around it.
+	if err := s1.AddService("veyronns", instances[1].host, 999); err != ErrNameConflict {
+		t.Errorf("AddService of a name in use returned %v", err)
+	}
+	name, err := s1.AddServiceWithRename("veyronns", instances[1].host, 999)
+	if err != nil || name != instances[1].host+" (2)" {
+		t.Errorf("AddServiceWithRename returned %s, %v", name, err)
+	}
+
+	opts := ServiceOptions{Rename: true}
+	if name, err := s1.RegisterService("veyronns", instances[1].host, 998, opts); err != nil || name != instances[1].host+" (2)" {
+		t.Errorf("RegisterService with Rename returned %s, %v", name, err)
+	}
+	if name, err := s1.RegisterService("veyronns", instances[1].host, 998, opts); err != nil || name != instances[1].host+" (2)" {
+		t.Errorf("repeated RegisterService with Rename returned %s, %v", name, err)
+	}
+	if err := s1.RemoveService("veyronns", instances[1].host+" (2)", 998); err != nil {
+		t.Error(err)
+	}
+
+	// Adding the same service again does nothing, adding it with new TXT records updates it.
+	if err := s1.AddService("veyronns", name, 999); err != nil {
+		t.Errorf("repeated AddService returned %v", err)
+	}
+	if err := s1.AddService("veyronns", name, 999, "renamed"); err != nil {
+		t.Errorf("AddService with new TXT returned %v", err)
+	}
+
+	// Each side should list only what it is still announcing.
+	local := s1.LocalServices()
+	if len(local) != 1 || local[0].Name != name || local[0].Service != "veyronns" || local[0].SrvRRs[0].Port != 999 ||
+		!reflect.DeepEqual(local[0].TxtRRs[0].Txt, []string{"renamed"}) {
+		t.Errorf("s1.LocalServices returned %v", local)
+	}
+	local = s2.LocalServices()
+	if len(local) != 1 || local[0].Name != updated.host || !reflect.DeepEqual(local[0].TxtRRs[0].Txt, updated.txt) {
+		t.Errorf("s2.LocalServices returned %v", local)
+	}
+
+	// s2 should have cached s1's service, learned from s1 once its announcement arrives.
+	time.Sleep(500 * time.Millisecond)
+	found := false
+	for _, e := range s2.DumpCache() {
+		if srv, ok := e.Record.(*dns.RR_SRV); ok && srv.Port == 999 && !e.Own {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("s2.DumpCache is missing s1's SRV record")
+	}
+
+	// Flushing should drop what s2 learned but keep what it announces; asking again should relearn it.
+	s2.FlushCache(false)
+	for _, e := range s2.DumpCache() {
+		if !e.Own {
+			t.Errorf("s2.FlushCache kept %v", e.Record)
+		}
+	}
+	if local := s2.LocalServices(); len(local) != 1 {
+		t.Errorf("s2.LocalServices after FlushCache returned %v", local)
+	}
+	s2.FlushCache(true)
+	time.Sleep(500 * time.Millisecond)
+	if discovered := s2.ServiceDiscovery("veyronns"); len(discovered) == 0 {
+		t.Errorf("s2 didn't rediscover veyronns after FlushCache")
+	}
+
+	// A host announced with explicit addresses should resolve both ways and go away when removed.
+	boxIP := net.IPv4(10, 1, 2, 3)
+	if err := s1.AddHostAddress("box", boxIP); err != nil {
+		t.Error(err)
+	}
+	if ips, _ := s2.ResolveAddress("box"); len(ips) != 1 || !ips[0].Equal(boxIP) {
+		t.Errorf("s2.ResolveAddress(box) returned %v", ips)
+	}
+	if names, err := s2.ReverseLookup(boxIP); err != nil || len(names) != 1 || names[0] != "box.local." {
+		t.Errorf("s2.ReverseLookup(%v) returned %v, %v", boxIP, names, err)
+	}
+	if err := s1.RemoveHostAddress("box"); err != nil {
+		t.Error(err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if ips, _ := s2.ResolveAddress("box"); len(ips) != 0 {
+		t.Errorf("s2.ResolveAddress(box) after removal returned %v", ips)
+	}
+
+	// Subtype browsers should see only the instances with the subtype; plain browsers see them all.
+	printer := instance{"printer", 668, []string{"color"}}
+	plain := instance{"plain", 669, []string{""}}
+	if err := s1.AddServiceWithSubtypes("http", printer.host, printer.port, []string{"printer"}, printer.txt...); err != nil {
+		t.Error(err)
+	}
+	if err := s1.AddService("http", plain.host, plain.port, plain.txt...); err != nil {
+		t.Error(err)
+	}
+	s2.SubscribeToService(SubtypeService("printer", "http"))
+	s2.SubscribeToService("http")
+	time.Sleep(500 * time.Millisecond)
+	discovered = s2.ServiceDiscovery(SubtypeService("printer", "http"))
+	if err := checkDiscovered(instances[1].host, discovered, printer); err != nil {
+		t.Error(err)
+	}
+	discovered = s2.ServiceDiscovery("http")
+	if err := checkDiscovered(instances[1].host, discovered, printer, plain); err != nil {
+		t.Error(err)
+	}
+	if err := s1.AddServiceWithSubtypes("http", "bad", 670, []string{"a.b"}); err == nil {
+		t.Errorf("AddServiceWithSubtypes accepted a subtype containing a dot")
+	}
+
+	// A service can have its own TTL and a TXT schema version.
+	if err := s1.AddServiceWithOptions("longlived", "long", 671, ServiceOptions{TTL: 4500, Txtvers: 1}, "txtvers=9", "a=b"); err != nil {
+		t.Error(err)
+	}
+	s2.SubscribeToService("longlived")
+	time.Sleep(500 * time.Millisecond)
+	discovered = s2.ServiceDiscovery("longlived")
+	if len(discovered) != 1 || len(discovered[0].SrvRRs) != 1 || discovered[0].SrvRRs[0].Hdr.Ttl < 4000 {
+		t.Errorf("expected one instance with a long TTL, got %v", discovered)
+	}
+	if len(discovered) == 1 {
+		if v, ok := discovered[0].Txtvers(); !ok || v != 1 {
+			t.Errorf("instance has txtvers %d, %v, want 1", v, ok)
+		}
+	}
+
+	// An instance is reachable while something listens on its port.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s1.AddService("reach", "reach", uint16(ln.Addr().(*net.TCPAddr).Port)); err != nil {
+		t.Error(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	discovered = s2.ServiceDiscovery("reach")
+	if len(discovered) != 1 {
+		t.Errorf("expected one reachable instance, got %v", discovered)
+	} else {
+		if !s2.VerifyReachable(discovered[0], time.Second) {
+			t.Errorf("%v isn't reachable", discovered[0])
+		}
+		ln.Close()
+		if s2.VerifyReachable(discovered[0], time.Second) {
+			t.Errorf("%v is reachable with nothing listening", discovered[0])
+		}
+	}
+	ln.Close()
+
+	// Both sides should have been busy.
+	for _, s := range []*MDNS{s1, s2} {
+		stats := s.Stats()
+		if stats.PacketsSent == 0 || stats.PacketsReceived == 0 || stats.QueriesAnswered == 0 || stats.CacheSize == 0 || stats.CacheHits == 0 {
+			t.Errorf("%s: unlikely stats %+v", s.hostName, stats)
+		}
+	}
+
+	// Stopping says goodbye so the renamed service should disappear well before its TTL runs out.
 	s1.Stop()
+	time.Sleep(2 * time.Second)
+	discovered = s2.ServiceDiscovery("veyronns")
+	if err := checkDiscovered(instances[1].host, discovered, updated); err != nil {
+		t.Error(err)
+	}
 	s2.Stop()
 }
+
+func srvInstance(name string, priority, weight uint16) ServiceInstance {
+	srv := NewSrvRR(name+"._test._tcp.local.", dns.ClassINET, 120, name+".local.", 1, priority, weight)
+	return ServiceInstance{Name: name, SrvRRs: []*dns.RR_SRV{srv.(*dns.RR_SRV)}}
+}
+
+func sortedNames(instances []ServiceInstance) string {
+	var names []string
+	for _, si := range instances {
+		names = append(names, si.Name)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestSortBySRV(t *testing.T) {
+	instances := []ServiceInstance{
+		{Name: "gone", Removed: true},
+		srvInstance("light", 1, 1),
+		srvInstance("backup", 2, 100),
+		srvInstance("heavy", 1, 99),
+		srvInstance("primary", 0, 0),
+	}
+
+	// Priorities are always respected.
+	heavyFirst := 0
+	for i := 0; i < 1000; i++ {
+		SortBySRV(instances, rand.New(rand.NewSource(int64(i))))
+		got := sortedNames(instances)
+		switch got {
+		case "primary heavy light backup gone":
+			heavyFirst++
+		case "primary light heavy backup gone":
+		default:
+			t.Fatalf("bad order %s", got)
+		}
+	}
+	// Weights pick the order within a priority.
+	if heavyFirst < 900 {
+		t.Errorf("weight 99 went before weight 1 only %d times in 1000", heavyFirst)
+	}
+
+	// The same seed gives the same order.
+	SortBySRV(instances, rand.New(rand.NewSource(42)))
+	want := sortedNames(instances)
+	for i := 0; i < 10; i++ {
+		SortBySRV(instances, rand.New(rand.NewSource(42)))
+		if got := sortedNames(instances); got != want {
+			t.Errorf("same seed gave %s then %s", want, got)
+		}
+	}
+}
+
+func TestPickSRV(t *testing.T) {
+	if si := PickSRV(nil, nil); si.Name != "" {
+		t.Errorf("PickSRV of nothing returned %v", si)
+	}
+	instances := []ServiceInstance{
+		srvInstance("backup", 1, 100),
+		srvInstance("zero", 0, 0),
+		srvInstance("one", 0, 1),
+		srvInstance("three", 0, 3),
+	}
+
+	// Of a sum of 4, the draw is uniform over 0..4 so zero wins once in 5, one once and three 3 times.
+	rnd := rand.New(rand.NewSource(1))
+	picked := make(map[string]int)
+	const n = 5000
+	for i := 0; i < n; i++ {
+		picked[PickSRV(instances, rnd).Name]++
+	}
+	for name, want := range map[string]int{"zero": n / 5, "one": n / 5, "three": 3 * n / 5, "backup": 0} {
+		if got := picked[name]; got < want-n/25 || got > want+n/25 {
+			t.Errorf("%s picked %d times out of %d, want about %d", name, got, n, want)
+		}
+	}
+	if got := sortedNames(instances); got != "backup zero one three" {
+		t.Errorf("PickSRV reordered its argument to %s", got)
+	}
+}
+
+func TestSubtypeNames(t *testing.T) {
+	dn := SubtypeService("printer", "http")
+	if dn != "_printer._sub._http._tcp.local." {
+		t.Errorf("SubtypeService returned %s", dn)
+	}
+	if got := instanceUnqualify("lp1._http._tcp.local.", dn); got != "lp1" {
+		t.Errorf("instanceUnqualify returned %s", got)
+	}
+	if got := baseServiceFQDN("http"); got != "_http._tcp.local." {
+		t.Errorf("baseServiceFQDN returned %s", got)
+	}
+}
+
+func TestQuerySuppression(t *testing.T) {
+	s := &MDNS{querySuppression: 100 * time.Millisecond, logger: log.Default()}
+	m := newMulticastIfc(4, net.Interface{}, nil, nil, s)
+	a := dns.Question{"a.local.", dns.TypeA, dns.ClassINET}
+	b := dns.Question{"b.local.", dns.TypeA, dns.ClassINET}
+	if q := m.suppress([]dns.Question{a}); len(q) != 1 {
+		t.Errorf("first question suppressed: %v", q)
+	}
+	if q := m.suppress([]dns.Question{a, b}); len(q) != 1 || q[0] != b {
+		t.Errorf("expected only %v, got %v", b, q)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if q := m.suppress([]dns.Question{a, b}); len(q) != 2 {
+		t.Errorf("questions still suppressed after the window: %v", q)
+	}
+	s.querySuppression = 0
+	if q := m.suppress([]dns.Question{a, b}); len(q) != 2 {
+		t.Errorf("questions suppressed with suppression off: %v", q)
+	}
+}
+
+func TestCheckServiceName(t *testing.T) {
+	good := []string{"http", "_http._tcp.local.", "_ipp._udp.example.com.", SubtypeService("printer", "http")}
+	bad := []string{"", "_http._tcp", "http.local", "_http", "http.local.", "_http._sctp.local.", "_printer._sub.local."}
+	for _, service := range good {
+		if err := checkServiceName(service); err != nil {
+			t.Errorf("%q: %v", service, err)
+		}
+	}
+	for _, service := range bad {
+		if err := checkServiceName(service); err == nil {
+			t.Errorf("%q: accepted", service)
+		}
+	}
+}
+
+func TestInterfaceFilter(t *testing.T) {
+	s, err := NewMDNS("", "224.0.0.254:9999", "[FF02::FF]:9998", true, *logLevelFlag, InterfaceFilter(func(net.Interface) bool { return false }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.mifcs) != 0 {
+		t.Errorf("filtered MDNS is using %d interfaces", len(s.mifcs))
+	}
+	if ips, _ := s.ResolveAddress("localhost"); len(ips) != 0 {
+		t.Errorf("filtered MDNS resolved %v", ips)
+	}
+	s.Stop()
+}
+
+func TestCoalesce(t *testing.T) {
+	s := &MDNS{partial: make(map[string]*partialMsg), partialDone: make(chan *partialMsg), quit: make(chan struct{}), logger: log.Default()}
+	defer close(s.quit)
+	mifc := newMulticastIfc(4, net.Interface{Name: "test"}, &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}, nil, s)
+	alice := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5353}
+	bob := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5353}
+	// Queries with known answers.
+	msg := func(truncated bool, host string) *dns.Msg {
+		m := newDnsMsg(0, false, false)
+		m.Truncated = truncated
+		m.Answer = []dns.RR{NewAddressRR(hostFQDN(host), dns.ClassINET, 120, net.IPv4(10, 0, 0, 3))}
+		return m
+	}
+
+	// A truncated query is held until its continuation arrives.  Others go straight through.
+	if m := s.coalesce(&msgFromNet{mifc, alice, msg(true, "a1")}); m != nil {
+		t.Errorf("truncated message wasn't held")
+	}
+
+	// Responses, truncated or not, aren't held or merged into the query.
+	resp := msg(true, "r1")
+	resp.Response = true
+	if m := s.coalesce(&msgFromNet{mifc, alice, resp}); m == nil || len(m.msg.Answer) != 1 {
+		t.Errorf("truncated response was held or merged: %v", m)
+	}
+	if m := s.coalesce(&msgFromNet{mifc, bob, msg(false, "b1")}); m == nil || len(m.msg.Answer) != 1 {
+		t.Errorf("message from another sender was held or merged: %v", m)
+	}
+	if m := s.coalesce(&msgFromNet{mifc, alice, msg(true, "a2")}); m != nil {
+		t.Errorf("truncated continuation wasn't held")
+	}
+	m := s.coalesce(&msgFromNet{mifc, alice, msg(false, "a3")})
+	if m == nil || m.msg.Truncated || len(m.msg.Answer) != 3 {
+		t.Fatalf("continuation wasn't merged: %v", m)
+	}
+	for i, rr := range m.msg.Answer {
+		if want := hostFQDN(fmt.Sprintf("a%d", i+1)); rr.Header().Name != want {
+			t.Errorf("answer %d is for %s, wanted %s", i, rr.Header().Name, want)
+		}
+	}
+
+	// If the continuation never arrives, we give up waiting.
+	s.coalesce(&msgFromNet{mifc, bob, msg(true, "b2")})
+	select {
+	case p := <-s.partialDone:
+		if s.partial[p.key] != p || p.m.sender != bob {
+			t.Errorf("wrong partial message timed out")
+		}
+	case <-time.After(2 * truncatedWait):
+		t.Errorf("truncated message never timed out")
+	}
+}
+
+func TestNsecAnswer(t *testing.T) {
+	s := &MDNS{hostName: "v4only", ttl: 120, services: make(map[string]map[string]announceRequest)}
+	_, v4net, _ := net.ParseCIDR("10.0.0.1/8")
+	mifc := newMulticastIfc(4, net.Interface{Name: "test"}, nil, []*net.IPNet{v4net}, s)
+	m := &msgFromNet{mifc: mifc}
+
+	// Asking for an address we have gets no NSEC.
+	msg := newDnsMsg(0, true, true)
+	s.answerAddress(m, dns.Question{"v4only.local.", dns.TypeA, dns.ClassINET}, msg, dns.TypeA)
+	if len(msg.Answer) != 1 || len(msg.Extra) != 0 {
+		t.Errorf("A question got answers %v and additional %v", msg.Answer, msg.Extra)
+	}
+
+	// Asking for one we don't gets an NSEC saying what we do have.
+	msg = newDnsMsg(0, true, true)
+	s.answerAddress(m, dns.Question{"v4only.local.", dns.TypeAAAA, dns.ClassINET}, msg, dns.TypeAAAA)
+	if len(msg.Answer) != 0 || len(msg.Extra) != 1 {
+		t.Fatalf("AAAA question got answers %v and additional %v", msg.Answer, msg.Extra)
+	}
+	nsec, ok := msg.Extra[0].(*dns.RR_NSEC)
+	if !ok || nsec.NextDomain != "v4only.local." || !reflect.DeepEqual(nsec.Types, []uint16{dns.TypeA}) {
+		t.Errorf("AAAA question got %v", msg.Extra[0])
+	}
+}
+
+func TestLogTo(t *testing.T) {
+	var buf bytes.Buffer
+	s, err := NewMDNS("", "224.0.0.254:9999", "[FF02::FF]:9998", true, 2, LogTo(log.New(&buf, "", 0)),
+		InterfaceFilter(func(net.Interface) bool { return false }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Make sure the main loop is running before stopping.
+	s.ResolveAddress("localhost")
+	s.Stop()
+	if !strings.Contains(buf.String(), "filtering out ifc") {
+		t.Errorf("logger got %q", buf.String())
+	}
+}
+
+func TestInterfaceScan(t *testing.T) {
+	ifcs, err := net.Interfaces()
+	if err != nil || len(ifcs) == 0 {
+		t.Skipf("no interfaces: %v", err)
+	}
+	// Count the scans by counting how often the filter sees one interface.
+	for _, d := range []time.Duration{0, 20 * time.Millisecond} {
+		var scans atomic.Int32
+		s, err := NewMDNS("", "224.0.0.254:9999", "[FF02::FF]:9998", true, *logLevelFlag, InterfaceScanInterval(d),
+			InterfaceFilter(func(ifc net.Interface) bool {
+				if ifc.Index == ifcs[0].Index {
+					scans.Add(1)
+				}
+				return false
+			}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(200 * time.Millisecond)
+		if n := scans.Load(); (d == 0) != (n == 1) {
+			t.Errorf("interval %v: %d scans", d, n)
+		}
+		if _, err := s.ScanInterfaces(); err != nil {
+			t.Errorf("ScanInterfaces: %v", err)
+		}
+		s.Stop()
+		if _, err := s.ScanInterfaces(); err != ErrClosed {
+			t.Errorf("ScanInterfaces after Stop returned %v", err)
+		}
+	}
+}
+
+// getMulticastLoopback reads back the multicast loopback option for a connection.
+func getMulticastLoopback(conn *net.UDPConn, ipversion int) (bool, error) {
+	proto, opt := syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP
+	if ipversion == 6 {
+		proto, opt = syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_LOOP
+	}
+	var v int
+	err := control(conn, func(fd int) error {
+		var err error
+		v, err = syscall.GetsockoptInt(fd, proto, opt)
+		return err
+	})
+	return v != 0, err
+}
+
+func TestMulticastLoopback(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("reading back IP_MULTICAST_LOOP as an int only works on linux")
+	}
+	// The loopback interface delivers IPv4 multicasts to this host whatever the option
+	// says so we can only check that the option is set for each family.
+	for _, v := range []bool{true, false} {
+		s, err := NewMDNS("loop", "224.0.0.254:9999", "[FF02::FF]:9998", true, *logLevelFlag, MulticastLoopback(v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(s.mifcs) == 0 {
+			t.Fatal("no interfaces")
+		}
+		for _, m := range s.mifcs {
+			got, err := getMulticastLoopback(m.conn.(*udpConn).UDPConn, m.ipver)
+			if err != nil {
+				t.Errorf("%s: %v", m, err)
+			} else if got != v {
+				t.Errorf("%s: multicast loopback is %v, wanted %v", m, got, v)
+			}
+		}
+		// Make sure the main loop is running before stopping.
+		s.ResolveAddress("localhost")
+		s.Stop()
+	}
+}
+
+func TestMulticastLoopbackDelivery(t *testing.T) {
+	// The loopback interface loops multicasts back regardless so we need a real one.
+	var ifc *net.Interface
+	ifcs, _ := net.Interfaces()
+	for i := range ifcs {
+		if ifcs[i].Flags&net.FlagUp == 0 || ifcs[i].Flags&net.FlagMulticast == 0 || ifcs[i].Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, _ := ifcs[i].Addrs()
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				ifc = &ifcs[i]
+			}
+		}
+		if ifc != nil {
+			break
+		}
+	}
+	if ifc == nil {
+		t.Skip("no non-loopback multicast interface")
+	}
+
+	// discovered returns whether a second MDNS on this host learns of a service announced by one
+	// with multicast loopback set to v.
+	discovered := func(v bool) bool {
+		opts := []Option{Interfaces(*ifc), DisableIPv6(), InterfaceScanInterval(0), MulticastLoopback(v)}
+		s1, err := NewMDNS("", "224.0.0.254:9999", "", false, *logLevelFlag, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s1.Stop()
+		s2, err := NewMDNS("", "224.0.0.254:9999", "", false, *logLevelFlag, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s2.Stop()
+		service := fmt.Sprintf("loop%v", v)
+		s2.SubscribeToService(service)
+		if err := s1.AddService(service, "looper", 1234); err != nil {
+			t.Fatal(err)
+		}
+		return len(s2.ServiceDiscoveryTimeout(service, 2*time.Second)) > 0
+	}
+	if !discovered(true) {
+		t.Skipf("multicasts on %s don't reach this host even with loopback on", ifc.Name)
+	}
+	if discovered(false) {
+		t.Errorf("with multicast loopback off, a service announced on %s was discovered on the same host", ifc.Name)
+	}
+}
+
+func TestSourcePort(t *testing.T) {
+	lo, err := net.InterfaceByIndex(1)
+	if err != nil {
+		t.Skip(err)
+	}
+	group := &net.UDPAddr{IP: net.ParseIP("224.0.0.254"), Port: 9999}
+	conn, err := net.ListenMulticastUDP("udp4", lo, group)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+
+	// Our host announcement should come from the source port rather than the multicast one.
+	s, err := NewMDNS("sourceport", group.String(), "[FF02::FF]:9998", true, *logLevelFlag, SourcePort(9997),
+		Interfaces(*lo), InterfaceScanInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, maxPacketSize)
+	for {
+		n, from, err := conn.ReadFromUDP(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := new(dns.Msg)
+		if !msg.Unpack(b[:n]) || !msg.Response {
+			continue
+		}
+		if from.Port != 9997 {
+			t.Errorf("response from %v, wanted port 9997", from)
+		}
+		break
+	}
+	s.Stop()
+}
+
+func TestMulticastTTL(t *testing.T) {
+	for _, ttl := range []int{-1, 256} {
+		if _, err := NewMDNS("", "224.0.0.254:9999", "[FF02::FF]:9998", true, *logLevelFlag, MulticastTTL(ttl)); err == nil {
+			t.Errorf("NewMDNS accepted multicast ttl %d", ttl)
+		}
+	}
+	s, err := NewMDNS("", "224.0.0.254:9999", "[FF02::FF]:9998", true, *logLevelFlag, MulticastTTL(1),
+		InterfaceFilter(func(net.Interface) bool { return false }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ResolveAddress("localhost")
+	s.Stop()
+}
+
+func TestReceiveBuffer(t *testing.T) {
+	if _, err := NewMDNS("", "224.0.0.254:9999", "[FF02::FF]:9998", true, *logLevelFlag, ReceiveBufferSize(-1)); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("NewMDNS with a negative receive buffer returned %v", err)
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := SetReceiveBuffer(conn, 4096); err != nil {
+		t.Fatal(err)
+	}
+	// The system may round up, Linux doubles it, but it shouldn't give us less.
+	if n, err := ReceiveBuffer(conn); err != nil || n < 4096 {
+		t.Errorf("ReceiveBuffer returned %d, %v after setting 4096", n, err)
+	}
+}
+
+func TestPacketInfo(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip(err)
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := SetPacketInfo(conn, 4); err != nil {
+		t.Skip(err)
+	}
+	if _, err := conn.WriteToUDP([]byte("hello"), conn.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	b, oob := make([]byte, 16), make([]byte, 128)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, oobn, _, _, err := conn.ReadMsgUDP(b, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i := ReceivedIfIndex(oob[:oobn]); i != lo.Index {
+		t.Errorf("packet arrived on interface %d, want %d", i, lo.Index)
+	}
+	if i := ReceivedIfIndex(nil); i != 0 {
+		t.Errorf("no out-of-band data gave interface %d", i)
+	}
+}
+
+func TestMergeInstances(t *testing.T) {
+	s := &MDNS{logger: log.Default(), mifcs: make(map[string]*multicastIfc)}
+	dn := instanceFQDN("x", "test")
+	add := func(index int, port uint16, txt string) {
+		m := newMulticastIfc(4, net.Interface{Index: index, Name: fmt.Sprintf("eth%d", index)}, nil, nil, s)
+		m.cache.AddFrom(NewSrvRR(dn, dns.ClassINET, 120, hostFQDN("x"), port, 0, 0), net.IPv4(10, 0, byte(index), 1))
+		m.cache.AddFrom(NewTxtRR(dn, dns.ClassINET, 120, []string{txt}), net.IPv4(10, 0, byte(index), 1))
+		s.mifcs[m.String()] = m
+	}
+	add(1, 80, "a")
+	add(2, 80, "a")
+	add(3, 81, "a")
+	add(4, 80, "b")
+
+	// The first two are the same responder; the others differ in port or TXT.
+	instances := s.cachedInstances(dn, "test")
+	if len(instances) != 3 {
+		t.Fatalf("got %d merged instances, want 3: %v", len(instances), instances)
+	}
+	if len(instances[0].Sources) != 2 || instances[0].Sources[0].Interface.Index != 1 || instances[0].Sources[1].Interface.Index != 2 {
+		t.Errorf("merged instance has sources %v", instances[0].Sources)
+	}
+	s.separateInstances = true
+	if instances := s.cachedInstances(dn, "test"); len(instances) != 4 {
+		t.Errorf("got %d separate instances, want 4: %v", len(instances), instances)
+	}
+}
+
+// fakeDNSServer answers every question it gets on a loopback port with a TXT RR until conn is closed.
+func fakeDNSServer(t *testing.T, txt string) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip(err)
+	}
+	go func() {
+		b := make([]byte, maxPacketSize)
+		for {
+			n, from, err := conn.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			msg := new(dns.Msg)
+			if !msg.Unpack(b[:n]) || len(msg.Question) != 1 {
+				continue
+			}
+			msg.Response = true
+			msg.Answer = []dns.RR{NewTxtRR(msg.Question[0].Name, dns.ClassINET, 60, []string{txt})}
+			if out, ok := msg.Pack(); ok {
+				conn.WriteToUDP(out, from)
+			}
+		}
+	}()
+	return conn
+}
+
+func TestResolveUnicast(t *testing.T) {
+	server := fakeDNSServer(t, "from unicast")
+	defer server.Close()
+	s, err := NewMDNS("", "224.0.0.254:9999", "[FF02::FF]:9998", true, *logLevelFlag, UnicastFallback(server.LocalAddr().String()),
+		InterfaceFilter(func(net.Interface) bool { return false }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	rrs, err := s.ResolveUnicast("x._test._tcp.example.com", dns.TypeTXT, server.LocalAddr().String())
+	if err != nil || len(rrs) != 1 || rrs[0].Header().Name != "x._test._tcp.example.com." {
+		t.Fatalf("ResolveUnicast returned %v, %v", rrs, err)
+	}
+	if txt, ok := rrs[0].(*dns.RR_TXT); !ok || !reflect.DeepEqual(txt.Txt, []string{"from unicast"}) {
+		t.Errorf("ResolveUnicast returned %v", rrs[0])
+	}
+
+	// With no interfaces, Resolve has to fall back to the server.
+	rrs, err = s.Resolve("y._test._tcp.example.com.", dns.TypeTXT)
+	if err != nil || len(rrs) != 1 {
+		t.Errorf("Resolve returned %v, %v", rrs, err)
+	}
+}
+
+// fakeTruncatingDNSServer answers every question it gets over UDP with an empty truncated reply and every one it
+// gets over TCP, on the same loopback port, with a TXT RR.  It returns the server's address and a function that
+// stops it.
+func fakeTruncatingDNSServer(t *testing.T, txt string) (string, func()) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip(err)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: l.Addr().(*net.TCPAddr).Port})
+	if err != nil {
+		l.Close()
+		t.Skip(err)
+	}
+	reply := func(b []byte, truncate bool) []byte {
+		msg := new(dns.Msg)
+		if !msg.Unpack(b) || len(msg.Question) != 1 {
+			return nil
+		}
+		msg.Response = true
+		msg.Truncated = truncate
+		if !truncate {
+			msg.Answer = []dns.RR{NewTxtRR(msg.Question[0].Name, dns.ClassINET, 60, []string{txt})}
+		}
+		out, _ := msg.Pack()
+		return out
+	}
+	go func() {
+		b := make([]byte, maxPacketSize)
+		for {
+			n, from, err := conn.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			if out := reply(b[:n], true); out != nil {
+				conn.WriteToUDP(out, from)
+			}
+		}
+	}()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			var n [2]byte
+			if _, err := io.ReadFull(c, n[:]); err == nil {
+				b := make([]byte, int(n[0])<<8|int(n[1]))
+				if _, err := io.ReadFull(c, b); err == nil {
+					if out := reply(b, false); out != nil {
+						c.Write(append([]byte{byte(len(out) >> 8), byte(len(out))}, out...))
+					}
+				}
+			}
+			c.Close()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close(); conn.Close() }
+}
+
+func TestResolveUnicastTCP(t *testing.T) {
+	server, stop := fakeTruncatingDNSServer(t, "over tcp")
+	defer stop()
+	s, err := NewMDNS("", "224.0.0.254:9999", "[FF02::FF]:9998", true, *logLevelFlag,
+		InterfaceFilter(func(net.Interface) bool { return false }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	rrs, err := s.ResolveUnicast("x._test._tcp.example.com.", dns.TypeTXT, server)
+	if err != nil || len(rrs) != 1 {
+		t.Fatalf("ResolveUnicast returned %v, %v", rrs, err)
+	}
+	if txt, ok := rrs[0].(*dns.RR_TXT); !ok || !reflect.DeepEqual(txt.Txt, []string{"over tcp"}) {
+		t.Errorf("ResolveUnicast returned %v", rrs[0])
+	}
+
+	// The server only has TXT RRs.
+	var e *dns.Error
+	if rrs, err := s.ResolveUnicast("x._test._tcp.example.com.", dns.TypeA, server); !errors.As(err, &e) || !e.IsNotFound {
+		t.Errorf("ResolveUnicast of a missing RR returned %v, %v", rrs, err)
+	}
+}
+
+func TestDiscoverOnce(t *testing.T) {
+	if _, err := DiscoverOnce("_bad", 100*time.Millisecond); err == nil {
+		t.Errorf("DiscoverOnce accepted a bad service name")
+	}
+	before := runtime.NumGoroutine()
+	instances, err := DiscoverOnce("test", 100*time.Millisecond, InterfaceFilter(func(net.Interface) bool { return false }))
+	if err != nil || len(instances) != 0 {
+		t.Errorf("DiscoverOnce returned %v, %v", instances, err)
+	}
+	// Give anything that isn't waited for, e.g., timers, a moment to go away.
+	time.Sleep(50 * time.Millisecond)
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("DiscoverOnce left %d goroutines running", after-before)
+	}
+}
+
+func TestMulticastAddr(t *testing.T) {
+	tests := []struct {
+		addr  string
+		ipver int
+		ok    bool
+	}{
+		{"224.0.0.251:5353", 4, true},
+		{"[FF02::FB]:5353", 6, true},
+		{"192.168.1.1:5353", 4, false},
+		{"[fe80::1]:5353", 6, false},
+		{"224.0.0.251:5353", 6, false},
+		{"[FF02::FB]:5353", 4, false},
+		{"224.0.0.251:0", 4, false},
+		{"224.0.0.251", 4, false},
+	}
+	for _, test := range tests {
+		if _, err := multicastAddr(test.addr, test.ipver); (err == nil) != test.ok {
+			t.Errorf("multicastAddr(%q, %d) returned %v", test.addr, test.ipver, err)
+		}
+	}
+	if _, err := NewMDNS("", "192.168.1.1:9999", "", true, *logLevelFlag); err == nil {
+		t.Errorf("NewMDNS accepted a unicast group address")
+	}
+}
+
+func TestDisableIPVersion(t *testing.T) {
+	if _, err := NewMDNS("", "", "", true, *logLevelFlag, DisableIPv4(), DisableIPv6()); err == nil {
+		t.Errorf("NewMDNS accepted disabling both IP versions")
+	}
+	// The v6 address isn't even looked at.
+	s, err := NewMDNS("", "224.0.0.254:9999", "not an address", true, *logLevelFlag, DisableIPv6(), InterfaceScanInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range s.mifcs {
+		if m.ipver != 4 {
+			t.Errorf("using %s", m)
+		}
+		for _, a := range m.addresses {
+			if a.IP.To4() == nil {
+				t.Errorf("%s has IPv6 address %s", m, a)
+			}
+		}
+	}
+	s.ResolveAddress("localhost")
+	s.Stop()
+}
+
+func TestErrors(t *testing.T) {
+	s, err := NewMDNS("", "224.0.0.254:9999", "[FF02::FF]:9998", true, *logLevelFlag, InterfaceFilter(func(net.Interface) bool { return false }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ResolveAddress("localhost")
+	tests := []struct {
+		err  error
+		want error
+	}{
+		{s.AddService("", "host", 1), ErrInvalidService},
+		{s.AddService("_bad", "host", 1), ErrInvalidService},
+		{s.AddService("test", "host", 1, strings.Repeat("x", 256)), ErrInvalidService},
+		{s.AddService("test", "", 1), ErrInvalidArgument},
+		{s.SubscribeToService("a.b"), ErrInvalidService},
+		{s.UpdateServiceTxt("test", "nosuchhost", 1, "x"), ErrNotAnnounced},
+		{s.AddHostAddress("", net.IPv4(10, 1, 2, 3)), ErrInvalidArgument},
+		{s.AddHostAddress("box"), ErrInvalidArgument},
+	}
+	_, err = s.Query("", dns.TypeA)
+	tests = append(tests, struct{ err, want error }{err, ErrInvalidArgument})
+	_, err = NewMDNS("", "192.168.1.1:9999", "", true, *logLevelFlag)
+	tests = append(tests, struct{ err, want error }{err, ErrInvalidArgument})
+	for i, test := range tests {
+		if !errors.Is(test.err, test.want) {
+			t.Errorf("%d: got %v, want %v", i, test.err, test.want)
+		}
+	}
+	s.Stop()
+	if _, err := s.Query("x", dns.TypeA); !errors.Is(err, ErrClosed) {
+		t.Errorf("Query after Stop returned %v", err)
+	}
+}
+
+func TestStopTwice(t *testing.T) {
+	s, err := NewMDNS("", "224.0.0.254:9999", "[FF02::FF]:9998", true, *logLevelFlag, InterfaceFilter(func(net.Interface) bool { return false }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Stop()
+		}()
+	}
+	wg.Wait()
+	s.Stop()
+
+	// Nothing should panic or hang once we're stopped.
+	if err := s.AddService("test", "host", 1); !errors.Is(err, ErrClosed) {
+		t.Errorf("AddService after Stop returned %v", err)
+	}
+	if err := s.RemoveService("test", "host", 1); !errors.Is(err, ErrClosed) {
+		t.Errorf("RemoveService after Stop returned %v", err)
+	}
+	if err := s.UpdateServiceTxt("test", "host", 1, "x"); !errors.Is(err, ErrClosed) {
+		t.Errorf("UpdateServiceTxt after Stop returned %v", err)
+	}
+	if instances := s.ServiceDiscovery("test"); instances != nil {
+		t.Errorf("ServiceDiscovery after Stop returned %v", instances)
+	}
+	if members := s.ServiceMemberDiscovery("test"); members != nil {
+		t.Errorf("ServiceMemberDiscovery after Stop returned %v", members)
+	}
+	if local, cache := s.LocalServices(), s.DumpCache(); local != nil || cache != nil {
+		t.Errorf("LocalServices and DumpCache after Stop returned %v, %v", local, cache)
+	}
+	if rrs := s.ResolveRR("host", dns.TypeA); len(rrs) != 0 {
+		t.Errorf("ResolveRR after Stop returned %v", rrs)
+	}
+	if ips, err := s.ResolveAddressContext(context.Background(), "host"); !errors.Is(err, ErrClosed) {
+		t.Errorf("ResolveAddressContext after Stop returned %v, %v", ips, err)
+	}
+	s.SetOutgoingTTL(10)
+}
+
+func TestExtraGroups(t *testing.T) {
+	for _, g := range []string{"192.168.1.1:9999", "224.0.0.253"} {
+		if _, err := NewMDNS("", "", "", true, *logLevelFlag, ExtraGroups(g)); !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("ExtraGroups(%q) returned %v", g, err)
+		}
+	}
+	if _, err := NewMDNS("", "", "", true, *logLevelFlag, DisableIPv6(), ExtraGroups("[FF02::FD]:9997")); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("ExtraGroups accepted a group for a disabled IP version: %v", err)
+	}
+
+	// Each interface should be on both v4 groups.
+	s, err := NewMDNS("", "224.0.0.254:9999", "", true, *logLevelFlag, DisableIPv6(), ExtraGroups("224.0.0.253:9997"),
+		InterfaceScanInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups := make(map[int][]string)
+	for _, m := range s.mifcs {
+		groups[m.ifc.Index] = append(groups[m.ifc.Index], m.addr.String())
+	}
+	if len(groups) == 0 {
+		t.Errorf("no interfaces")
+	}
+	for index, g := range groups {
+		if sort.Strings(g); !reflect.DeepEqual(g, []string{"224.0.0.253:9997", "224.0.0.254:9999"}) {
+			t.Errorf("interface %d is on groups %v", index, g)
+		}
+	}
+	s.ResolveAddress("localhost")
+	s.Stop()
+}
+
+func TestTxtUpdateDebounce(t *testing.T) {
+	s := &MDNS{logger: log.Default(), mifcs: make(map[string]*multicastIfc), txtDebounce: 200 * time.Millisecond,
+		txtAnnounced: make(map[string]time.Time), txtPending: make(map[string]bool), txtDue: make(chan announceRequest),
+		quit: make(chan struct{})}
+	defer close(s.quit)
+	key := "test " + hostport("x", 1)
+	update := func(txt string) {
+		s.updateTxtAnnounce(announceRequest{"test", "x", "x", 1, []string{txt}, nil, 0})
+	}
+
+	// The first update is announced at once, the rest of the burst waits for the end of the window.
+	start := time.Now()
+	update("1")
+	if s.txtAnnounced[key].IsZero() || s.txtPending[key] {
+		t.Fatalf("first update wasn't announced at once")
+	}
+	for _, txt := range []string{"2", "3", "4"} {
+		update(txt)
+	}
+	if !s.txtPending[key] {
+		t.Fatalf("later updates aren't waiting")
+	}
+	select {
+	case <-s.txtDue:
+		if d := time.Since(start); d < 150*time.Millisecond {
+			t.Errorf("debounced announcement came due after %v", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("debounced announcement never came due")
+	}
+
+	// Only one announcement should come due for the burst.
+	select {
+	case <-s.txtDue:
+		t.Errorf("more than one announcement came due")
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestDuplicateAnswerSuppression(t *testing.T) {
+	s := &MDNS{logger: log.Default()}
+	m1 := newMulticastIfc(4, net.Interface{}, nil, nil, s)
+	m2 := newMulticastIfc(4, net.Interface{}, nil, nil, s)
+	a := dns.NewPTR("_x._tcp.local.", "a._x._tcp.local.", 120)
+	b := dns.NewPTR("_x._tcp.local.", "b._x._tcp.local.", 120)
+	pending := func(mifc *multicastIfc) *delayedResponse {
+		d := &delayedResponse{mifc, new(dns.Msg)}
+		d.msg.Answer = []dns.RR{a, b}
+		s.pending = append(s.pending, d)
+		return d
+	}
+	heard := func(rrs ...dns.RR) {
+		msg := new(dns.Msg)
+		msg.Response = true
+		msg.Answer = rrs
+		s.suppressDuplicates(&msgFromNet{m1, nil, msg})
+	}
+	d1, d2 := pending(m1), pending(m2)
+
+	// Too little of the TTL left doesn't count as an answer.
+	heard(dns.NewPTR("_x._tcp.local.", "a._x._tcp.local.", 59))
+	if len(d1.msg.Answer) != 2 {
+		t.Errorf("answer with low TTL suppressed ours: %v", d1.msg.Answer)
+	}
+
+	// Only responses on the same interface are suppressed.
+	heard(dns.NewPTR("_X._tcp.local.", "a._x._tcp.local.", 60))
+	if len(d1.msg.Answer) != 1 || d1.msg.Answer[0] != b {
+		t.Errorf("expected only %v, got %v", b, d1.msg.Answer)
+	}
+	if len(d2.msg.Answer) != 2 {
+		t.Errorf("answer on another interface suppressed: %v", d2.msg.Answer)
+	}
+	heard(b)
+	if len(d1.msg.Answer) != 0 {
+		t.Errorf("all answers given but still have %v", d1.msg.Answer)
+	}
+}
+
+func TestSubscriptionRequery(t *testing.T) {
+	s := &MDNS{query: make(chan []dns.Question), quit: make(chan struct{}), subscribed: make(map[string]chan struct{})}
+	SubscriptionRequery(20*time.Millisecond, 50*time.Millisecond)(s)
+	defer close(s.quit)
+	if err := s.SubscribeToService("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first question comes after the random delay, the next ones at 20, 40, 50 and 50 ms.
+	last := time.Now()
+	for i, want := range []time.Duration{maxRandomDelay, 20 * time.Millisecond, 40 * time.Millisecond, 50 * time.Millisecond, 50 * time.Millisecond} {
+		select {
+		case q := <-s.query:
+			if q[0].Name != serviceFQDN("test") {
+				t.Errorf("asked %v", q)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("question %d never asked", i)
+		}
+		if d := time.Since(last); i > 0 && (d < want-5*time.Millisecond || d > want+100*time.Millisecond) {
+			t.Errorf("question %d asked after %v, want %v", i, d, want)
+		}
+		last = time.Now()
+	}
+
+	// Once unsubscribed we stop asking.
+	s.UnsubscribeFromService("test")
+	select {
+	case q := <-s.query:
+		t.Errorf("asked %v after unsubscribing", q)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestOnPacket(t *testing.T) {
+	packets := make(chan []byte, 100)
+	s, err := NewMDNS("tap", "224.0.0.254:9999", "[FF02::FF]:9998", true, *logLevelFlag, OnPacket(func(src net.Addr, data []byte) {
+		select {
+		case packets <- data:
+		default:
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	if len(s.mifcs) == 0 {
+		t.Skip("no interfaces")
+	}
+
+	// Our own announcements loop back to us.
+	select {
+	case data := <-packets:
+		msg := new(dns.Msg)
+		if !msg.Unpack(data) {
+			t.Errorf("tapped packet %x doesn't unpack", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("no packets tapped")
+	}
+}
+
+func TestAddServices(t *testing.T) {
+	// Loopback's MTU is large so limit the packets to what fits in an Ethernet frame.
+	const limit = 1440
+	packets := make(chan []byte, 100)
+	s, err := NewMDNS("batch", "224.0.0.254:9999", "[FF02::FF]:9998", true, *logLevelFlag, MaxPacketSize(limit), OnPacket(func(src net.Addr, data []byte) {
+		select {
+		case packets <- data:
+		default:
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	if len(s.mifcs) == 0 {
+		t.Skip("no interfaces")
+	}
+
+	// One bad service keeps all of them from being added.
+	bad := []ServiceSpec{{Service: "batch", Host: "good", Port: 1}, {Service: "bad.service", Host: "bad", Port: 2}}
+	if err := s.AddServices(bad); !errors.Is(err, ErrInvalidService) || !strings.Contains(err.Error(), "bad.service") {
+		t.Errorf("AddServices with a bad service returned %v", err)
+	}
+	if local := s.LocalServices(); len(local) != 0 {
+		t.Errorf("AddServices with a bad service added %v", local)
+	}
+
+	// Enough services with long TXTs to need several messages, but far fewer than one per service.
+	const n = 20
+	var specs []ServiceSpec
+	for i := 0; i < n; i++ {
+		specs = append(specs, ServiceSpec{Service: "batch", Host: fmt.Sprintf("batch%d", i), Port: uint16(1000 + i), Txt: []string{strings.Repeat("x", 100)}})
+	}
+	for len(packets) > 0 {
+		<-packets
+	}
+	if err := s.AddServices(specs); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	messages := 0
+	for len(seen) < n {
+		select {
+		case data := <-packets:
+			msg := new(dns.Msg)
+			if !msg.Unpack(data) || !msg.Response {
+				continue
+			}
+			messages++
+			if len(data) > limit {
+				t.Errorf("announcement of %d bytes", len(data))
+			}
+			for _, rr := range msg.Answer {
+				if ptr, ok := rr.(*dns.RR_PTR); ok && ptr.Hdr.Name == serviceFQDN("batch") {
+					seen[ptr.Ptr] = true
+				}
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("saw announcements of only %d of %d services", len(seen), n)
+		}
+	}
+	if messages >= n/2 {
+		t.Errorf("%d services took %d messages", n, messages)
+	}
+	if local := s.LocalServices(); len(local) != n {
+		t.Errorf("LocalServices returned %d services, want %d", len(local), n)
+	}
+}
+
+func TestCachedIPAddrs(t *testing.T) {
+	s := &MDNS{logger: log.Default(), mifcs: make(map[string]*multicastIfc)}
+	dn := hostFQDN("x")
+	for _, name := range []string{"eth0", "eth1"} {
+		m := newMulticastIfc(6, net.Interface{Name: name}, nil, nil, s)
+		m.cache.Add(dns.NewA(dn, net.IPv4(10, 0, 0, 1), 120))
+		m.cache.Add(dns.NewAAAA(dn, net.ParseIP("fe80::1"), 120))
+		m.cache.Add(dns.NewAAAA(dn, net.ParseIP("2001:db8::1"), 120))
+		s.mifcs[name] = m
+	}
+	got := make(map[string]bool)
+	for _, addr := range s.cachedIPAddrs(dn, dns.TypeALL) {
+		got[addr.String()] = true
+	}
+	want := map[string]bool{"10.0.0.1": true, "fe80::1%eth0": true, "fe80::1%eth1": true, "2001:db8::1": true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got addresses %v, want %v", got, want)
+	}
+	if addrs := s.cachedIPAddrs(dn, dns.TypeA); len(addrs) != 1 || addrs[0].Zone != "" {
+		t.Errorf("got IPv4 addresses %v", addrs)
+	}
+}
+
+func TestScopedGroups(t *testing.T) {
+	s := &MDNS{logger: log.Default()}
+	eth1 := net.Interface{Index: 2, Name: "eth1"}
+	for _, c := range []struct {
+		ipver int
+		group string
+		zone  string
+	}{
+		{6, "[ff02::fb]:5353", "eth1"},
+		{6, "[ff01::fb]:5353", "eth1"},
+		{6, "[ff05::fb]:5353", ""},
+		{4, "224.0.0.251:5353", ""},
+	} {
+		g, err := net.ResolveUDPAddr("udp", c.group)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := newMulticastIfc(c.ipver, eth1, g, nil, s)
+		if m.addr.Zone != c.zone || !m.addr.IP.Equal(g.IP) || m.addr.Port != g.Port {
+			t.Errorf("%s on eth1 is %v, want zone %q", c.group, m.addr, c.zone)
+		}
+		if g.Zone != "" {
+			t.Errorf("scoping %s changed the shared address", c.group)
+		}
+	}
+
+	// Several interfaces each get their own copy.
+	g := &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: 5353}
+	m0 := newMulticastIfc(6, net.Interface{Index: 1, Name: "eth0"}, g, nil, s)
+	m1 := newMulticastIfc(6, eth1, g, nil, s)
+	if m0.addr.Zone != "eth0" || m1.addr.Zone != "eth1" {
+		t.Errorf("got groups %v and %v", m0.addr, m1.addr)
+	}
+}
+
+// The most a message sent on a MemoryNetwork host's IPv4 interface holds: its MTU less the IP and UDP
+// headers.
+const memPacketLimit = 1500 - 20 - 8
+
+// newMemMDNS starts an MDNS on a MemoryNetwork host with address 10.0.0.<n>.
+func newMemMDNS(network *MemoryNetwork, host string, n byte) (*MDNS, error) {
+	ipnet := &net.IPNet{IP: net.IPv4(10, 0, 0, n), Mask: net.CIDRMask(24, 32)}
+	return NewMDNS(host, "", "", false, *logLevelFlag, UseTransport(network.Host(ipnet)), InterfaceScanInterval(0))
+}
+
+func TestMemoryNetwork(t *testing.T) {
+	network := NewMemoryNetwork()
+	s1, err := newMemMDNS(network, "mem1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Stop()
+	s2, err := newMemMDNS(network, "mem2", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Stop()
+
+	// A host name that's in use from another address is refused.
+	if s, err := newMemMDNS(network, "mem1", 3); !errors.Is(err, ErrNameConflict) {
+		t.Errorf("NewMDNS with a name in use returned %v", err)
+		if s != nil {
+			s.Stop()
+		}
+	}
+
+	if err := s1.AddService("memtest", "", 1234, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.SubscribeToService("memtest"); err != nil {
+		t.Fatal(err)
+	}
+	discovered := s2.ServiceDiscoveryTimeout("memtest", 2*time.Second)
+	if len(discovered) != 1 || discovered[0].Name != "mem1" || discovered[0].SrvRRs[0].Port != 1234 {
+		t.Fatalf("s2 discovered %v", discovered)
+	}
+	if ips, _ := s2.ResolveAddress("mem1"); len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("s2 resolved mem1 to %v", ips)
+	}
+
+	rs, err := s2.ResolveService("mem1._memtest._tcp", 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs.Targets) != 1 || rs.Targets[0].Host != "mem1.local." || rs.Targets[0].Port != 1234 ||
+		len(rs.Targets[0].Addrs) != 1 || !rs.Targets[0].Addrs[0].IP.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("ResolveService returned targets %+v", rs.Targets)
+	}
+	if v, ok := rs.Txt["a"]; !ok || v != nil {
+		t.Errorf("ResolveService returned TXT %v", rs.Txt)
+	}
+	if _, err := s2.ResolveService("nosuch._memtest._tcp.local.", 300*time.Millisecond); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ResolveService of a missing instance returned %v", err)
+	}
+	if _, err := s2.ResolveService("notaninstance", time.Second); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("ResolveService of a bad name returned %v", err)
+	}
+
+	// Claiming names s1 is using.
+	tests := []struct {
+		host   string
+		opts   ServiceOptions
+		name   string
+		wanted error
+	}{
+		{"mem1", ServiceOptions{}, "", ErrNameConflict},
+		{"mem1", ServiceOptions{Rename: true}, "mem1 (2)", nil},
+		{"other", ServiceOptions{}, "other", nil},
+	}
+	for _, test := range tests {
+		name, err := s2.RegisterService("memtest", test.host, 4321, test.opts)
+		if name != test.name || !errors.Is(err, test.wanted) {
+			t.Errorf("RegisterService %s %+v returned %q, %v; want %q, %v", test.host, test.opts, name, err, test.name, test.wanted)
+		}
+	}
+	// mem1 is s1's host name too, so the renamed instance's SRV RR names a renamed host.
+	target := ""
+	for _, local := range s2.LocalServices() {
+		if local.Name == "mem1 (2)" {
+			target = local.SrvRRs[0].Target
+		}
+	}
+	if target != "mem1-2.local." {
+		t.Errorf("renamed instance has SRV target %q, want mem1-2.local.", target)
+	}
+}
+
+func TestAdditionalRecords(t *testing.T) {
+	network := NewMemoryNetwork()
+	s, err := newMemMDNS(network, "", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	// A responder that, like many, puts the target's address in the additional section.
+	ipnet := &net.IPNet{IP: net.IPv4(10, 0, 0, 2), Mask: net.CIDRMask(24, 32)}
+	ifcs, _ := network.Host(ipnet).Interfaces()
+	conn, err := network.Host(ipnet).Listen(ifcs[0], s.v4addr, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	msg := newDnsMsg(0, true, true)
+	msg.Answer = append(msg.Answer, NewSrvRR(instanceFQDN("other", "extra"), dns.ClassINET|0x8000, 120, "other.local.", 80, 0, 0))
+	msg.Extra = append(msg.Extra, NewAddressRR("other.local.", dns.ClassINET|0x8000, 120, ipnet.IP))
+	buf, _ := msg.Pack()
+	if _, err := conn.WriteTo(buf, s.v4addr); err != nil {
+		t.Fatal(err)
+	}
+
+	// The address should be cached without asking for it.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var found *CacheEntry
+		for _, e := range s.DumpCache() {
+			if _, ok := e.Record.(*dns.RR_A); ok && e.Record.Header().Name == "other.local." {
+				found = &e
+			}
+		}
+		if found != nil {
+			if !found.Additional {
+				t.Errorf("additional address cached as an answer")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("additional address never cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPassive(t *testing.T) {
+	network := NewMemoryNetwork()
+	ipnet := &net.IPNet{IP: net.IPv4(10, 0, 0, 2), Mask: net.CIDRMask(24, 32)}
+	observer, err := NewMDNS("", "", "", false, *logLevelFlag, UseTransport(network.Host(ipnet)), Passive(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer observer.Stop()
+
+	// Watch the network for anything the observer sends.
+	ifcs, _ := network.Host(ipnet).Interfaces()
+	sniffer, err := network.Host(&net.IPNet{IP: net.IPv4(10, 0, 0, 3), Mask: net.CIDRMask(24, 32)}).Listen(ifcs[0], observer.v4addr, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sniffer.Close()
+	sent := make(chan *net.UDPAddr, 100)
+	go func() {
+		b := make([]byte, maxPacketSize)
+		for {
+			_, from, _, err := sniffer.ReadPacket(b)
+			if err != nil {
+				return
+			}
+			if from.IP.Equal(ipnet.IP) {
+				sent <- from
+			}
+		}
+	}()
+
+	s, err := newMemMDNS(network, "active", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	if err := s.AddService("passive", "", 1234); err != nil {
+		t.Fatal(err)
+	}
+	// The observer only learns of the service from its announcement.
+	observer.SubscribeToService("passive")
+	var discovered []ServiceInstance
+	for deadline := time.Now().Add(2 * time.Second); len(discovered) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		discovered = observer.ServiceDiscovery("passive")
+	}
+	if len(discovered) != 1 || discovered[0].Name != "active" {
+		t.Errorf("observer discovered %v", discovered)
+	}
+	if ips, _ := observer.ResolveAddress("active"); len(ips) != 1 {
+		t.Errorf("observer resolved active to %v", ips)
+	}
+	if err := observer.AddService("passive", "observer", 1); !errors.Is(err, ErrPassive) {
+		t.Errorf("AddService in passive mode returned %v", err)
+	}
+	if err := observer.AddHostAddress("observer", ipnet.IP); !errors.Is(err, ErrPassive) {
+		t.Errorf("AddHostAddress in passive mode returned %v", err)
+	}
+	select {
+	case from := <-sent:
+		t.Errorf("passive observer sent a packet from %v", from)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestServiceMemberWatchFilter(t *testing.T) {
+	network := NewMemoryNetwork()
+	s, err := newMemMDNS(network, "announcer", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	watcher, err := newMemMDNS(network, "watcher", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Stop()
+
+	watcher.SubscribeToService("filtered")
+	c, stop := watcher.ServiceMemberWatchFilter("filtered", func(inst ServiceInstance) bool {
+		v, _ := inst.TxtValue("Role")
+		return string(v) == "primary"
+	})
+	defer stop()
+	next := func() ServiceInstance {
+		select {
+		case inst := <-c:
+			return inst
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for the watcher")
+		}
+		return ServiceInstance{}
+	}
+
+	if err := s.AddService("filtered", "backup", 1, "ROLE=backup"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddService("filtered", "primary", 2, "ROLE=primary"); err != nil {
+		t.Fatal(err)
+	}
+	if inst := next(); inst.Name != "primary" || inst.Removed {
+		t.Errorf("got %+v, wanted primary", inst)
+	}
+
+	// Once it stops matching, the primary is removed as far as the watcher is concerned.
+	if err := s.UpdateServiceTxt("filtered", "primary", 2, "ROLE=backup"); err != nil {
+		t.Fatal(err)
+	}
+	if inst := next(); inst.Name != "primary" || !inst.Removed {
+		t.Errorf("got %+v, wanted primary removed", inst)
+	}
+	if err := s.UpdateServiceTxt("filtered", "backup", 1, "role=primary"); err != nil {
+		t.Fatal(err)
+	}
+	if inst := next(); inst.Name != "backup" || inst.Removed {
+		t.Errorf("got %+v, wanted backup", inst)
+	}
+	select {
+	case inst := <-c:
+		t.Errorf("unexpected %+v", inst)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	network := NewMemoryNetwork()
+	s, err := newMemMDNS(network, "announcer", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	packets := make(chan []byte, 100)
+	ipnet := &net.IPNet{IP: net.IPv4(10, 0, 0, 2), Mask: net.CIDRMask(24, 32)}
+	listener, err := NewMDNS("listener", "", "", false, *logLevelFlag, UseTransport(network.Host(ipnet)), InterfaceScanInterval(0), OnPacket(func(src net.Addr, data []byte) {
+		select {
+		case packets <- data:
+		default:
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Stop()
+
+	const n = 20
+	var specs []ServiceSpec
+	for i := 0; i < n; i++ {
+		specs = append(specs, ServiceSpec{Service: "announce", Host: fmt.Sprintf("announce%d", i), Port: uint16(1000 + i), Txt: []string{strings.Repeat("x", 100)}})
+	}
+	if err := s.AddServices(specs); err != nil {
+		t.Fatal(err)
+	}
+
+	// Let the first announcement go by, then force another well before the scheduled repeat.
+	for quiet := false; !quiet; {
+		select {
+		case <-packets:
+		case <-time.After(100 * time.Millisecond):
+			quiet = true
+		}
+	}
+	s.Announce()
+	seen := make(map[string]bool)
+	for deadline := time.After(500 * time.Millisecond); len(seen) < n; {
+		select {
+		case data := <-packets:
+			msg := new(dns.Msg)
+			if !msg.Unpack(data) || !msg.Response {
+				continue
+			}
+			if len(data) > memPacketLimit {
+				t.Errorf("announcement of %d bytes", len(data))
+			}
+			for _, rr := range msg.Answer {
+				if ptr, ok := rr.(*dns.RR_PTR); ok && ptr.Hdr.Name == serviceFQDN("announce") {
+					seen[ptr.Ptr] = true
+				}
+			}
+		case <-deadline:
+			t.Fatalf("Announce reannounced only %d of %d services", len(seen), n)
+		}
+	}
+
+	// After Stop, Announce returns at once.
+	s.Stop()
+	s.Announce()
+}
+
+func TestSelfDiscovery(t *testing.T) {
+	network := NewMemoryNetwork()
+	s, err := newMemMDNS(network, "self", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	other, err := newMemMDNS(network, "other", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Stop()
+
+	// The memory network, like multicast loopback, delivers everything we send back to us too.
+	s.SubscribeToService("self")
+	if err := s.AddService("self", "", 1234); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.AddService("self", "", 1235); err != nil {
+		t.Fatal(err)
+	}
+	var discovered []ServiceInstance
+	for deadline := time.Now().Add(2 * time.Second); len(discovered) < 2 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		discovered = s.ServiceDiscovery("self")
+	}
+	if len(discovered) != 2 {
+		t.Fatalf("discovered %v", discovered)
+	}
+
+	// Our own records stay ours, once each, rather than being relearned from the network, while
+	// the other's are learned from it.
+	cachedSRVs := func() map[string]CacheEntry {
+		srvs := make(map[string]CacheEntry)
+		for _, e := range s.DumpCache() {
+			if e.Record.Header().Rrtype != dns.TypeSRV {
+				continue
+			}
+			if _, ok := srvs[e.Record.Header().Name]; ok {
+				t.Errorf("%v cached twice", e.Record)
+			}
+			srvs[e.Record.Header().Name] = e
+		}
+		return srvs
+	}
+	s.Announce()
+	time.Sleep(100 * time.Millisecond)
+	srvs := cachedSRVs()
+	if e := srvs[instanceFQDN("self", "self")]; !e.Own || e.Sender != nil {
+		t.Errorf("own SRV cached as %+v", e)
+	}
+	if e := srvs[instanceFQDN("other", "self")]; e.Own || !e.Sender.Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Errorf("other's SRV cached as %+v", e)
+	}
+
+	// We still answer others' questions.
+	if instances := other.ServiceDiscovery("self"); len(instances) != 2 {
+		t.Errorf("other discovered %v", instances)
+	}
+
+	// Leaving ourselves out leaves the other.
+	if peers := s.ServiceDiscoveryExcludingSelf("self"); len(peers) != 1 || peers[0].Name != "other" {
+		t.Errorf("ServiceDiscoveryExcludingSelf returned %v", peers)
+	}
+	if peers := other.ServiceDiscoveryExcludingSelf("self"); len(peers) != 1 || peers[0].Name != "self" {
+		t.Errorf("other's ServiceDiscoveryExcludingSelf returned %v", peers)
+	}
+
+	// Someone else's goodbye for our record doesn't make it go away.
+	ipnet := &net.IPNet{IP: net.IPv4(10, 0, 0, 3), Mask: net.CIDRMask(24, 32)}
+	ifcs, _ := network.Host(ipnet).Interfaces()
+	conn, err := network.Host(ipnet).Listen(ifcs[0], s.v4addr, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	goodbye := newDnsMsg(0, true, true)
+	goodbye.Answer = append(goodbye.Answer, NewSrvRR(instanceFQDN("self", "self"), 0x8000|dns.ClassINET, 0, hostFQDN("self"), 1234, 0, 0))
+	buf, _ := goodbye.Pack()
+	if _, err := conn.WriteTo(buf, s.v4addr); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if _, ok := cachedSRVs()[instanceFQDN("self", "self")]; !ok {
+		t.Errorf("a goodbye from someone else removed our SRV")
+	}
+}
+
+func TestWatchDedupWindow(t *testing.T) {
+	network := NewMemoryNetwork()
+	s1, err := newMemMDNS(network, "flapper", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Stop()
+	plain, err := newMemMDNS(network, "plain", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Stop()
+	ipnet := &net.IPNet{IP: net.IPv4(10, 0, 0, 3), Mask: net.CIDRMask(24, 32)}
+	dedup, err := NewMDNS("dedup", "", "", false, *logLevelFlag, UseTransport(network.Host(ipnet)), InterfaceScanInterval(0), WatchDedupWindow(1500*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dedup.Stop()
+
+	plain.SubscribeToService("flap")
+	dedup.SubscribeToService("flap")
+	pc, pstop := plain.ServiceMemberWatch("flap")
+	defer pstop()
+	dc, dstop := dedup.ServiceMemberWatch("flap")
+	defer dstop()
+	next := func(c <-chan ServiceInstance, d time.Duration) (ServiceInstance, bool) {
+		select {
+		case inst := <-c:
+			return inst, true
+		case <-time.After(d):
+			return ServiceInstance{}, false
+		}
+	}
+
+	if err := s1.AddService("flap", "", 1234, "x=1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []<-chan ServiceInstance{pc, dc} {
+		if inst, ok := next(c, 2*time.Second); !ok || inst.Removed {
+			t.Fatalf("got %v, %v; wanted the new instance", inst, ok)
+		}
+	}
+
+	// Gone and back again with the same records: the plain watcher hears both, the other neither.
+	if err := s1.RemoveService("flap", "", 1234, "x=1"); err != nil {
+		t.Fatal(err)
+	}
+	if inst, ok := next(pc, 5*time.Second); !ok || !inst.Removed {
+		t.Fatalf("plain watcher got %v, %v; wanted a removal", inst, ok)
+	}
+	if err := s1.AddService("flap", "", 1234, "x=1"); err != nil {
+		t.Fatal(err)
+	}
+	if inst, ok := next(pc, 2*time.Second); !ok || inst.Removed {
+		t.Errorf("plain watcher got %v, %v; wanted the instance back", inst, ok)
+	}
+	if inst, ok := next(dc, 2*time.Second); ok {
+		t.Errorf("deduplicating watcher got %+v", inst)
+	}
+
+	// Changes aren't held back.  A repeated announcement of the old TXT may still be cached, so
+	// there can be more than one change before only the new one is left.
+	if err := s1.UpdateServiceTxt("flap", "", 1234, "x=2"); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(3 * time.Second); ; {
+		inst, ok := next(dc, time.Until(deadline))
+		if !ok || inst.Removed {
+			t.Fatalf("deduplicating watcher got %v, %v; wanted the change", inst, ok)
+		}
+		if txt := inst.MergedTxt(); len(txt) == 1 && txt[0] == "x=2" {
+			break
+		}
+	}
+
+	// Gone for good is reported at the end of the window.
+	if err := s1.RemoveService("flap", "", 1234, "x=2"); err != nil {
+		t.Fatal(err)
+	}
+	if inst, ok := next(dc, 5*time.Second); !ok || !inst.Removed {
+		t.Errorf("deduplicating watcher got %v, %v; wanted a removal", inst, ok)
+	}
+}
+
+func TestWaitForInstance(t *testing.T) {
+	network := NewMemoryNetwork()
+	s1, err := newMemMDNS(network, "announcer", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Stop()
+	s2, err := newMemMDNS(network, "waiter", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Stop()
+
+	if err := s1.AddService("wait", "early", 1); err != nil {
+		t.Fatal(err)
+	}
+	if inst, err := s2.WaitForInstance("wait", "early", 2*time.Second); err != nil || inst.Name != "early" {
+		t.Fatalf("WaitForInstance(early) returned %v, %v", inst, err)
+	}
+
+	// Once cached, there is no waiting.
+	start := time.Now()
+	if _, err := s2.WaitForInstance("wait", "early", 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("waiting for a cached instance took %v", d)
+	}
+
+	// One that shows up later is waited for, whatever the case of its name.
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		s1.AddService("wait", "late", 2)
+	}()
+	if inst, err := s2.WaitForInstance("wait", "LATE", 3*time.Second); err != nil || inst.Name != "late" || len(inst.SrvRRs) == 0 {
+		t.Errorf("WaitForInstance(LATE) returned %v, %v", inst, err)
+	}
+
+	start = time.Now()
+	if _, err := s2.WaitForInstance("wait", "never", 200*time.Millisecond); !errors.Is(err, ErrNotFound) {
+		t.Errorf("WaitForInstance(never) returned %v", err)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("gave up after %v", d)
+	}
+	if _, err := s2.WaitForInstance("wait", "", time.Second); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("WaitForInstance with no name returned %v", err)
+	}
+	s2.Stop()
+	if _, err := s2.WaitForInstance("wait", "early", time.Second); !errors.Is(err, ErrClosed) {
+		t.Errorf("WaitForInstance after Stop returned %v", err)
+	}
+}
+
+func TestQueryMulti(t *testing.T) {
+	network := NewMemoryNetwork()
+	questions := make(chan []dns.Question, 100)
+	ipnet := &net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(24, 32)}
+	s1, err := NewMDNS("responder", "", "", false, *logLevelFlag, UseTransport(network.Host(ipnet)), InterfaceScanInterval(0), OnPacket(func(src net.Addr, data []byte) {
+		msg := new(dns.Msg)
+		if msg.Unpack(data) && !msg.Response {
+			if len(data) > memPacketLimit {
+				t.Errorf("query of %d bytes", len(data))
+			}
+			questions <- msg.Question
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Stop()
+	if err := s1.AddService("multi", "", 1); err != nil {
+		t.Fatal(err)
+	}
+	s2, err := newMemMDNS(network, "querier", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Stop()
+
+	// A dozen services in one packet, answered as usual.
+	var names []string
+	for i := 0; i < 12; i++ {
+		names = append(names, fmt.Sprintf("_multi%d._tcp.local.", i))
+	}
+	names = append(names, serviceFQDN("multi"))
+	time.Sleep(100 * time.Millisecond)
+	for len(questions) > 0 {
+		<-questions
+	}
+	rrs, err := s2.QueryMulti(names, dns.TypePTR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rrs) != 1 || rrs[0].(*dns.RR_PTR).Ptr != instanceFQDN("responder", "multi") {
+		t.Errorf("QueryMulti returned %v", rrs)
+	}
+	if n := len(questions); n != 1 {
+		t.Fatalf("%d queries for %d names", n, len(names))
+	}
+	if q := <-questions; len(q) != len(names) {
+		t.Errorf("query with %d questions for %d names", len(q), len(names))
+	}
+
+	// Too many to fit are spread over as few packets as needed.
+	names = nil
+	for i := 0; i < 40; i++ {
+		names = append(names, fmt.Sprintf("%s%d._tcp.local.", strings.Repeat("x", 50), i))
+	}
+	if _, err := s2.QueryMulti(names, dns.TypeSRV); err != nil {
+		t.Fatal(err)
+	}
+	asked := 0
+	for n := len(questions); n > 0; n-- {
+		asked += len(<-questions)
+	}
+	if asked != len(names) {
+		t.Errorf("asked %d of %d questions", asked, len(names))
+	}
+
+	if _, err := s2.QueryMulti(nil, dns.TypePTR); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("QueryMulti with no names returned %v", err)
+	}
+}
+
+func TestEDNS0Options(t *testing.T) {
+	network := NewMemoryNetwork()
+	capability := dns.EDNS0Option{65001, []byte("unicast")}
+	ipnet := &net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(24, 32)}
+	s1, err := NewMDNS("edns1", "", "", false, *logLevelFlag, UseTransport(network.Host(ipnet)), EDNS0Options(capability))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Stop()
+	heard := make(chan []dns.EDNS0Option, 10)
+	ipnet = &net.IPNet{IP: net.IPv4(10, 0, 0, 2), Mask: net.CIDRMask(24, 32)}
+	s2, err := NewMDNS("", "", "", false, *logLevelFlag, UseTransport(network.Host(ipnet)), OnEDNS0Options(func(src net.Addr, opts []dns.EDNS0Option) {
+		if src.(*net.UDPAddr).IP.Equal(net.IPv4(10, 0, 0, 1)) {
+			select {
+			case heard <- opts:
+			default:
+			}
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Stop()
+
+	// s1's answers carry its options too.
+	if ips, _ := s2.ResolveAddress("edns1"); len(ips) == 0 {
+		t.Fatalf("couldn't resolve edns1")
+	}
+	select {
+	case opts := <-heard:
+		if len(opts) != 1 || opts[0].Code != capability.Code || !bytes.Equal(opts[0].Data, capability.Data) {
+			t.Errorf("heard options %v, want %v", opts, capability)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("heard no options from s1")
+	}
+}
+
+func TestMergedTxt(t *testing.T) {
+	dn := instanceFQDN("x", "test")
+	txt := func(strs ...string) *dns.RR_TXT {
+		return NewTxtRR(dn, dns.ClassINET, 120, strs).(*dns.RR_TXT)
+	}
+	a := txt("path=/b", "Color=red", "bare")
+	b := txt("path=/a", "color=blue", "size=2", "", "=x")
+	want := []string{"path=/a", "color=blue", "size=2", "bare"}
+
+	// The order the RRs arrived in, and duplicates, don't matter.
+	for _, rrs := range [][]*dns.RR_TXT{{a, b}, {b, a}, {a, b, a}} {
+		if got := (ServiceInstance{TxtRRs: rrs}).MergedTxt(); !reflect.DeepEqual(got, want) {
+			t.Errorf("MergedTxt of %v = %q, want %q", rrs, got, want)
+		}
+	}
+	if got := (ServiceInstance{TxtRRs: []*dns.RR_TXT{txt()}}).MergedTxt(); len(got) != 0 {
+		t.Errorf("MergedTxt of an empty TXT = %q", got)
+	}
+}
+
+func TestResponseDelay(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		if d := randomDelay(); d < 20*time.Millisecond || d > 120*time.Millisecond {
+			t.Fatalf("randomDelay returned %v", d)
+		}
+	}
+	msg := newDnsMsg(0, true, true)
+	msg.Answer = append(msg.Answer, NewSrvRR("x._test._tcp.local.", 0x8000|dns.ClassINET, 120, "x.local.", 1, 0, 0))
+	if hasSharedRR(msg) {
+		t.Errorf("unique SRV RR counted as shared")
+	}
+	msg.Answer = append(msg.Answer, NewPtrRR("_test._tcp.local.", dns.ClassINET, 120, "x._test._tcp.local."))
+	if !hasSharedRR(msg) {
+		t.Errorf("PTR RR not counted as shared")
+	}
+}
+
+func TestTxtFromMap(t *testing.T) {
+	got, err := txtFromMap(map[string]string{"path": "/", "color": "red", "empty": ""})
+	if want := []string{"color=red", "empty=", "path=/"}; err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("txtFromMap returned %q, %v, want %q", got, err, want)
+	}
+	for _, bad := range []map[string]string{{"": "x"}, {"a=b": "c"}, {"café": "x"}, {"Key": "1", "key": "2"}} {
+		if _, err := txtFromMap(bad); !errors.Is(err, ErrInvalidArgument) {
+			t.Errorf("txtFromMap(%q) returned %v", bad, err)
+		}
+	}
+}
+
+// failingTransport is a Transport that can't listen for one IP version.
+type failingTransport struct {
+	Transport
+	ipver int
+}
+
+func (t failingTransport) Listen(ifc net.Interface, addr *net.UDPAddr, ipver int) (PacketConn, error) {
+	if ipver == t.ipver {
+		return nil, errors.New("can't multicast")
+	}
+	return t.Transport.Listen(ifc, addr, ipver)
+}
+
+func TestInterfaceFailure(t *testing.T) {
+	network := NewMemoryNetwork()
+	host := network.Host(&net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(24, 32)},
+		&net.IPNet{IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(64, 128)})
+
+	// Failing on one interface leaves the other in use.
+	s, err := NewMDNS("partial", "", "", false, *logLevelFlag, UseTransport(failingTransport{host, 6}), InterfaceScanInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	if ifcs := s.Interfaces(); len(ifcs) != 1 || !strings.Contains(ifcs[0], " v4 ") {
+		t.Errorf("Interfaces returned %q", ifcs)
+	}
+	errs := s.InterfaceErrors()
+	if len(errs) != 1 {
+		t.Errorf("InterfaceErrors returned %v", errs)
+	}
+	for ifc, err := range errs {
+		if !strings.Contains(ifc, " v6 ") || !strings.Contains(err.Error(), "can't multicast") {
+			t.Errorf("InterfaceErrors returned %s: %v", ifc, err)
+		}
+	}
+	if _, err := s.ScanInterfaces(); !errors.Is(err, ErrInterface) {
+		t.Errorf("ScanInterfaces returned %v", err)
+	}
+
+	// Failing on all of them fails.
+	if s, err := NewMDNS("", "", "", false, *logLevelFlag, UseTransport(failingTransport{network.Host(&net.IPNet{IP: net.ParseIP("fd00::2"), Mask: net.CIDRMask(64, 128)}), 6}), InterfaceScanInterval(0)); s != nil || !errors.Is(err, ErrInterface) {
+		t.Errorf("NewMDNS with no usable interfaces returned %v, %v", s, err)
+	}
+}
+
+func TestSubscribeToAll(t *testing.T) {
+	network := NewMemoryNetwork()
+	s1, err := newMemMDNS(network, "everything", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Stop()
+	s2, err := newMemMDNS(network, "browser", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Stop()
+	if err := s1.AddService("first", "", 1, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	c, stop := s2.SubscribeToAll()
+	wait := func(service string) {
+		t.Helper()
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case inst := <-c:
+				if inst.Service == service && inst.Name == "everything" && !inst.Removed {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("%s not seen", service)
+			}
+		}
+	}
+	wait("_first._tcp.local.")
+
+	// Types that show up later are subscribed to as well.
+	if err := s1.AddService("second", "", 2, "b"); err != nil {
+		t.Fatal(err)
+	}
+	wait("_second._tcp.local.")
+
+	stop()
+	for range c {
+	}
+	s2.watchedLock.RLock()
+	defer s2.watchedLock.RUnlock()
+	if len(s2.subscribed) != 0 {
+		t.Errorf("still subscribed to %v after stopping", s2.subscribed)
+	}
+}
+
+func TestRefreshDue(t *testing.T) {
+	network := NewMemoryNetwork()
+	s, err := newMemMDNS(network, "refresher", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	packets := make(chan []byte, 100)
+	ipnet := &net.IPNet{IP: net.IPv4(10, 0, 0, 2), Mask: net.CIDRMask(24, 32)}
+	listener, err := NewMDNS("listener", "", "", false, *logLevelFlag, UseTransport(network.Host(ipnet)), InterfaceScanInterval(0), OnPacket(func(src net.Addr, data []byte) {
+		select {
+		case packets <- data:
+		default:
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Stop()
+
+	// The host's addresses live 5 seconds, the service far longer.
+	s.SetOutgoingTTL(5)
+	if err := s.AddServiceWithOptions("refresh", "", 1, ServiceOptions{TTL: 4500}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the announcements are over, only the addresses should be refreshed.
+	time.Sleep(3500 * time.Millisecond)
+	for len(packets) > 0 {
+		<-packets
+	}
+	addrs := false
+	for deadline := time.After(6 * time.Second); !addrs; {
+		select {
+		case data := <-packets:
+			msg := new(dns.Msg)
+			if !msg.Unpack(data) || !msg.Response {
+				continue
+			}
+			for _, rr := range msg.Answer {
+				switch rr.Header().Rrtype {
+				case dns.TypeA:
+					addrs = addrs || rr.Header().Name == hostFQDN("refresher")
+				case dns.TypeSRV:
+					t.Errorf("service refreshed early with %v", rr)
+				}
+			}
+		case <-deadline:
+			t.Fatalf("host addresses weren't refreshed")
+		}
+	}
+}
+
+func TestSplitMsg(t *testing.T) {
+	var rrs []dns.RR
+	for i := 0; i < 30; i++ {
+		rrs = append(rrs, NewSrvRR(instanceFQDN(fmt.Sprintf("host%d", i), "split"), dns.ClassINET, 120, hostFQDN(fmt.Sprintf("host%d", i)), 80, 0, 0))
+	}
+	for _, response := range []bool{true, false} {
+		msg := newDnsMsg(0, response, response)
+		if !response {
+			msg = newQuestionMsg([]dns.Question{{serviceFQDN("split"), dns.TypePTR, dns.ClassINET}})
+		}
+		msg.Answer = append(msg.Answer, rrs...)
+		parts := splitMsg(msg, 512)
+		if len(parts) < 2 {
+			t.Fatalf("%d records split into %d messages", len(rrs), len(parts))
+		}
+		var got []dns.RR
+		for i, part := range parts {
+			buf, ok := part.Pack()
+			if !ok || len(buf) > 512 {
+				t.Errorf("message %d of %d bytes", i, len(buf))
+			}
+			if (len(part.Question) > 0) != (i == 0 && !response) {
+				t.Errorf("message %d has questions %v", i, part.Question)
+			}
+			if part.Truncated != (!response && i < len(parts)-1) {
+				t.Errorf("message %d of response %v has TC %v", i, response, part.Truncated)
+			}
+			if !response && len(part.Extra) != 1 {
+				t.Errorf("message %d has extra records %v, want the OPT", i, part.Extra)
+			}
+			got = append(got, part.Answer...)
+		}
+		if !reflect.DeepEqual(got, rrs) {
+			t.Errorf("split messages have answers %v", got)
+		}
+	}
+
+	if _, err := NewMDNS("", "", "", true, *logLevelFlag, MaxPacketSize(100)); !errors.Is(err, ErrInvalidArgument) {
+		t.Errorf("NewMDNS with a 100 byte max packet size returned %v", err)
+	}
+}
+
+func TestInterfaceDirections(t *testing.T) {
+	network := NewMemoryNetwork()
+	none := func(net.Interface) bool { return false }
+	start := func(host string, n byte, opts ...Option) *MDNS {
+		ipnet := &net.IPNet{IP: net.IPv4(10, 0, 0, n), Mask: net.CIDRMask(24, 32)}
+		s, err := NewMDNS(host, "", "", false, *logLevelFlag, append([]Option{UseTransport(network.Host(ipnet)), InterfaceScanInterval(0)}, opts...)...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.AddService("direction", "", 1); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	both := start("both", 1)
+	defer both.Stop()
+	listener := start("listener", 2, SendInterfaceFilter(none))
+	defer listener.Stop()
+	announcer := start("announcer", 3, ReceiveInterfaceFilter(none))
+	defer announcer.Stop()
+
+	names := func(s *MDNS) []string {
+		var names []string
+		for _, inst := range s.ServiceDiscoveryTimeout("direction", time.Second) {
+			names = append(names, inst.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	if got, want := names(both), []string{"announcer", "both"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("both discovered %v, want %v", got, want)
+	}
+	if got, want := names(listener), []string{"announcer", "both", "listener"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("listener discovered %v, want %v", got, want)
+	}
+	if got, want := names(announcer), []string{"announcer"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("announcer discovered %v, want %v", got, want)
+	}
+}
+
+func TestPause(t *testing.T) {
+	network := NewMemoryNetwork()
+	s, err := newMemMDNS(network, "pauser", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	packets := make(chan []byte, 100)
+	ipnet := &net.IPNet{IP: net.IPv4(10, 0, 0, 2), Mask: net.CIDRMask(24, 32)}
+	listener, err := NewMDNS("listener", "", "", false, *logLevelFlag, UseTransport(network.Host(ipnet)), InterfaceScanInterval(0), OnPacket(func(src net.Addr, data []byte) {
+		if ua, ok := src.(*net.UDPAddr); !ok || !ua.IP.Equal(net.IPv4(10, 0, 0, 1)) {
+			return
+		}
+		select {
+		case packets <- data:
+		default:
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Stop()
+
+	// srvTTLs returns the TTLs of the SRV records in the responses heard within d.
+	srvTTLs := func(d time.Duration) []uint32 {
+		var ttls []uint32
+		for deadline := time.After(d); ; {
+			select {
+			case data := <-packets:
+				msg := new(dns.Msg)
+				if !msg.Unpack(data) || !msg.Response {
+					continue
+				}
+				for _, rr := range msg.Answer {
+					if rr.Header().Rrtype == dns.TypeSRV {
+						ttls = append(ttls, rr.Header().Ttl)
+					}
+				}
+			case <-deadline:
+				return ttls
+			}
+		}
+	}
+
+	if err := s.AddService("pause", "", 1234); err != nil {
+		t.Fatal(err)
+	}
+	if insts := listener.ServiceDiscoveryTimeout("pause", 2*time.Second); len(insts) != 1 {
+		t.Fatalf("found %v before pausing", insts)
+	}
+	srvTTLs(time.Second)
+
+	// Pausing says goodbye, twice, and then nothing else even when asked.
+	s.Pause()
+	if ttls := srvTTLs(time.Second); len(ttls) != 2 || ttls[0] != 0 || ttls[1] != 0 {
+		t.Errorf("pausing sent SRV TTLs %v; wanted two goodbyes", ttls)
+	}
+	listener.FlushCache(false)
+	if insts := listener.ServiceDiscoveryTimeout("pause", time.Second); len(insts) != 0 {
+		t.Errorf("found %v while paused", insts)
+	}
+	if ttls := srvTTLs(500 * time.Millisecond); len(ttls) != 0 {
+		t.Errorf("sent SRV TTLs %v while paused", ttls)
+	}
+
+	// Resuming announces again and answers again.
+	s.Resume()
+	if ttls := srvTTLs(500 * time.Millisecond); len(ttls) == 0 || ttls[0] == 0 {
+		t.Errorf("resuming sent SRV TTLs %v; wanted an announcement", ttls)
+	}
+	listener.FlushCache(false)
+	if insts := listener.ServiceDiscoveryTimeout("pause", 2*time.Second); len(insts) != 1 {
+		t.Errorf("found %v after resuming", insts)
+	}
+
+	// After Stop, Pause and Resume return at once.
+	s.Stop()
+	s.Pause()
+	s.Resume()
+}
+
+func TestRenameLimit(t *testing.T) {
+	network := NewMemoryNetwork()
+	s1, err := newMemMDNS(network, "holder", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Stop()
+	s2, err := newMemMDNS(network, "renamer", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Stop()
+
+	// s1 holds every host name but the last AddServiceWithRename may try.
+	specs := []ServiceSpec{{Service: "limit", Host: "busy", Port: 1}}
+	for i := 2; i <= maxRenames; i++ {
+		specs = append(specs, ServiceSpec{Service: "limit", Host: fmt.Sprintf("busy-%d", i), Port: 1})
+	}
+	if err := s1.AddServices(specs); err != nil {
+		t.Fatal(err)
+	}
+	last := fmt.Sprintf("busy-%d.local.", maxRenames+1)
+	name, err := s2.AddServiceWithRename("limit", "busy", 2)
+	if err != nil || name != "busy (2)" {
+		t.Errorf("AddServiceWithRename returned %q, %v; want %q", name, err, "busy (2)")
+	}
+	if rrs := s2.ResolveRR(instanceFQDN(name, "limit"), dns.TypeSRV); len(rrs) != 1 || rrs[0].(*dns.RR_SRV).Target != last {
+		t.Errorf("%s has SRV records %v; want the target %s", name, rrs, last)
+	}
+
+	// Once that one is taken too, it gives up.
+	s3, err := newMemMDNS(network, "latecomer", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s3.Stop()
+	if name, err := s3.AddServiceWithRename("limit", "busy", 3); !errors.Is(err, ErrNameConflict) {
+		t.Errorf("AddServiceWithRename with every name taken returned %q, %v", name, err)
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	network := NewMemoryNetwork()
+	host := network.Host(&net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: net.CIDRMask(24, 32)},
+		&net.IPNet{IP: net.ParseIP("fd00::1"), Mask: net.CIDRMask(64, 128)})
+	s, err := NewMDNS("stats", "", "", false, *logLevelFlag, UseTransport(host), InterfaceScanInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	if ifcs := s.Interfaces(); len(ifcs) != 2 {
+		t.Fatalf("Interfaces returned %q", ifcs)
+	}
+
+	// A lookup counts once however many interfaces it searches.
+	before := s.Stats()
+	if rrs := s.ResolveRR("stats", dns.TypeA); len(rrs) == 0 {
+		t.Fatal("own address not in the cache")
+	}
+	after := s.Stats()
+	if after.CacheHits != before.CacheHits+1 || after.CacheMisses != before.CacheMisses {
+		t.Errorf("one hit changed the stats from %+v to %+v", before, after)
+	}
+
+	// A miss counts once too, even though ResolveRR also checks for
+	// records known to be absent.
+	before = after
+	s.ResolveRR("nosuch", dns.TypeA)
+	after = s.Stats()
+	if after.CacheHits != before.CacheHits || after.CacheMisses != before.CacheMisses+3 {
+		t.Errorf("three misses changed the stats from %+v to %+v", before, after)
+	}
+}
+
+func TestUnicastResponse(t *testing.T) {
+	network := NewMemoryNetwork()
+	s, err := newMemMDNS(network, "responder", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	// newHost starts another host, numbered n, that passes the packets it gets from s to packets.
+	newHost := func(name string, n byte, packets chan []byte, opts ...Option) *MDNS {
+		ipnet := &net.IPNet{IP: net.IPv4(10, 0, 0, n), Mask: net.CIDRMask(24, 32)}
+		opts = append(opts, UseTransport(network.Host(ipnet)), InterfaceScanInterval(0), OnPacket(func(src net.Addr, data []byte) {
+			if ua, ok := src.(*net.UDPAddr); !ok || !ua.IP.Equal(net.IPv4(10, 0, 0, 1)) {
+				return
+			}
+			select {
+			case packets <- data:
+			default:
+			}
+		}))
+		h, err := NewMDNS(name, "", "", false, *logLevelFlag, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+	listened, asked := make(chan []byte, 100), make(chan []byte, 100)
+	listener := newHost("listener", 2, listened)
+	defer listener.Stop()
+	asker := newHost("asker", 3, asked, UnicastQuestions())
+	defer asker.Stop()
+
+	// heardSRV returns whether an SRV answer was among the responses heard within d, or just those
+	// already heard if d is 0.
+	heardSRV := func(packets chan []byte, d time.Duration) bool {
+		found := false
+		for deadline := time.After(d); ; {
+			if d == 0 && len(packets) == 0 {
+				return found
+			}
+			select {
+			case data := <-packets:
+				msg := new(dns.Msg)
+				if !msg.Unpack(data) || !msg.Response {
+					continue
+				}
+				for _, rr := range msg.Answer {
+					if rr.Header().Rrtype == dns.TypeSRV {
+						found = true
+					}
+				}
+			case <-deadline:
+				return found
+			}
+		}
+	}
+
+	// With a 12 second TTL, the records multicast in the last 3 seconds are answered by unicast.
+	name, err := s.RegisterService("qu", "", 1234, ServiceOptions{TTL: 12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := instanceFQDN(name, "qu")
+	// Wait out the announcements.
+	if !heardSRV(listened, 4500*time.Millisecond) {
+		t.Fatal("service never announced")
+	}
+	heardSRV(asked, 0)
+	if rrs, err := asker.Query(srv, dns.TypeSRV); err != nil || len(rrs) == 0 {
+		t.Errorf("QU question for %s returned %v, %v", srv, rrs, err)
+	}
+	if !heardSRV(asked, 500*time.Millisecond) {
+		t.Error("no unicast response to a QU question")
+	}
+	if heardSRV(listened, 0) {
+		t.Error("multicast a response to a QU question for records just multicast")
+	}
+
+	// Once they haven't been multicast for a quarter of their TTL they're multicast again.
+	time.Sleep(3500 * time.Millisecond)
+	asker.FlushCache(false)
+	if rrs, err := asker.Query(srv, dns.TypeSRV); err != nil || len(rrs) == 0 {
+		t.Errorf("QU question for %s returned %v, %v", srv, rrs, err)
+	}
+	if !heardSRV(listened, 500*time.Millisecond) {
+		t.Error("didn't multicast a response to a QU question for records not multicast lately")
+	}
+}
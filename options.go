@@ -0,0 +1,288 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mdns
+
+// Options that can be passed to NewMDNS.
+
+import (
+	"net"
+	"time"
+
+	"github.com/presotto/go-mdns-sd/go_dns"
+)
+
+// A Logger receives the log messages of an MDNS.  A *log.Logger will do.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// An Option changes the default behavior of an MDNS.
+type Option func(s *MDNS)
+
+// InterfaceFilter restricts the interfaces used for sending and receiving to those for which
+// f returns true.  By default all interfaces with suitable addresses are used.
+func InterfaceFilter(f func(net.Interface) bool) Option {
+	return func(s *MDNS) {
+		s.ifcFilter = f
+	}
+}
+
+// Interfaces restricts the interfaces used for sending and receiving to the ones listed.
+func Interfaces(ifcs ...net.Interface) Option {
+	return InterfaceFilter(func(ifc net.Interface) bool {
+		for _, x := range ifcs {
+			if x.Name == ifc.Name {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// ReceiveInterfaceFilter restricts the interfaces whose packets we act on to those for which f returns
+// true.  We still send on the others, e.g., to announce our services on a network we don't trust to
+// answer us, but learn nothing from them and answer no questions asked on them.  By default we
+// receive on all the interfaces we use.
+func ReceiveInterfaceFilter(f func(net.Interface) bool) Option {
+	return func(s *MDNS) {
+		s.recvFilter = f
+	}
+}
+
+// SendInterfaceFilter restricts the interfaces we send on to those for which f returns true.  On the
+// others we only listen, as though in Passive mode.  An interface rejected by both
+// SendInterfaceFilter and ReceiveInterfaceFilter isn't used at all.  By default we send on all the
+// interfaces we use.
+func SendInterfaceFilter(f func(net.Interface) bool) Option {
+	return func(s *MDNS) {
+		s.sendFilter = f
+	}
+}
+
+// UnicastQuestions sets the QU bit in our questions asking responders to reply directly to us rather
+// than multicasting the answer (RFC 6762 section 5.4).  Probes are always multicast.
+func UnicastQuestions() Option {
+	return func(s *MDNS) {
+		s.unicastQuestions = true
+	}
+}
+
+// MulticastLoopback controls whether our multicasts are also delivered to listeners on this host,
+// including ourselves.  The default is true.  Turning it off keeps other MDNS instances on the same
+// host from hearing us.
+func MulticastLoopback(v bool) Option {
+	return func(s *MDNS) {
+		s.multicastLoopback = v
+	}
+}
+
+// DuplicateAnswerSuppression controls whether, while waiting to send a shared answer, we drop it when
+// another responder multicasts it first with at least half our TTL (RFC 6762 section 7.4).  The default
+// is true.
+func DuplicateAnswerSuppression(v bool) Option {
+	return func(s *MDNS) {
+		s.duplicateSuppression = v
+	}
+}
+
+// UseTransport has the MDNS find its interfaces and talk over t rather than the system's interfaces
+// and UDP multicast sockets, e.g., a MemoryNetwork host so that tests are fast and deterministic.
+// Socket options such as MulticastTTL and ReceiveBufferSize only apply to the default transport.
+func UseTransport(t Transport) Option {
+	return func(s *MDNS) {
+		s.transport = t
+	}
+}
+
+// Passive, if v is true, has us only listen: we cache what we hear but never send anything, neither
+// questions, answers, nor announcements, e.g., for an inventory of the network that mustn't disturb it.
+// Lookups and discovery answer from what has been heard so far.  Adding services or host addresses and
+// ResolveUnicast fail with ErrPassive.  The default is false.
+func Passive(v bool) Option {
+	return func(s *MDNS) {
+		s.passive = v
+	}
+}
+
+// LogTo sends log messages to l rather than the standard logger.  How many messages there are is still
+// controlled by the logLevel passed to NewMDNS.
+func LogTo(l Logger) Option {
+	return func(s *MDNS) {
+		s.logger = l
+	}
+}
+
+// MaxCacheEntries limits the number of records cached for each interface.  When the limit is reached, the
+// least recently looked up records are evicted, other than the ones we are advertising.  The default is no
+// limit.
+func MaxCacheEntries(n int) Option {
+	return func(s *MDNS) {
+		s.maxCacheEntries = n
+	}
+}
+
+// InterfaceScanInterval sets how often to look for interfaces that have come up, gone away, or changed
+// addresses, e.g., after a laptop wakes up.  We join the new ones and announce our host and services
+// on them.  The default is 10 seconds.  An interval of 0 turns off scanning, which may suit hosts whose
+// interfaces never change.
+func InterfaceScanInterval(d time.Duration) Option {
+	return func(s *MDNS) {
+		s.scanInterval = d
+	}
+}
+
+// QuerySuppression sets how long after asking a question on an interface we refrain from asking it
+// again, so that many callers looking for the same thing at once cause only one multicast.  The
+// default is one second.  0 turns suppression off.  Probes are never suppressed.
+func QuerySuppression(d time.Duration) Option {
+	return func(s *MDNS) {
+		s.querySuppression = d
+	}
+}
+
+// OnPacket calls f with every packet we receive, before it is parsed, and the address it came from,
+// e.g., to capture traffic for debugging or for test fixtures.  f gets its own copy of the packet and
+// is called from a goroutine of its own, in the order the packets arrived, so that it never holds up
+// receiving.  If f falls too far behind, packets are dropped rather than queued for it.
+func OnPacket(f func(src net.Addr, data []byte)) Option {
+	return func(s *MDNS) {
+		s.tap = f
+	}
+}
+
+// EDNS0Options puts opts in the OPT RR (RFC 6891) of every message we send, adding one to messages,
+// e.g., responses, that wouldn't otherwise have it.  It lets responders advertise capabilities to
+// clients that know the option codes; those that don't ignore them.  Experiments should use the local
+// codes, 65001 to 65534.
+func EDNS0Options(opts ...dns.EDNS0Option) Option {
+	return func(s *MDNS) {
+		s.ednsOptions = opts
+	}
+}
+
+// OnEDNS0Options calls f with the EDNS0 options of every message we receive that has any, and the
+// address it came from, including options we know nothing about.  f is called from the goroutine
+// receiving on the interface so it should return quickly.
+func OnEDNS0Options(f func(src net.Addr, opts []dns.EDNS0Option)) Option {
+	return func(s *MDNS) {
+		s.onEDNS = f
+	}
+}
+
+// TxtUpdateDebounce limits how often the changed TXT of a service is announced to once every d, e.g.,
+// for a sensor that updates it many times a second.  UpdateServiceTxt calls within d of an announcement
+// are merged into one announcement, of the latest TXT, at the end of the window.  The default, 0,
+// announces every update at once.
+func TxtUpdateDebounce(d time.Duration) Option {
+	return func(s *MDNS) {
+		s.txtDebounce = d
+	}
+}
+
+// WatchDedupWindow keeps watchers, see ServiceMemberWatch, from hearing about instances that flap, e.g.,
+// a chatty device that says goodbye and announces itself again, or one whose records briefly lapse
+// between refreshes.  An instance that disappears is only reported removed if it is still gone d later;
+// if it comes back with the same records, watchers hear nothing.  Changes are always reported at once.
+// The default, 0, reports removals at once.
+func WatchDedupWindow(d time.Duration) Option {
+	return func(s *MDNS) {
+		s.watchDedup = d
+	}
+}
+
+// SubscriptionRequery sets how SubscribeToService keeps asking for a service: first after the initial
+// question, and then at doubling intervals of at most max.  The default is 1 second and 1 minute as in
+// RFC 6762 section 5.2.  A first of 0 asks only once.  A max below first is taken to be first.
+func SubscriptionRequery(first, max time.Duration) Option {
+	return func(s *MDNS) {
+		if max < first {
+			max = first
+		}
+		s.requeryFirst, s.requeryMax = first, max
+	}
+}
+
+// SourcePort makes us send from the given UDP port, e.g., 5353, for firewalls that only pass mdns
+// traffic to and from the standard port.  We also listen on it for replies sent directly to us.  By
+// default we send from the port of the multicast address passed to NewMDNS, which is 5353 unless
+// another address is given.
+func SourcePort(port int) Option {
+	return func(s *MDNS) {
+		s.sourcePort = port
+	}
+}
+
+// MulticastTTL sets the IP TTL (IPv6 hop limit) of the multicasts we send.  The default, also chosen by
+// 0, is 255.  A TTL of 1 guarantees packets never leave the local subnet while a higher one lets them
+// cross a router that reflects mdns.  An interface on which the TTL can't be set isn't used.  NewMDNS
+// fails if ttl is over 255.
+func MulticastTTL(ttl int) Option {
+	return func(s *MDNS) {
+		s.multicastTTL = ttl
+	}
+}
+
+// ReceiveBufferSize asks for n byte socket receive buffers (SO_RCVBUF) on the connections we listen on
+// so that bursts of answers, e.g., to a discovery query on a busy network, aren't dropped.  The system
+// may round or limit n; ReceiveBufferSizes tells what we got.  The default, also chosen by 0, is the
+// system's.  NewMDNS fails if n is negative.
+func ReceiveBufferSize(n int) Option {
+	return func(s *MDNS) {
+		s.receiveBufferSize = n
+	}
+}
+
+// MaxPacketSize caps the messages we send at n bytes.  Messages are also kept within each interface's
+// MTU, so n only matters if it is smaller.  Messages with more records than fit are split into several,
+// as many records to each as fit; a query's known answers that don't fit go in following messages with
+// the TC bit set on all but the last (RFC 6762 section 7.2).  The default, also chosen by 0, is 9000, the
+// most RFC 6762 section 17 allows.  NewMDNS fails if n is under 512 or over 9000.
+func MaxPacketSize(n int) Option {
+	return func(s *MDNS) {
+		s.maxMessageSize = n
+	}
+}
+
+// MergeInstances says whether ServiceDiscovery merges the copies of an instance heard on several
+// interfaces, i.e., those with the same name, SRV targets and ports, and TXT, into one listing all of
+// their Sources.  The default is true.  With false, each interface gets its own entry.
+func MergeInstances(v bool) Option {
+	return func(s *MDNS) {
+		s.separateInstances = !v
+	}
+}
+
+// UnicastFallback gives Resolve a DNS server, "host:port" or just an address for port 53, to ask when
+// nothing on the local networks answers.  By default Resolve only uses multicast.
+func UnicastFallback(server string) Option {
+	return func(s *MDNS) {
+		s.unicastServer = server
+	}
+}
+
+// DisableIPv4 keeps us off IPv4: we neither join the IPv4 group nor announce our IPv4 addresses.
+func DisableIPv4() Option {
+	return func(s *MDNS) {
+		s.noIPv4 = true
+	}
+}
+
+// DisableIPv6 keeps us off IPv6, e.g., on hosts or in containers where IPv6 is turned off and every
+// attempt to use it fails: we neither join the IPv6 group nor announce our IPv6 addresses.
+func DisableIPv6() Option {
+	return func(s *MDNS) {
+		s.noIPv6 = true
+	}
+}
+
+// ExtraGroups joins the multicast groups addrs, e.g., "224.0.0.254:9999" or "[FF02::FF]:9998", on
+// every interface as well as the ones passed to NewMDNS, so that we take part in several mdns
+// networks at once, e.g., the standard one and a private one.  Our records are announced on, and
+// answers are learned from, all of the groups.  NewMDNS fails if an address isn't a multicast address
+// with a port.
+func ExtraGroups(addrs ...string) Option {
+	return func(s *MDNS) {
+		s.extraGroupAddrs = append(s.extraGroupAddrs, addrs...)
+	}
+}
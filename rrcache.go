@@ -6,29 +6,54 @@ package mdns
 // A cache of DNS RRs (resource records).
 
 import (
-	"log"
+	"container/list"
+	"net"
 	"reflect"
+	"strings"
 	"time"
 
 	"github.com/presotto/go-mdns-sd/go_dns"
 )
 
 type rrCacheEntry struct {
+	added   time.Time
 	expires time.Time
+	ttl     uint32 // TTL when the entry was added
+	own     bool   // one of the records we are advertising
+	from    net.IP // who sent it to us, nil if we don't know
+	extra   bool   // only ever came in the authority or additional section of a response
 	rr      dns.RR
+
+	// When we last multicast the record, if it is one of ours.
+	multicast time.Time
+
+	// Where the entry is in the cache's lru list, nil for our own records, which are never evicted.
+	elem *list.Element
 }
 
 type rrCache struct {
 	// The first key is the domain name and the second is the RR type
 	cache map[string]map[uint16][]*rrCacheEntry
 
+	// Number of entries and, if not 0, the most we allow.
+	size       int
+	maxEntries int
+
+	// The entries other than our own, most recently looked up first.
+	lru *list.List
+
+	logger   Logger
 	logLevel int
 }
 
-// Create a new rr cache.  Make sure at least the top level map exists.
-func newRRCache(logLevel int) *rrCache {
+// Create a new rr cache.  Make sure at least the top level map exists.  If maxEntries is
+// not 0, the least recently looked up entries are evicted to keep the size under it.
+func newRRCache(logLevel int, logger Logger, maxEntries int) *rrCache {
 	rrcache := new(rrCache)
 	rrcache.cache = make(map[string]map[uint16][]*rrCacheEntry, 0)
+	rrcache.maxEntries = maxEntries
+	rrcache.lru = list.New()
+	rrcache.logger = logger
 	rrcache.logLevel = logLevel
 	return rrcache
 }
@@ -37,23 +62,125 @@ func newRRCache(logLevel int) *rrCache {
 //
 // In MDNS there are two types of RR sets, private ones that are only answered by a single machine and shared ones that
 // are made up of responses from any machine. The most significant bit in the rrclass (can you say hack?) has been
-// purloined as a cache flush bit.  If this bit is set this RR replaces all cached ones of the same type.
+// purloined as a cache flush bit.  If this bit is set this RR replaces all cached ones of the same type and class
+// that were added more than a second ago.  The grace period lets the records of a multi-packet response, or
+// several flushing records in the same response, coexist (RFC 6762 section 10.2).
 //
-// Returns true if this entry was not already in the cache.
+// Returns true if this entry was not already in the cache or it flushed others.
 func (c *rrCache) Add(rr dns.RR) bool {
-	// Create an entry for the domain name if none exists.
-	dnmap, ok := c.cache[rr.Header().Name]
-	if !ok {
-		dnmap = make(map[uint16][]*rrCacheEntry, 0)
-		c.cache[rr.Header().Name] = dnmap
+	return c.add(rr, false, nil, false)
+}
+
+// AddFrom is Add for records received from the network.  It remembers who sent them.
+func (c *rrCache) AddFrom(rr dns.RR, from net.IP) bool {
+	return c.add(rr, false, from, false)
+}
+
+// AddExtraFrom is AddFrom for records that came along with the answers, in the authority or additional
+// section, rather than as answers themselves.
+func (c *rrCache) AddExtraFrom(rr dns.RR, from net.IP) bool {
+	return c.add(rr, false, from, true)
+}
+
+// The cache flush bit in an RR's class (RFC 6762 section 10.2).
+const cacheFlushBit = 0x8000
+
+// The same bit in a question's class asks for a unicast response (RFC 6762 section 5.4).
+const unicastResponseBit = 0x8000
+
+// rrClass returns the class of rr without the cache flush bit, which is a signal to caches rather
+// than part of the class.
+func rrClass(rr dns.RR) uint16 {
+	return rr.Header().Class &^ cacheFlushBit
+}
+
+// inet returns true if the entry is of the Internet class.  Lookups are only for that class, the one
+// mDNS uses, so that a record of another class, even with the same name and type, isn't mistaken for
+// one.  Such records are still cached, e.g., for DumpCache.
+func (e *rrCacheEntry) inet() bool {
+	return rrClass(e.rr) == dns.ClassINET
+}
+
+// has returns true if we have a record with the same class and data as rr.
+func (c *rrCache) has(rr dns.RR) bool {
+	for _, e := range c.cache[rr.Header().Name][rr.Header().Rrtype] {
+		if e != nil && rrClass(rr) == rrClass(e.rr) && sameRRData(rr, e.rr) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsOwn returns true if rr, ignoring its TTL, is one of the records we are advertising.
+func (c *rrCache) IsOwn(rr dns.RR) bool {
+	return c.ownEntry(rr) != nil
+}
+
+// ownEntry returns the entry of ours with the same class and data as rr, nil if none.
+func (c *rrCache) ownEntry(rr dns.RR) *rrCacheEntry {
+	for _, e := range c.cache[rr.Header().Name][rr.Header().Rrtype] {
+		if e != nil && e.own && rrClass(rr) == rrClass(e.rr) && sameRRData(rr, e.rr) {
+			return e
+		}
+	}
+	return nil
+}
+
+// Multicast notes that we just multicast rr, one of our own records.
+func (c *rrCache) Multicast(rr dns.RR) {
+	if e := c.ownEntry(rr); e != nil {
+		e.multicast = time.Now()
+	}
+}
+
+// MulticastRecently returns true if we multicast rr, one of our own records, within fraction of its TTL.
+func (c *rrCache) MulticastRecently(rr dns.RR, fraction float64) bool {
+	e := c.ownEntry(rr)
+	if e == nil || e.multicast.IsZero() {
+		return false
+	}
+	return time.Since(e.multicast) < time.Duration(fraction*float64(rr.Header().Ttl)*float64(time.Second))
+}
+
+// AddOwn is Add for records we are advertising.  These are never evicted to make room.
+func (c *rrCache) AddOwn(rr dns.RR) bool {
+	return c.add(rr, true, nil, false)
+}
+
+func (c *rrCache) add(rr dns.RR, own bool, from net.IP, extra bool) bool {
+	// A goodbye for a record we don't have has nothing to say goodbye to.  Ignore it rather than
+	// caching it for a second and telling watchers about a record that is already gone.
+	if rr.Header().Ttl == 0 && !c.has(rr) {
+		if c.logLevel >= 2 {
+			c.logger.Printf("ignoring goodbye for uncached %v\n", rr)
+		}
+		return false
 	}
 
-	// Remove all rr's matching this one's type if a cache flush is requested.
-	if rr.Header().Class&0x8000 == 0x8000 {
+	// Remove all older rr's matching this one's type and class if a cache flush is requested.  Only
+	// our own records flush our own: someone else's can't take away what we are advertising.
+	now := time.Now()
+	name, rrtype := rr.Header().Name, rr.Header().Rrtype
+	flushed := false
+	if rr.Header().Class&cacheFlushBit != 0 {
 		if c.logLevel >= 2 {
-			log.Printf("cache flush for %v\n", rr)
+			c.logger.Printf("cache flush for %v\n", rr)
+		}
+		entries := c.cache[name][rrtype]
+		for i, e := range entries {
+			if e != nil && rrClass(e.rr) == rrClass(rr) && now.Sub(e.added) > time.Second && !sameRRData(rr, e.rr) && (own || !e.own) {
+				c.drop(entries, i)
+				flushed = true
+			}
 		}
-		dnmap[rr.Header().Rrtype] = make([]*rrCacheEntry, 0)
+		c.tidy(name, rrtype)
+	}
+
+	// Create an entry for the domain name if none exists.
+	dnmap, ok := c.cache[name]
+	if !ok {
+		dnmap = make(map[uint16][]*rrCacheEntry, 0)
+		c.cache[name] = dnmap
 	}
 
 	switch {
@@ -69,142 +196,366 @@ func (c *rrCache) Add(rr dns.RR) bool {
 	}
 
 	// Add absolute expiration time to the entry.
-	entry := &rrCacheEntry{time.Now().Add(time.Duration(rr.Header().Ttl) * time.Second), rr}
+	entry := &rrCacheEntry{
+		added:   now,
+		expires: now.Add(time.Duration(rr.Header().Ttl) * time.Second),
+		ttl:     rr.Header().Ttl,
+		own:     own,
+		from:    from,
+		extra:   extra,
+		rr:      rr,
+	}
 
-	// If the slice doesn't exist yet, create it.
-	rrslice, ok := dnmap[rr.Header().Rrtype]
-	if !ok {
-		dnmap[rr.Header().Rrtype] = make([]*rrCacheEntry, 0)
-		rrslice = dnmap[rr.Header().Rrtype]
-	}
-
-	// If an existing cache rr has the same data fields, replace it.  Otherwise, just append.  We just
-	// worry about a subset of rr types used by mdns.
-	firstnil := -1
-	for i := range rrslice {
-		if rrslice[i] == nil {
-			// When we take down entries with expired TTLs, we just nil out the pointer so we
-			// remember the first nil'd pointer for subsequent reuse.
-			if firstnil < 0 {
-				firstnil = i
-			}
+	// If an existing cache rr has the same class and data fields, replace it, keeping its place in
+	// the lru list.  Otherwise, just append.
+	rrslice := dnmap[rrtype]
+	for i, e := range rrslice {
+		if e == nil || rrClass(rr) != rrClass(e.rr) || !sameRRData(rr, e.rr) {
 			continue
 		}
-		same := false
-		switch x := rr.(type) {
-		case *dns.RR_A:
-			y := rrslice[i].rr.(*dns.RR_A)
-			if same = x.A == y.A; same {
-				break
-			}
-		case *dns.RR_AAAA:
-			y := rrslice[i].rr.(*dns.RR_AAAA)
-			same = true
-			for j := range x.AAAA {
-				if x.AAAA[j] != y.AAAA[j] {
-					same = false
-					break
-				}
-			}
-			if same {
-				break
-			}
-		case *dns.RR_TXT:
-			y := rrslice[i].rr.(*dns.RR_TXT)
-			if same = reflect.DeepEqual(x.Txt, y.Txt); same {
-				break
-			}
-		case *dns.RR_PTR:
-			y := rrslice[i].rr.(*dns.RR_PTR)
-			if same = x.Ptr == y.Ptr; same {
-				break
-			}
-		case *dns.RR_SRV:
-			y := rrslice[i].rr.(*dns.RR_SRV)
-			if same = x.Priority == y.Priority && x.Weight == y.Weight && x.Port == y.Port && x.Target == y.Target; same {
-				break
-			}
+		if c.logLevel >= 2 {
+			c.logger.Printf("replacing cached entry for %v with %v\n", e.rr, rr)
 		}
-		if same {
-			if c.logLevel >= 2 {
-				log.Printf("replacing cached entry for %v with %v\n", rrslice[i].rr, rr)
+		entry.multicast = e.multicast
+		entry.own = entry.own || e.own
+		entry.extra = entry.extra && e.extra
+		if e.elem != nil {
+			if entry.own {
+				c.lru.Remove(e.elem)
+			} else {
+				entry.elem = e.elem
+				entry.elem.Value = entry
 			}
-			rrslice[i] = entry
-			return false
 		}
+		rrslice[i] = entry
+		return flushed
 	}
 	// If we get to here, we have a new record.
-	if firstnil >= 0 {
-		// Fill in a hole.
-		rrslice[firstnil] = entry
-		if c.logLevel >= 2 {
-			log.Printf("adding cached entry for %v (in a hole)\n", rr)
+	c.size++
+	dnmap[rrtype] = append(rrslice, entry)
+	if !own {
+		entry.elem = c.lru.PushFront(entry)
+	}
+	if c.logLevel >= 2 {
+		c.logger.Printf("adding cached entry for %v\n", rr)
+	}
+	for c.maxEntries > 0 && c.size > c.maxEntries {
+		if !c.evict() {
+			break
 		}
-	} else {
-		// Append to the end of the list.
-		dnmap[rr.Header().Rrtype] = append(rrslice, entry)
-		if c.logLevel >= 2 {
-			log.Printf("adding cached entry for %v (append)\n", rr)
+	}
+	return true
+}
+
+// evict removes the least recently looked up entry that isn't one of our own.  It returns false if
+// there was nothing to evict.
+func (c *rrCache) evict() bool {
+	back := c.lru.Back()
+	if back == nil {
+		return false
+	}
+	victim := back.Value.(*rrCacheEntry)
+	if c.logLevel >= 2 {
+		c.logger.Printf("evicting cached entry %v\n", victim.rr)
+	}
+	name, rrtype := victim.rr.Header().Name, victim.rr.Header().Rrtype
+	entries := c.cache[name][rrtype]
+	for i, e := range entries {
+		if e == victim {
+			c.drop(entries, i)
+			break
 		}
 	}
+	c.tidy(name, rrtype)
 	return true
 }
 
-// Send all RRs in entries to rc.  Ignore expired entries.
-func sendRRs(entries []*rrCacheEntry, rc chan dns.RR) {
+// drop removes entries[i] from the cache, leaving a hole for tidy to remove.
+func (c *rrCache) drop(entries []*rrCacheEntry, i int) {
+	if e := entries[i]; e.elem != nil {
+		c.lru.Remove(e.elem)
+		e.elem = nil
+	}
+	entries[i] = nil
+	c.size--
+}
+
+// tidy removes the holes drop left in the entries for name and rrtype, and the map entries that are
+// left empty, so that names that come and go don't leave anything behind.
+func (c *rrCache) tidy(name string, rrtype uint16) {
+	dnmap, ok := c.cache[name]
+	if !ok {
+		return
+	}
+	entries := dnmap[rrtype][:0]
+	for _, e := range dnmap[rrtype] {
+		if e != nil {
+			entries = append(entries, e)
+		}
+	}
+	// Don't keep pointers to dropped entries beyond the new end.
+	for i := len(entries); i < len(dnmap[rrtype]); i++ {
+		dnmap[rrtype][i] = nil
+	}
+	if len(entries) > 0 {
+		dnmap[rrtype] = entries
+		return
+	}
+	delete(dnmap, rrtype)
+	if len(dnmap) == 0 {
+		delete(c.cache, name)
+	}
+}
+
+// sameRRData returns true if x and y are of the same type and have the same data fields.  We just
+// worry about a subset of rr types used by mdns.
+func sameRRData(x, y dns.RR) bool {
+	switch x := x.(type) {
+	case *dns.RR_A:
+		y, ok := y.(*dns.RR_A)
+		return ok && x.A.Equal(y.A)
+	case *dns.RR_AAAA:
+		y, ok := y.(*dns.RR_AAAA)
+		return ok && x.AAAA.Equal(y.AAAA)
+	case *dns.RR_TXT:
+		y, ok := y.(*dns.RR_TXT)
+		return ok && reflect.DeepEqual(x.Txt, y.Txt)
+	case *dns.RR_PTR:
+		y, ok := y.(*dns.RR_PTR)
+		return ok && x.Ptr == y.Ptr
+	case *dns.RR_SRV:
+		y, ok := y.(*dns.RR_SRV)
+		return ok && x.Priority == y.Priority && x.Weight == y.Weight && x.Port == y.Port && x.Target == y.Target
+	case *dns.RR_NSEC:
+		y, ok := y.(*dns.RR_NSEC)
+		return ok && x.NextDomain == y.NextDomain && reflect.DeepEqual(x.Types, y.Types)
+	case *dns.RR_HINFO:
+		y, ok := y.(*dns.RR_HINFO)
+		return ok && x.Cpu == y.Cpu && x.Os == y.Os
+	}
+	return false
+}
+
+// used notes that e was just looked up.
+func (c *rrCache) used(e *rrCacheEntry) {
+	if e.elem != nil {
+		c.lru.MoveToFront(e.elem)
+	}
+}
+
+// Send all RRs in entries to rc and return how many.  Ignore expired entries and those not of the
+// Internet class.
+func (c *rrCache) sendRRs(entries []*rrCacheEntry, rc chan dns.RR) int {
+	n := 0
 	now := time.Now()
 	for _, e := range entries {
-		if e == nil {
+		if e == nil || !e.inet() {
 			continue
 		}
 		ttl := e.expires.Sub(now).Seconds()
 		if ttl <= 0 {
 			continue
 		}
+		c.used(e)
 		e.rr.Header().Ttl = uint32(ttl)
 		rc <- e.rr // Don't read this as err!
+		n++
 	}
+	return n
 }
 
 // Lookup and Write to rc any cached RRs for name of the given rrtype.
 //
 // Note: it is up to the immediate caller to close rc.  This allows him to chain together
 //	multiple calls to Lookup, directly feeding all the answers to his caller.
-func (c *rrCache) Lookup(name string, rrtype uint16, rc chan dns.RR) {
+//
+// It returns the number of RRs written, e.g., for counting cache hits.
+func (c *rrCache) Lookup(name string, rrtype uint16, rc chan dns.RR) int {
+	n := 0
 	if dnmap, ok := c.cache[name]; ok {
 		// TypeAll matches all RR types.
 		if rrtype == dns.TypeALL {
 			for _, entries := range dnmap {
-				sendRRs(entries, rc)
+				n += c.sendRRs(entries, rc)
 			}
-			return
+			return n
 		}
 
 		// Otherwise, look for the specific type.
 		if entries, ok := dnmap[rrtype]; ok {
-			sendRRs(entries, rc)
+			n += c.sendRRs(entries, rc)
+		}
+	}
+	return n
+}
+
+// LookupSuffix is like Lookup but writes to rc the cached RRs of every name ending in suffix, e.g., all
+// the instances under "._http._tcp.local.".  It walks the whole cache so Lookup is better when the
+// name is known.
+func (c *rrCache) LookupSuffix(suffix string, rrtype uint16, rc chan dns.RR) int {
+	n := 0
+	for name := range c.cache {
+		if strings.HasSuffix(name, suffix) {
+			n += c.Lookup(name, rrtype, rc)
+		}
+	}
+	return n
+}
+
+// Records returns the unexpired cached RRs for name of the given rrtype.
+func (c *rrCache) Records(name string, rrtype uint16) []dns.RR {
+	var rrs []dns.RR
+	now := time.Now()
+	for t, entries := range c.cache[name] {
+		if rrtype != dns.TypeALL && t != rrtype {
+			continue
+		}
+		for _, e := range entries {
+			if e == nil || !e.inet() || !now.Before(e.expires) {
+				continue
+			}
+			c.used(e)
+			rrs = append(rrs, e.rr)
+		}
+	}
+	return rrs
+}
+
+// Expiring returns true if any unexpired cached RR for name of the given rrtype, other than our own,
+// has less than fraction of its TTL left.
+func (c *rrCache) Expiring(name string, rrtype uint16, fraction float64) bool {
+	now := time.Now()
+	for t, entries := range c.cache[name] {
+		if rrtype != dns.TypeALL && t != rrtype {
+			continue
+		}
+		for _, e := range entries {
+			if e == nil || e.own || !e.inet() || !now.Before(e.expires) {
+				continue
+			}
+			if e.expires.Sub(now) < time.Duration(fraction*float64(e.ttl)*float64(time.Second)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Sender returns the sender of the most recently added unexpired RR for name of the given rrtype.  The
+// boolean is false if there is no such RR.  The address is nil for RRs whose sender we don't know,
+// e.g., our own.
+func (c *rrCache) Sender(name string, rrtype uint16) (net.IP, bool) {
+	var latest *rrCacheEntry
+	now := time.Now()
+	for _, e := range c.cache[name][rrtype] {
+		if e == nil || !e.inet() || !now.Before(e.expires) {
+			continue
 		}
+		if latest == nil || e.added.After(latest.added) {
+			latest = e
+		}
+	}
+	if latest == nil {
+		return nil, false
 	}
+	return latest.from, true
+}
+
+// KnownAnswers returns the cached RRs for name of the given rrtype that still have more than half
+// of their original TTL remaining.  These are included in queries so that responders can suppress
+// answers we already have (RFC 6762 section 7.1).  The returned RRs are copies with their TTLs set to
+// the remaining time and without the cache flush bit, which mustn't be set in known answers (RFC 6762
+// section 10.2).
+func (c *rrCache) KnownAnswers(name string, rrtype uint16) []dns.RR {
+	var rrs []dns.RR
+	now := time.Now()
+	for t, entries := range c.cache[name] {
+		if rrtype != dns.TypeALL && t != rrtype {
+			continue
+		}
+		for _, e := range entries {
+			if e == nil || !e.inet() {
+				continue
+			}
+			ttl := e.expires.Sub(now).Seconds()
+			if ttl <= float64(e.ttl)/2 {
+				continue
+			}
+			rr := copyRR(e.rr)
+			rr.Header().Ttl = uint32(ttl)
+			rr.Header().Class = rrClass(rr)
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
 }
 
 // CleanExpired cleans out expired entries.  We run this occasionally to kill off entries that haven't been seen in a while.
 func (c *rrCache) CleanExpired() []dns.RR {
 	var expired []dns.RR
 	now := time.Now()
-	for _, dnmap := range c.cache {
-		for _, entries := range dnmap {
+	for name, dnmap := range c.cache {
+		for rrtype, entries := range dnmap {
 			for i, e := range entries {
-				if e == nil {
+				if e != nil && now.After(e.expires) {
+					expired = append(expired, e.rr)
+					c.drop(entries, i)
+				}
+			}
+			c.tidy(name, rrtype)
+		}
+	}
+	return expired
+}
+
+// Flush removes all the entries that aren't our own and returns their RRs.
+func (c *rrCache) Flush() []dns.RR {
+	var flushed []dns.RR
+	for name, dnmap := range c.cache {
+		for rrtype, entries := range dnmap {
+			for i, e := range entries {
+				if e == nil || e.own {
 					continue
 				}
-				if now.After(e.expires) {
-					// Nil out any expired entries, faster than rebuilding the slice.
-					expired = append(expired, e.rr)
-					entries[i] = nil
+				flushed = append(flushed, e.rr)
+				c.drop(entries, i)
+			}
+			c.tidy(name, rrtype)
+		}
+	}
+	return flushed
+}
+
+// Entries returns a copy of every unexpired entry in the cache.  The TTLs of the returned RRs are set
+// to the remaining time.
+func (c *rrCache) Entries() []CacheEntry {
+	var entries []CacheEntry
+	now := time.Now()
+	for _, dnmap := range c.cache {
+		for _, rrslice := range dnmap {
+			for _, e := range rrslice {
+				if e == nil || !now.Before(e.expires) {
 					continue
 				}
+				rr := copyRR(e.rr)
+				rr.Header().Ttl = uint32(e.expires.Sub(now).Seconds())
+				entries = append(entries, CacheEntry{Record: rr, Expires: e.expires, Added: e.added, TTL: e.ttl, Own: e.own, Sender: e.from, Additional: e.extra})
 			}
 		}
 	}
-	return expired
+	return entries
+}
+
+// copyRR returns a shallow copy of rr.  Cached RRs are never changed other than their headers so
+// this is enough to keep the copy from changing under its holder.
+func copyRR(rr dns.RR) dns.RR {
+	v := reflect.ValueOf(rr).Elem()
+	c := reflect.New(v.Type())
+	c.Elem().Set(v)
+	return c.Interface().(dns.RR)
+}
+
+// Size returns the number of records in the cache, including any that have expired but haven't been cleaned out yet.
+func (c *rrCache) Size() int {
+	return c.size
 }
@@ -4,6 +4,9 @@
 package mdns
 
 import (
+	"fmt"
+	"log"
+	"net"
 	"testing"
 	"time"
 
@@ -23,6 +26,13 @@ var (
 		&dns.RR_TXT{dns.RR_Header{"x.local.", dns.TypeTXT, dns.ClassINET | 0x8000, 10000, 0}, []string{"except on tuesday"}},
 		&dns.RR_PTR{dns.RR_Header{"x.local.", dns.TypePTR, dns.ClassINET | 0x8000, 10000, 0}, "q.local."},
 	}
+	flushA []dns.RR = []dns.RR{
+		&dns.RR_A{dns.RR_Header{"a.local.", dns.TypeA, dns.ClassINET | 0x8000, 120, 0}, net.IPv4(192, 168, 1, 1).To4()},
+		&dns.RR_A{dns.RR_Header{"a.local.", dns.TypeA, dns.ClassINET | 0x8000, 120, 0}, net.IPv4(192, 168, 1, 2).To4()},
+	}
+	flushA2 []dns.RR = []dns.RR{
+		&dns.RR_A{dns.RR_Header{"a.local.", dns.TypeA, dns.ClassINET | 0x8000, 120, 0}, net.IPv4(192, 168, 1, 3).To4()},
+	}
 	goodbye []dns.RR = []dns.RR{
 		&dns.RR_TXT{dns.RR_Header{"x.local.", dns.TypeTXT, dns.ClassINET, 0, 0}, []string{"except on tuesday"}},
 		&dns.RR_PTR{dns.RR_Header{"x.local.", dns.TypePTR, dns.ClassINET, 0, 0}, "q.local."},
@@ -71,6 +81,12 @@ func compare(a, b []dns.RR) bool {
 					found = true
 					break L
 				}
+			case *dns.RR_SRV:
+				rrb := rrb.(*dns.RR_SRV)
+				if rra.Target == rrb.Target && rra.Port == rrb.Port {
+					found = true
+					break L
+				}
 			}
 		}
 		if !found {
@@ -80,8 +96,81 @@ func compare(a, b []dns.RR) bool {
 	return true
 }
 
+func TestKnownAnswers(t *testing.T) {
+	cache := newRRCache(*logLevelFlag, log.Default(), 0)
+	for _, rr := range append(short, long...) {
+		cache.Add(rr)
+	}
+
+	// Everything is fresh.
+	x := cache.KnownAnswers("x.local.", dns.TypeALL)
+	if len(x) != len(short)+len(long) {
+		t.Errorf("%v should have %d entries", x, len(short)+len(long))
+	}
+
+	// Wait until the short TTLs are more than half gone.
+	time.Sleep(1100 * time.Millisecond)
+	x = cache.KnownAnswers("x.local.", dns.TypeALL)
+	if len(x) != len(long) {
+		t.Errorf("%v should have %d entries", x, len(long))
+	}
+	x = cache.KnownAnswers("x.local.", dns.TypePTR)
+	if len(x) != 1 || x[0].(*dns.RR_PTR).Ptr != "z.local." {
+		t.Errorf("%v should only contain z.local.", x)
+	}
+}
+
+func TestCacheFlush(t *testing.T) {
+	cache := newRRCache(*logLevelFlag, log.Default(), 0)
+
+	// Records flushed together should both survive.
+	for _, rr := range flushA {
+		cache.Add(rr)
+	}
+	x := lookup(cache, "a.local.", dns.TypeA)
+	if len(x) != len(flushA) {
+		t.Errorf("%v should have %d entries", x, len(flushA))
+	}
+
+	// A later flush should replace them.
+	time.Sleep(1100 * time.Millisecond)
+	for _, rr := range flushA2 {
+		cache.Add(rr)
+	}
+	x = lookup(cache, "a.local.", dns.TypeA)
+	if len(x) != 1 || !x[0].(*dns.RR_A).A.Equal(flushA2[0].(*dns.RR_A).A) {
+		t.Errorf("%v should only contain %v", x, flushA2[0])
+	}
+
+	// Flushing a stale record is a change even if the flushing one was cached already.
+	cache.Add(NewAddressRR("a.local.", dns.ClassINET, 120, net.IPv4(10, 9, 9, 9)))
+	for _, e := range cache.cache["a.local."][dns.TypeA] {
+		e.added = e.added.Add(-2 * time.Second)
+	}
+	if !cache.Add(flushA2[0]) {
+		t.Errorf("flushing a stale record wasn't a change")
+	}
+	if len(lookup(cache, "a.local.", dns.TypeA)) != 1 {
+		t.Errorf("stale record wasn't flushed")
+	}
+	if cache.Add(flushA2[0]) {
+		t.Errorf("refreshing a record was a change")
+	}
+
+	// Someone else's flush leaves our own records alone.
+	own := NewSrvRR("me._http._tcp.local.", cacheFlushBit|dns.ClassINET, 120, "me.local.", 80, 0, 0)
+	cache.AddOwn(own)
+	for _, e := range cache.cache["me._http._tcp.local."][dns.TypeSRV] {
+		e.added = e.added.Add(-2 * time.Second)
+	}
+	cache.AddFrom(NewSrvRR("me._http._tcp.local.", cacheFlushBit|dns.ClassINET, 120, "other.local.", 80, 0, 0), net.IPv4(10, 9, 9, 8))
+	if x := lookup(cache, "me._http._tcp.local.", dns.TypeSRV); len(x) != 2 || !cache.IsOwn(own) {
+		t.Errorf("%v should contain our own %v", x, own)
+	}
+}
+
 func TestRRCache(t *testing.T) {
-	cache := newRRCache(*logLevelFlag)
+	cache := newRRCache(*logLevelFlag, log.Default(), 0)
 	// Cache a number of RRs with short TTLs.
 	for _, rr := range short {
 		cache.Add(rr)
@@ -130,3 +219,329 @@ func TestRRCache(t *testing.T) {
 		t.Errorf("%v != []", x)
 	}
 }
+
+func TestCacheEviction(t *testing.T) {
+	cache := newRRCache(*logLevelFlag, log.Default(), 3)
+	rr := func(name string) dns.RR {
+		return NewTxtRR(name, dns.ClassINET, 120, []string{name})
+	}
+	cache.AddOwn(rr("own.local."))
+	cache.Add(rr("a.local."))
+	time.Sleep(time.Millisecond)
+	cache.Add(rr("b.local."))
+	time.Sleep(time.Millisecond)
+
+	// Looking up a makes b the least recently used.
+	lookup(cache, "a.local.", dns.TypeTXT)
+	time.Sleep(time.Millisecond)
+	cache.Add(rr("c.local."))
+	if cache.Size() != 3 {
+		t.Errorf("cache has %d entries, wanted 3", cache.Size())
+	}
+	for name, want := range map[string]int{"own.local.": 1, "a.local.": 1, "b.local.": 0, "c.local.": 1} {
+		if x := lookup(cache, name, dns.TypeTXT); len(x) != want {
+			t.Errorf("%s has %d entries, wanted %d", name, len(x), want)
+		}
+	}
+
+	// Our own records are never evicted, even if they are the least recently used.
+	time.Sleep(time.Millisecond)
+	cache.AddOwn(rr("own2.local."))
+	if x := lookup(cache, "own.local.", dns.TypeTXT); len(x) != 1 {
+		t.Errorf("own record was evicted")
+	}
+	if cache.Size() != 3 {
+		t.Errorf("cache has %d entries, wanted 3", cache.Size())
+	}
+
+	// Names that come and go leave nothing behind.
+	for i := 0; i < 1000; i++ {
+		cache.Add(rr(fmt.Sprintf("ephemeral%d.local.", i)))
+	}
+	if cache.Size() != 3 || len(cache.cache) != 3 || cache.lru.Len() != 1 {
+		t.Errorf("cache has %d entries under %d names, %d evictable; wanted 3, 3 and 1", cache.Size(), len(cache.cache), cache.lru.Len())
+	}
+	cache.Flush()
+	if len(cache.cache) != 2 || cache.lru.Len() != 0 {
+		t.Errorf("flushed cache has %d names, %d evictable; wanted 2 and 0", len(cache.cache), cache.lru.Len())
+	}
+}
+
+func TestCacheSender(t *testing.T) {
+	cache := newRRCache(*logLevelFlag, log.Default(), 0)
+	rr := NewSrvRR("x._test._tcp.local.", dns.ClassINET, 120, "x.local.", 1, 0, 0)
+	if _, ok := cache.Sender("x._test._tcp.local.", dns.TypeSRV); ok {
+		t.Errorf("Sender found an RR in an empty cache")
+	}
+	cache.AddOwn(rr)
+	if from, ok := cache.Sender("x._test._tcp.local.", dns.TypeSRV); !ok || from != nil {
+		t.Errorf("Sender of own RR returned %v, %v", from, ok)
+	}
+	sender := net.ParseIP("192.168.1.2")
+	cache.AddFrom(rr, sender)
+	if from, ok := cache.Sender("x._test._tcp.local.", dns.TypeSRV); !ok || !from.Equal(sender) {
+		t.Errorf("Sender returned %v, %v; want %v", from, ok, sender)
+	}
+}
+
+func TestCacheEntries(t *testing.T) {
+	cache := newRRCache(*logLevelFlag, log.Default(), 0)
+	sender := net.ParseIP("192.168.1.2")
+	before := time.Now()
+	rrs := []dns.RR{
+		&dns.RR_TXT{dns.RR_Header{"x.local.", dns.TypeTXT, dns.ClassINET, 10000, 0}, []string{"dump me"}},
+		&dns.RR_PTR{dns.RR_Header{"x.local.", dns.TypePTR, dns.ClassINET, 10000, 0}, "z.local."},
+	}
+	for _, rr := range rrs {
+		cache.AddFrom(rr, sender)
+	}
+	entries := cache.Entries()
+	if len(entries) != len(rrs) {
+		t.Fatalf("Entries returned %d entries, want %d", len(entries), len(rrs))
+	}
+	for _, e := range entries {
+		if e.Own || !e.Sender.Equal(sender) {
+			t.Errorf("entry %v: own %v sender %v", e.Record, e.Own, e.Sender)
+		}
+		if e.Record.Header().Ttl == 0 || e.Record.Header().Ttl > 10000 {
+			t.Errorf("entry %v: bad remaining ttl %d", e.Record, e.Record.Header().Ttl)
+		}
+		// We don't believe TTLs over 75 minutes.
+		if e.TTL != 4500 || e.Added.Before(before) || e.Added.After(time.Now()) {
+			t.Errorf("entry %v: original ttl %d added %v", e.Record, e.TTL, e.Added)
+		}
+		// Changing the copy must not change the cache.
+		e.Record.Header().Ttl = 0
+	}
+	for _, e := range cache.Entries() {
+		if e.Record.Header().Ttl == 0 {
+			t.Errorf("Entries shares RRs with the cache: %v", e.Record)
+		}
+	}
+}
+
+func TestLookupSuffix(t *testing.T) {
+	cache := newRRCache(*logLevelFlag, log.Default(), 0)
+	a := NewSrvRR("a._http._tcp.local.", dns.ClassINET, 120, "a.local.", 80, 0, 0)
+	b := NewSrvRR("b._http._tcp.local.", dns.ClassINET, 120, "b.local.", 80, 0, 0)
+	c := NewSrvRR("c._ftp._tcp.local.", dns.ClassINET, 120, "c.local.", 21, 0, 0)
+	d := NewTxtRR("a._http._tcp.local.", dns.ClassINET, 120, []string{"x"})
+	for _, rr := range []dns.RR{a, b, c, d} {
+		cache.Add(rr)
+	}
+	lookupSuffix := func(suffix string, rrtype uint16) []dns.RR {
+		rc := make(chan dns.RR, 10)
+		cache.LookupSuffix(suffix, rrtype, rc)
+		close(rc)
+		var rrs []dns.RR
+		for rr := range rc {
+			rrs = append(rrs, rr)
+		}
+		return rrs
+	}
+	if x := lookupSuffix("._http._tcp.local.", dns.TypeSRV); !compare(x, []dns.RR{a, b}) {
+		t.Errorf("%v != %v", x, []dns.RR{a, b})
+	}
+	if x := lookupSuffix("._http._tcp.local.", dns.TypeALL); !compare(x, []dns.RR{a, b, d}) {
+		t.Errorf("%v != %v", x, []dns.RR{a, b, d})
+	}
+	if x := lookupSuffix("._ipp._tcp.local.", dns.TypeALL); len(x) != 0 {
+		t.Errorf("%v != []", x)
+	}
+}
+
+func TestCacheExpiring(t *testing.T) {
+	cache := newRRCache(*logLevelFlag, log.Default(), 0)
+	a := &dns.RR_A{dns.RR_Header{"a.local.", dns.TypeA, dns.ClassINET, 10, 0}, net.IPv4(192, 168, 1, 1).To4()}
+	cache.Add(a)
+	if cache.Expiring("a.local.", dns.TypeA, 0.2) {
+		t.Errorf("fresh RR is expiring")
+	}
+	// Any time at all has passed so all of the TTL is no longer left.
+	if !cache.Expiring("a.local.", dns.TypeA, 1) || !cache.Expiring("a.local.", dns.TypeALL, 1) {
+		t.Errorf("RR isn't expiring")
+	}
+	if cache.Expiring("a.local.", dns.TypeAAAA, 1) || cache.Expiring("b.local.", dns.TypeA, 1) {
+		t.Errorf("missing RR is expiring")
+	}
+	own := newRRCache(*logLevelFlag, log.Default(), 0)
+	own.AddOwn(a)
+	if own.Expiring("a.local.", dns.TypeA, 1) {
+		t.Errorf("own RR is expiring")
+	}
+}
+
+func TestCacheFlushLearned(t *testing.T) {
+	cache := newRRCache(*logLevelFlag, log.Default(), 0)
+	own := NewSrvRR("x._test._tcp.local.", dns.ClassINET, 120, "x.local.", 1, 0, 0)
+	learned := NewSrvRR("y._test._tcp.local.", dns.ClassINET, 120, "y.local.", 2, 0, 0)
+	cache.AddOwn(own)
+	cache.Add(learned)
+	if flushed := cache.Flush(); len(flushed) != 1 || flushed[0] != learned {
+		t.Errorf("Flush returned %v", flushed)
+	}
+	if cache.Size() != 1 || len(cache.Records("x._test._tcp.local.", dns.TypeSRV)) != 1 || len(cache.Records("y._test._tcp.local.", dns.TypeSRV)) != 0 {
+		t.Errorf("after Flush the cache has %v", cache.Entries())
+	}
+}
+
+func TestCacheGoodbyeUnknown(t *testing.T) {
+	cache := newRRCache(*logLevelFlag, log.Default(), 0)
+	known := NewSrvRR("x._test._tcp.local.", dns.ClassINET, 120, "x.local.", 1, 0, 0)
+	cache.Add(known)
+
+	// Goodbyes for an unknown name and for unknown data under a known name change nothing.
+	for _, rr := range []dns.RR{
+		NewSrvRR("y._test._tcp.local.", dns.ClassINET, 0, "y.local.", 2, 0, 0),
+		NewSrvRR("x._test._tcp.local.", dns.ClassINET|0x8000, 0, "x.local.", 3, 0, 0),
+	} {
+		if cache.Add(rr) {
+			t.Errorf("goodbye for uncached %v reported as a change", rr)
+		}
+	}
+	if cache.Size() != 1 || len(cache.Records("x._test._tcp.local.", dns.TypeSRV)) != 1 {
+		t.Errorf("after goodbyes for uncached records the cache has %v", cache.Entries())
+	}
+	if _, ok := cache.cache["y._test._tcp.local."]; ok {
+		t.Errorf("goodbye for an uncached name created an entry for it")
+	}
+
+	// A goodbye for a record we have still schedules its removal.
+	cache.Add(NewSrvRR("x._test._tcp.local.", dns.ClassINET, 0, "x.local.", 1, 0, 0))
+	if e := cache.Entries(); len(e) != 1 || time.Until(e[0].Expires) > time.Second {
+		t.Errorf("after a goodbye the cache has %v", e)
+	}
+}
+
+func TestCacheAdditional(t *testing.T) {
+	cache := newRRCache(*logLevelFlag, log.Default(), 0)
+	from := net.IPv4(10, 0, 0, 1)
+	a := NewAddressRR("x.local.", dns.ClassINET, 120, from)
+	if !cache.AddExtraFrom(a, from) {
+		t.Errorf("additional record not added")
+	}
+	if e := cache.Entries(); len(e) != 1 || !e[0].Additional || !e[0].Sender.Equal(from) {
+		t.Errorf("after adding an additional record the cache has %v", e)
+	}
+
+	// Once it comes as an answer, it stays one.
+	cache.AddFrom(NewAddressRR("x.local.", dns.ClassINET, 120, from), from)
+	cache.AddExtraFrom(NewAddressRR("x.local.", dns.ClassINET, 120, from), from)
+	if e := cache.Entries(); len(e) != 1 || e[0].Additional {
+		t.Errorf("after the record came as an answer the cache has %v", e)
+	}
+}
+
+func TestCacheClasses(t *testing.T) {
+	cache := newRRCache(*logLevelFlag, log.Default(), 0)
+	ip := net.IPv4(192, 168, 1, 1).To4()
+	plain := &dns.RR_A{dns.RR_Header{"c.local.", dns.TypeA, dns.ClassINET, 120, 0}, ip}
+	flush := &dns.RR_A{dns.RR_Header{"c.local.", dns.TypeA, dns.ClassINET | 0x8000, 120, 0}, ip}
+	chaos := &dns.RR_A{dns.RR_Header{"c.local.", dns.TypeA, dns.ClassCHAOS, 120, 0}, ip}
+
+	// The same record with and without the cache flush bit is one record.
+	cache.Add(plain)
+	if cache.Add(flush) {
+		t.Errorf("flushing copy of a cached record was added as a new one")
+	}
+	if cache.Size() != 1 {
+		t.Errorf("cache has %d entries, wanted 1", cache.Size())
+	}
+
+	// The same data in another class is another record, but lookups only see the Internet class.
+	if !cache.Add(chaos) {
+		t.Errorf("record of another class replaced the cached one")
+	}
+	if x := lookup(cache, "c.local.", dns.TypeA); len(x) != 1 || rrClass(x[0]) != dns.ClassINET {
+		t.Errorf("lookup returned %v, wanted one Internet class record", x)
+	}
+	if x := cache.Records("c.local.", dns.TypeA); len(x) != 1 || rrClass(x[0]) != dns.ClassINET {
+		t.Errorf("Records returned %v, wanted one Internet class record", x)
+	}
+	if len(cache.Entries()) != 2 {
+		t.Errorf("Entries returned %v, wanted both classes", cache.Entries())
+	}
+
+	// Known answers never carry the cache flush bit.
+	if x := cache.KnownAnswers("c.local.", dns.TypeA); len(x) != 1 || x[0].Header().Class != dns.ClassINET {
+		t.Errorf("KnownAnswers returned %v", x)
+	}
+
+	// A later flush in one class leaves the other class alone.
+	time.Sleep(1100 * time.Millisecond)
+	cache.Add(&dns.RR_A{dns.RR_Header{"c.local.", dns.TypeA, dns.ClassINET | 0x8000, 120, 0}, net.IPv4(192, 168, 1, 2).To4()})
+	if cache.Size() != 2 {
+		t.Errorf("cache has %d entries after flush, wanted 2", cache.Size())
+	}
+	if x := cache.Records("c.local.", dns.TypeA); len(x) != 1 || !x[0].(*dns.RR_A).A.Equal(net.IPv4(192, 168, 1, 2)) {
+		t.Errorf("Records after flush returned %v", x)
+	}
+}
+
+func TestCacheHinfo(t *testing.T) {
+	cache := newRRCache(*logLevelFlag, log.Default(), 0)
+	if !cache.Add(dns.NewHINFO("p.local.", 120, "MIPS", "LINUX")) {
+		t.Errorf("HINFO wasn't added")
+	}
+	if cache.Add(dns.NewHINFO("p.local.", 120, "MIPS", "LINUX")) {
+		t.Errorf("refreshed HINFO was added as a new record")
+	}
+	if !cache.Add(dns.NewHINFO("p.local.", 120, "MIPS", "VXWORKS")) {
+		t.Errorf("changed HINFO wasn't added")
+	}
+	if cache.Size() != 2 {
+		t.Errorf("cache has %d entries, wanted 2", cache.Size())
+	}
+}
+
+func TestCacheLookupCount(t *testing.T) {
+	cache := newRRCache(*logLevelFlag, log.Default(), 0)
+	cache.Add(NewSrvRR("a._http._tcp.local.", dns.ClassINET, 120, "a.local.", 80, 0, 0))
+	cache.Add(NewSrvRR("b._http._tcp.local.", dns.ClassINET, 120, "b.local.", 80, 0, 0))
+	rc := make(chan dns.RR, 10)
+	tests := []struct{ got, want int }{
+		{cache.Lookup("a._http._tcp.local.", dns.TypeSRV, rc), 1},
+		{cache.Lookup("a._http._tcp.local.", dns.TypeALL, rc), 1},
+		{cache.Lookup("a._http._tcp.local.", dns.TypeTXT, rc), 0},
+		{cache.Lookup("c._http._tcp.local.", dns.TypeSRV, rc), 0},
+		{cache.LookupSuffix("._http._tcp.local.", dns.TypeSRV, rc), 2},
+		{cache.LookupSuffix("._ftp._tcp.local.", dns.TypeSRV, rc), 0},
+	}
+	for i, test := range tests {
+		if test.got != test.want {
+			t.Errorf("lookup %d found %d RRs, wanted %d", i, test.got, test.want)
+		}
+	}
+}
+
+func TestCacheMulticastRecently(t *testing.T) {
+	cache := newRRCache(*logLevelFlag, log.Default(), 0)
+	ip := net.IPv4(192, 168, 1, 1).To4()
+	own := NewAddressRR("m.local.", dns.ClassINET|0x8000, 4, ip)
+	learned := NewAddressRR("n.local.", dns.ClassINET, 120, ip)
+	cache.AddOwn(own)
+	cache.Add(learned)
+
+	// Only records of ours that we have multicast count.
+	if cache.MulticastRecently(own, 0.25) {
+		t.Errorf("record never multicast was multicast recently")
+	}
+	cache.Multicast(own)
+	cache.Multicast(learned)
+	if !cache.MulticastRecently(own, 0.25) {
+		t.Errorf("record just multicast wasn't multicast recently")
+	}
+	if cache.MulticastRecently(learned, 0.25) {
+		t.Errorf("learned record was multicast recently")
+	}
+
+	// Refreshing the record keeps when we multicast it, but it goes stale after the fraction of its TTL.
+	cache.AddOwn(own)
+	if !cache.MulticastRecently(own, 0.25) {
+		t.Errorf("refreshed record lost when it was multicast")
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if cache.MulticastRecently(own, 0.25) {
+		t.Errorf("record multicast over a quarter of its TTL ago was multicast recently")
+	}
+}
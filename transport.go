@@ -0,0 +1,218 @@
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mdns
+
+// How we reach the networks: the system's interfaces and UDP multicast or, for tests, an in-memory
+// network.
+
+import (
+	"net"
+	"sync"
+)
+
+// A Transport provides the network interfaces an MDNS listens on and the connections it talks over.
+// The default is the system's interfaces and UDP multicast sockets; tests can use a MemoryNetwork
+// instead, see UseTransport.
+type Transport interface {
+	// Interfaces returns the network interfaces.
+	Interfaces() ([]net.Interface, error)
+
+	// Addrs returns the addresses of an interface.
+	Addrs(ifc net.Interface) ([]net.Addr, error)
+
+	// Listen returns a connection on ifc bound to addr's port, with the group in addr joined, for
+	// IP version ipver.
+	Listen(ifc net.Interface, addr *net.UDPAddr, ipver int) (PacketConn, error)
+}
+
+// A PacketConn is a connection returned by a Transport.
+type PacketConn interface {
+	// ReadPacket reads a packet into b and returns its length, who sent it, and the index of the
+	// interface it arrived on, 0 if not known.
+	ReadPacket(b []byte) (n int, from *net.UDPAddr, ifIndex int, err error)
+
+	// WriteTo sends a packet to addr.
+	WriteTo(b []byte, addr net.Addr) (int, error)
+
+	// LocalAddr returns the address the connection is bound to.
+	LocalAddr() net.Addr
+
+	// Close closes the connection.  A ReadPacket waiting on it returns an error.
+	Close() error
+}
+
+// udpTransport is the default Transport.
+type udpTransport struct {
+	s *MDNS
+}
+
+func (t udpTransport) Interfaces() ([]net.Interface, error) {
+	return net.Interfaces()
+}
+
+func (t udpTransport) Addrs(ifc net.Interface) ([]net.Addr, error) {
+	return ifc.Addrs()
+}
+
+func (t udpTransport) Listen(ifc net.Interface, addr *net.UDPAddr, ipver int) (PacketConn, error) {
+	conn, err := t.s.listenUDP(ifc, addr, ipver)
+	if err != nil {
+		return nil, err
+	}
+	return &udpConn{conn, make([]byte, 128)}, nil
+}
+
+// udpConn is a UDP connection that knows which interface each packet arrived on.
+type udpConn struct {
+	*net.UDPConn
+	oob []byte
+}
+
+func (c *udpConn) ReadPacket(b []byte) (int, *net.UDPAddr, int, error) {
+	n, oobn, _, a, err := c.ReadMsgUDP(b, c.oob)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	return n, a, ReceivedIfIndex(c.oob[:oobn]), nil
+}
+
+// How many packets may wait to be read on a MemoryNetwork connection before more are dropped.
+const memQueueLen = 100
+
+// A MemoryNetwork connects the MDNS instances given its hosts' Transports, without any sockets, so that
+// tests needn't depend on the system's multicast.  Every packet sent to a multicast address is delivered
+// to every connection that joined that group, including the sender; others go to the connection bound
+// to the address.
+type MemoryNetwork struct {
+	mu    sync.Mutex
+	conns map[*memConn]bool
+}
+
+// NewMemoryNetwork returns an empty in-memory network.
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{conns: make(map[*memConn]bool)}
+}
+
+// Host returns a Transport for a host on the network with a single interface, index 1 and named mem0,
+// with the given addresses.  Pass it to NewMDNS with UseTransport.  Since the addresses aren't loopback
+// ones, NewMDNS's loopback argument should be false.
+func (n *MemoryNetwork) Host(addrs ...*net.IPNet) Transport {
+	return &memHost{n, net.Interface{Index: 1, MTU: 1500, Name: "mem0", Flags: net.FlagUp | net.FlagMulticast}, addrs}
+}
+
+// memHost is a host's view of a MemoryNetwork.
+type memHost struct {
+	n     *MemoryNetwork
+	ifc   net.Interface
+	addrs []*net.IPNet
+}
+
+func (h *memHost) Interfaces() ([]net.Interface, error) {
+	return []net.Interface{h.ifc}, nil
+}
+
+func (h *memHost) Addrs(ifc net.Interface) ([]net.Addr, error) {
+	var addrs []net.Addr
+	if ifc.Index == h.ifc.Index {
+		for _, a := range h.addrs {
+			addrs = append(addrs, a)
+		}
+	}
+	return addrs, nil
+}
+
+func (h *memHost) Listen(ifc net.Interface, addr *net.UDPAddr, ipver int) (PacketConn, error) {
+	// Packets we send come from our first address of the right version.
+	var local net.IP
+	for _, a := range h.addrs {
+		if (a.IP.To4() != nil) == (ipver == 4) {
+			local = a.IP
+			break
+		}
+	}
+	if local == nil {
+		return nil, &net.AddrError{Err: "no address of the right version", Addr: addr.String()}
+	}
+	c := &memConn{
+		n:      h.n,
+		ifc:    ifc,
+		group:  addr,
+		local:  &net.UDPAddr{IP: local, Port: addr.Port},
+		in:     make(chan memPacket, memQueueLen),
+		closed: make(chan struct{}),
+	}
+	h.n.mu.Lock()
+	h.n.conns[c] = true
+	h.n.mu.Unlock()
+	return c, nil
+}
+
+// A packet in flight on a MemoryNetwork.
+type memPacket struct {
+	from *net.UDPAddr
+	data []byte
+}
+
+// memConn is a connection on a MemoryNetwork.
+type memConn struct {
+	n      *MemoryNetwork
+	ifc    net.Interface
+	group  *net.UDPAddr
+	local  *net.UDPAddr
+	in     chan memPacket
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *memConn) ReadPacket(b []byte) (int, *net.UDPAddr, int, error) {
+	select {
+	case p := <-c.in:
+		return copy(b, p.data), p.from, c.ifc.Index, nil
+	case <-c.closed:
+		return 0, nil, 0, net.ErrClosed
+	}
+}
+
+func (c *memConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	to, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, &net.AddrError{Err: "not a UDP address", Addr: addr.String()}
+	}
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	c.n.mu.Lock()
+	defer c.n.mu.Unlock()
+	for d := range c.n.conns {
+		if to.IP.IsMulticast() {
+			if !d.group.IP.Equal(to.IP) || d.group.Port != to.Port {
+				continue
+			}
+		} else if !d.local.IP.Equal(to.IP) || d.local.Port != to.Port {
+			continue
+		}
+		select {
+		case d.in <- memPacket{c.local, append([]byte(nil), b...)}:
+		default:
+			// Like a real network, drop what the receiver hasn't room for.
+		}
+	}
+	return len(b), nil
+}
+
+func (c *memConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *memConn) Close() error {
+	c.once.Do(func() {
+		c.n.mu.Lock()
+		delete(c.n.conns, c)
+		c.n.mu.Unlock()
+		close(c.closed)
+	})
+	return nil
+}